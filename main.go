@@ -1,528 +1,9529 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
+	"hash/fnv"
 	"io"
 	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
+// Compression identifies how values are encoded in an SSTable.
+type Compression byte
+
+const (
+	NoCompression   Compression = iota // Values are stored as raw bytes
+	GzipCompression                    // Each value is compressed with gzip
+)
+
+// ValueType tags how a stored value should be interpreted. It is stored as
+// one byte per entry in the WAL and SSTables.
+type ValueType byte
+
+const (
+	ValueBinary ValueType = iota // application/octet-stream, the default
+	ValueString                  // text/plain
+	ValueJSON                    // application/json
+)
+
+// valueLogFlag is set in the value type of an SSTable entry whose value is
+// in the value log, in which case the entry holds a valuePointer. It is
+// never set on a value type returned to callers.
+const valueLogFlag ValueType = 0x80
+
+// ContentType returns the MIME type of the value type.
+func (valueType ValueType) ContentType() string {
+	switch valueType {
+	case ValueString:
+		return "text/plain; charset=utf-8"
+	case ValueJSON:
+		return "application/json"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// parseValueType maps a MIME type to a value type. An empty content type is
+// binary.
+func parseValueType(contentType string) (ValueType, error) {
+	if contentType == "" {
+		return ValueBinary, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ValueBinary, fmt.Errorf("%w: %s", ErrUnsupportedContentType, contentType)
+	}
+
+	switch mediaType {
+	case "application/octet-stream":
+		return ValueBinary, nil
+	case "text/plain":
+		return ValueString, nil
+	case "application/json":
+		return ValueJSON, nil
+	default:
+		return ValueBinary, fmt.Errorf("%w: %s", ErrUnsupportedContentType, contentType)
+	}
+}
+
+// Comparator orders keys: it returns a negative number if a sorts before b,
+// zero if they are the same key, and a positive number if a sorts after b.
+// It must only return zero for identical keys.
+type Comparator func(a, b string) int
+
+// bytewiseComparatorName names the default comparator, strings.Compare.
+const bytewiseComparatorName = "bytewise"
+
+// Options configures a KeyValueStore. The zero value uses the defaults.
+type Options struct {
+	// Comparator orders keys in the memtable, SSTables, and scans. Nil uses
+	// strings.Compare, ordering keys bytewise. The empty key always sorts
+	// first. Keys are ordered on disk, so a data directory must always be
+	// opened with the same comparator.
+	Comparator Comparator
+
+	// ComparatorName identifies Comparator, and is required with it. It is
+	// recorded in the manifest, and opening a data directory whose SSTables
+	// were written with a differently named comparator fails.
+	ComparatorName string
+
+	// Compression is applied to values in newly written SSTables.
+	Compression Compression
+
+	// CacheSize is the number of SSTable lookups kept in the LRU cache.
+	// Zero uses defaultCacheSize and a negative value disables the cache.
+	CacheSize int
+
+	// WALSegmentBytes is the size at which the WAL rolls over to a new
+	// segment. Zero uses defaultWALSegmentBytes.
+	WALSegmentBytes int64
+
+	// MaxKeySize is the largest accepted key in bytes. Zero uses
+	// defaultMaxKeySize.
+	MaxKeySize int
+
+	// MaxValueSize is the largest accepted value in bytes. Zero uses
+	// defaultMaxValueSize.
+	MaxValueSize int
+
+	// SyncMode controls when WAL writes are fsynced. The zero value is
+	// SyncAlways.
+	SyncMode SyncMode
+
+	// WALBufferSize, if set, buffers WAL records in memory up to this many
+	// bytes before writing them to the WAL file, so small writes cost fewer
+	// system calls. The buffer is written out when it fills, before every
+	// fsync, including those of Sync, SyncAlways, and SyncInterval, and when
+	// a segment is finished. Until then a crash of the process loses the
+	// records in it, so it suits SyncNever with explicit Sync calls. Zero
+	// writes each record to the file as it is made.
+	WALBufferSize int
+
+	// FlushInterval, if set, flushes the memtable this often even if it
+	// hasn't reached a flush threshold, so recent writes don't have to be
+	// replayed from the WAL after a restart.
+	FlushInterval time.Duration
+
+	// MaxIndexedTables is the number of most recent SSTables whose key range
+	// and bloom filter are kept in memory, so lookups skip those that can't
+	// hold a key without opening them. Zero indexes every SSTable.
+	MaxIndexedTables int
+
+	// MaxMemtableBytes is the approximate size of the keys and values in
+	// memory at which the memtable is flushed, even if it holds fewer than
+	// memtableFlushKeys keys. Zero uses defaultMaxMemtableBytes.
+	MaxMemtableBytes int64
+
+	// MaxPendingFlushes is the number of full memtables that may wait to be
+	// written to SSTables, so a burst of writes isn't held up by each flush.
+	// They are written one at a time, oldest first. A write that fills the
+	// memtable while as many are waiting blocks until the oldest is written,
+	// which bounds the memory used by memtables to about MaxMemtableBytes
+	// times one more than this. Zero uses 1.
+	MaxPendingFlushes int
+
+	// MaxWALBytes, if set, bounds the WAL written since the last flush, so
+	// keys overwritten many times don't make recovery replay every version.
+	// Once the WAL outgrows it, the memtable is flushed even if it isn't
+	// full, and the WAL segments are replaced by an SSTable holding only the
+	// latest value of each key. An in-memory store instead rewrites its WAL
+	// with one record per live key, once the records written since the last
+	// rewrite outgrow both MaxWALBytes and the rewritten WAL.
+	MaxWALBytes int64
+
+	// SparseIndexInterval is the number of entries between the points of the
+	// sparse index written in each SSTable's footer. A lookup jumps to the
+	// point at or before its key and reads at most this many entries. Zero
+	// uses defaultSparseIndexInterval.
+	SparseIndexInterval int
+
+	// MaxOpenFiles is the largest number of SST files that lookups, scans,
+	// and compactions hold open at once. Zero uses defaultMaxOpenFiles.
+	MaxOpenFiles int
+
+	// TargetFileSize, if set, is the approximate size of the keys and values
+	// in each SSTable written by a flush. A memtable holding more is split
+	// into several tables with adjacent key ranges, so flushes don't produce
+	// huge files that are slow to compact. Zero writes each flush to a
+	// single table.
+	TargetFileSize int64
+
+	// MaxTables and MaxTableBytes, if set, bound the number and total size
+	// of the committed SSTables. Once either is exceeded, the background
+	// compaction removes the tables whose every entry is shadowed by a newer
+	// table, and if that isn't enough, merges all tables as Compact does.
+	// Zero disables each limit.
+	MaxTables     int
+	MaxTableBytes int64
+
+	// TombstoneGracePeriod is how long a tombstone is kept at least before
+	// compaction may drop it. Compaction only drops tombstones whose key no
+	// deeper level can hold, whatever the grace period.
+	TombstoneGracePeriod time.Duration
+
+	// TombstoneRatio, if set, is the fraction of SSTable entries, from 0 to
+	// 1, that tombstones may make up before the background compaction
+	// merges every table, as Compact does, to drop them, so workloads that
+	// churn keys don't slow scans down with tombstones. It isn't repeated
+	// until more tombstones are written than the last merge left, such as
+	// those still within TombstoneGracePeriod. Zero disables it.
+	TombstoneRatio float64
+
+	// FileMode, if set, is the permission of every file the store creates:
+	// WAL segments, SSTables, the value log, and the manifest. The files are
+	// given exactly this mode, whatever the umask, and a data directory the
+	// store creates gets the same permissions plus search permission
+	// wherever read is granted, such as 0700 for 0600. It must give the
+	// owner read and write permission. Zero leaves files at 0644, or 0666
+	// for SSTables and the manifest, and the directory at 0755, less the
+	// umask.
+	FileMode os.FileMode
+
+	// EncryptionKey, if set, encrypts SSTable values and WAL records with
+	// AES-GCM. It must be 16, 24, or 32 bytes long, selecting AES-128,
+	// AES-192, or AES-256.
+	EncryptionKey []byte
+
+	// Logger receives the store's logs. Failures are logged at Error level
+	// and the contents of every SSTable entry read by a lookup at Debug
+	// level. Nil uses slog.Default(), which drops Debug logs.
+	Logger *slog.Logger
+
+	// OnFlush, if set, is called with the path and entry count, tombstones
+	// included, of each SSTable a flush commits. It runs on the flush's
+	// background goroutine once the flush is finished and the lock is
+	// released, so it may call back into the store.
+	OnFlush func(sstablePath string, entryCount int)
+
+	// ChangeSink, if set, is sent every key set or deleted, for change data
+	// capture. The changes are queued as their WAL records are written and
+	// published in order by a background goroutine once the records are
+	// durable. A Publish that fails is retried, waiting longer each time,
+	// until it succeeds; later changes wait behind it in memory. Changes
+	// still queued when the store is closed are published before Close
+	// returns, and are only logged as lost if the sink keeps failing then.
+	ChangeSink ChangeSink
+
+	// MergeFunc, if set, combines the operands passed to Merge with a key's
+	// value. Without it Merge returns ErrNoMergeFunc.
+	MergeFunc MergeFunc
+
+	// ValueLogThreshold, if set, is the size from which values are stored
+	// out of line: an SSTable holds a pointer to the value in the value log,
+	// an append-only log beside the SSTables, so compactions move the
+	// pointer rather than the value. Smaller values stay inline. Zero keeps
+	// every value inline.
+	ValueLogThreshold int
+
+	// InMemoryOnly keeps every key in the memtable and never flushes it to
+	// SSTables, whatever its size, so the store is limited by memory. Writes
+	// are made durable by the WAL alone, which recovery replays in full to
+	// rebuild the memtable. Existing SSTables in the data directory are
+	// ignored.
+	InMemoryOnly bool
+
+	// Follower makes the store a read replica of a leader: it changes only
+	// by the leader's WAL records, applied by Follow or ApplyReplicated, and
+	// other writes return ErrReadOnly.
+	Follower bool
+
+	// ReadOnly opens the store for reading only, so another process can
+	// read a data directory without modifying it. Writes return ErrReadOnly.
+	ReadOnly bool
+}
+
+// SyncMode controls when WAL writes are fsynced to disk.
+type SyncMode struct {
+	policy   syncPolicy
+	interval time.Duration
+}
+
+type syncPolicy int
+
+const (
+	syncAlways syncPolicy = iota
+	syncInterval
+	syncNever
+)
+
+var (
+	// SyncAlways makes every write wait until its WAL record is fsynced, so
+	// a write that returned survives a crash of the process or the machine.
+	// Concurrent writers share a single fsync (group commit).
+	SyncAlways = SyncMode{policy: syncAlways}
+
+	// SyncNever fsyncs the WAL only when a segment is finished or the store
+	// is closed, and otherwise leaves flushing it to the operating system.
+	// Writes survive a crash of the process but may be lost if the machine
+	// crashes.
+	SyncNever = SyncMode{policy: syncNever}
+)
+
+// SyncInterval fsyncs the WAL every d in the background and lets writes
+// return without waiting, so a machine crash loses at most the writes of
+// the last d. A d of zero or less uses defaultSyncInterval.
+func SyncInterval(d time.Duration) SyncMode {
+	if d <= 0 {
+		d = defaultSyncInterval
+	}
+	return SyncMode{policy: syncInterval, interval: d}
+}
+
+// defaultSyncInterval is the sync interval used by SyncInterval(0).
+const defaultSyncInterval = 100 * time.Millisecond
+
+// defaultMaxKeySize is the key size limit used when Options.MaxKeySize is zero.
+const defaultMaxKeySize = 4 << 10
+
+// defaultMaxValueSize is the value size limit used when Options.MaxValueSize is zero.
+const defaultMaxValueSize = 64 << 20
+
+// Errors returned when a key or value is rejected.
+var (
+	ErrEmptyKey      = errors.New("key must not be empty")
+	ErrKeyTooLarge   = errors.New("key exceeds the maximum key size")
+	ErrValueTooLarge = errors.New("value exceeds the maximum value size")
+)
+
+// ErrInvalidBucket is returned for a bucket name that is empty or contains
+// bucketSeparator.
+var ErrInvalidBucket = errors.New("bucket name must not be empty or contain a null byte")
+
+// ErrUnsupportedContentType is returned for a content type that has no
+// ValueType.
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+// ErrDecryption is returned when encrypted data fails authentication, either
+// because the encryption key is wrong or because the data is corrupted.
+var ErrDecryption = errors.New("decryption failed: wrong encryption key or corrupted data")
+
+// ErrReadOnly is returned by writes to a store opened with Options.ReadOnly.
+var ErrReadOnly = errors.New("store is read-only")
+
+// ErrInMemoryOnly is returned by operations that write SSTables directly to
+// a store opened with Options.InMemoryOnly.
+var ErrInMemoryOnly = errors.New("store is in-memory only and has no SSTables")
+
+// ErrReplicationGap is returned when a follower asks for WAL records that
+// the leader has already flushed and deleted, so it can't catch up by
+// replication alone.
+var ErrReplicationGap = errors.New("WAL records are no longer available")
+
+// ErrFollowerAhead is returned when a follower asks for WAL records past the
+// leader's last one, which means it applied records the leader has lost.
+var ErrFollowerAhead = errors.New("follower is ahead of the leader")
+
+// ErrBatchClosed is returned when a WriteBatch is used after Commit or Close.
+var ErrBatchClosed = errors.New("write batch is already committed or closed")
+
+// ErrClosed is returned by writes to a store that is closing or closed, and
+// by a second Close.
+var ErrClosed = errors.New("store is closed")
+
+// ErrNoMergeFunc is returned by Merge on a store opened without
+// Options.MergeFunc.
+var ErrNoMergeFunc = errors.New("no merge function is configured")
+
+// ErrNotInteger is returned by Increment for a key whose value isn't a
+// base-10 integer.
+var ErrNotInteger = errors.New("value is not an integer")
+
+// ErrNotFound is returned by GetE for a key that isn't in the store.
+var ErrNotFound = errors.New("key not found")
+
+// ErrUnreadableSSTable is wrapped, along with the underlying error, by the
+// errors GetE returns for an SST file that may hold the key but can't be
+// read.
+var ErrUnreadableSSTable = errors.New("unreadable SST file")
+
+// defaultCacheSize is the cache size used when Options.CacheSize is zero.
+const defaultCacheSize = 1024
+
+// memtableFlushKeys is the number of keys at which the memtable is flushed.
+const memtableFlushKeys = 10
+
+// defaultMaxMemtableBytes is the memtable size limit used when
+// Options.MaxMemtableBytes is zero.
+const defaultMaxMemtableBytes = 4 << 20
+
+// defaultSparseIndexInterval is the sparse index interval used when
+// Options.SparseIndexInterval is zero.
+const defaultSparseIndexInterval = 16
+
+// defaultMaxOpenFiles is the open SST file limit used when
+// Options.MaxOpenFiles is zero.
+const defaultMaxOpenFiles = 256
+
+// defaultWALSegmentBytes is the WAL segment size used when
+// Options.WALSegmentBytes is zero.
+const defaultWALSegmentBytes = 16 << 20
+
 // KeyValueStore represents the in-memory key-value store.
 type KeyValueStore struct {
-	data map[string][]byte
-	wal  *os.File
+	mu   sync.RWMutex
+	data *skipList
+	walPath string // Base path of the WAL; segments are named walPath.NNNNNN
+
+	// The WAL file and its counters are guarded by walMu rather than mu so
+	// fsyncs don't block the store.
+	walMu      sync.Mutex
+	walCond    *sync.Cond // Signalled when a WAL fsync finishes
+	wal        *os.File
+	walBuffer  *bufio.Writer // Buffers records for wal; nil without Options.WALBufferSize
+	walSegment uint64 // Number of the segment currently being written
+	walSize    int64  // Bytes written to the current segment
+	walWritten uint64 // Number of records written to the WAL
+	walSeq     uint64 // Sequence number of the last WAL record written or replayed
+	walPending int64  // Bytes written to the WAL since the memtable was last flushed or rewritten
+	walRewrite int64  // Bytes of the last rewrite of an in-memory store's WAL
+	walNotify  chan struct{} // Closed when the next record is written; nil if unwatched
+	walDurable uint64 // Number of records known to be fsynced
+	walSyncing bool   // Whether an fsync is in progress
+	changes    []pendingChange // Changes waiting to be published to Options.ChangeSink
+	changed    chan struct{}   // Signalled when changes are queued or become durable; nil without a sink
+
+	ready      atomic.Bool    // Set once startup recovery has completed
+	closed     atomic.Bool    // Set once Close is called, to refuse further writes
+	closing    chan struct{}  // Closed to stop background goroutines
+	background sync.WaitGroup // Tracks background goroutines
+	dataDir string
+	options Options
+	manifest *Manifest
+	compare  Comparator  // Options.Comparator, with the empty key first
+	cache    *lruCache
+	files    *filePool   // Open SST files shared by readers
+	values   *valueLog   // Values stored out of line by SSTables
+	aead     cipher.AEAD // Encrypts SSTable values and WAL records; nil if unencrypted
+	logger   *slog.Logger
+
+	// In-memory indexes of SST files by path, guarded by indexMu rather than
+	// mu so lookups under the read lock can load them
+	indexMu      sync.Mutex
+	tableIndexes map[string]*tableIndex
+	tableLayouts map[string]*tableLayout // Parsed headers and footers of indexed files
+	tableFiles   []string                // sstableFiles' result; nil once the manifest changes
+	corruptFiles map[string]error        // SST files lookups found unreadable and skip, with why
+	metrics  storeMetrics
+	memtableBytes int64 // Approximate size of the keys and values in data
+
+	// flushing holds the full memtables waiting to be written to SSTables in
+	// the background, newest first; the last is being written. It is
+	// replaced rather than modified, so readers may keep it. compacting is
+	// set while a background compaction runs. flushDone is signalled, with
+	// mu as its lock, when either finishes.
+	flushing   []*frozenMemtable
+	compacting bool
+	flushDone  *sync.Cond
+	flushErr   error // Why the last flush failed after its retries; nil once one succeeds
+
+	// writeTable writes an SSTable for a flush; it is writeSSTableEntries
+	// outside of tests
+	writeTable func(filename string, seq uint64, entries []iteratorEntry) error
+
+	// The number and size of the SSTables left by the last enforcement of
+	// MaxTables and MaxTableBytes, which the next waits for the tables to
+	// outgrow, so live data over the limits isn't merged again and again.
+	// Only the goroutine that set compacting uses them.
+	retainedTables int
+	retainedBytes  int64
+
+	// The tombstones left in the SSTables by the last merge for
+	// TombstoneRatio, which the next waits for them to outnumber. Only the
+	// goroutine that set compacting uses it.
+	retainedTombstones int
 	smallestKeyLength int
 	largestKeyLength  int
 	DeletedKeys map[string]bool
+	valueTypes  map[string]ValueType // Types of memtable values that aren't ValueBinary
+	versions    map[string]uint64    // Versions of memtable values that have one
 }
 
-// NewKeyValueStore creates a new instance of KeyValueStore.
-func NewKeyValueStore(walFilePath string) (*KeyValueStore, error) {
-	data := make(map[string][]byte)
+// NewKeyValueStore creates a new instance of KeyValueStore whose SSTables
+// are stored in dataDir.
+func NewKeyValueStore(walFilePath string, dataDir string, options Options) (*KeyValueStore, error) {
+	if options.Comparator == nil {
+		if options.ComparatorName != "" && options.ComparatorName != bytewiseComparatorName {
+			return nil, fmt.Errorf("ComparatorName %q is set without a Comparator", options.ComparatorName)
+		}
+		options.Comparator, options.ComparatorName = strings.Compare, bytewiseComparatorName
+	} else if options.ComparatorName == "" {
+		return nil, fmt.Errorf("a Comparator needs a ComparatorName")
+	}
+	if options.FileMode&^os.ModePerm != 0 || (options.FileMode != 0 && options.FileMode&0600 != 0600) {
+		return nil, fmt.Errorf("FileMode %v must be permission bits that give the owner read and write permission", options.FileMode)
+	}
+	if !(options.TombstoneRatio >= 0 && options.TombstoneRatio <= 1) {
+		return nil, fmt.Errorf("TombstoneRatio %v must be between 0 and 1", options.TombstoneRatio)
+	}
+	compare := options.Comparator
+	if options.ComparatorName != bytewiseComparatorName {
+		compare = orderedComparator(compare)
+	}
+	data := newSkipList(compare)
+
+	// Make sure the SSTable directory exists
+	if !options.ReadOnly {
+		if err := makeDataDir(dataDir, options.FileMode); err != nil {
+			return nil, err
+		}
+	}
+
+	// Load the list of committed SSTables
+	manifest, err := loadManifest(dataDir, options.ReadOnly, options.FileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// The SSTables can only be read in the order they were written in
+	if len(manifest.Tables) > 0 && manifest.comparatorName() != options.ComparatorName {
+		return nil, fmt.Errorf("SSTables were written with comparator %q, but the store was opened with %q", manifest.comparatorName(), options.ComparatorName)
+	}
+	manifest.Comparator = options.ComparatorName
+
+	if options.WALSegmentBytes == 0 {
+		options.WALSegmentBytes = defaultWALSegmentBytes
+	}
+	if options.MaxKeySize == 0 {
+		options.MaxKeySize = defaultMaxKeySize
+	}
+	if options.MaxValueSize == 0 {
+		options.MaxValueSize = defaultMaxValueSize
+	}
+	if options.MaxMemtableBytes == 0 {
+		options.MaxMemtableBytes = defaultMaxMemtableBytes
+	}
+	if options.MaxOpenFiles == 0 {
+		options.MaxOpenFiles = defaultMaxOpenFiles
+	}
+	if options.MaxPendingFlushes <= 0 {
+		options.MaxPendingFlushes = 1
+	}
+	if options.SparseIndexInterval <= 0 {
+		options.SparseIndexInterval = defaultSparseIndexInterval
+	}
+	if options.Logger == nil {
+		options.Logger = slog.Default()
+	}
+	if options.InMemoryOnly {
+		// Every lookup is served from memory, so there is nothing to cache
+		options.CacheSize = -1
+	}
+	if options.ReadOnly && options.Follower {
+		return nil, fmt.Errorf("a follower must be able to write its data directory")
+	}
+
+	// Set up encryption at rest if a key was given
+	var aead cipher.AEAD
+	if options.EncryptionKey != nil {
+		block, err := aes.NewCipher(options.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %w", err)
+		}
+		aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Continue writing to the newest WAL segment, or start the first one
+	segments, err := listWALSegments(walFilePath)
+	if err != nil {
+		return nil, err
+	}
+	walSegment := uint64(1)
+	if len(segments) > 0 {
+		walSegment = segments[len(segments)-1]
+	}
+	if options.ReadOnly {
+		// The WAL is only read, by recovery; a missing one is left missing
+		wal, err := os.Open(walSegmentPath(walFilePath, walSegment))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err != nil {
+			wal = nil
+		}
+		kv := &KeyValueStore{
+			data:        data,
+			walPath:     walFilePath,
+			wal:         wal,
+			walSegment:  walSegment,
+			closing:     make(chan struct{}),
+			dataDir:     dataDir,
+			options:     options,
+			manifest:    manifest,
+			compare:     compare,
+			cache:       newLRUCache(options.CacheSize),
+			files:       newFilePool(options.MaxOpenFiles),
+			values:      newValueLog(dataDir, aead, options.FileMode),
+			aead:        aead,
+			logger:      options.Logger,
+			DeletedKeys: make(map[string]bool),
+			valueTypes:  make(map[string]ValueType),
+			versions:    make(map[string]uint64),
+		}
+		kv.walCond = sync.NewCond(&kv.walMu)
+		kv.flushDone = sync.NewCond(&kv.mu)
+		kv.writeTable = kv.writeSSTableEntries
+		return kv, nil
+	}
 
-	// Open or create the WAL file
-	wal, err := os.OpenFile(walFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	wal, err := openFile(walSegmentPath(walFilePath, walSegment), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644, options.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	walInfo, err := wal.Stat()
 	if err != nil {
+		wal.Close()
 		return nil, err
 	}
+	walSize := walInfo.Size()
+	if walSize == 0 {
+		written, err := writeWALHeader(wal)
+		if err != nil {
+			wal.Close()
+			return nil, err
+		}
+		walSize = int64(written)
+	}
 
-	return &KeyValueStore{
+	kv := &KeyValueStore{
 		data: data,
-		wal:  wal,
+		walPath:    walFilePath,
+		wal:        wal,
+		walSegment: walSegment,
+		walSize:    walSize,
+		closing:    make(chan struct{}),
+		dataDir: dataDir,
+		options: options,
+		manifest: manifest,
+		compare:  compare,
+		cache:    newLRUCache(options.CacheSize),
+		files:    newFilePool(options.MaxOpenFiles),
+		values:   newValueLog(dataDir, aead, options.FileMode),
+		aead:     aead,
+		logger:   options.Logger,
 		smallestKeyLength: 0,
 		largestKeyLength:  0,
 		DeletedKeys: make(map[string]bool),
-	}, nil
+		valueTypes:  make(map[string]ValueType),
+		versions:    make(map[string]uint64),
+	}
+	kv.walCond = sync.NewCond(&kv.walMu)
+	kv.flushDone = sync.NewCond(&kv.mu)
+	kv.writeTable = kv.writeSSTableEntries
+	if options.WALBufferSize > 0 {
+		kv.walBuffer = bufio.NewWriterSize(wal, options.WALBufferSize)
+	}
+
+	// Nothing in the WAL has been flushed yet
+	if kv.walPending, err = kv.walBytes(); err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	// Publish changes in the background if requested
+	if options.ChangeSink != nil {
+		kv.changed = make(chan struct{}, 1)
+		kv.background.Add(1)
+		go kv.publishChanges()
+	}
+
+	// Sync the WAL on a timer if requested
+	if options.SyncMode.policy == syncInterval {
+		kv.background.Add(1)
+		go kv.syncWALPeriodically()
+	}
+
+	// Flush the memtable on a timer if requested
+	if options.FlushInterval > 0 {
+		kv.background.Add(1)
+		go kv.flushPeriodically()
+	}
+
+	return kv, nil
 }
 
 // CloseWAL closes the Write-Ahead Log file.
 func (kv *KeyValueStore) CloseWAL() {
-	kv.wal.Close()
-}
+	kv.walMu.Lock()
+	defer kv.walMu.Unlock()
 
-// Get retrieves the value associated with the given key.
-func (kv *KeyValueStore) Get(key string) ([]byte, bool) {
-	value, ok := kv.data[key]
+	kv.closeWALFile()
+}
 
-	// Check if the key is marked as deleted
-	if kv.DeletedKeys[key] {
-		return nil, false
-	}else if !ok{
-		// Key not found in memory, and not deleted in DeletedKeys, search in SST files
-		value, ok = kv.SearchSSTFiles(key)
+// Close shuts the store down. It refuses new writes with ErrClosed, stops
+// the background goroutines, flushes any pending in-memory data to an
+// SSTable, waits for the flushes and compaction in progress to finish, and
+// fsyncs and closes the WAL, the value log, and the idle SST file handles.
+// It returns every error met on the way, after closing everything it can,
+// and ErrClosed if the store was already closed.
+func (kv *KeyValueStore) Close() error {
+	if !kv.closed.CompareAndSwap(false, true) {
+		return ErrClosed
 	}
 
-	return value, ok
-}
+	// Stop background goroutines first, since they may take the lock
+	close(kv.closing)
+	kv.background.Wait()
 
-// Set writes the key-value pair to the in-memory store and the WAL.
-func (kv *KeyValueStore) Set(key string, value []byte) {
-	// Check if the key is marked as deleted
-	if kv.DeletedKeys[key] {
-		// Mark it as not deleted, so it won't be flushed
-		kv.DeletedKeys[key] = false
-		return
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	// Flush whatever is left in the memtable so it doesn't only live in the
+	// WAL, and wait for it to reach disk. A flush that fails leaves its
+	// entries in the WAL, to be recovered on the next open.
+	var errs []error
+	if !kv.options.ReadOnly && (kv.data.len() > 0 || len(kv.DeletedKeys) > 0) {
+		if err := kv.flush(); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	
-	// Update smallest and largest key lengths
-	keyLength := len(key)
-	if kv.smallestKeyLength == 0 || keyLength < kv.smallestKeyLength {
-		kv.smallestKeyLength = keyLength
+	kv.waitForFlush()
+	for kv.compacting {
+		kv.flushDone.Wait()
 	}
-	if keyLength > kv.largestKeyLength {
-		kv.largestKeyLength = keyLength
+	if kv.flushErr != nil && len(errs) == 0 {
+		errs = append(errs, kv.flushErr)
+	}
+	kv.files.closeIdle()
+	if err := kv.values.close(); err != nil {
+		kv.logger.Error("error closing value log", "err", err)
+		errs = append(errs, err)
 	}
 
+	kv.walMu.Lock()
+	defer kv.walMu.Unlock()
 
-	// Write to the WAL
-	logEntry := map[string]interface{}{
-		"operation": "set",
-		"key":       key,
-		"value":     string(value),
+	if err := kv.closeWALFile(); err != nil {
+		errs = append(errs, err)
 	}
-	kv.writeToWAL(logEntry)
+	return errors.Join(errs...)
+}
 
-	// Update the in-memory store
-	kv.data[key] = value
+// Get retrieves the value associated with the given key.
+func (kv *KeyValueStore) Get(key string) ([]byte, bool) {
+	defer kv.metrics.get.observe(time.Now())
 
-	// Check if the map size has reached the threshold
-    if len(kv.data) >= 10 {
-        // Flush to SSTable
-        if err := kv.WriteSSTable("sstable_" + strconv.FormatInt(time.Now().UnixNano(), 10) + ".sst"); err != nil {
-            log.Printf("Error flushing to SSTable: %v\n", err)
-            return // Exit if flush fails
-        }
-        // Clear the in-memory store after flushing
-        kv.data = make(map[string][]byte)
-        kv.DeletedKeys = make(map[string]bool)
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
 
-        // Clear the Write-Ahead Log
-        if err := kv.ClearWAL(); err != nil {
-            log.Printf("Error clearing WAL: %v\n", err)
-        }
-    }
+	return kv.get(key)
 }
 
-
-// Delete removes the key and returns its value.
-func (kv *KeyValueStore) Delete(key string) ([]byte, bool) {
-	value, ok := kv.data[key]
-	if ok {
-		// Write to the WAL
-		logEntry := map[string]interface{}{
-			"operation": "delete",
-			"key":       key,
-			"value":     string(value),
-		}
-		kv.writeToWAL(logEntry)
-		delete(kv.data, key)
-		return value, ok
-	}else if value, ok = kv.Get(key); ok{
-		logEntry := map[string]interface{}{
-			"operation": "delete",
-			"key":       key,
-			"value":     string(value),
-		}
-		kv.writeToWAL(logEntry)
-		kv.DeletedKeys[key] = true
+// GetOrDefault retrieves the value associated with the given key, or def if
+// the key is not in the store.
+func (kv *KeyValueStore) GetOrDefault(key string, def []byte) []byte {
+	if value, ok := kv.Get(key); ok {
+		return value
 	}
-	return value, ok	
+	return def
 }
 
-// ClearWAL closes, truncates, and reopens the Write-Ahead Log.
-func (kv *KeyValueStore) ClearWAL() error {
-    // Close the Write-Ahead Log
-    if err := kv.wal.Close(); err != nil {
-        return err
-    }
-
-    // Truncate the Write-Ahead Log
-    if err := os.Truncate("wal.log", 0); err != nil {
-        return err
-    }
+// GetContext retrieves the value associated with the given key, aborting
+// with the context's error if it is cancelled while searching SST files.
+func (kv *KeyValueStore) GetContext(ctx context.Context, key string) ([]byte, bool, error) {
+	defer kv.metrics.get.observe(time.Now())
 
-    // Reopen the Write-Ahead Log
-    wal, err := os.OpenFile("wal.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-    if err != nil {
-        return err
-    }
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
 
-    // Update the KeyValueStore's WAL reference
-    kv.wal = wal
+	return kv.getContext(ctx, key)
+}
 
-    return nil
+// GetE retrieves the value associated with the given key, returning
+// ErrNotFound if the key is not in the store. Where Get skips an SST file it
+// can't read and answers from the older files, GetE returns the read error,
+// wrapping ErrUnreadableSSTable, so callers can tell a failing store from a
+// miss.
+func (kv *KeyValueStore) GetE(key string) ([]byte, error) {
+	return kv.GetEContext(context.Background(), key)
 }
 
-// WriteSSTable writes the in-memory data to an SSTable file.
-func (kv *KeyValueStore) WriteSSTable(filename string) error {
-    // Open or create the SSTable file
-    sstableFile, err := os.Create(filename)
-    if err != nil {
-        return err
-    }
-    defer sstableFile.Close()
+// GetEContext is GetE with cancellation.
+func (kv *KeyValueStore) GetEContext(ctx context.Context, key string) ([]byte, error) {
+	defer kv.metrics.get.observe(time.Now())
 
-    // Write magic number
-    if _, err := sstableFile.Write([]byte("SSTB")); err != nil {
-        return err
-    }
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
 
-    // Combine keys from data and DeletedKeys maps for sequential writes in SSTable
-    var keys []string
-    for key := range kv.data {
-        keys = append(keys, key)
-    }
-    for key := range kv.DeletedKeys {
-        keys = append(keys, key)
-    }
-    sort.Strings(keys)
+	value, _, _, source, err := kv.lookupVersion(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if source == SourceNotFound {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
 
-    // Write entry count
-    entryCount := len(keys)
-    if err := binary.Write(sstableFile, binary.LittleEndian, uint32(entryCount)); err != nil {
-        return err
-    }
+// Exists reports whether the key has a live value. It looks in the same
+// places as Get, but only locates the key's entry in an SST file, without
+// reading its value, so it costs the same whatever the value's size. Like
+// GetE, it returns an error wrapping ErrUnreadableSSTable if an SST file
+// that may hold the key can't be read.
+func (kv *KeyValueStore) Exists(key string) (bool, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
 
-    // Write smallest key length
-    if err := binary.Write(sstableFile, binary.LittleEndian, uint32(kv.smallestKeyLength)); err != nil {
-        return err
-    }
+	if _, _, source, found := kv.lookupMemtables(key); found {
+		return source != SourceNotFound, nil
+	}
+	if entry, cached := kv.lookupCache(key); cached {
+		return entry.found, nil
+	}
 
-    // Write largest key length
-    if err := binary.Write(sstableFile, binary.LittleEndian, uint32(kv.largestKeyLength)); err != nil {
-        return err
-    }
+	files, err := kv.sstableFiles()
+	if err != nil {
+		kv.logger.Error("error listing SST files", "err", err)
+		return false, unreadable("", err)
+	}
+	for i, sstFile := range files {
+		if kv.ruledOutByIndex(i, sstFile, key) {
+			// A corrupt file is ruled out for every key, including ones it held
+			if err := kv.corruptError(sstFile); err != nil {
+				return false, unreadable(sstFile, err)
+			}
+			continue
+		}
+		state, err := kv.locateInSSTFileByPath(key, sstFile)
+		if err != nil {
+			return false, err
+		}
+		switch state {
+		case entryLive:
+			return true, nil
+		case entryDeleted:
+			return false, nil
+		}
+	}
 
-    // Write key-value pairs to the SSTable
-    for _, key := range keys {
-        value := kv.data[key]
+	return false, nil
+}
 
-        // Determine the operation type (set or delete)
-        var operationMarker uint16
-        if kv.DeletedKeys[key] {
-            operationMarker = 1 // Delete operation
-        } else {
-            operationMarker = 0 // Set operation
-        }
+// get looks up the key without taking the lock.
+func (kv *KeyValueStore) get(key string) ([]byte, bool) {
+	value, ok, _ := kv.getContext(context.Background(), key)
+	return value, ok
+}
 
-        // Write operation marker
-        if err := binary.Write(sstableFile, binary.LittleEndian, operationMarker); err != nil {
-            return err
-        }
+// getContext looks up the key without taking the lock.
+func (kv *KeyValueStore) getContext(ctx context.Context, key string) ([]byte, bool, error) {
+	value, _, source, err := kv.lookup(ctx, key)
+	return value, source != SourceNotFound, err
+}
 
-        // Write key length
-        if err := binary.Write(sstableFile, binary.LittleEndian, uint32(len(key))); err != nil {
-            return err
-        }
+// Source identifies which layer of the store served a read.
+type Source int
 
-        // Write value length
-        if err := binary.Write(sstableFile, binary.LittleEndian, uint32(len(value))); err != nil {
+const (
+	SourceNotFound Source = iota // The key is not in the store
+	SourceMemtable               // The value came from the in-memory store
+	SourceSSTable                // The value came from an SST file
+)
+
+// String returns the name of the source as used in the X-Source header.
+func (source Source) String() string {
+	switch source {
+	case SourceMemtable:
+		return "memtable"
+	case SourceSSTable:
+		return "sstable"
+	default:
+		return "notfound"
+	}
+}
+
+// GetWithSource retrieves the value associated with the given key and
+// reports which layer served it.
+func (kv *KeyValueStore) GetWithSource(key string) ([]byte, Source, bool) {
+	value, source, _ := kv.GetWithSourceContext(context.Background(), key)
+	return value, source, source != SourceNotFound
+}
+
+// GetWithSourceContext is GetWithSource with cancellation, aborting with the
+// context's error if it is cancelled while searching SST files.
+func (kv *KeyValueStore) GetWithSourceContext(ctx context.Context, key string) ([]byte, Source, error) {
+	defer kv.metrics.get.observe(time.Now())
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	value, _, source, err := kv.lookup(ctx, key)
+	return value, source, err
+}
+
+// GetTyped retrieves the value associated with the given key along with its
+// content type.
+func (kv *KeyValueStore) GetTyped(key string) ([]byte, string, bool) {
+	value, contentType, source, _ := kv.GetTypedContext(context.Background(), key)
+	return value, contentType, source != SourceNotFound
+}
+
+// GetTypedContext is GetTyped with cancellation that also reports which
+// layer served the read.
+func (kv *KeyValueStore) GetTypedContext(ctx context.Context, key string) ([]byte, string, Source, error) {
+	defer kv.metrics.get.observe(time.Now())
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	value, valueType, source, err := kv.lookup(ctx, key)
+	return value, valueType.ContentType(), source, err
+}
+
+// VersionedValue is a value read by GetVersionContext.
+type VersionedValue struct {
+	Value       []byte
+	ContentType string
+	Version     uint64 // Zero for a value written before versions were kept
+	Source      Source
+}
+
+// GetVersion retrieves the value associated with the given key along with
+// its version: the sequence number of the WAL record that wrote it. Every
+// later Set or Delete of the key is numbered higher, so a caller holding a
+// copy can tell whether it is still current by comparing versions.
+func (kv *KeyValueStore) GetVersion(key string) ([]byte, uint64, bool) {
+	versioned, _ := kv.GetVersionContext(context.Background(), key)
+	if versioned == nil {
+		return nil, 0, false
+	}
+	return versioned.Value, versioned.Version, true
+}
+
+// GetVersionContext is GetVersion with cancellation that also reports the
+// value's content type and which layer served it. It returns nil if the key
+// is not in the store.
+func (kv *KeyValueStore) GetVersionContext(ctx context.Context, key string) (*VersionedValue, error) {
+	defer kv.metrics.get.observe(time.Now())
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	value, valueType, version, source, err := kv.lookupVersion(ctx, key)
+	if err != nil && !errors.Is(err, ErrUnreadableSSTable) {
+		return nil, err
+	}
+	if source == SourceNotFound {
+		return nil, nil
+	}
+	return &VersionedValue{Value: value, ContentType: valueType.ContentType(), Version: version, Source: source}, nil
+}
+
+// ValueStream is a value being read by GetStreamContext.
+type ValueStream struct {
+	io.ReadCloser
+	Size        int64 // The value's length in bytes, or -1 if it isn't known up front
+	ContentType string
+	Source      Source
+}
+
+// GetStream returns a reader over the value associated with the given key.
+// A value in an SST file is streamed from the file rather than loaded into
+// memory first, so it suits values too large to hold in memory. The caller
+// must close the reader.
+func (kv *KeyValueStore) GetStream(key string) (io.ReadCloser, bool) {
+	stream, err := kv.GetStreamContext(context.Background(), key)
+	if err != nil || stream == nil {
+		return nil, false
+	}
+	return stream, true
+}
+
+// GetStreamContext is GetStream with cancellation that also reports the
+// value's size, content type, and which layer served it. It returns a nil
+// stream if the key is not in the store, and an error wrapping
+// ErrUnreadableSSTable if an SST file that may hold it can't be read.
+func (kv *KeyValueStore) GetStreamContext(ctx context.Context, key string) (*ValueStream, error) {
+	defer kv.metrics.get.observe(time.Now())
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	inMemory := func(value []byte, valueType ValueType, source Source) *ValueStream {
+		return &ValueStream{
+			ReadCloser:  io.NopCloser(bytes.NewReader(value)),
+			Size:        int64(len(value)),
+			ContentType: valueType.ContentType(),
+			Source:      source,
+		}
+	}
+
+	if value, valueType, source, found := kv.lookupMemtables(key); found {
+		if source == SourceNotFound {
+			return nil, nil
+		}
+		return inMemory(value, valueType, source), nil
+	}
+
+	// A cached value is already in memory. Streamed values aren't added to
+	// the cache, as that would load them into memory.
+	if entry, cached := kv.lookupCache(key); cached {
+		if !entry.found {
+			return nil, nil
+		}
+		return inMemory(entry.value, entry.valueType, SourceSSTable), nil
+	}
+
+	return kv.streamSSTFiles(ctx, key)
+}
+
+// MultiGet retrieves the values of many keys at once, returning the keys
+// that exist mapped to their values. If an SST file that may hold some of
+// the keys can't be read, the values found are returned along with its
+// error, which wraps ErrUnreadableSSTable.
+func (kv *KeyValueStore) MultiGet(keys []string) (map[string][]byte, error) {
+	return kv.MultiGetContext(context.Background(), keys)
+}
+
+// MultiGetContext is MultiGet with cancellation. Rather than searching the
+// SST files for each key in turn, it opens each file that may hold any of
+// the keys still unresolved once and finds all of them in a single forward
+// pass, from most recent file to oldest, so the newest value or tombstone of
+// each key wins as in Get. Keys a file couldn't be read for are looked up in
+// the older files, but the answer isn't cached, so the file is tried again.
+func (kv *KeyValueStore) MultiGetContext(ctx context.Context, keys []string) (map[string][]byte, error) {
+	defer kv.metrics.get.observe(time.Now())
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	values := make(map[string][]byte)
+	pending := make(map[string]bool)
+	for _, key := range keys {
+		if value, _, source, found := kv.lookupMemtables(key); found {
+			if source != SourceNotFound {
+				values[key] = value
+			}
+			continue
+		}
+		if entry, cached := kv.lookupCache(key); cached {
+			if entry.found {
+				values[key] = entry.value
+			}
+			continue
+		}
+		pending[key] = true
+	}
+
+	files, err := kv.sstableFiles()
+	if err != nil {
+		return nil, unreadable("", err)
+	}
+
+	// The first read error, and the keys whose lookup skipped a file
+	var skipped error
+	skippedKeys := make(map[string]bool)
+	skip := func(keys []string, err error) {
+		for _, key := range keys {
+			skippedKeys[key] = true
+		}
+		if skipped == nil {
+			skipped = err
+		}
+	}
+
+	for i, sstFile := range files {
+		if len(pending) == 0 {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Only open the file for the keys its index doesn't rule out. A
+		// corrupt file is ruled out for every key, including ones it held.
+		var candidates, ruledOut []string
+		for key := range pending {
+			if !kv.ruledOutByIndex(i, sstFile, key) {
+				candidates = append(candidates, key)
+			} else {
+				ruledOut = append(ruledOut, key)
+			}
+		}
+		if err := kv.corruptError(sstFile); err != nil {
+			skip(ruledOut, unreadable(sstFile, err))
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return kv.compare(candidates[i], candidates[j]) < 0
+		})
+
+		entries, err := kv.searchSSTFileMulti(ctx, candidates, sstFile)
+		if errors.Is(err, ErrUnreadableSSTable) {
+			// Logged already; the older files' answer stands for the keys
+			// the file didn't settle
+			var unsettled []string
+			for _, key := range candidates {
+				if _, ok := entries[key]; !ok {
+					unsettled = append(unsettled, key)
+				}
+			}
+			skip(unsettled, err)
+		} else if err != nil {
+			return nil, err
+		}
+		for key, entry := range entries {
+			delete(pending, key)
+			if !skippedKeys[key] {
+				kv.cache.put(cacheEntry{key: key, value: entry.value, valueType: entry.valueType, version: entry.version, found: !entry.deleted})
+			}
+			if !entry.deleted {
+				values[key] = entry.value
+			}
+		}
+	}
+
+	// The keys left are in no layer
+	for key := range pending {
+		if !skippedKeys[key] {
+			kv.cache.put(cacheEntry{key: key})
+		}
+	}
+
+	return values, skipped
+}
+
+// searchSSTFileMulti finds the entries for the keys, which must be sorted,
+// in a specific SST file in a single forward pass. Keys without an entry in
+// the file are left out of the result, and tombstones are returned as
+// deleted entries. Read errors are logged and returned, wrapping
+// ErrUnreadableSSTable, with the entries found before them.
+func (kv *KeyValueStore) searchSSTFileMulti(ctx context.Context, keys []string, sstFile string) (map[string]iteratorEntry, error) {
+	found := make(map[string]iteratorEntry)
+
+	file, err := kv.files.acquire(sstFile)
+	if err != nil {
+		kv.logger.Error("error opening SST file", "file", sstFile, "err", err)
+		return found, unreadable(sstFile, err)
+	}
+	defer kv.files.release(file)
+	kv.metrics.sstableReads.Add(1)
+
+	fail := func(err error) (map[string]iteratorEntry, error) {
+		kv.logger.Error("error reading SST file", "file", sstFile, "err", err)
+		return found, unreadable(sstFile, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	header, err := readSSTableHeader(file.File)
+	if err != nil {
+		return fail(err)
+	}
+	footer, err := readSSTableFooter(file.File, header)
+	if err != nil {
+		return fail(err)
+	}
+
+	// The file is read strictly forward. ordinal is the number of the next
+	// entry to consume, and once its key has been read, current holds it
+	// while its value is still ahead in the file.
+	var ordinal uint32
+	var current sstableMatch
+	var deleted, haveCurrent bool
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if kv.compare(key, footer.minKey) < 0 || kv.compare(key, footer.maxKey) > 0 {
+			continue
+		}
+
+		// Skip ahead to the key's sparse index point if it is further on
+		if offset, point, ok := footer.seek(kv.compare, key, header.entryCount); ok && point > ordinal {
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				return fail(err)
+			}
+			ordinal, haveCurrent = point, false
+		}
+
+		for {
+			if !haveCurrent {
+				if ordinal >= header.entryCount {
+					return found, nil // The rest of the keys are past the last entry
+				}
+				entry, valueLength, err := readSSTableEntryKey(file.File)
+				if err != nil {
+					return fail(err)
+				}
+				current = sstableMatch{
+					header:      header,
+					key:         entry.key,
+					index:       ordinal,
+					valueType:   entry.valueType &^ valueLogFlag,
+					valueLength: valueLength,
+					inValueLog:  entry.valueType&valueLogFlag != 0,
+					version:     entry.version,
+				}
+				deleted, haveCurrent = entry.operationMarker == 1, true
+			}
+			if kv.compare(current.key, key) > 0 {
+				break // The key isn't in the file; the entry may be a later key's
+			}
+
+			// Consume the entry, reading its value only if it is the key's
+			if current.key == key && !deleted {
+				value, err := kv.readMatch(current, file.File)
+				if err != nil {
+					return fail(err)
+				}
+				found[key] = iteratorEntry{key: key, value: value, valueType: current.valueType, version: current.version}
+			} else {
+				if _, err := file.Seek(int64(current.valueLength), io.SeekCurrent); err != nil {
+					return fail(err)
+				}
+				if current.key == key {
+					found[key] = iteratorEntry{key: key, deleted: true}
+				}
+			}
+			ordinal, haveCurrent = ordinal+1, false
+			if current.key == key {
+				break
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// lookup searches the memtable and then the SST files for the key without
+// taking the lock, and reports the value's type and which layer served it.
+// SST files that can't be read are skipped.
+func (kv *KeyValueStore) lookup(ctx context.Context, key string) ([]byte, ValueType, Source, error) {
+	value, valueType, _, source, err := kv.lookupVersion(ctx, key)
+	if errors.Is(err, ErrUnreadableSSTable) {
+		err = nil // Logged already; the older files' answer stands
+	}
+	return value, valueType, source, err
+}
+
+// lookupVersion is lookup that also reports the value's version. If an SST
+// file that may hold the key can't be read, its error is returned along
+// with what the older files hold, for the caller to decide whether that
+// answer stands.
+func (kv *KeyValueStore) lookupVersion(ctx context.Context, key string) ([]byte, ValueType, uint64, Source, error) {
+	if value, valueType, source, found := kv.lookupMemtables(key); found {
+		if source == SourceNotFound {
+			return nil, ValueBinary, 0, source, nil
+		}
+		return value, valueType, kv.memtableVersion(key), source, nil
+	}
+
+	// Key not found in memory, and not deleted in DeletedKeys, check the cache
+	// before searching the SST files
+	entry, cached := kv.lookupCache(key)
+	var skipped error
+	if !cached {
+		value, match, ok, err := kv.searchSSTFiles(ctx, key)
+		if err != nil && !errors.Is(err, ErrUnreadableSSTable) {
+			return nil, ValueBinary, 0, SourceNotFound, err
+		}
+		entry = cacheEntry{key: key, value: value, valueType: match.valueType, version: match.version, found: ok}
+		skipped = err
+		// An answer that skipped a file isn't cached, so the file is tried again
+		if skipped == nil {
+			kv.cache.put(entry)
+		}
+	}
+	if !entry.found {
+		return nil, ValueBinary, 0, SourceNotFound, skipped
+	}
+
+	return entry.value, entry.valueType, entry.version, SourceSSTable, skipped
+}
+
+// lookupMemtables searches the memtable and then the memtable being flushed
+// for the key, and reports whether either settled the lookup with a value or
+// a tombstone.
+func (kv *KeyValueStore) lookupMemtables(key string) ([]byte, ValueType, Source, bool) {
+	value, ok := kv.data.get(key)
+
+	// Check if the key is marked as deleted
+	if kv.DeletedKeys[key] {
+		return nil, ValueBinary, SourceNotFound, true
+	}else if ok{
+		return value, kv.valueTypes[key], SourceMemtable, true
+	}
+
+	// Then the memtables waiting to be flushed, newest first
+	for _, frozen := range kv.flushing {
+		if frozen.deletedKeys[key] {
+			return nil, ValueBinary, SourceNotFound, true
+		}
+		if value, ok := frozen.data.get(key); ok {
+			return value, frozen.valueTypes[key], SourceMemtable, true
+		}
+	}
+
+	return nil, ValueBinary, SourceNotFound, false
+}
+
+// memtableVersion returns the version of the key's value in the memtable, or
+// else in the newest memtable being flushed that holds it. The caller must
+// have found the value in one of them with lookupMemtables.
+func (kv *KeyValueStore) memtableVersion(key string) uint64 {
+	if _, ok := kv.data.get(key); ok {
+		return kv.versions[key]
+	}
+	for _, frozen := range kv.flushing {
+		if _, ok := frozen.data.get(key); ok {
+			return frozen.versions[key]
+		}
+	}
+	return 0
+}
+
+// lookupCache looks the key up in the cache, counting the hit or miss.
+func (kv *KeyValueStore) lookupCache(key string) (cacheEntry, bool) {
+	entry, cached := kv.cache.get(key)
+	if kv.cache != nil {
+		if cached {
+			kv.metrics.cacheHits.Add(1)
+		} else {
+			kv.metrics.cacheMisses.Add(1)
+		}
+	}
+	return entry, cached
+}
+
+// lruCache caches the results of SSTable lookups, evicting the least
+// recently used key once it holds capacity entries. A nil cache is disabled.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List               // Most recently used at the front
+	items    map[string]*list.Element // Elements hold *cacheEntry values
+}
+
+// cacheEntry is a cached lookup result; found is false for keys that are
+// absent or deleted in the SST files.
+type cacheEntry struct {
+	key       string
+	value     []byte
+	valueType ValueType
+	version   uint64
+	found     bool
+}
+
+// newLRUCache creates a cache for the configured size, or returns nil if
+// caching is disabled.
+func newLRUCache(size int) *lruCache {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = defaultCacheSize
+	}
+
+	return &lruCache{
+		capacity: size,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached lookup result for key and whether one was cached.
+func (c *lruCache) get(key string) (cacheEntry, bool) {
+	if c == nil {
+		return cacheEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	c.order.MoveToFront(element)
+	return *element.Value.(*cacheEntry), true
+}
+
+// put caches a lookup result, evicting the least recently used entry if full.
+func (c *lruCache) put(entry cacheEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[entry.key]; ok {
+		element.Value = &entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.items[entry.key] = c.order.PushFront(&entry)
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// clear drops all cached results.
+func (c *lruCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// remove drops any cached result for key.
+func (c *lruCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.order.Remove(element)
+		delete(c.items, key)
+	}
+}
+
+// Set writes the key-value pair to the in-memory store and the WAL. It
+// returns an error if the key or value is rejected by the size limits.
+func (kv *KeyValueStore) Set(key string, value []byte) error {
+	defer kv.metrics.set.observe(time.Now())
+
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
+	if err := kv.validate(key, value); err != nil {
+		return err
+	}
+
+	if err := kv.lockWrite(); err != nil {
+		return err
+	}
+	defer kv.commitWAL()
+	defer kv.mu.Unlock()
+
+	if err := kv.set(key, value, ValueBinary); err != nil {
+		return err
+	}
+	if err := kv.flushIfFull(); err != nil {
+		kv.logger.Error("error flushing to SSTable", "err", err)
+	}
+
+	return nil
+}
+
+// SetTyped is Set for a value with a content type, such as "text/plain" or
+// "application/json", that is returned with it by GetTyped. It returns
+// ErrUnsupportedContentType for content types without a ValueType.
+func (kv *KeyValueStore) SetTyped(key string, value []byte, contentType string) error {
+	defer kv.metrics.set.observe(time.Now())
+
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
+	if err := kv.validate(key, value); err != nil {
+		return err
+	}
+	valueType, err := parseValueType(contentType)
+	if err != nil {
+		return err
+	}
+
+	if err := kv.lockWrite(); err != nil {
+		return err
+	}
+	defer kv.commitWAL()
+	defer kv.mu.Unlock()
+
+	if err := kv.set(key, value, valueType); err != nil {
+		return err
+	}
+	if err := kv.flushIfFull(); err != nil {
+		kv.logger.Error("error flushing to SSTable", "err", err)
+	}
+
+	return nil
+}
+
+// checkWritable returns ErrReadOnly if the store was opened read-only or as
+// a follower.
+func (kv *KeyValueStore) checkWritable() error {
+	if kv.options.ReadOnly || kv.options.Follower {
+		return ErrReadOnly
+	}
+	if kv.closed.Load() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// lockWrite takes the write lock for a write that passed checkWritable, or
+// returns ErrClosed without it if Close began while the write waited for
+// the lock.
+func (kv *KeyValueStore) lockWrite() error {
+	kv.mu.Lock()
+	if kv.closed.Load() {
+		kv.mu.Unlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+// ReadOnly reports whether the store was opened with Options.ReadOnly.
+func (kv *KeyValueStore) ReadOnly() bool {
+	return kv.options.ReadOnly
+}
+
+// validate checks a key and value against the configured size limits.
+func (kv *KeyValueStore) validate(key string, value []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > kv.options.MaxKeySize {
+		return fmt.Errorf("%w: %d > %d bytes", ErrKeyTooLarge, len(key), kv.options.MaxKeySize)
+	}
+	if len(value) > kv.options.MaxValueSize {
+		return fmt.Errorf("%w: %d > %d bytes", ErrValueTooLarge, len(value), kv.options.MaxValueSize)
+	}
+	return nil
+}
+
+// set stores the key-value pair and its type without taking the lock. It
+// returns the error from writing to the WAL, leaving the memtable alone, if
+// the write fails. Callers flush a full memtable with flushIfFull.
+func (kv *KeyValueStore) set(key string, value []byte, valueType ValueType) error {
+	// Write to the WAL
+	logEntry := map[string]interface{}{
+		"operation": "set",
+		"key":       key,
+	}
+	setWALValue(logEntry, value)
+	if valueType != ValueBinary {
+		logEntry["type"] = valueType
+	}
+	version, err := kv.writeToWAL(logEntry)
+	if err != nil {
+		return err
+	}
+
+	// Any cached SSTable result for the key is now stale
+	kv.cache.remove(key)
+
+	// The new value replaces any tombstone for the key, which would
+	// otherwise hide it
+	delete(kv.DeletedKeys, key)
+
+	// Update smallest and largest key lengths
+	kv.trackKeyLength(key)
+
+	// Update the in-memory store
+	kv.storeInMemtable(key, value, version)
+	kv.setValueType(key, valueType)
+
+    return nil
+}
+
+// flushIfFull flushes the memtable if it has reached a flush threshold and
+// returns any error from the flush.
+func (kv *KeyValueStore) flushIfFull() error {
+	if kv.memtableFull() {
+		return kv.flush()
+	}
+	return nil
+}
+
+// orderedComparator wraps a comparator so that identical keys compare equal
+// without calling it and the empty key, which stands for an unbounded start
+// of a range, sorts before every other key.
+func orderedComparator(compare Comparator) Comparator {
+	return func(a, b string) int {
+		switch {
+		case a == b:
+			return 0
+		case a == "":
+			return -1
+		case b == "":
+			return 1
+		}
+		return compare(a, b)
+	}
+}
+
+// skipListMaxLevel bounds the height of skip list nodes. With a branching
+// probability of 1/4 it suits memtables of up to about 4^16 keys.
+const skipListMaxLevel = 16
+
+// skipList is a map from keys to values that keeps its keys sorted, so the
+// memtable can be flushed and scanned in key order without sorting. It is
+// not safe for concurrent use; the store's lock guards it.
+type skipList struct {
+	head    *skipNode // Sentinel whose next pointers start each level
+	level   int       // Number of levels in use
+	length  int
+	seed    uint64     // State of the generator for node heights
+	compare Comparator // Orders the keys
+}
+
+// skipNode is a key-value pair in a skipList, linked to the next node on
+// each of its levels.
+type skipNode struct {
+	key   string
+	value []byte
+	next  []*skipNode
+}
+
+// newSkipList returns an empty skip list ordered by compare.
+func newSkipList(compare Comparator) *skipList {
+	return &skipList{
+		head:    &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level:   1,
+		seed:    uint64(time.Now().UnixNano()) | 1,
+		compare: compare,
+	}
+}
+
+// randomLevel returns the height of a new node: each extra level is added
+// with probability 1/4.
+func (l *skipList) randomLevel() int {
+	// xorshift64
+	l.seed ^= l.seed << 13
+	l.seed ^= l.seed >> 7
+	l.seed ^= l.seed << 17
+
+	level := 1
+	for bits := l.seed; level < skipListMaxLevel && bits&3 == 0; bits >>= 2 {
+		level++
+	}
+	return level
+}
+
+// findPredecessors returns, for each level, the last node whose key is less
+// than key.
+func (l *skipList) findPredecessors(key string) []*skipNode {
+	predecessors := make([]*skipNode, skipListMaxLevel)
+	node := l.head
+	for level := l.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && l.compare(node.next[level].key, key) < 0 {
+			node = node.next[level]
+		}
+		predecessors[level] = node
+	}
+	return predecessors
+}
+
+// seek returns the first node whose key is at least key, or nil.
+func (l *skipList) seek(key string) *skipNode {
+	node := l.head
+	for level := l.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && l.compare(node.next[level].key, key) < 0 {
+			node = node.next[level]
+		}
+	}
+	return node.next[0]
+}
+
+// get returns the value stored for key.
+func (l *skipList) get(key string) ([]byte, bool) {
+	node := l.seek(key)
+	if node == nil || node.key != key {
+		return nil, false
+	}
+	return node.value, true
+}
+
+// put stores the value for key, replacing any previous one.
+func (l *skipList) put(key string, value []byte) {
+	predecessors := l.findPredecessors(key)
+	if node := predecessors[0].next[0]; node != nil && node.key == key {
+		node.value = value
+		return
+	}
+
+	level := l.randomLevel()
+	for ; l.level < level; l.level++ {
+		predecessors[l.level] = l.head
+	}
+	node := &skipNode{key: key, value: value, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = predecessors[i].next[i]
+		predecessors[i].next[i] = node
+	}
+	l.length++
+}
+
+// remove deletes key and reports whether it was present.
+func (l *skipList) remove(key string) bool {
+	predecessors := l.findPredecessors(key)
+	node := predecessors[0].next[0]
+	if node == nil || node.key != key {
+		return false
+	}
+
+	for i := range node.next {
+		predecessors[i].next[i] = node.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.length--
+	return true
+}
+
+// len returns the number of keys in the list.
+func (l *skipList) len() int {
+	return l.length
+}
+
+// storeInMemtable puts the pair in the memtable, with its version, and
+// updates its tracked size. A zero version is not kept.
+func (kv *KeyValueStore) storeInMemtable(key string, value []byte, version uint64) {
+	if old, ok := kv.data.get(key); ok {
+		kv.memtableBytes -= int64(len(key) + len(old))
+	}
+	kv.data.put(key, value)
+	kv.memtableBytes += int64(len(key) + len(value))
+	if version != 0 {
+		kv.versions[key] = version
+	} else {
+		delete(kv.versions, key)
+	}
+}
+
+// removeFromMemtable deletes the key from the memtable and updates its
+// tracked size.
+func (kv *KeyValueStore) removeFromMemtable(key string) {
+	if old, ok := kv.data.get(key); ok {
+		kv.memtableBytes -= int64(len(key) + len(old))
+		kv.data.remove(key)
+		delete(kv.versions, key)
+	}
+}
+
+// memtableFull reports whether the memtable has reached a flush threshold:
+// memtableFlushKeys keys, MaxMemtableBytes bytes, or, if set, MaxWALBytes
+// of WAL written since the last flush.
+func (kv *KeyValueStore) memtableFull() bool {
+	return kv.data.len() >= memtableFlushKeys || kv.memtableBytes >= kv.options.MaxMemtableBytes || kv.walOutgrown()
+}
+
+// walOutgrown reports whether the WAL written since the last flush, or for
+// an in-memory store the last rewrite, has outgrown MaxWALBytes.
+func (kv *KeyValueStore) walOutgrown() bool {
+	if kv.options.MaxWALBytes == 0 {
+		return false
+	}
+
+	kv.walMu.Lock()
+	defer kv.walMu.Unlock()
+
+	return kv.walPending >= kv.options.MaxWALBytes && kv.walPending >= kv.walRewrite
+}
+
+// setValueType records the type of a memtable value. Only types other than
+// ValueBinary are kept.
+func (kv *KeyValueStore) setValueType(key string, valueType ValueType) {
+	if valueType == ValueBinary {
+		delete(kv.valueTypes, key)
+	} else {
+		kv.valueTypes[key] = valueType
+	}
+}
+
+// trackKeyLength updates the smallest and largest key lengths seen in memory.
+func (kv *KeyValueStore) trackKeyLength(key string) {
+	keyLength := len(key)
+	if kv.smallestKeyLength == 0 || keyLength < kv.smallestKeyLength {
+		kv.smallestKeyLength = keyLength
+	}
+	if keyLength > kv.largestKeyLength {
+		kv.largestKeyLength = keyLength
+	}
+}
+
+// CompareAndSwap sets key to newValue only if its current value equals
+// oldValue, and reports whether the swap happened.
+func (kv *KeyValueStore) CompareAndSwap(key string, oldValue, newValue []byte) (bool, error) {
+	if err := kv.checkWritable(); err != nil {
+		return false, err
+	}
+	if err := kv.validate(key, newValue); err != nil {
+		return false, err
+	}
+
+	// Hold the write lock across the read-compare-write so it's atomic
+	if err := kv.lockWrite(); err != nil {
+		return false, err
+	}
+	defer kv.commitWAL()
+	defer kv.mu.Unlock()
+
+	current, ok := kv.get(key)
+	if !ok || !bytes.Equal(current, oldValue) {
+		return false, nil
+	}
+
+	if err := kv.set(key, newValue, ValueBinary); err != nil {
+		return false, err
+	}
+	if err := kv.flushIfFull(); err != nil {
+		kv.logger.Error("error flushing to SSTable", "err", err)
+	}
+
+	return true, nil
+}
+
+// SetIfAbsent stores the value only if the key doesn't exist, and reports
+// whether it was stored.
+func (kv *KeyValueStore) SetIfAbsent(key string, value []byte) (bool, error) {
+	return kv.setIfAbsent(key, value, "")
+}
+
+// setIfAbsent is SetIfAbsent for a value with a content type, as in SetTyped.
+func (kv *KeyValueStore) setIfAbsent(key string, value []byte, contentType string) (bool, error) {
+	if err := kv.checkWritable(); err != nil {
+		return false, err
+	}
+	if err := kv.validate(key, value); err != nil {
+		return false, err
+	}
+	valueType, err := parseValueType(contentType)
+	if err != nil {
+		return false, err
+	}
+
+	// Hold the write lock across the check and the write so it's atomic
+	if err := kv.lockWrite(); err != nil {
+		return false, err
+	}
+	defer kv.commitWAL()
+	defer kv.mu.Unlock()
+
+	if _, ok := kv.get(key); ok {
+		return false, nil
+	}
+
+	if err := kv.set(key, value, valueType); err != nil {
+		return false, err
+	}
+	if err := kv.flushIfFull(); err != nil {
+		kv.logger.Error("error flushing to SSTable", "err", err)
+	}
+
+	return true, nil
+}
+
+// Increment adds delta to the integer stored at key and returns the new value.
+// A missing key starts from zero, and a value that isn't an integer returns
+// ErrNotInteger.
+func (kv *KeyValueStore) Increment(key string, delta int64) (int64, error) {
+	if err := kv.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := kv.validate(key, nil); err != nil {
+		return 0, err
+	}
+
+	if err := kv.lockWrite(); err != nil {
+		return 0, err
+	}
+	defer kv.commitWAL()
+	defer kv.mu.Unlock()
+
+	// Parse the current value as a base-10 integer
+	var current int64
+	if value, ok := kv.get(key); ok {
+		parsed, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("value for key %s: %w: %w", key, ErrNotInteger, err)
+		}
+		current = parsed
+	}
+
+	newValue := current + delta
+	if err := kv.set(key, []byte(strconv.FormatInt(newValue, 10)), ValueString); err != nil {
+		return 0, err
+	}
+	if err := kv.flushIfFull(); err != nil {
+		kv.logger.Error("error flushing to SSTable", "err", err)
+	}
+
+	return newValue, nil
+}
+
+// Append adds suffix to the end of the value stored at key and returns the
+// new value, which keeps the old value's type. A missing key is created
+// with suffix as its value.
+func (kv *KeyValueStore) Append(key string, suffix []byte) ([]byte, error) {
+	if err := kv.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := kv.validate(key, suffix); err != nil {
+		return nil, err
+	}
+
+	if err := kv.lockWrite(); err != nil {
+		return nil, err
+	}
+	defer kv.commitWAL()
+	defer kv.mu.Unlock()
+
+	current, valueType, _, err := kv.lookup(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the new value in a fresh slice, since the current one may be
+	// shared with the memtable or the cache
+	value := make([]byte, 0, len(current)+len(suffix))
+	value = append(append(value, current...), suffix...)
+	if err := kv.validate(key, value); err != nil {
+		return nil, err
+	}
+	if err := kv.set(key, value, valueType); err != nil {
+		return nil, err
+	}
+	if err := kv.flushIfFull(); err != nil {
+		kv.logger.Error("error flushing to SSTable", "err", err)
+	}
+
+	return value, nil
+}
+
+// MergeFunc combines a key's existing value, nil if the key is missing, with
+// merge operands, oldest first, and returns the new value. It must not keep
+// or modify existing or the operands.
+type MergeFunc func(existing []byte, operands [][]byte) []byte
+
+// Merge combines operand with the value stored at key using
+// Options.MergeFunc and stores the result, which keeps the old value's type.
+// The read, merge, and write happen under the write lock, so concurrent
+// merges of the same key are applied one after another and none is lost,
+// without the caller reading the value first.
+func (kv *KeyValueStore) Merge(key string, operand []byte) error {
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
+	if kv.options.MergeFunc == nil {
+		return ErrNoMergeFunc
+	}
+	if err := kv.validate(key, operand); err != nil {
+		return err
+	}
+
+	if err := kv.lockWrite(); err != nil {
+		return err
+	}
+	defer kv.commitWAL()
+	defer kv.mu.Unlock()
+
+	current, valueType, source, err := kv.lookup(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	if source == SourceNotFound {
+		current = nil
+	}
+
+	value := kv.options.MergeFunc(current, [][]byte{operand})
+	if err := kv.validate(key, value); err != nil {
+		return err
+	}
+	if err := kv.set(key, value, valueType); err != nil {
+		return err
+	}
+	if err := kv.flushIfFull(); err != nil {
+		kv.logger.Error("error flushing to SSTable", "err", err)
+	}
+
+	return nil
+}
+
+// frozenMemtable is a full memtable that has been swapped out of the store
+// and is waiting to be written, or being written, to an SSTable in the
+// background. It is never modified.
+type frozenMemtable struct {
+	data        *skipList
+	deletedKeys map[string]bool
+	valueTypes  map[string]ValueType
+	versions    map[string]uint64
+	walSegment  uint64 // Last WAL segment holding its records
+	walSeq      uint64 // Sequence number of its last WAL record
+}
+
+// flush swaps the memtable out for an empty one and writes it to a new
+// SSTable in the background, so reads and writes aren't held up by the disk
+// I/O. If MaxPendingFlushes memtables are already waiting to be written, it
+// waits for the oldest first. The caller must hold the write lock.
+func (kv *KeyValueStore) flush() error {
+	// Followers flush the records they apply like any other store
+	if kv.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	// An in-memory store never flushes, so its memtable and WAL keep
+	// everything; a WAL grown large is rewritten instead
+	if kv.options.InMemoryOnly {
+		if kv.walOutgrown() {
+			return kv.rewriteWAL()
+		}
+		return nil
+	}
+
+	// Hold up the writer while the disk falls behind, so full memtables
+	// can't pile up in memory
+	for len(kv.flushing) >= kv.options.MaxPendingFlushes {
+		kv.flushDone.Wait()
+	}
+	if kv.data.len() == 0 && len(kv.DeletedKeys) == 0 {
+		return nil
+	}
+
+	// Start a new WAL segment, so the frozen memtable's records end where
+	// the new memtable's begin
+	kv.walMu.Lock()
+	err := kv.rotateWAL()
+	walSegment, walSeq := kv.walSegment-1, kv.walSeq
+	if err == nil {
+		kv.walPending = 0
+	}
+	kv.walMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	frozen := &frozenMemtable{
+		data:        kv.data,
+		deletedKeys: kv.DeletedKeys,
+		valueTypes:  kv.valueTypes,
+		versions:    kv.versions,
+		walSegment:  walSegment,
+		walSeq:      walSeq,
+	}
+	kv.flushing = append([]*frozenMemtable{frozen}, kv.flushing...)
+
+	// Start a new in-memory store
+	kv.data = newSkipList(kv.compare)
+	kv.DeletedKeys = make(map[string]bool)
+	kv.valueTypes = make(map[string]ValueType)
+	kv.versions = make(map[string]uint64)
+	kv.memtableBytes = 0
+	kv.smallestKeyLength = 0
+	kv.largestKeyLength = 0
+
+	// Memtables are written one at a time, in order; a queued one is
+	// started once the one before it is written
+	if len(kv.flushing) == 1 {
+		go kv.writeFrozenMemtable(frozen)
+	}
+
+	return nil
+}
+
+// waitForFlush waits until no memtable is waiting to be flushed. The caller
+// must hold the write lock, which is released while waiting.
+func (kv *KeyValueStore) waitForFlush() {
+	for len(kv.flushing) > 0 {
+		kv.flushDone.Wait()
+	}
+}
+
+// Flush writes the memtable to an SSTable now, however few keys it holds,
+// and waits until the SSTable is committed and the WAL segments it covered
+// are deleted. It returns the flush's error if it failed even after
+// retrying, in which case the entries stay in the memtable and the WAL. An
+// empty memtable is left alone. A store opened with InMemoryOnly returns
+// ErrInMemoryOnly, and a read-only store ErrReadOnly.
+func (kv *KeyValueStore) Flush() error {
+	if kv.options.InMemoryOnly {
+		return ErrInMemoryOnly
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if err := kv.flush(); err != nil {
+		return err
+	}
+	if len(kv.flushing) == 0 {
+		return nil // Nothing to flush
+	}
+	kv.waitForFlush()
+
+	return kv.flushErr
+}
+
+// flushRetries is how many more times a flush whose SSTable write fails is
+// attempted, waiting flushRetryBackoff before the first retry and twice as
+// long before each one after.
+const (
+	flushRetries      = 3
+	flushRetryBackoff = 100 * time.Millisecond
+)
+
+// writeFrozenMemtable writes the oldest frozen memtable to its SSTable
+// without the store lock, then commits the SSTable, deletes the WAL segments
+// it covered, and starts writing the next one waiting, if any. A failed
+// write is retried with backoff, since disk errors such as a full disk may
+// be transient. If the flush still fails, the entries of every waiting
+// memtable are moved back into the memtable, since the newer ones can't be
+// committed before it, and the error is kept for FlushError; their WAL
+// segments are kept, so nothing is lost.
+func (kv *KeyValueStore) writeFrozenMemtable(frozen *frozenMemtable) {
+	start := time.Now()
+	outputs, entryCounts, err := kv.writeFlushTables(frozen)
+	for attempt := 0; err != nil && attempt < flushRetries; attempt++ {
+		kv.logger.Warn("error flushing to SSTable, retrying", "attempt", attempt+1, "err", err)
+		kv.removeTables(outputs)
+		time.Sleep(flushRetryBackoff << attempt)
+		outputs, entryCounts, err = kv.writeFlushTables(frozen)
+	}
+
+	kv.mu.Lock()
+
+	// Commit the SSTables to the manifest together so readers can see them,
+	// along with the last WAL record they hold, which recovery then skips
+	if err == nil {
+		previousWALSeq := kv.manifest.LastWALSeq
+		kv.manifest.LastWALSeq = frozen.walSeq
+		if err = kv.manifest.replace(kv.dataDir, nil, outputs); err != nil {
+			kv.manifest.LastWALSeq = previousWALSeq
+		}
+		kv.pruneTableIndexes()
+	}
+
+	kv.flushErr = err
+	if err != nil {
+		kv.logger.Error("error flushing to SSTable", "err", err)
+		kv.removeTables(outputs)
+
+		// Thawing the newest first keeps each key's newest version
+		for _, pending := range kv.flushing {
+			kv.thaw(pending)
+		}
+		kv.flushing = nil
+	} else {
+		kv.metrics.flush.observe(start)
+		if err := kv.removeWALSegments(frozen.walSegment); err != nil {
+			kv.logger.Error("error clearing WAL", "err", err)
+		}
+
+		// The new L0 table may trigger a compaction
+		if !kv.compacting {
+			kv.compacting = true
+			go kv.compact()
+		}
+	}
+
+	if len(kv.flushing) > 0 {
+		kv.flushing = kv.flushing[:len(kv.flushing)-1]
+		if len(kv.flushing) > 0 {
+			go kv.writeFrozenMemtable(kv.flushing[len(kv.flushing)-1])
+		}
+	}
+	kv.flushDone.Broadcast()
+	kv.mu.Unlock()
+
+	// Report the new tables without the lock, so the callback can use the
+	// store, even to write and start another flush
+	if err == nil && kv.options.OnFlush != nil {
+		for i, output := range outputs {
+			kv.options.OnFlush(filepath.Join(kv.dataDir, output.File), entryCounts[i])
+		}
+	}
+}
+
+// removeTables deletes the files of SSTables that failed to be written.
+func (kv *KeyValueStore) removeTables(outputs []ManifestEntry) {
+	for _, output := range outputs {
+		os.Remove(filepath.Join(kv.dataDir, output.File))
+	}
+}
+
+// FlushError returns the error of the last memtable flush if it failed even
+// after retrying, or nil if it succeeded. While it is set, writes still
+// succeed, but they only reach the WAL, which keeps growing.
+func (kv *KeyValueStore) FlushError() error {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	return kv.flushErr
+}
+
+// writeFlushTables writes a frozen memtable to L0 SSTables, splitting it
+// into tables of about TargetFileSize each if that is set, and returns them
+// with their entry counts. Each table's sequence number is allocated as it
+// is written, so the tables of a memtable are numbered after those of the
+// memtables written before it. The tables are returned even if writing one
+// of them fails, so the caller can remove them.
+func (kv *KeyValueStore) writeFlushTables(frozen *frozenMemtable) ([]ManifestEntry, []int, error) {
+	entries := memtableEntries(frozen.data, frozen.deletedKeys, frozen.valueTypes, frozen.versions, "", "")
+
+	var outputs []ManifestEntry
+	var entryCounts []int
+	for len(entries) > 0 || len(outputs) == 0 {
+		// Take entries until the table reaches the target size
+		n, tableBytes := len(entries), int64(0)
+		if kv.options.TargetFileSize > 0 {
+			for i, entry := range entries {
+				tableBytes += int64(len(entry.key) + len(entry.value))
+				if tableBytes >= kv.options.TargetFileSize {
+					n = i + 1
+					break
+				}
+			}
+		}
+
+		kv.mu.Lock()
+		seq := kv.manifest.allocateSeq()
+		kv.mu.Unlock()
+		filename := sstableFileName(seq)
+		tombstones := 0
+		for _, entry := range entries[:n] {
+			if entry.deleted {
+				tombstones++
+			}
+		}
+		outputs = append(outputs, ManifestEntry{File: filename, Seq: seq, Level: 0, Entries: n, Tombstones: tombstones})
+		entryCounts = append(entryCounts, n)
+		if err := kv.writeTable(filepath.Join(kv.dataDir, filename), seq, entries[:n]); err != nil {
+			return outputs, entryCounts, err
+		}
+		entries = entries[n:]
+	}
+
+	return outputs, entryCounts, nil
+}
+
+// thaw moves the entries of a frozen memtable that failed to flush back into
+// the memtable, keeping any newer version written since or thawed before
+// it. The caller must hold the write lock.
+func (kv *KeyValueStore) thaw(frozen *frozenMemtable) {
+	for node := frozen.data.seek(""); node != nil; node = node.next[0] {
+		key, value := node.key, node.value
+		if _, ok := kv.data.get(key); ok {
+			continue
+		}
+		if _, ok := kv.DeletedKeys[key]; ok {
+			continue
+		}
+		kv.trackKeyLength(key)
+		kv.storeInMemtable(key, value, frozen.versions[key])
+		kv.setValueType(key, frozen.valueTypes[key])
+	}
+	for key, deleted := range frozen.deletedKeys {
+		if _, ok := kv.data.get(key); ok {
+			continue
+		}
+		if _, ok := kv.DeletedKeys[key]; ok {
+			continue
+		}
+		kv.DeletedKeys[key] = deleted
+	}
+}
+
+// Delete removes the key and returns its prior value. It reports false,
+// with a nil error, if the key didn't exist or was already deleted, and
+// returns an error if the delete couldn't be attempted: ErrReadOnly for a
+// read-only store, ErrEmptyKey or ErrKeyTooLarge for an invalid key, or the
+// error from looking the key up.
+func (kv *KeyValueStore) Delete(key string) ([]byte, bool, error) {
+	defer kv.metrics.delete.observe(time.Now())
+
+	if err := kv.checkWritable(); err != nil {
+		return nil, false, err
+	}
+	if err := kv.validate(key, nil); err != nil {
+		return nil, false, err
+	}
+
+	if err := kv.lockWrite(); err != nil {
+		return nil, false, err
+	}
+	defer kv.commitWAL()
+	defer kv.mu.Unlock()
+
+	// Any cached SSTable result for the key is about to be stale
+	defer kv.cache.remove(key)
+
+	// Find the current value, in memory or in the SST files. A key that is
+	// already deleted is reported as not found and left alone.
+	value, ok, err := kv.getContext(context.Background(), key)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, nil
+	}
+
+	// Write to the WAL
+	logEntry := map[string]interface{}{
+		"operation": "delete",
+		"key":       key,
+	}
+	if _, err := kv.writeToWAL(logEntry); err != nil {
+		return nil, false, err
+	}
+	kv.removeFromMemtable(key)
+	delete(kv.valueTypes, key)
+
+	// An older version, in the memtable being flushed or an SST file, would
+	// surface again without a tombstone
+	if kv.inOlderTables(key) {
+		kv.DeletedKeys[key] = true
+	}
+	return value, true, nil
+}
+
+// WriteBatch stages sets and deletes in memory so they can be applied to the
+// store atomically. A WriteBatch is not safe for concurrent use.
+type WriteBatch struct {
+	kv     *KeyValueStore
+	ops    []batchOp
+	closed bool
+}
+
+// batchOp is a single staged operation in a WriteBatch.
+type batchOp struct {
+	deleted bool
+	key     string
+	value   []byte
+}
+
+// NewWriteBatch returns an empty batch of writes to the store.
+func (kv *KeyValueStore) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{kv: kv}
+}
+
+// Set stages a key-value pair, returning an error if it is rejected by the
+// store's size limits.
+func (b *WriteBatch) Set(key string, value []byte) error {
+	if b.closed {
+		return ErrBatchClosed
+	}
+	if err := b.kv.validate(key, value); err != nil {
+		return err
+	}
+
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+	return nil
+}
+
+// Delete stages the deletion of a key, returning an error if the key is
+// rejected by the store's size limits.
+func (b *WriteBatch) Delete(key string) error {
+	if b.closed {
+		return ErrBatchClosed
+	}
+	if err := b.kv.validate(key, nil); err != nil {
+		return err
+	}
+
+	b.ops = append(b.ops, batchOp{deleted: true, key: key})
+	return nil
+}
+
+// Commit applies the staged operations to the store. They are written to the
+// WAL as a single record and made durable with one fsync, so readers and
+// recovery see either all of them or none.
+func (b *WriteBatch) Commit() error {
+	if b.closed {
+		return ErrBatchClosed
+	}
+	b.closed = true
+	if err := b.kv.checkWritable(); err != nil {
+		return err
+	}
+
+	kv := b.kv
+	if err := kv.lockWrite(); err != nil {
+		return err
+	}
+	defer kv.commitWAL()
+	defer kv.mu.Unlock()
+
+	// Write the whole batch to the WAL as one entry, whose sequence number
+	// is the version of every value it sets
+	version, err := kv.writeBatchToWAL(b.ops)
+	if err != nil {
+		return err
+	}
+
+	// Apply it to the in-memory store, flushing at most once at the end so
+	// the batch never straddles an SSTable and a WAL segment
+	for _, op := range b.ops {
+		if op.deleted {
+			kv.applyDelete(op.key)
+		} else {
+			kv.applySet(op.key, op.value, version)
+		}
+	}
+	if err := kv.flushIfFull(); err != nil {
+		kv.logger.Error("error flushing to SSTable", "err", err)
+	}
+
+	return nil
+}
+
+// writeBatchToWAL writes the operations to the WAL as a single batch record,
+// so recovery replays all of them or none, and returns its sequence number.
+func (kv *KeyValueStore) writeBatchToWAL(batch []batchOp) (uint64, error) {
+	ops := make([]interface{}, 0, len(batch))
+	for _, op := range batch {
+		if op.deleted {
+			ops = append(ops, map[string]interface{}{
+				"operation": "delete",
+				"key":       op.key,
+			})
+		} else {
+			opEntry := map[string]interface{}{
+				"operation": "set",
+				"key":       op.key,
+			}
+			setWALValue(opEntry, op.value)
+			ops = append(ops, opEntry)
+		}
+	}
+	return kv.writeToWAL(map[string]interface{}{
+		"operation": "batch",
+		"ops":       ops,
+	})
+}
+
+// Close discards the batch if it has not been committed.
+func (b *WriteBatch) Close() {
+	b.closed = true
+	b.ops = nil
+}
+
+// applySet stores a key-value pair in memory with its version, replacing any
+// tombstone, without writing to the WAL. The caller must hold the write
+// lock.
+func (kv *KeyValueStore) applySet(key string, value []byte, version uint64) {
+	kv.cache.remove(key)
+	kv.trackKeyLength(key)
+	delete(kv.DeletedKeys, key)
+	kv.storeInMemtable(key, value, version)
+	delete(kv.valueTypes, key)
+}
+
+// applyDelete removes a key from memory and tombstones it so older SSTables
+// can't resurface it, without writing to the WAL. The caller must hold the
+// write lock.
+func (kv *KeyValueStore) applyDelete(key string) {
+	kv.cache.remove(key)
+	kv.removeFromMemtable(key)
+	delete(kv.valueTypes, key)
+	kv.DeletedKeys[key] = true
+}
+
+// DeleteRange deletes every live key in [start, end), across the memtable and
+// SSTables, and returns how many keys were deleted. An empty end is
+// unbounded. The deletes are written to the WAL as one batch record.
+func (kv *KeyValueStore) DeleteRange(start, end string) (int, error) {
+	return kv.deleteMatching(start, end, nil)
+}
+
+// deleteMatching deletes every live key in [start, end) for which match,
+// if not nil, returns true, and returns how many keys were deleted.
+func (kv *KeyValueStore) deleteMatching(start, end string, match func(key string) bool) (int, error) {
+	if err := kv.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	if err := kv.lockWrite(); err != nil {
+		return 0, err
+	}
+	defer kv.commitWAL()
+	defer kv.mu.Unlock()
+
+	// Find the live keys in the range
+	it := kv.newIterator(start, end)
+	it.start()
+	var ops []batchOp
+	for it.Next() {
+		if match != nil && !match(it.Key()) {
+			continue
+		}
+		ops = append(ops, batchOp{deleted: true, key: it.Key()})
+	}
+	it.Close()
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	if len(ops) == 0 {
+		return 0, nil
+	}
+
+	if _, err := kv.writeBatchToWAL(ops); err != nil {
+		return 0, err
+	}
+	for _, op := range ops {
+		kv.applyDelete(op.key)
+	}
+
+	return len(ops), nil
+}
+
+// bucketSeparator ends a bucket's name in the keys that store the bucket's
+// pairs, so one bucket's keys are never a prefix of another's.
+const bucketSeparator = "\x00"
+
+// bucketPrefix returns the prefix of the keys that store bucket's pairs.
+func bucketPrefix(bucket string) (string, error) {
+	if bucket == "" || strings.Contains(bucket, bucketSeparator) {
+		return "", ErrInvalidBucket
+	}
+	return bucket + bucketSeparator, nil
+}
+
+// bucketKey returns the key that stores key in bucket.
+func bucketKey(bucket, key string) (string, error) {
+	prefix, err := bucketPrefix(bucket)
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		return "", ErrEmptyKey
+	}
+	return prefix + key, nil
+}
+
+// SetInBucket sets a key-value pair in bucket, a namespace of keys within
+// the store, so the same key can hold a different value in each bucket. It
+// returns ErrInvalidBucket for an invalid bucket name; the bucket name
+// counts towards the key size limit.
+func (kv *KeyValueStore) SetInBucket(bucket, key string, value []byte) error {
+	storeKey, err := bucketKey(bucket, key)
+	if err != nil {
+		return err
+	}
+	return kv.Set(storeKey, value)
+}
+
+// GetFromBucket retrieves the value associated with key in bucket.
+func (kv *KeyValueStore) GetFromBucket(bucket, key string) ([]byte, bool) {
+	storeKey, err := bucketKey(bucket, key)
+	if err != nil {
+		return nil, false
+	}
+	return kv.Get(storeKey)
+}
+
+// DeleteFromBucket deletes key from bucket like Delete, returning the value
+// it held.
+func (kv *KeyValueStore) DeleteFromBucket(bucket, key string) ([]byte, bool, error) {
+	storeKey, err := bucketKey(bucket, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return kv.Delete(storeKey)
+}
+
+// ScanBucket returns the live key-value pairs in bucket, sorted by key, with
+// the keys as they were set in the bucket.
+func (kv *KeyValueStore) ScanBucket(bucket string) ([]KeyValue, error) {
+	return kv.ScanBucketContext(context.Background(), bucket)
+}
+
+// ScanBucketContext is ScanBucket, aborting with the context's error if the
+// context is cancelled while iterating.
+func (kv *KeyValueStore) ScanBucketContext(ctx context.Context, bucket string) ([]KeyValue, error) {
+	prefix, err := bucketPrefix(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs, err := kv.ScanPrefixContext(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pairs {
+		pairs[i].Key = strings.TrimPrefix(pairs[i].Key, prefix)
+	}
+
+	return pairs, nil
+}
+
+// DeleteBucket deletes every live key in bucket and returns how many keys
+// were deleted. The deletes are written to the WAL as one batch record.
+func (kv *KeyValueStore) DeleteBucket(bucket string) (int, error) {
+	prefix, err := bucketPrefix(bucket)
+	if err != nil {
+		return 0, err
+	}
+
+	if kv.options.ComparatorName == bytewiseComparatorName {
+		return kv.deleteMatching(prefix, prefixUpperBound(prefix), nil)
+	}
+
+	// Keys sharing a prefix are only contiguous in bytewise order, so with
+	// another comparator every key is checked
+	return kv.deleteMatching("", "", func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// ClearWAL closes the Write-Ahead Log, deletes all of its segments, and
+// starts a new segment. It is called once the WAL's data is in an SSTable.
+func (kv *KeyValueStore) ClearWAL() error {
+    kv.walMu.Lock()
+    defer kv.walMu.Unlock()
+
+    // Close the Write-Ahead Log
+    if err := kv.closeWALFile(); err != nil {
+        return err
+    }
+
+    // Delete every segment, since their data is safely in SSTables
+    walFiles, err := kv.walFiles()
+    if err != nil {
+        return err
+    }
+    for _, walFile := range walFiles {
+        if err := os.Remove(walFile); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+
+    // Start a new segment, keeping segment numbers increasing
+    return kv.openWALSegment(kv.walSegment + 1)
+}
+
+// removeWALSegments deletes the WAL segments numbered up to upTo, along with
+// any legacy unsegmented WAL, once their data is in an SSTable.
+func (kv *KeyValueStore) removeWALSegments(upTo uint64) error {
+	kv.walMu.Lock()
+	defer kv.walMu.Unlock()
+
+	if err := os.Remove(kv.walPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	segments, err := listWALSegments(kv.walPath)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment > upTo {
+			continue
+		}
+		if err := os.Remove(walSegmentPath(kv.walPath, segment)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walBytes returns the size of all WAL files.
+func (kv *KeyValueStore) walBytes() (int64, error) {
+	walFiles, err := kv.walFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, walFile := range walFiles {
+		walInfo, err := os.Stat(walFile)
+		if err != nil {
+			return 0, err
+		}
+		size += walInfo.Size()
+	}
+	return size, nil
+}
+
+// rewriteWAL replaces an in-memory store's WAL with one set record per key
+// in the memtable, dropping overwritten values and deleted keys. The new
+// records are synced before the old segments are deleted, so a crash at any
+// point leaves a WAL that recovers the same memtable. The caller must hold
+// the write lock.
+func (kv *KeyValueStore) rewriteWAL() error {
+	// Start the rewrite in a new segment, after every record it replaces
+	kv.walMu.Lock()
+	err := kv.rotateWAL()
+	replaced := kv.walSegment - 1
+	kv.walMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for node := kv.data.seek(""); node != nil; node = node.next[0] {
+		logEntry := map[string]interface{}{
+			"operation": "set",
+			"key":       node.key,
+		}
+		setWALValue(logEntry, node.value)
+		if valueType := kv.valueTypes[node.key]; valueType != ValueBinary {
+			logEntry["type"] = valueType
+		}
+
+		// The record is numbered anew, so it carries the value's version
+		if version := kv.versions[node.key]; version != 0 {
+			logEntry["version"] = version
+		}
+		if _, err := kv.writeToWAL(logEntry); err != nil {
+			return err
+		}
+	}
+
+	// Finish the rewrite's last segment, which syncs it, then drop the
+	// segments it replaces
+	kv.walMu.Lock()
+	err = kv.rotateWAL()
+	if err == nil {
+		kv.walRewrite, kv.walPending = kv.walPending, 0
+	}
+	kv.walMu.Unlock()
+	if err != nil {
+		return err
+	}
+	kv.logger.Info("rewrote WAL", "keys", kv.data.len(), "bytes", kv.walRewrite)
+
+	return kv.removeWALSegments(replaced)
+}
+
+// rotateWAL closes the current WAL segment and starts the next one. The
+// caller must hold walMu.
+func (kv *KeyValueStore) rotateWAL() error {
+    if err := kv.closeWALFile(); err != nil {
+        return err
+    }
+
+    return kv.openWALSegment(kv.walSegment + 1)
+}
+
+// closeWALFile waits for any in-progress fsync, then syncs and closes the
+// current WAL segment. The caller must hold walMu.
+func (kv *KeyValueStore) closeWALFile() error {
+    // A read-only store has nothing to sync, and may have no WAL at all
+    if kv.options.ReadOnly {
+        if kv.wal == nil {
+            return nil
+        }
+        return kv.wal.Close()
+    }
+
+    for kv.walSyncing {
+        kv.walCond.Wait()
+    }
+
+    // Make sure the finished segment is durable before moving on
+    if err := kv.flushWALBuffer(); err != nil {
+        kv.wal.Close()
+        return err
+    }
+    if err := kv.wal.Sync(); err != nil {
+        kv.wal.Close()
+        return err
+    }
+    kv.walDurable = kv.walWritten
+    kv.signalChanges()
+
+    return kv.wal.Close()
+}
+
+// openWALSegment creates the numbered WAL segment and makes it the one
+// being written. The caller must hold walMu.
+func (kv *KeyValueStore) openWALSegment(segment uint64) error {
+    wal, err := openFile(walSegmentPath(kv.walPath, segment), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644, kv.options.FileMode)
+    if err != nil {
+        return err
+    }
+
+    // Start the new segment with a header
+    written, err := writeWALHeader(wal)
+    if err != nil {
+        wal.Close()
+        return err
+    }
+
+    // Update the KeyValueStore's WAL reference
+    kv.wal = wal
+    if kv.walBuffer != nil {
+        kv.walBuffer.Reset(wal)
+    }
+    kv.walSegment = segment
+    kv.walSize = int64(written)
+
+    return nil
+}
+
+// syncWAL waits until the first target WAL records are fsynced. If no fsync
+// is in progress the caller performs one covering every record written so
+// far; otherwise it waits for the running fsync and checks again. Concurrent
+// writers therefore share fsyncs instead of each paying for their own.
+func (kv *KeyValueStore) syncWAL(target uint64) error {
+    kv.walMu.Lock()
+    defer kv.walMu.Unlock()
+
+    for kv.walDurable < target {
+        if kv.walSyncing {
+            kv.walCond.Wait()
+            continue
+        }
+
+        // Sync everything written so far without holding walMu, so other
+        // writers can keep appending records for the next fsync
+        if err := kv.flushWALBuffer(); err != nil {
+            return err
+        }
+        kv.walSyncing = true
+        wal, written := kv.wal, kv.walWritten
+        kv.walMu.Unlock()
+        err := wal.Sync()
+        kv.walMu.Lock()
+        kv.walSyncing = false
+        kv.walCond.Broadcast()
+
+        if err != nil {
+            return err
+        }
+        if written > kv.walDurable {
+            kv.walDurable = written
+            kv.signalChanges()
+        }
+    }
+
+    return nil
+}
+
+// Sync writes out the WAL buffer and fsyncs the WAL, so every write that
+// returned before it survives a crash, whatever the sync mode. With
+// SyncNever or a WAL buffer, it lets callers choose their own durability
+// points.
+func (kv *KeyValueStore) Sync() error {
+	if kv.options.ReadOnly {
+		return nil
+	}
+	if kv.closed.Load() {
+		return ErrClosed
+	}
+
+	kv.walMu.Lock()
+	target := kv.walWritten
+	kv.walMu.Unlock()
+
+	return kv.syncWAL(target)
+}
+
+// flushWALBuffer writes the buffered WAL records to the WAL file, and wakes
+// followers waiting for them. The caller must hold walMu.
+func (kv *KeyValueStore) flushWALBuffer() error {
+	if kv.walBuffer == nil || kv.walBuffer.Buffered() == 0 {
+		return nil
+	}
+	if err := kv.walBuffer.Flush(); err != nil {
+		return fmt.Errorf("error writing WAL buffer: %w", err)
+	}
+	kv.notifyWAL()
+	return nil
+}
+
+// notifyWAL wakes up followers waiting for new WAL records. The caller must
+// hold walMu.
+func (kv *KeyValueStore) notifyWAL() {
+	if kv.walNotify != nil {
+		close(kv.walNotify)
+		kv.walNotify = nil
+	}
+}
+
+// commitWAL makes the WAL records written so far durable according to the
+// sync mode. It must be called after releasing mu so that concurrent
+// writers can be grouped into one fsync.
+func (kv *KeyValueStore) commitWAL() {
+    if kv.options.SyncMode.policy != syncAlways {
+        return
+    }
+
+    kv.walMu.Lock()
+    target := kv.walWritten
+    kv.walMu.Unlock()
+
+    if err := kv.syncWAL(target); err != nil {
+        kv.logger.Error("error syncing WAL", "err", err)
+    }
+}
+
+// flushPeriodically flushes a non-empty memtable every FlushInterval until
+// the store is closed.
+func (kv *KeyValueStore) flushPeriodically() {
+	defer kv.background.Done()
+
+	ticker := time.NewTicker(kv.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-kv.closing:
+			return
+		case <-ticker.C:
+			// flush holds the write lock like threshold-triggered flushes, so
+			// the two can't interleave
+			kv.mu.Lock()
+			var err error
+			if kv.data.len() > 0 || len(kv.DeletedKeys) > 0 {
+				err = kv.flush()
+			}
+			kv.mu.Unlock()
+
+			if err != nil {
+				kv.logger.Error("error flushing memtable", "err", err)
+			}
+		}
+	}
+}
+
+// syncWALPeriodically fsyncs the WAL at the SyncInterval period until the
+// store is closed.
+func (kv *KeyValueStore) syncWALPeriodically() {
+    defer kv.background.Done()
+
+    ticker := time.NewTicker(kv.options.SyncMode.interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-kv.closing:
+            return
+        case <-ticker.C:
+            kv.walMu.Lock()
+            target := kv.walWritten
+            kv.walMu.Unlock()
+
+            if err := kv.syncWAL(target); err != nil {
+                kv.logger.Error("error syncing WAL", "err", err)
+            }
+        }
+    }
+}
+
+// walSegmentPath returns the path of a numbered WAL segment.
+func walSegmentPath(walPath string, segment uint64) string {
+	return fmt.Sprintf("%s.%06d", walPath, segment)
+}
+
+// listWALSegments returns the numbers of the existing WAL segments in order.
+func listWALSegments(walPath string) ([]uint64, error) {
+	matches, err := filepath.Glob(walPath + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, match := range matches {
+		segment, err := strconv.ParseUint(strings.TrimPrefix(match, walPath+"."), 10, 64)
+		if err != nil {
+			continue // Not a segment, e.g. an unrelated file sharing the prefix
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+
+	return segments, nil
+}
+
+// walFiles returns the paths of all WAL files in replay order. A WAL written
+// before segmenting was added, at the base path itself, comes first.
+func (kv *KeyValueStore) walFiles() ([]string, error) {
+	var walFiles []string
+	if _, err := os.Stat(kv.walPath); err == nil {
+		walFiles = append(walFiles, kv.walPath)
+	}
+
+	segments, err := listWALSegments(kv.walPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		walFiles = append(walFiles, walSegmentPath(kv.walPath, segment))
+	}
+
+	return walFiles, nil
+}
+
+// manifestFileName is the name of the manifest file in the data directory.
+const manifestFileName = "MANIFEST"
+
+// ManifestEntry records one committed SSTable.
+type ManifestEntry struct {
+	File  string `json:"file"`  // File name relative to the data directory
+	Seq   uint64 `json:"seq"`   // Higher sequence numbers hold newer data
+	Level int    `json:"level"` // 0 for flushed tables, 1+ for compacted ones
+
+	// Entries, tombstones included, and tombstones in the table. Both are
+	// zero for tables committed before they were recorded.
+	Entries    int `json:"entries,omitempty"`
+	Tombstones int `json:"tombstones,omitempty"`
+}
+
+// Manifest records the ordered list of committed SSTables. Only SSTables
+// listed in the manifest are read, so partially written files are ignored.
+type Manifest struct {
+	NextSeq    uint64          `json:"next_seq"`               // Sequence number for the next SSTable
+	LastWALSeq uint64          `json:"last_wal_seq,omitempty"` // Last WAL record whose data is in the tables
+	Comparator string          `json:"comparator,omitempty"`   // Name of the comparator ordering the tables' keys
+	Tables     []ManifestEntry `json:"tables"`
+
+	mode os.FileMode // Options.FileMode, for the manifest file
+}
+
+// comparatorName returns the name of the comparator the tables were written
+// with. Manifests written before comparators were configurable have none,
+// and their tables are ordered bytewise.
+func (m *Manifest) comparatorName() string {
+	if m.Comparator == "" {
+		return bytewiseComparatorName
+	}
+	return m.Comparator
+}
+
+// loadManifest reads the manifest from the data directory. If there is no
+// manifest yet, one is built from the existing SSTables ordered by
+// modification time so stores created before the manifest keep their data.
+func loadManifest(dataDir string, readOnly bool, mode os.FileMode) (*Manifest, error) {
+	manifestJSON, err := os.ReadFile(filepath.Join(dataDir, manifestFileName))
+	if err == nil {
+		var manifest Manifest
+		if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+			return nil, fmt.Errorf("error parsing manifest: %w", err)
+		}
+
+		// Never hand out a sequence number that is already in use
+		for _, table := range manifest.Tables {
+			if table.Seq >= manifest.NextSeq {
+				manifest.NextSeq = table.Seq + 1
+			}
+		}
+		manifest.mode = mode
+		return &manifest, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Get a list of SST files in the directory
+	files, err := filepath.Glob(filepath.Join(dataDir, "sstable_*.sst"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort files based on modification time (oldest to most recent)
+	sort.Slice(files, func(i, j int) bool {
+		return fileInfoModTime(files[i]).Before(fileInfoModTime(files[j]))
+	})
+
+	manifest := &Manifest{NextSeq: 1, mode: mode}
+	for _, sstFile := range files {
+		manifest.Tables = append(manifest.Tables, ManifestEntry{File: filepath.Base(sstFile), Seq: manifest.allocateSeq()})
+	}
+	if len(files) > 0 && !readOnly {
+		if err := manifest.save(dataDir); err != nil {
+			return nil, err
+		}
+	}
+
+	return manifest, nil
+}
+
+// openFile opens a file the store writes like os.OpenFile. With a mode from
+// Options.FileMode, the file is given exactly that mode, whatever the umask;
+// without one, a new file gets perm less the umask.
+func openFile(name string, flag int, perm os.FileMode, mode os.FileMode) (*os.File, error) {
+	if mode == 0 {
+		return os.OpenFile(name, flag, perm)
+	}
+	file, err := os.OpenFile(name, flag, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// makeDataDir creates the data directory if it doesn't exist. With a mode
+// from Options.FileMode, the directory is given exactly dirMode(mode),
+// whatever the umask; an existing directory is left as it is.
+func makeDataDir(dataDir string, mode os.FileMode) error {
+	if mode == 0 {
+		return os.MkdirAll(dataDir, 0755)
+	}
+	if _, err := os.Stat(dataDir); !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(dataDir, dirMode(mode)); err != nil {
+		return err
+	}
+	return os.Chmod(dataDir, dirMode(mode))
+}
+
+// dirMode returns the mode of a directory holding files with the given
+// mode: the same permissions plus search permission wherever read is
+// granted.
+func dirMode(mode os.FileMode) os.FileMode {
+	return mode | (mode&0444)>>2
+}
+
+// save atomically replaces the manifest file by writing a temporary file
+// and renaming it over the old one.
+func (m *Manifest) save(dataDir string) error {
+	manifestJSON, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(dataDir, manifestFileName+".tmp")
+	tmpFile, err := openFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, m.mode)
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(manifestJSON); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(dataDir, manifestFileName))
+}
+
+// allocateSeq returns the next unused SSTable sequence number. It is
+// persisted the next time the manifest is saved.
+func (m *Manifest) allocateSeq() uint64 {
+	seq := m.NextSeq
+	m.NextSeq++
+	return seq
+}
+
+// replace swaps the tables named in removed for added and saves the
+// manifest, so a compaction's inputs and outputs change atomically.
+func (m *Manifest) replace(dataDir string, removed []string, added []ManifestEntry) error {
+	removedFiles := make(map[string]bool)
+	for _, file := range removed {
+		removedFiles[file] = true
+	}
+
+	tables := make([]ManifestEntry, 0, len(m.Tables)+len(added))
+	for _, table := range m.Tables {
+		if !removedFiles[table.File] {
+			tables = append(tables, table)
+		}
+	}
+	tables = append(tables, added...)
+
+	previous := m.Tables
+	m.Tables = tables
+	if err := m.save(dataDir); err != nil {
+		m.Tables = previous
+		return err
+	}
+
+	return nil
+}
+
+// sstableFileName returns the file name for the SSTable with the given
+// sequence number.
+func sstableFileName(seq uint64) string {
+	return fmt.Sprintf("sstable_%010d.sst", seq)
+}
+
+// WriteSSTable writes the in-memory data to an SSTable file with the given
+// sequence number.
+func (kv *KeyValueStore) WriteSSTable(filename string, seq uint64) error {
+    return kv.writeSSTable(filename, seq, &frozenMemtable{
+        data:        kv.data,
+        deletedKeys: kv.DeletedKeys,
+        valueTypes:  kv.valueTypes,
+        versions:    kv.versions,
+    })
+}
+
+// writeSSTable writes the entries of a memtable to an SSTable file.
+func (kv *KeyValueStore) writeSSTable(filename string, seq uint64, table *frozenMemtable) error {
+	// Walk the memtable in key order, merging in the tombstones. A key present
+	// in both is written once, with the tombstone taking precedence as it does
+	// in Get.
+	entries := memtableEntries(table.data, table.deletedKeys, table.valueTypes, table.versions, "", "")
+	return kv.writeSSTableEntries(filename, seq, entries)
+}
+
+// writeSSTableEntries writes entries, sorted by key, to an SSTable file.
+func (kv *KeyValueStore) writeSSTableEntries(filename string, seq uint64, entries []iteratorEntry) error {
+    // Open or create the SSTable file
+    sstableFile, err := openFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, kv.options.FileMode)
+    if err != nil {
+        return err
+    }
+    defer sstableFile.Close()
+
+    // Write magic number and format version. A file is written in the
+    // oldest version that holds its entries, so older builds can still read
+    // it: one without versioned entries or values in the value log keeps
+    // the versions before them.
+    version := byte(valueLogFreeVersion)
+    for _, entry := range entries {
+        if entry.deleted {
+            continue
+        }
+        if entry.version != 0 {
+            version = sstableFormatVersion
+            break
+        }
+        if entry.valueType&valueLogFlag != 0 || kv.storesInValueLog(entry.value) {
+            version = valueLogVersion
+        }
+    }
+    if _, err := sstableFile.Write(append([]byte(sstableMagic), version)); err != nil {
+        return err
+    }
+
+    keys := make([]string, len(entries))
+    for i, entry := range entries {
+        keys[i] = entry.key
+    }
+
+    // Compute the key length bounds from the keys actually in this SSTable
+    smallestKeyLength, largestKeyLength := 0, 0
+    for _, key := range keys {
+        if smallestKeyLength == 0 || len(key) < smallestKeyLength {
+            smallestKeyLength = len(key)
+        }
+        if len(key) > largestKeyLength {
+            largestKeyLength = len(key)
+        }
+    }
+
+    // Write entry count
+    entryCount := len(keys)
+    if err := binary.Write(sstableFile, binary.LittleEndian, uint32(entryCount)); err != nil {
+        return err
+    }
+
+    // Write smallest key length
+    if err := binary.Write(sstableFile, binary.LittleEndian, uint32(smallestKeyLength)); err != nil {
+        return err
+    }
+
+    // Write largest key length
+    if err := binary.Write(sstableFile, binary.LittleEndian, uint32(largestKeyLength)); err != nil {
+        return err
+    }
+
+    // Write compression type, flagged if the values are encrypted
+    compression := kv.options.Compression
+    formatFlags := byte(compression)
+    if kv.aead != nil {
+        formatFlags |= encryptedFlag
+    }
+    if err := binary.Write(sstableFile, binary.LittleEndian, formatFlags); err != nil {
+        return err
+    }
+
+    // Write sequence number
+    if err := binary.Write(sstableFile, binary.LittleEndian, seq); err != nil {
+        return err
+    }
+
+    // Write the random nonce prefix that the values' nonces share
+    var noncePrefix []byte
+    if kv.aead != nil {
+        noncePrefix = make([]byte, noncePrefixSize)
+        if _, err := rand.Read(noncePrefix); err != nil {
+            return err
+        }
+        if _, err := sstableFile.Write(noncePrefix); err != nil {
+            return err
+        }
+    }
+
+    // Write key-value pairs to the SSTable, noting the offset of every
+    // indexInterval-th entry for the sparse index
+    indexInterval := kv.options.SparseIndexInterval
+    var sparseIndex []sparseIndexEntry
+    appended := false
+    for index, entry := range entries {
+        key := entry.key
+
+        if index%indexInterval == 0 {
+            offset, err := sstableFile.Seek(0, io.SeekCurrent)
+            if err != nil {
+                return err
+            }
+            sparseIndex = append(sparseIndex, sparseIndexEntry{key: key, offset: offset})
+        }
+
+        // Determine the operation type (set or delete)
+        var operationMarker uint16
+        var value []byte
+        if entry.deleted {
+            operationMarker = 1 // Delete operation, written with an empty value
+        } else {
+            // A large value goes to the value log, and the entry holds the
+            // pointer to it instead. A compaction passes on the pointers it
+            // reads as they are.
+            valueType := entry.valueType
+            value = entry.value
+            if valueType&valueLogFlag == 0 && kv.storesInValueLog(value) {
+                pointer, err := kv.values.append(key, value)
+                if err != nil {
+                    return err
+                }
+                value, valueType, appended = pointer, valueType|valueLogFlag, true
+            }
+
+            // Set operation, with the value type in the high byte
+            operationMarker = uint16(valueType) << 8
+
+            // Compress the value if the SSTable uses compression
+            if compression == GzipCompression {
+                compressed, err := gzipCompress(value)
+                if err != nil {
+                    return err
+                }
+                value = compressed
+            }
+
+            // Encrypt the value, bound to its key and position in the file
+            if kv.aead != nil {
+                value = kv.aead.Seal(nil, entryNonce(noncePrefix, uint32(index)), value, []byte(key))
+            }
+        }
+
+        // Write operation marker, then the version of a value that has one
+        if !entry.deleted && entry.version != 0 {
+            operationMarker |= versionedEntryFlag
+        }
+        if err := binary.Write(sstableFile, binary.LittleEndian, operationMarker); err != nil {
+            return err
+        }
+        if operationMarker&versionedEntryFlag != 0 {
+            if err := binary.Write(sstableFile, binary.LittleEndian, entry.version); err != nil {
+                return err
+            }
+        }
+
+        // Write key length
+        if err := binary.Write(sstableFile, binary.LittleEndian, uint32(len(key))); err != nil {
+            return err
+        }
+
+        // Write value length
+        if err := binary.Write(sstableFile, binary.LittleEndian, uint32(len(value))); err != nil {
+            return err
+        }
+
+        // Write key
+        if _, err := sstableFile.Write([]byte(key)); err != nil {
+            return err
+        }
+
+        // Write value
+        if _, err := sstableFile.Write(value); err != nil {
+            return err
+        }
+    }
+
+    // Write the footer with the smallest and largest keys so readers can skip this file
+    var minKey, maxKey string
+    if len(keys) > 0 {
+        minKey, maxKey = keys[0], keys[len(keys)-1]
+    }
+    footerOffset, err := sstableFile.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return err
+    }
+    for _, boundKey := range []string{minKey, maxKey} {
+        if err := binary.Write(sstableFile, binary.LittleEndian, uint32(len(boundKey))); err != nil {
+            return err
+        }
+        if _, err := sstableFile.Write([]byte(boundKey)); err != nil {
+            return err
+        }
+    }
+
+    // Write the sparse index: its interval and number of points, then each
+    // point's key and offset
+    if err := binary.Write(sstableFile, binary.LittleEndian, [2]uint32{uint32(indexInterval), uint32(len(sparseIndex))}); err != nil {
+        return err
+    }
+    for _, point := range sparseIndex {
+        if err := binary.Write(sstableFile, binary.LittleEndian, uint32(len(point.key))); err != nil {
+            return err
+        }
+        if _, err := sstableFile.Write([]byte(point.key)); err != nil {
+            return err
+        }
+        if err := binary.Write(sstableFile, binary.LittleEndian, uint64(point.offset)); err != nil {
+            return err
+        }
+    }
+
+    // Write the footer offset as the last 8 bytes of the file
+    if err := binary.Write(sstableFile, binary.LittleEndian, uint64(footerOffset)); err != nil {
+        return err
+    }
+
+    // Make sure the SSTable, and the values it points to, are on disk before
+    // it is committed to the manifest
+    if appended {
+        if err := kv.values.sync(); err != nil {
+            return err
+        }
+    }
+    if err := sstableFile.Sync(); err != nil {
+        return err
+    }
+
+    // Index the new SSTable while its keys are at hand
+    kv.storeTableIndex(filename, newTableIndex(keys, kv.compare))
+
+    return nil
+}
+
+// gzipCompress returns the gzip-compressed form of value.
+func gzipCompress(value []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(value); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// gzipDecompress returns the original bytes of a gzip-compressed value.
+func gzipDecompress(value []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// readKeyRange reads the smallest and largest keys from the footer of an
+// SSTable with the given header without moving the file's offset.
+func readKeyRange(file *os.File, header sstableHeader) (string, string, error) {
+	footer, err := readSSTableFooter(file, header)
+	if err != nil {
+		return "", "", err
+	}
+	return footer.minKey, footer.maxKey, nil
+}
+
+// sstableFooter holds the fields at the end of an SSTable file.
+type sstableFooter struct {
+	offset        int64 // Where the footer starts, right after the last entry
+	minKey        string
+	maxKey        string
+	indexInterval uint32             // Entries between sparse index points
+	index         []sparseIndexEntry // Empty for version 0 files written before the sparse index
+}
+
+// sparseIndexEntry is a point of an SSTable's sparse index: the key and
+// offset of every indexInterval-th entry, starting with the first.
+type sparseIndexEntry struct {
+	key    string
+	offset int64
+}
+
+// readSSTableFooter reads the footer of an SSTable with the given header,
+// which the last 8 bytes of the file locate, without moving the file's
+// offset. A file in the original format has no footer, so its entries are
+// scanned for the same fields instead.
+func readSSTableFooter(file *os.File, header sstableHeader) (sstableFooter, error) {
+	if header.baseline {
+		return readBaselineFooter(file, header.entryCount)
+	}
+
+	var footer sstableFooter
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return footer, err
+	}
+	size := fileInfo.Size()
+	if size < 8 {
+		return footer, fmt.Errorf("file is too short for a footer")
+	}
+
+	// Read the footer offset, then the whole footer at once
+	var offsetBytes [8]byte
+	if _, err := file.ReadAt(offsetBytes[:], size-8); err != nil {
+		return footer, err
+	}
+	footer.offset = int64(binary.LittleEndian.Uint64(offsetBytes[:]))
+	if footer.offset < 0 || footer.offset > size-8 {
+		return footer, fmt.Errorf("footer offset %d is outside the file", footer.offset)
+	}
+	data := make([]byte, size-8-footer.offset)
+	if _, err := file.ReadAt(data, footer.offset); err != nil {
+		return footer, err
+	}
+	reader := bytes.NewReader(data)
+	readKey := func() (string, error) {
+		var keyLength uint32
+		if err := binary.Read(reader, binary.LittleEndian, &keyLength); err != nil {
+			return "", err
+		}
+		if int64(keyLength) > int64(reader.Len()) {
+			return "", io.ErrUnexpectedEOF
+		}
+		keyBytes := make([]byte, keyLength)
+		reader.Read(keyBytes)
+		return string(keyBytes), nil
+	}
+
+	// Read the smallest and largest keys
+	if footer.minKey, err = readKey(); err != nil {
+		return footer, fmt.Errorf("error reading smallest key: %w", err)
+	}
+	if footer.maxKey, err = readKey(); err != nil {
+		return footer, fmt.Errorf("error reading largest key: %w", err)
+	}
+
+	// Version 0 files written before the sparse index end here
+	if reader.Len() == 0 {
+		if header.version > 0 {
+			return footer, fmt.Errorf("missing sparse index")
+		}
+		return footer, nil
+	}
+	var counts [2]uint32
+	if err := binary.Read(reader, binary.LittleEndian, &counts); err != nil {
+		return footer, fmt.Errorf("error reading sparse index: %w", err)
+	}
+	footer.indexInterval = counts[0]
+	if footer.indexInterval == 0 || counts[1] > uint32(reader.Len()/12) {
+		return footer, fmt.Errorf("invalid sparse index of %d points every %d entries", counts[1], counts[0])
+	}
+	footer.index = make([]sparseIndexEntry, counts[1])
+	for i := range footer.index {
+		key, err := readKey()
+		if err != nil {
+			return footer, fmt.Errorf("error reading sparse index: %w", err)
+		}
+		var offset uint64
+		if err := binary.Read(reader, binary.LittleEndian, &offset); err != nil {
+			return footer, fmt.Errorf("error reading sparse index: %w", err)
+		}
+		footer.index[i] = sparseIndexEntry{key: key, offset: int64(offset)}
+	}
+
+	return footer, nil
+}
+
+// seek finds where to start reading a file with entryCount entries, whose
+// keys are ordered by compare, to reach key: the offset and number of the
+// last sparse index point at or before key. It reports false if there is no
+// such point past the first entry, in which case reading starts at the first
+// entry.
+func (footer sstableFooter) seek(compare Comparator, key string, entryCount uint32) (int64, uint32, bool) {
+	point := sort.Search(len(footer.index), func(i int) bool { return compare(footer.index[i].key, key) > 0 }) - 1
+	if point <= 0 {
+		return 0, 0, false
+	}
+	ordinal := uint32(point) * footer.indexInterval
+	if ordinal >= entryCount || footer.index[point].offset >= footer.offset {
+		return 0, 0, false
+	}
+	return footer.index[point].offset, ordinal, true
+}
+
+// writeToWAL writes a log entry to the Write-Ahead Log file, numbered with
+// the next WAL sequence number unless it is a record replicated from a
+// leader, which keeps its own, and returns the number. If the entry can't be
+// written, the WAL's counters are left alone and the error is returned, and
+// callers must not apply the entry. Callers must call commitWAL after
+// releasing mu to make the entry durable.
+func (kv *KeyValueStore) writeToWAL(entry map[string]interface{}) (uint64, error) {
+	kv.walMu.Lock()
+	defer kv.walMu.Unlock()
+
+	// Number the entry and convert it to JSON
+	seq := kv.walSeq + 1
+	if replicated, ok := entry["seq"].(float64); ok {
+		seq = uint64(replicated)
+	}
+	entry["seq"] = seq
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling WAL entry: %w", err)
+	}
+
+	// Encrypt the whole record if encryption is enabled
+	if kv.aead != nil {
+		entryJSON, err = json.Marshal(map[string]string{"sealed": kv.sealWALRecord(entryJSON)})
+		if err != nil {
+			return 0, fmt.Errorf("error marshaling WAL entry: %w", err)
+		}
+	}
+
+	// Write the JSON entry followed by a newline to the WAL, or its buffer.
+	// It is fsynced later by commitWAL or the periodic sync, depending on
+	// the sync policy.
+	var written int
+	if kv.walBuffer != nil {
+		written, err = kv.walBuffer.WriteString(string(entryJSON) + "\n")
+	} else {
+		written, err = kv.wal.WriteString(string(entryJSON) + "\n")
+	}
+	if err != nil {
+		// Cut off any part of the record that reached the file, so the
+		// next record starts on a line of its own
+		if written > 0 && kv.walBuffer == nil {
+			kv.wal.Truncate(kv.walSize)
+		}
+		return 0, fmt.Errorf("error writing to WAL: %w", err)
+	}
+	kv.walSize += int64(written)
+	kv.walPending += int64(written)
+	kv.walWritten++
+	kv.walSeq = seq
+
+	// Queue the record's changes for the change sink
+	if kv.changed != nil {
+		kv.queueChanges(entry, seq)
+	}
+
+	// Wake up followers waiting for new records
+	kv.notifyWAL()
+
+	// Roll over to a new segment once this one is full
+	if kv.walSize >= kv.options.WALSegmentBytes {
+		if err := kv.rotateWAL(); err != nil {
+			kv.logger.Error("error rotating WAL", "err", err)
+		}
+	}
+
+	return seq, nil
+}
+
+// WAL header. Each WAL file starts with a JSON line naming its format, so
+// recovery rejects a foreign file, or one written by a newer build, rather
+// than misparsing it. Files written before the header start directly with
+// a record and are read as version 0.
+const (
+	walMagic         = "KVWAL"
+	walFormatVersion = 1
+)
+
+// walHeader is the first line of a WAL file. CRC covers the other fields.
+type walHeader struct {
+	Magic   string `json:"magic"`
+	Version int    `json:"version"`
+	Created string `json:"created"`
+	CRC     uint32 `json:"crc"`
+}
+
+// checksum returns the CRC-32 of the header's other fields.
+func (header walHeader) checksum() uint32 {
+	return crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s:%d:%s", header.Magic, header.Version, header.Created)))
+}
+
+// writeWALHeader writes the header of a new WAL file and returns its size.
+func writeWALHeader(wal *os.File) (int, error) {
+	header := walHeader{Magic: walMagic, Version: walFormatVersion, Created: time.Now().UTC().Format(time.RFC3339Nano)}
+	header.CRC = header.checksum()
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return 0, err
+	}
+	return wal.WriteString(string(headerJSON) + "\n")
+}
+
+// checkWALHeader validates the first entry of a WAL file and reports whether
+// it is a header. A file written before headers starts with a record, which
+// is left to be applied; anything else isn't a WAL file.
+func checkWALHeader(first map[string]interface{}) (bool, error) {
+	magic, ok := first["magic"].(string)
+	if !ok {
+		_, isRecord := first["operation"]
+		_, isSealed := first["sealed"]
+		if isRecord || isSealed {
+			return false, nil
+		}
+		return false, fmt.Errorf("not a WAL file: it starts with neither a header nor a record")
+	}
+	if magic != walMagic {
+		return false, fmt.Errorf("not a WAL file: header magic is %q, not %q", magic, walMagic)
+	}
+
+	header := walHeader{Magic: magic}
+	version, _ := first["version"].(float64)
+	header.Version = int(version)
+	header.Created, _ = first["created"].(string)
+	crc, _ := first["crc"].(float64)
+	header.CRC = uint32(crc)
+
+	// Check the checksum first, so a corrupt version isn't reported as an
+	// unsupported one
+	if header.CRC != header.checksum() {
+		return false, fmt.Errorf("corrupt WAL header: checksum is %08x, expected %08x", header.CRC, header.checksum())
+	}
+	if header.Version == 0 || header.Version > walFormatVersion {
+		return false, fmt.Errorf("unsupported WAL version %d: this build reads versions up to %d", header.Version, walFormatVersion)
+	}
+	return true, nil
+}
+
+// setWALValue stores value in a WAL entry. JSON strings can only hold valid
+// UTF-8, so other values are stored base64-encoded under "value_base64".
+func setWALValue(entry map[string]interface{}, value []byte) {
+	if utf8.Valid(value) {
+		entry["value"] = string(value)
+	} else {
+		entry["value_base64"] = base64.StdEncoding.EncodeToString(value)
+	}
+}
+
+// walValue returns the value stored in a WAL entry by setWALValue.
+func walValue(entry map[string]interface{}) ([]byte, error) {
+	if encoded, ok := entry["value_base64"].(string); ok {
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+	value, _ := entry["value"].(string)
+	return []byte(value), nil
+}
+
+// ChangeSink receives the store's changes from Options.ChangeSink. Publish
+// is called once for each key set or deleted, in WAL order, with op "set"
+// and the value, or op "delete" and a nil value, and the sequence number of
+// the WAL record that wrote it; the keys of a batch share their record's
+// number. An error makes the store retry the same change later.
+type ChangeSink interface {
+	Publish(op string, key string, value []byte, seq uint64) error
+}
+
+// pendingChange is a change waiting to be published to the ChangeSink.
+type pendingChange struct {
+	op     string
+	key    string
+	value  []byte
+	seq    uint64
+	record uint64 // The number of WAL records written up to and including its own
+}
+
+// Delays between attempts to publish a change the ChangeSink failed on,
+// doubling from changeRetryBackoff up to maxChangeRetryBackoff. Once the
+// store is closing, a change is retried at most closeChangeRetries times.
+const (
+	changeRetryBackoff    = 100 * time.Millisecond
+	maxChangeRetryBackoff = 10 * time.Second
+	closeChangeRetries    = 3
+)
+
+// queueChanges queues the changes in a WAL record numbered seq for the
+// ChangeSink. A record restating a value with its original version is a
+// rewrite of an in-memory store's WAL rather than a change, and is skipped.
+// The caller must hold walMu.
+func (kv *KeyValueStore) queueChanges(entry map[string]interface{}, seq uint64) {
+	if _, rewritten := entry["version"]; rewritten {
+		return
+	}
+
+	ops := []interface{}{entry}
+	if operation, _ := entry["operation"].(string); operation == "batch" {
+		ops, _ = entry["ops"].([]interface{})
+	}
+	for _, op := range ops {
+		opEntry, _ := op.(map[string]interface{})
+		change := pendingChange{seq: seq, record: kv.walWritten}
+		change.op, _ = opEntry["operation"].(string)
+		change.key, _ = opEntry["key"].(string)
+		switch change.op {
+		case "set":
+			value, err := walValue(opEntry)
+			if err != nil {
+				kv.logger.Error("error decoding value for change sink", "key", change.key, "err", err)
+				continue
+			}
+			change.value = value
+		case "delete":
+		default:
+			continue
+		}
+		kv.changes = append(kv.changes, change)
+	}
+	kv.signalChanges()
+}
+
+// signalChanges wakes publishChanges, if it isn't already due to wake. The
+// caller must hold walMu.
+func (kv *KeyValueStore) signalChanges() {
+	if kv.changed == nil {
+		return
+	}
+	select {
+	case kv.changed <- struct{}{}:
+	default:
+	}
+}
+
+// nextChange returns the oldest queued change if it may be published: under
+// SyncAlways, once its WAL record is fsynced, and otherwise once it is
+// written.
+func (kv *KeyValueStore) nextChange() (pendingChange, bool) {
+	kv.walMu.Lock()
+	defer kv.walMu.Unlock()
+
+	if len(kv.changes) == 0 {
+		return pendingChange{}, false
+	}
+	change := kv.changes[0]
+	if kv.options.SyncMode.policy == syncAlways && change.record > kv.walDurable {
+		return pendingChange{}, false
+	}
+	return change, true
+}
+
+// dropChange removes the oldest queued change once it is published.
+func (kv *KeyValueStore) dropChange() {
+	kv.walMu.Lock()
+	defer kv.walMu.Unlock()
+
+	kv.changes[0] = pendingChange{}
+	kv.changes = kv.changes[1:]
+}
+
+// publishChanges publishes queued changes to the ChangeSink in order until
+// the store is closed, retrying a change that fails until it succeeds.
+func (kv *KeyValueStore) publishChanges() {
+	defer kv.background.Done()
+
+	backoff := changeRetryBackoff
+	for {
+		change, ok := kv.nextChange()
+		if !ok {
+			select {
+			case <-kv.changed:
+				continue
+			case <-kv.closing:
+				kv.drainChanges()
+				return
+			}
+		}
+
+		if err := kv.options.ChangeSink.Publish(change.op, change.key, change.value, change.seq); err != nil {
+			kv.logger.Error("error publishing change", "key", change.key, "seq", change.seq, "retry_in", backoff, "err", err)
+			select {
+			case <-time.After(backoff):
+				backoff = min(backoff*2, maxChangeRetryBackoff)
+				continue
+			case <-kv.closing:
+				kv.drainChanges()
+				return
+			}
+		}
+		kv.dropChange()
+		backoff = changeRetryBackoff
+	}
+}
+
+// drainChanges publishes every queued change as the store closes, retrying
+// a change that fails up to closeChangeRetries times, and logs how many are
+// lost if it still fails.
+func (kv *KeyValueStore) drainChanges() {
+	kv.walMu.Lock()
+	changes := kv.changes
+	kv.changes = nil
+	kv.walMu.Unlock()
+
+	for i, change := range changes {
+		err := kv.options.ChangeSink.Publish(change.op, change.key, change.value, change.seq)
+		for attempt := 0; err != nil && attempt < closeChangeRetries; attempt++ {
+			time.Sleep(changeRetryBackoff << attempt)
+			err = kv.options.ChangeSink.Publish(change.op, change.key, change.value, change.seq)
+		}
+		if err != nil {
+			kv.logger.Error("dropping unpublished changes on close", "count", len(changes)-i, "first_seq", change.seq, "err", err)
+			return
+		}
+	}
+}
+
+// tornWALTail reports whether the bytes of a WAL file from offset on hold at
+// most one line, i.e. whether a record that failed to decode there is the last
+// one in the file.
+func tornWALTail(walFile *os.File, offset int64) (bool, error) {
+	if _, err := walFile.Seek(offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	tail, err := io.ReadAll(walFile)
+	if err != nil {
+		return false, err
+	}
+
+	tail = bytes.TrimLeft(tail, " \t\r\n")
+	newline := bytes.IndexByte(tail, '\n')
+	return newline == -1 || newline == len(tail)-1, nil
+}
+
+// truncateWAL cuts an incomplete record off the end of a WAL file, so that
+// records appended after recovery follow the last complete one. A read-only
+// store leaves the file as it is.
+func (kv *KeyValueStore) truncateWAL(walPath string, size int64) error {
+	if kv.options.ReadOnly {
+		return nil
+	}
+	if err := os.Truncate(walPath, size); err != nil {
+		return fmt.Errorf("error truncating WAL %s: %w", walPath, err)
+	}
+
+	kv.walMu.Lock()
+	if kv.wal != nil && kv.wal.Name() == walPath {
+		kv.walSize = size
+	}
+	kv.walMu.Unlock()
+
+	return nil
+}
+
+// sealWALRecord encrypts a WAL record with a random nonce and returns the
+// nonce and ciphertext, base64-encoded.
+func (kv *KeyValueStore) sealWALRecord(record []byte) string {
+	nonce := make([]byte, kv.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return base64.StdEncoding.EncodeToString(kv.aead.Seal(nonce, nonce, record, nil))
+}
+
+// openWALRecord decrypts a record sealed by sealWALRecord into logEntry.
+func (kv *KeyValueStore) openWALRecord(sealed string, logEntry *map[string]interface{}) error {
+	if kv.aead == nil {
+		return fmt.Errorf("WAL is encrypted but no encryption key is configured")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(ciphertext) < kv.aead.NonceSize() {
+		return ErrDecryption
+	}
+	nonce, ciphertext := ciphertext[:kv.aead.NonceSize()], ciphertext[kv.aead.NonceSize():]
+	record, err := kv.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return ErrDecryption
+	}
+
+	return json.Unmarshal(record, logEntry)
+}
+
+// ApplyReplicated applies one WAL record streamed from a leader's /replicate
+// endpoint to a follower store and writes it to the follower's WAL with the
+// leader's sequence number, so the follower resumes where it left off after
+// a restart. Records at or below LastSequence were already applied and are
+// ignored.
+func (kv *KeyValueStore) ApplyReplicated(record []byte) error {
+	if !kv.options.Follower {
+		return fmt.Errorf("store is not a follower")
+	}
+
+	var logEntry map[string]interface{}
+	if err := json.Unmarshal(record, &logEntry); err != nil {
+		return fmt.Errorf("error decoding replicated record: %w", err)
+	}
+	seq, _ := logEntry["seq"].(float64)
+	if seq <= 0 {
+		return fmt.Errorf("replicated record has no sequence number")
+	}
+
+	if err := kv.lockWrite(); err != nil {
+		return err
+	}
+	defer kv.commitWAL()
+	defer kv.mu.Unlock()
+
+	if uint64(seq) <= kv.LastSequence() {
+		return nil
+	}
+	if err := kv.applyWALRecord(logEntry); err != nil {
+		return err
+	}
+
+	// The record is applied first, so one that can't be applied never
+	// reaches the WAL. If the write fails, the last sequence number stays
+	// put, so the leader sends the record again and it is reapplied.
+	if _, err := kv.writeToWAL(logEntry); err != nil {
+		return err
+	}
+
+	// The record is durable now, so a failed flush mustn't make the
+	// follower think otherwise
+	if err := kv.flushIfFull(); err != nil {
+		kv.logger.Error("error flushing to SSTable", "err", err)
+	}
+	return nil
+}
+
+// walTailer reads the WAL records numbered from a starting sequence number
+// on, in order, as they are written, for streaming to followers.
+type walTailer struct {
+	kv      *KeyValueStore
+	next    uint64 // Sequence number of the next record to return
+	segment uint64 // Segment being read
+	offset  int64  // Offset of its first unread record
+}
+
+// tailWAL returns a walTailer starting at record from. It returns
+// ErrReplicationGap if that record was already flushed and deleted, and
+// ErrFollowerAhead if it is more than one past the last record written.
+func (kv *KeyValueStore) tailWAL(from uint64) (*walTailer, error) {
+	if from == 0 {
+		from = 1
+	}
+
+	kv.mu.RLock()
+	flushed := kv.manifest.LastWALSeq
+	kv.mu.RUnlock()
+	if from <= flushed {
+		return nil, fmt.Errorf("%w: records up to %d were flushed", ErrReplicationGap, flushed)
+	}
+	if last := kv.LastSequence(); from > last+1 {
+		return nil, fmt.Errorf("%w: asked for record %d, but the last is %d", ErrFollowerAhead, from, last)
+	}
+
+	return &walTailer{kv: kv, next: from}, nil
+}
+
+// wait returns the next records as JSON, waiting until at least one has
+// been written. It stops when ctx is done or the store is closed, and
+// returns ErrReplicationGap if a flush deleted records before they were
+// read.
+func (t *walTailer) wait(ctx context.Context) ([][]byte, error) {
+	for {
+		// Watch for new records before reading, so none are missed
+		changed := t.kv.walChanged()
+		records, err := t.read()
+		if err != nil || len(records) > 0 {
+			return records, err
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-t.kv.closing:
+			return nil, fmt.Errorf("store is closed")
+		}
+	}
+}
+
+// read returns the complete records written since the last read. A record
+// that is still being written is left for the next read.
+func (t *walTailer) read() ([][]byte, error) {
+	segments, err := listWALSegments(t.kv.walPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var records [][]byte
+	for _, segment := range segments {
+		if segment < t.segment {
+			continue
+		}
+		if segment > t.segment {
+			t.segment, t.offset = segment, 0
+		}
+
+		data, err := readFileFrom(walSegmentPath(t.kv.walPath, segment), t.offset)
+		if os.IsNotExist(err) {
+			continue // Deleted by a flush; the sequence check catches a gap
+		} else if err != nil {
+			return nil, err
+		}
+
+		for {
+			newline := bytes.IndexByte(data, '\n')
+			if newline == -1 {
+				break
+			}
+			line := data[:newline]
+			data = data[newline+1:]
+			t.offset += int64(newline + 1)
+
+			record, seq, err := t.kv.decodeWALRecord(line)
+			if err != nil {
+				return nil, err
+			}
+			if seq < t.next {
+				continue // Already sent, the header, or written before sequence numbers
+			}
+			if seq > t.next {
+				return nil, fmt.Errorf("%w: records %d to %d were flushed", ErrReplicationGap, t.next, seq-1)
+			}
+			records = append(records, record)
+			t.next++
+		}
+	}
+
+	return records, nil
+}
+
+// walChanged returns a channel that is closed when the next WAL record is
+// written.
+func (kv *KeyValueStore) walChanged() <-chan struct{} {
+	kv.walMu.Lock()
+	defer kv.walMu.Unlock()
+
+	if kv.walNotify == nil {
+		kv.walNotify = make(chan struct{})
+	}
+	return kv.walNotify
+}
+
+// decodeWALRecord decodes one line of a WAL file and returns the record as
+// unencrypted JSON, along with its sequence number, which is 0 for the
+// header and records written before sequence numbers.
+func (kv *KeyValueStore) decodeWALRecord(line []byte) ([]byte, uint64, error) {
+	var logEntry map[string]interface{}
+	if err := json.Unmarshal(line, &logEntry); err != nil {
+		return nil, 0, fmt.Errorf("error decoding WAL record: %w", err)
+	}
+	if sealed, ok := logEntry["sealed"].(string); ok {
+		logEntry = nil
+		if err := kv.openWALRecord(sealed, &logEntry); err != nil {
+			return nil, 0, fmt.Errorf("error decrypting WAL record: %w", err)
+		}
+		decrypted, err := json.Marshal(logEntry)
+		if err != nil {
+			return nil, 0, err
+		}
+		line = decrypted
+	}
+
+	seq, _ := logEntry["seq"].(float64)
+	return line, uint64(seq), nil
+}
+
+// readFileFrom reads a file from offset to its end.
+func readFileFrom(path string, offset int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(file)
+}
+
+// followRetryDelay is the longest a follower waits before reconnecting to
+// its leader. It starts at a second and doubles with each failure.
+const followRetryDelay = 30 * time.Second
+
+// Follow keeps a follower store caught up with the leader at leaderURL: it
+// streams the leader's WAL records from /replicate, starting after the last
+// one applied, and applies them with ApplyReplicated. A non-empty token is
+// sent as a bearer token. When the stream ends or fails it reconnects,
+// backing off up to followRetryDelay, until ctx is done or the store is
+// closed. A follower that the leader returns ErrReplicationGap for must be
+// seeded again from a copy of the leader's data directory.
+func (kv *KeyValueStore) Follow(ctx context.Context, leaderURL, token string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-kv.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	delay := time.Second
+	for {
+		applied, err := kv.followOnce(ctx, leaderURL, token)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		kv.logger.Error("error following leader", "leader", leaderURL, "err", err)
+
+		// Reconnect at once after a stream that made progress
+		if applied > 0 {
+			delay = time.Second
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay = min(2*delay, followRetryDelay)
+	}
+}
+
+// followOnce streams and applies records from the leader until the stream
+// ends, and returns how many it applied.
+func (kv *KeyValueStore) followOnce(ctx context.Context, leaderURL, token string) (int, error) {
+	from := kv.LastSequence() + 1
+	url := strings.TrimSuffix(leaderURL, "/") + "/replicate?from=" + strconv.FormatUint(from, 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("leader answered %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	kv.logger.Info("following leader", "leader", leaderURL, "from", from)
+
+	reader := bufio.NewReader(resp.Body)
+	applied := 0
+	for {
+		record, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return applied, fmt.Errorf("leader closed the stream")
+		} else if err != nil {
+			return applied, err
+		}
+		if err := kv.ApplyReplicated(record); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+}
+
+// Recover restores the store's state during system startup: it validates the
+// SSTables in the manifest, then replays the WAL on top of them.
+func (kv *KeyValueStore) Recover() error {
+    kv.mu.Lock()
+    defer kv.mu.Unlock()
+
+    if err := kv.RecoverFromSSTables(); err != nil {
+        return err
+    }
+    if err := kv.RecoverFromWAL(); err != nil {
+        return err
+    }
+
+    kv.ready.Store(true)
+    return nil
+}
+
+// LastSequence returns the sequence number of the last WAL record written,
+// or replayed by recovery. Every write's record is numbered one higher than
+// the one before, across WAL segments and restarts.
+func (kv *KeyValueStore) LastSequence() uint64 {
+	kv.walMu.Lock()
+	defer kv.walMu.Unlock()
+	return kv.walSeq
+}
+
+// Ready reports whether startup recovery has completed successfully.
+func (kv *KeyValueStore) Ready() bool {
+    return kv.ready.Load()
+}
+
+// Healthy checks that the WAL file handle is still open for writing.
+func (kv *KeyValueStore) Healthy() error {
+    // A read-only store never writes to the WAL
+    if kv.options.ReadOnly {
+        return nil
+    }
+
+    kv.walMu.Lock()
+    defer kv.walMu.Unlock()
+
+    // Writing zero bytes checks the handle without changing the file
+    if _, err := kv.wal.Write(nil); err != nil {
+        return fmt.Errorf("WAL is not writable: %w", err)
+    }
+
+    return nil
+}
+
+// RecoverFromSSTables checks that every SSTable in the manifest exists and
+// has a readable header and footer, so the store never serves a view that
+// silently skips durable data.
+func (kv *KeyValueStore) RecoverFromSSTables() error {
+    files, err := kv.sstableFiles()
+    if err != nil {
+        return err
+    }
+
+    for i, sstFile := range files {
+        if err := validateSSTable(sstFile, kv.aead); err != nil {
+            return fmt.Errorf("error validating SST file %s: %w", sstFile, err)
+        }
+        kv.logger.Info("recovered SST file", "file", sstFile)
+
+        // Index the newest SSTables up front, so lookups don't have to
+        if kv.options.MaxIndexedTables == 0 || i < kv.options.MaxIndexedTables {
+            if _, err := kv.loadTableIndex(sstFile); err != nil {
+                return fmt.Errorf("error indexing SST file %s: %w", sstFile, err)
+            }
+        }
+    }
+
+    return nil
+}
+
+// validateSSTable opens an SST file and reads its header and footer. For an
+// encrypted file it also decrypts the first value, so a wrong key is caught
+// at startup.
+func validateSSTable(sstFile string, aead cipher.AEAD) error {
+    file, err := os.Open(sstFile)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    header, err := readSSTableHeader(file)
+    if err != nil {
+        return err
+    }
+    if _, _, err := readKeyRange(file, header); err != nil {
+        return fmt.Errorf("error reading key range: %w", err)
+    }
+    if header.encrypted {
+        for i := uint32(0); i < header.entryCount; i++ {
+            entry, err := readSSTableEntry(file)
+            if err != nil {
+                return err
+            }
+            if entry.operationMarker == 1 {
+                continue
+            }
+            if _, err := header.decodeValue(aead, i, entry.key, entry.value); err != nil {
+                return err
+            }
+            break
+        }
+    }
+
+    return nil
+}
+
+// CorruptTable is an SSTable that failed verification and why.
+type CorruptTable struct {
+	File string
+	Err  error
+}
+
+// Verify reads every SSTable in the manifest in full and returns those that
+// are corrupt: a bad magic number, header, or footer, fewer entries than the
+// header's entry count, keys out of order or outside the footer's key range,
+// or values that fail to decompress or decrypt. It doesn't stop at the first
+// corrupt table, and an empty result means all of them are intact.
+func (kv *KeyValueStore) Verify() ([]CorruptTable, error) {
+	// Pin the tables, so a compaction can't delete them while they are read
+	kv.mu.RLock()
+	files, err := kv.sstableFiles()
+	for _, sstFile := range files {
+		kv.files.pin(sstFile)
+	}
+	kv.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var corrupt []CorruptTable
+	for _, sstFile := range files {
+		if err := verifySSTable(sstFile, kv.aead, kv.compare); err != nil {
+			corrupt = append(corrupt, CorruptTable{File: sstFile, Err: err})
+		}
+		if err := kv.files.unpin(sstFile); err != nil {
+			kv.logger.Error("error removing compacted SST file", "file", sstFile, "err", err)
+		}
+	}
+
+	return corrupt, nil
+}
+
+// verifySSTable reads an SST file in full and checks that its entries are
+// consistent with its header and footer, in the order of compare, and that
+// every value decodes.
+func verifySSTable(sstFile string, aead cipher.AEAD, compare Comparator) error {
+	file, err := os.Open(sstFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header, err := readSSTableHeader(file)
+	if err != nil {
+		return err
+	}
+	footer, err := readSSTableFooter(file, header)
+	if err != nil {
+		return fmt.Errorf("error reading footer: %w", err)
+	}
+	minKey, maxKey := footer.minKey, footer.maxKey
+
+	var previous string
+	for i := uint32(0); i < header.entryCount; i++ {
+		position, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		entry, err := readSSTableEntry(file)
+		if err != nil {
+			return fmt.Errorf("entry %d of %d: %w", i, header.entryCount, err)
+		}
+
+		// Every indexInterval-th entry must be the sparse index point for it
+		if footer.indexInterval > 0 && i%footer.indexInterval == 0 {
+			point := int(i / footer.indexInterval)
+			if point >= len(footer.index) || footer.index[point] != (sparseIndexEntry{key: entry.key, offset: position}) {
+				return fmt.Errorf("entry %d: sparse index doesn't point to key %q at offset %d", i, entry.key, position)
+			}
+		}
+		if i > 0 && compare(entry.key, previous) <= 0 {
+			return fmt.Errorf("entry %d: key %q is not after %q", i, entry.key, previous)
+		}
+		if compare(entry.key, minKey) < 0 || compare(entry.key, maxKey) > 0 {
+			return fmt.Errorf("entry %d: key %q is outside the key range [%q, %q]", i, entry.key, minKey, maxKey)
+		}
+		previous = entry.key
+
+		if entry.operationMarker == 1 {
+			continue
+		}
+		if _, err := header.decodeValue(aead, i, entry.key, entry.value); err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+	}
+
+	// The footer must start right after the last entry
+	position, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if position != footer.offset {
+		return fmt.Errorf("entries end at offset %d, but the footer starts at %d", position, footer.offset)
+	}
+	if footer.indexInterval > 0 && uint32(len(footer.index)) != (header.entryCount+footer.indexInterval-1)/footer.indexInterval {
+		return fmt.Errorf("sparse index has %d points for %d entries every %d", len(footer.index), header.entryCount, footer.indexInterval)
+	}
+
+	return nil
+}
+
+// ErrInvalidTableName is returned by DumpSSTable for a name that isn't an
+// SST file directly inside the data directory.
+var ErrInvalidTableName = errors.New("invalid SSTable name")
+
+// SSTableDump is the parsed header and footer of an SST file and,
+// optionally, its entries, for debugging.
+type SSTableDump struct {
+	File              string             `json:"file"`
+	Version           byte               `json:"version"`
+	Seq               uint64             `json:"seq"`
+	EntryCount        uint32             `json:"entry_count"`
+	SmallestKeyLength uint32             `json:"smallest_key_length"`
+	LargestKeyLength  uint32             `json:"largest_key_length"`
+	Compression       Compression        `json:"compression"`
+	Encrypted         bool               `json:"encrypted"`
+	MinKey            string             `json:"min_key"`
+	MaxKey            string             `json:"max_key"`
+	Entries           []SSTableDumpEntry `json:"entries,omitempty"`
+}
+
+// SSTableDumpEntry is one entry of an SSTableDump. ValueLength is the
+// length stored in the file, after compression or encryption.
+type SSTableDumpEntry struct {
+	Key         string `json:"key"`
+	Marker      uint16 `json:"marker"` // 0 for a set, 1 for a delete
+	Version     uint64 `json:"version,omitempty"`
+	ValueLength uint32 `json:"value_length"`
+}
+
+// SSTableInfo describes a committed SSTable, as listed by SSTables.
+type SSTableInfo struct {
+	File       string `json:"file"`
+	Size       int64  `json:"size"`
+	EntryCount int    `json:"entry_count"` // Including tombstones
+	MinKey     string `json:"min_key"`
+	MaxKey     string `json:"max_key"`
+	Seq        uint64 `json:"seq"`
+	Level      int    `json:"level"`
+}
+
+// SSTables describes the committed SSTables, from most recent to oldest. The
+// entry counts and key ranges come from the in-memory indexes, or else the
+// cached layouts, so only files beyond MaxIndexedTables are read.
+func (kv *KeyValueStore) SSTables() ([]SSTableInfo, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	tables := []SSTableInfo{}
+	if kv.options.InMemoryOnly {
+		return tables, nil
+	}
+	entries := make([]ManifestEntry, len(kv.manifest.Tables))
+	copy(entries, kv.manifest.Tables)
+	sortNewestFirst(entries)
+
+	for _, entry := range entries {
+		sstFile := filepath.Join(kv.dataDir, entry.File)
+		table := SSTableInfo{File: entry.File, Seq: entry.Seq, Level: entry.Level}
+		fileInfo, err := os.Stat(sstFile)
+		if err != nil {
+			return nil, err
+		}
+		table.Size = fileInfo.Size()
+
+		kv.indexMu.Lock()
+		index := kv.tableIndexes[sstFile]
+		kv.indexMu.Unlock()
+		if index != nil {
+			table.EntryCount, table.MinKey, table.MaxKey = index.entryCount, index.minKey, index.maxKey
+		} else {
+			file, err := kv.files.acquire(sstFile)
+			if err != nil {
+				return nil, err
+			}
+			layout, err := kv.loadTableLayout(sstFile, file.File)
+			kv.files.release(file)
+			if err != nil {
+				return nil, fmt.Errorf("error reading SST file %s: %w", sstFile, err)
+			}
+			table.EntryCount = int(layout.header.entryCount)
+			table.MinKey, table.MaxKey = layout.footer.minKey, layout.footer.maxKey
+		}
+		tables = append(tables, table)
+	}
+
+	return tables, nil
+}
+
+// DumpSSTable parses the SST file with the given name in the data directory
+// and returns its header and key range, and its entries if withEntries is
+// set. The name must be a bare file name ending in .sst; anything else,
+// such as a path that would leave the data directory, returns
+// ErrInvalidTableName.
+func (kv *KeyValueStore) DumpSSTable(name string, withEntries bool) (SSTableDump, error) {
+	dump := SSTableDump{File: name}
+	if name == "" || filepath.Base(name) != name || filepath.Ext(name) != ".sst" {
+		return dump, fmt.Errorf("%w: %q", ErrInvalidTableName, name)
+	}
+
+	// Pin the file, so a compaction can't delete it while it is read
+	sstFile := filepath.Join(kv.dataDir, name)
+	kv.files.pin(sstFile)
+	defer func() {
+		if err := kv.files.unpin(sstFile); err != nil {
+			kv.logger.Error("error removing compacted SST file", "file", sstFile, "err", err)
+		}
+	}()
+
+	file, err := os.Open(sstFile)
+	if err != nil {
+		return dump, err
+	}
+	defer file.Close()
+
+	header, err := readSSTableHeader(file)
+	if err != nil {
+		return dump, err
+	}
+	footer, err := readSSTableFooter(file, header)
+	if err != nil {
+		return dump, fmt.Errorf("error reading footer: %w", err)
+	}
+	dump.Version = header.version
+	dump.Seq = header.seq
+	dump.EntryCount = header.entryCount
+	dump.SmallestKeyLength = header.smallestKeyLength
+	dump.LargestKeyLength = header.largestKeyLength
+	dump.Compression = header.compression
+	dump.Encrypted = header.encrypted
+	dump.MinKey, dump.MaxKey = footer.minKey, footer.maxKey
+
+	if !withEntries {
+		return dump, nil
+	}
+	dump.Entries = make([]SSTableDumpEntry, 0, header.entryCount)
+	for i := uint32(0); i < header.entryCount; i++ {
+		entry, valueLength, err := readSSTableEntryKey(file)
+		if err != nil {
+			return dump, fmt.Errorf("entry %d of %d: %w", i, header.entryCount, err)
+		}
+		if _, err := file.Seek(int64(valueLength), io.SeekCurrent); err != nil {
+			return dump, err
+		}
+		dump.Entries = append(dump.Entries, SSTableDumpEntry{
+			Key:         entry.key,
+			Marker:      entry.operationMarker,
+			Version:     entry.version,
+			ValueLength: valueLength,
+		})
+	}
+
+	return dump, nil
+}
+
+// RecoverFromWAL replays operations from all Write-Ahead Log segments, oldest
+// first, during system startup. Records numbered at or below the last
+// sequence number applied, starting from the manifest's LastWALSeq, are
+// skipped, so a record is never applied twice.
+func (kv *KeyValueStore) RecoverFromWAL() error {
+    walFiles, err := kv.walFiles()
+    if err != nil {
+        return err
+    }
+
+    // Recovery runs before any writes, so walSeq needs no lock here
+    if kv.walSeq < kv.manifest.LastWALSeq {
+        kv.walSeq = kv.manifest.LastWALSeq
+    }
+
+    for _, walFile := range walFiles {
+        if err := kv.replayWALFile(walFile); err != nil {
+            return fmt.Errorf("error replaying %s: %w", walFile, err)
+        }
+    }
+
+    return nil
+}
+
+// replayWALFile replays the operations in a single WAL file.
+func (kv *KeyValueStore) replayWALFile(walPath string) error {
+    // Open the WAL file
+    walFile, err := os.Open(walPath)
+    if err != nil {
+        return err
+    }
+    defer walFile.Close()
+
+    // Create a JSON decoder for the WAL file
+    decoder := json.NewDecoder(walFile)
+
+    // Replay operations from the Write-Ahead Log
+    for {
+        var logEntry map[string]interface{}
+
+        // Decode the next log entry
+        offset := decoder.InputOffset()
+        if err := decoder.Decode(&logEntry); err == io.EOF {
+            // End of file reached
+            break
+        } else if err != nil {
+            // A crash in the middle of a write leaves a partial last record;
+            // everything before it was written completely
+            torn, tailErr := tornWALTail(walFile, offset)
+            if tailErr != nil {
+                return tailErr
+            }
+            if !torn {
+                return err
+            }
+            kv.logger.Warn("ignoring incomplete WAL record", "file", walPath, "offset", offset, "err", err)
+            return kv.truncateWAL(walPath, offset)
+        }
+
+        // Check the header, which isn't applied
+        if offset == 0 {
+            isHeader, err := checkWALHeader(logEntry)
+            if err != nil {
+                return fmt.Errorf("error reading WAL header: %w", err)
+            }
+            if isHeader {
+                continue
+            }
+        }
+
+        // Decrypt an encrypted record
+        if sealed, ok := logEntry["sealed"].(string); ok {
+            logEntry = nil
+            if err := kv.openWALRecord(sealed, &logEntry); err != nil {
+                return fmt.Errorf("error decrypting WAL record in %s: %w", walPath, err)
+            }
+        }
+
+        // Skip records already applied, such as those of a flushed memtable
+        // whose segments weren't deleted. Records written before sequence
+        // numbers have none and are always applied.
+        if seq, _ := logEntry["seq"].(float64); seq > 0 {
+            if uint64(seq) <= kv.walSeq {
+                kv.logger.Debug("skipping applied WAL record", "file", walPath, "seq", uint64(seq))
+                continue
+            }
+            kv.walSeq = uint64(seq)
+        }
+
+        // Perform the operation based on the log entry
+        if err := kv.applyWALRecord(logEntry); err != nil {
             return err
         }
+    }
+
+    return nil
+}
+
+// walRecordVersion returns the version of the values a WAL record sets: the
+// one it carries, if an in-memory store's WAL rewrite renumbered it, or
+// else its sequence number. Records written before sequence numbers have
+// none.
+func walRecordVersion(logEntry map[string]interface{}) uint64 {
+	if version, ok := logEntry["version"].(float64); ok {
+		return uint64(version)
+	}
+	seq, _ := logEntry["seq"].(float64)
+	return uint64(seq)
+}
+
+// applyWALRecord applies a decoded WAL record to the in-memory store, for
+// recovery or a follower applying its leader's records. The caller must hold
+// the write lock.
+func (kv *KeyValueStore) applyWALRecord(logEntry map[string]interface{}) error {
+	switch operation, _ := logEntry["operation"].(string); operation {
+	case "set":
+		key, _ := logEntry["key"].(string)
+		value, err := walValue(logEntry)
+		if err != nil {
+			return fmt.Errorf("error decoding value of key %q: %w", key, err)
+		}
+		kv.logger.Debug("applied set from WAL", "key", key, "value_length", len(value))
+		// Set the key-value pair in memory, replacing any tombstone
+		kv.cache.remove(key)
+		kv.trackKeyLength(key)
+		delete(kv.DeletedKeys, key)
+		kv.storeInMemtable(key, value, walRecordVersion(logEntry))
+		valueType, _ := logEntry["type"].(float64)
+		kv.setValueType(key, ValueType(valueType))
+
+	case "delete":
+		key, _ := logEntry["key"].(string)
+		kv.logger.Debug("applied delete from WAL", "key", key)
+		// Delete the key from memory, or tombstone it if it was only in
+		// SSTables, the same way Delete does
+		kv.cache.remove(key)
+		if _, ok := kv.data.get(key); ok {
+			kv.removeFromMemtable(key)
+			delete(kv.valueTypes, key)
+			if kv.inOlderTables(key) {
+				kv.DeletedKeys[key] = true
+			}
+		} else {
+			kv.DeletedKeys[key] = true
+		}
+
+	case "batch":
+		// A batch is a single record, so it is applied all-or-nothing
+		ops, _ := logEntry["ops"].([]interface{})
+		for _, op := range ops {
+			opEntry, _ := op.(map[string]interface{})
+			key, _ := opEntry["key"].(string)
+			switch opEntry["operation"] {
+			case "set":
+				value, err := walValue(opEntry)
+				if err != nil {
+					return fmt.Errorf("error decoding value of key %q: %w", key, err)
+				}
+				kv.applySet(key, value, walRecordVersion(logEntry))
+			case "delete":
+				kv.applyDelete(key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// wantsText reports whether the client asked for plain-text responses
+// instead of JSON.
+func wantsText(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/plain")
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeResponse writes v as a JSON response, or text if the client asked
+// for plain text.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, text string, v interface{}) {
+	if wantsText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprint(w, text)
+		return
+	}
+	writeJSON(w, status, v)
+}
+
+// writeError writes an error response with a JSON {"error": ...} body, or a
+// plain-text one if the client asked for plain text.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeResponse(w, r, status, message+"\n", map[string]string{"error": message})
+}
+
+// requireToken wraps a handler so that it answers 401 unless the request
+// carries "Authorization: Bearer <token>". An empty token leaves the handler
+// unprotected.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kvstore"`)
+			writeError(w, r, http.StatusUnauthorized, "Missing or invalid bearer token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// defaultMaxBodyBytes is the request body limit of JSON endpoints used when
+// -max-body-bytes isn't given: twice the default value limit, leaving room
+// for the key and for escaping the value in JSON.
+const defaultMaxBodyBytes = 2 * defaultMaxValueSize
+
+// limitBody wraps a handler so that reading more than maxBytes of the
+// request body fails with an *http.MaxBytesError, which decodeJSONBody
+// answers with 413.
+func limitBody(maxBytes int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		next(w, r)
+	}
+}
+
+// accessRecord holds what a handler learned about a request for the access
+// log: the key it names and the size of the value it read or wrote, or -1
+// if it noted none.
+type accessRecord struct {
+	key        string
+	valueBytes int64
+}
+
+// accessRecordKey is the context key under which accessLog passes the
+// request's accessRecord to the handler.
+type accessRecordKey struct{}
+
+// noteAccess records the key a request names and the size of its value for
+// the access log. It does nothing unless accessLog wraps the handler.
+func noteAccess(r *http.Request, key string, valueBytes int64) {
+	if record, ok := r.Context().Value(accessRecordKey{}).(*accessRecord); ok {
+		record.key, record.valueBytes = key, valueBytes
+	}
+}
+
+// statusRecorder wraps a ResponseWriter to remember the status code and the
+// number of body bytes written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// liftDeadlines still works behind the recorder.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// accessLog wraps a handler so that each request is logged at Info level
+// once it is served, with its method, path, key, status, value size, and
+// latency. The key is the one the handler noted with noteAccess, or else the
+// key query parameter or path segment. Values are never logged, only their
+// sizes, so secrets stored in the store don't leak into the logs; the query
+// string is left out for the same reason.
+func accessLog(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		record := &accessRecord{valueBytes: -1}
+		recorder := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, record))
+		next.ServeHTTP(recorder, r)
+
+		// The router sets the path values on r, so they can be read now
+		key := record.key
+		if key == "" {
+			key = r.URL.Query().Get("key")
+		}
+		if key == "" {
+			key = r.PathValue("key")
+		}
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("key", key),
+			slog.Int("status", status),
+		}
+		if record.valueBytes >= 0 {
+			attrs = append(attrs, slog.Int64("value_bytes", record.valueBytes))
+		}
+		attrs = append(attrs,
+			slog.Int64("response_bytes", recorder.bytes),
+			slog.Duration("latency", time.Since(start)),
+		)
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "http request", attrs...)
+	})
+}
+
+// decodeJSONBody decodes the request's JSON body into v. If that fails it
+// writes a 413 response for a body over the limit set by limitBody or a 400
+// otherwise, and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit))
+		return false
+	}
+	writeError(w, r, http.StatusBadRequest, "Error decoding JSON body")
+	return false
+}
+
+// liftDeadlines removes the server's read and write timeouts for a request
+// that streams its body or response, which takes as long as the data needs.
+func liftDeadlines(w http.ResponseWriter) {
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+}
+
+// validationStatus maps an error from a write to an HTTP status code: 413 for
+// oversized keys or values, 400 for empty keys, 403 for a read-only store, 415
+// for unsupported content types, 503 for a closed store, and 500 otherwise.
+func validationStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrKeyTooLarge), errors.Is(err, ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrEmptyKey), errors.Is(err, ErrInvalidBucket):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, ErrUnsupportedContentType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrClosed):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleSet handles the POST request for setting a key-value pair.
+func handleSet(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Parse the JSON body
+		var requestBody map[string]string
+		if !decodeJSONBody(w, r, &requestBody) {
+			return
+		}
+
+		// Extract key and value from the JSON body
+		key, ok := requestBody["key"]
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, "Key not found in JSON body")
+			return
+		}
+
+		value, ok := requestBody["value"]
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, "Value not found in JSON body")
+			return
+		}
+		noteAccess(r, key, int64(len(value)))
+
+		// With If-None-Match: *, only create the key, failing the
+		// precondition if it already exists
+		if match := r.Header.Get("If-None-Match"); match != "" {
+			if match != "*" {
+				writeError(w, r, http.StatusBadRequest, "Only If-None-Match: * is supported")
+				return
+			}
+			stored, err := kv.setIfAbsent(key, []byte(value), requestBody["content_type"])
+			if err != nil {
+				writeError(w, r, validationStatus(err), err.Error())
+				return
+			}
+			if !stored {
+				writeError(w, r, http.StatusPreconditionFailed, "Key already exists")
+				return
+			}
+			writeResponse(w, r, http.StatusCreated, "OK\n", map[string]string{"key": key})
+			return
+		}
+
+		// Update the in-memory store, with the value's content type if given
+		if err := kv.SetTyped(key, []byte(value), requestBody["content_type"]); err != nil {
+			writeError(w, r, validationStatus(err), err.Error())
+			return
+		}
+
+		writeResponse(w, r, http.StatusCreated, "OK\n", map[string]string{"key": key})
+	}
+}
+
+// handleCompareAndSwap handles the POST request for a compare-and-swap.
+func handleCompareAndSwap(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Parse the JSON body
+		var requestBody map[string]string
+		if !decodeJSONBody(w, r, &requestBody) {
+			return
+		}
+
+		// Extract key, expected, and new values from the JSON body
+		key, ok := requestBody["key"]
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, "Key not found in JSON body")
+			return
+		}
+
+		expected, ok := requestBody["expected"]
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, "Expected value not found in JSON body")
+			return
+		}
+
+		newValue, ok := requestBody["new"]
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, "New value not found in JSON body")
+			return
+		}
+
+		swapped, err := kv.CompareAndSwap(key, []byte(expected), []byte(newValue))
+		if err != nil {
+			writeError(w, r, validationStatus(err), fmt.Sprintf("Error swapping value: %v", err))
+			return
+		}
+
+		// A value that didn't match is a conflict with the current state
+		status := http.StatusOK
+		if !swapped {
+			status = http.StatusConflict
+		}
+		writeResponse(w, r, status, fmt.Sprintf("Swapped: %t\n", swapped), map[string]bool{"swapped": swapped})
+	}
+}
+
+// handleIncrement handles the POST request for incrementing an integer value.
+func handleIncrement(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+
+		// Default to incrementing by one
+		delta := int64(1)
+		if deltaParam := r.URL.Query().Get("delta"); deltaParam != "" {
+			parsed, err := strconv.ParseInt(deltaParam, 10, 64)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "Delta must be an integer")
+				return
+			}
+			delta = parsed
+		}
+
+		value, err := kv.Increment(key, delta)
+		if err != nil {
+			// A non-numeric value is a bad request; anything else is
+			// mapped like any other write error
+			status := validationStatus(err)
+			if errors.Is(err, ErrNotInteger) {
+				status = http.StatusBadRequest
+			}
+			writeError(w, r, status, fmt.Sprintf("Error incrementing key: %v", err))
+			return
+		}
+
+		writeResponse(w, r, http.StatusOK, fmt.Sprintf("Value: %d\n", value), map[string]interface{}{"key": key, "value": value})
+	}
+}
+
+// handleAppend handles the POST request for appending the request body to
+// a key's value, and responds with the new value's length. With
+// encoding=base64 it also returns the new value, base64-encoded.
+func handleAppend(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		encoding := r.URL.Query().Get("encoding")
+		if encoding != "" && encoding != "base64" {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Unsupported encoding: %s", encoding))
+			return
+		}
+
+		suffix, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(kv.options.MaxValueSize)))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("%v: more than %d bytes", ErrValueTooLarge, tooLarge.Limit))
+				return
+			}
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Error reading body: %v", err))
+			return
+		}
+
+		value, err := kv.Append(key, suffix)
+		if err != nil {
+			writeError(w, r, validationStatus(err), fmt.Sprintf("Error appending to key: %v", err))
+			return
+		}
+
+		// Values grow with every append, so only their length is returned,
+		// unless the new value is asked for, base64-encoded
+		response := map[string]interface{}{"key": key, "length": len(value)}
+		text := fmt.Sprintf("Length: %d\n", len(value))
+		if encoding == "base64" {
+			response["value"] = base64.StdEncoding.EncodeToString(value)
+			response["encoding"] = encoding
+			text += fmt.Sprintf("Value: %s\n", response["value"])
+		}
+		writeResponse(w, r, http.StatusOK, text, response)
+	}
+}
+
+// entryState describes what an SSTable holds for a key.
+type entryState int
+
+const (
+	entryAbsent  entryState = iota // The file has no entry for the key
+	entryLive                      // The file holds a value for the key
+	entryDeleted                   // The file holds a tombstone for the key
+)
+
+// sstableFiles lists the SST files committed to the manifest from most recent
+// to oldest: L0 by descending sequence number, then each deeper level, whose
+// tables don't overlap.
+func (kv *KeyValueStore) sstableFiles() ([]string, error) {
+	// An in-memory store reads nothing from SSTables
+	if kv.options.InMemoryOnly {
+		return nil, nil
+	}
+
+	// The list only changes with the manifest, so it is sorted once per change
+	kv.indexMu.Lock()
+	defer kv.indexMu.Unlock()
+	if kv.tableFiles != nil {
+		return kv.tableFiles, nil
+	}
+
+	tables := make([]ManifestEntry, len(kv.manifest.Tables))
+	copy(tables, kv.manifest.Tables)
+	sortNewestFirst(tables)
+
+	files := make([]string, 0, len(tables))
+	for _, table := range tables {
+		files = append(files, filepath.Join(kv.dataDir, table.File))
+	}
+	kv.tableFiles = files
+
+	return files, nil
+}
+
+// sortNewestFirst orders tables from most recent to oldest: by level, and
+// within a level by descending sequence number. A compaction can give a
+// deeper table a higher sequence number than an L0 table holding newer data,
+// so the level comes first.
+func sortNewestFirst(tables []ManifestEntry) {
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].Level != tables[j].Level {
+			return tables[i].Level < tables[j].Level
+		}
+		return tables[i].Seq > tables[j].Seq
+	})
+}
+
+// SearchSSTFiles searches for the key in the data directory's SST files from
+// most recent to oldest.
+func (kv *KeyValueStore) SearchSSTFiles(key string) ([]byte, bool) {
+	value, _, ok, _ := kv.searchSSTFiles(context.Background(), key)
+	return value, ok
+}
+
+// searchSSTFiles searches for the key in SST files from most recent to oldest,
+// aborting with the context's error if it is cancelled between files. The
+// match describes the entry of a value found. A file that may hold the key
+// but can't be read is skipped, and the first such file's error is returned,
+// wrapping ErrUnreadableSSTable, along with what the older files hold.
+func (kv *KeyValueStore) searchSSTFiles(ctx context.Context, key string) ([]byte, sstableMatch, bool, error) {
+	files, err := kv.sstableFiles()
+	if err != nil {
+		kv.logger.Error("error listing SST files", "err", err)
+		return nil, sstableMatch{}, false, unreadable("", err)
+	}
+
+	// Iterate through SST files from most recent to oldest
+	var skipped error
+	for i, sstFile := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, sstableMatch{}, false, err
+		}
+
+		// Skip the file without opening it if its index rules the key out
+		if kv.ruledOutByIndex(i, sstFile, key) {
+			// A corrupt file is ruled out for every key, including ones it held
+			if err := kv.corruptError(sstFile); err != nil && skipped == nil {
+				skipped = unreadable(sstFile, err)
+			}
+			continue
+		}
+
+		// Search for the key in the SST file
+		value, match, state, err := kv.searchSSTFile(ctx, key, sstFile)
+		if errors.Is(err, ErrUnreadableSSTable) {
+			if skipped == nil {
+				skipped = err
+			}
+			continue
+		} else if err != nil {
+			return nil, sstableMatch{}, false, err
+		}
+		switch state {
+		case entryLive:
+			return value, match, true, skipped
+		case entryDeleted:
+			// A newer tombstone hides any value in older files
+			return nil, sstableMatch{}, false, skipped
+		}
+	}
+
+	return nil, sstableMatch{}, false, skipped
+}
+
+// unreadable wraps an error reading an SST file so that it matches
+// ErrUnreadableSSTable as well as the underlying error.
+func unreadable(sstFile string, err error) error {
+	if sstFile == "" {
+		return fmt.Errorf("%w: %w", ErrUnreadableSSTable, err)
+	}
+	return fmt.Errorf("%w %s: %w", ErrUnreadableSSTable, sstFile, err)
+}
+
+// ruledOutByIndex reports whether the index of the SST file at position i in
+// the newest-first list shows it has no entry for the key. Files beyond
+// MaxIndexedTables aren't indexed and are never ruled out. A file found
+// truncated, or without a valid magic number, while indexing it is marked
+// corrupt and ruled out for every key, which logs it once.
+func (kv *KeyValueStore) ruledOutByIndex(i int, sstFile string, key string) bool {
+	if kv.corruptError(sstFile) != nil {
+		return true
+	}
+	if kv.options.MaxIndexedTables > 0 && i >= kv.options.MaxIndexedTables {
+		return false
+	}
+	index, err := kv.loadTableIndex(sstFile)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errInvalidSSTable) {
+		kv.markCorrupt(sstFile, err)
+		return true
+	} else if err != nil {
+		kv.logger.Error("error indexing SST file", "file", sstFile, "err", err)
+		return false
+	}
+	return !index.mayContain(key)
+}
+
+// streamSSTFiles searches for the key in SST files from most recent to
+// oldest like searchSSTFiles, but returns a stream over the value instead of
+// reading it. An SST file that may hold the key but can't be read fails the
+// lookup with an error wrapping ErrUnreadableSSTable, as the older files
+// could only give a stale answer.
+func (kv *KeyValueStore) streamSSTFiles(ctx context.Context, key string) (*ValueStream, error) {
+	files, err := kv.sstableFiles()
+	if err != nil {
+		kv.logger.Error("error listing SST files", "err", err)
+		return nil, unreadable("", err)
+	}
+
+	for i, sstFile := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if kv.ruledOutByIndex(i, sstFile, key) {
+			// A corrupt file is ruled out for every key, including ones it held
+			if err := kv.corruptError(sstFile); err != nil {
+				return nil, unreadable(sstFile, err)
+			}
+			continue
+		}
+
+		stream, state, err := kv.streamSSTFile(ctx, key, sstFile)
+		if err != nil {
+			return nil, err
+		}
+		switch state {
+		case entryLive:
+			return stream, nil
+		case entryDeleted:
+			// A newer tombstone hides any value in older files
+			return nil, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// sstableFileReader reads a value out of an SST file taken from the file
+// pool. The file is pinned while it is read, so a compaction can't delete
+// it, and given back to the pool when the reader is closed.
+type sstableFileReader struct {
+	io.Reader
+	kv   *KeyValueStore
+	file *pooledFile // Nil once closed
+}
+
+// Close gives the SST file back to the pool and unpins it.
+func (r *sstableFileReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	file := r.file
+	r.file = nil
+	r.kv.files.release(file)
+	return r.kv.files.unpin(file.path)
+}
+
+// streamSSTFile returns a stream over the value of the key in a specific SST
+// file, whose handle is held from the file pool until the stream is closed.
+// Values are read from the file as the stream is read, decompressing them on
+// the way, except in encrypted files: a value's authentication tag can only
+// be checked once all of it is read, so it is decrypted in memory first.
+// Read errors are logged and returned wrapping ErrUnreadableSSTable.
+func (kv *KeyValueStore) streamSSTFile(ctx context.Context, key string, sstFile string) (*ValueStream, entryState, error) {
+	// Take the SST file from the pool
+	file, err := kv.files.acquire(sstFile)
+	if err != nil {
+		kv.logger.Error("error opening SST file", "file", sstFile, "err", err)
+		return nil, entryAbsent, unreadable(sstFile, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		kv.files.release(file)
+		kv.logger.Error("error reading SST file", "file", sstFile, "err", err)
+		return nil, entryAbsent, unreadable(sstFile, err)
+	}
+	kv.metrics.sstableReads.Add(1)
+
+	match, state, err := kv.locateInSSTFile(ctx, key, sstFile, file.File)
+	if err != nil || state != entryLive {
+		kv.files.release(file)
+		return nil, state, err
+	}
+
+	stream := &ValueStream{Size: -1, ContentType: match.valueType.ContentType(), Source: SourceSSTable}
+	if match.inValueLog {
+		defer kv.files.release(file)
+		pointer, err := match.read(kv.aead, file.File)
+		if err == nil {
+			stream.ReadCloser, stream.Size, err = kv.values.stream(match.key, pointer)
+		}
+		if err != nil {
+			kv.logger.Error("error decoding value from SST file", "file", sstFile, "err", err)
+			return nil, entryAbsent, unreadable(sstFile, err)
+		}
+		return stream, entryLive, nil
+	}
+	var reader io.Reader = io.LimitReader(file, int64(match.valueLength))
+	if match.header.encrypted {
+		defer kv.files.release(file)
+		value, err := match.read(kv.aead, file.File)
+		if err != nil {
+			kv.logger.Error("error decoding value from SST file", "file", sstFile, "err", err)
+			return nil, entryAbsent, unreadable(sstFile, err)
+		}
+		stream.ReadCloser = io.NopCloser(bytes.NewReader(value))
+		stream.Size = int64(len(value))
+		return stream, entryLive, nil
+	}
+	if match.header.compression == GzipCompression {
+		reader, err = gzip.NewReader(reader)
+		if err != nil {
+			kv.files.release(file)
+			kv.logger.Error("error decoding value from SST file", "file", sstFile, "err", err)
+			return nil, entryAbsent, unreadable(sstFile, err)
+		}
+	} else {
+		stream.Size = int64(match.valueLength)
+	}
+	kv.files.pin(sstFile)
+	stream.ReadCloser = &sstableFileReader{Reader: reader, kv: kv, file: file}
+
+	return stream, entryLive, nil
+}
+
+// bloomBitsPerKey and bloomHashCount size the bloom filters of SSTable
+// indexes for a false positive rate of about 1%.
+const (
+	bloomBitsPerKey = 10
+	bloomHashCount  = 7
+)
+
+// bloomFilter is a set of keys that may report false positives but never
+// false negatives.
+type bloomFilter struct {
+	bits []uint64
+}
+
+// newBloomFilter returns an empty bloom filter sized for the number of keys.
+func newBloomFilter(keys int) *bloomFilter {
+	size := keys * bloomBitsPerKey
+	if size < 64 {
+		size = 64
+	}
+	return &bloomFilter{bits: make([]uint64, (size+63)/64)}
+}
+
+// bitPositions returns the filter bits for key, derived from two hashes.
+func (f *bloomFilter) bitPositions(key string) [bloomHashCount]uint64 {
+	h1, h2 := fnv.New64a(), fnv.New64()
+	h1.Write([]byte(key))
+	h2.Write([]byte(key))
+	sum1, sum2 := h1.Sum64(), h2.Sum64()|1
+
+	var positions [bloomHashCount]uint64
+	size := uint64(len(f.bits) * 64)
+	for i := range positions {
+		positions[i] = (sum1 + uint64(i)*sum2) % size
+	}
+	return positions
+}
+
+// add puts key in the filter.
+func (f *bloomFilter) add(key string) {
+	for _, bit := range f.bitPositions(key) {
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mayContain reports whether key may have been added to the filter.
+func (f *bloomFilter) mayContain(key string) bool {
+	for _, bit := range f.bitPositions(key) {
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// tableIndex holds what a lookup needs to know about an SSTable without
+// opening it: its key range and a bloom filter of its keys.
+type tableIndex struct {
+	minKey, maxKey string
+	entryCount     int
+	filter         *bloomFilter
+	compare        Comparator // The order of the SSTable's keys
+}
+
+// newTableIndex indexes an SSTable with the given keys, in the order of
+// compare.
+func newTableIndex(keys []string, compare Comparator) *tableIndex {
+	index := &tableIndex{entryCount: len(keys), filter: newBloomFilter(len(keys)), compare: compare}
+	if len(keys) > 0 {
+		index.minKey, index.maxKey = keys[0], keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		index.filter.add(key)
+	}
+	return index
+}
+
+// mayContain reports whether the SSTable may hold an entry for key.
+func (index *tableIndex) mayContain(key string) bool {
+	if index.entryCount == 0 || index.compare(key, index.minKey) < 0 || index.compare(key, index.maxKey) > 0 {
+		return false
+	}
+	return index.filter.mayContain(key)
+}
+
+// buildTableIndex reads the keys of an SST file, ordered by compare, and
+// indexes them.
+func buildTableIndex(sstFile string, compare Comparator) (*tableIndex, error) {
+	file, err := os.Open(sstFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header, err := readSSTableHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, header.entryCount)
+	for i := uint32(0); i < header.entryCount; i++ {
+		entry, valueLength, err := readSSTableEntryKey(file)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(int64(valueLength), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		keys = append(keys, entry.key)
+	}
+
+	return newTableIndex(keys, compare), nil
+}
+
+// loadTableIndex returns the index of an SST file, building it from the file
+// if it isn't in memory yet.
+func (kv *KeyValueStore) loadTableIndex(sstFile string) (*tableIndex, error) {
+	kv.indexMu.Lock()
+	index := kv.tableIndexes[sstFile]
+	kv.indexMu.Unlock()
+	if index != nil {
+		return index, nil
+	}
+
+	index, err := buildTableIndex(sstFile, kv.compare)
+	if err != nil {
+		return nil, err
+	}
+	kv.storeTableIndex(sstFile, index)
+
+	return index, nil
+}
+
+// storeTableIndex keeps the index of an SST file in memory.
+func (kv *KeyValueStore) storeTableIndex(sstFile string, index *tableIndex) {
+	kv.indexMu.Lock()
+	defer kv.indexMu.Unlock()
+
+	if kv.tableIndexes == nil {
+		kv.tableIndexes = make(map[string]*tableIndex)
+	}
+	kv.tableIndexes[sstFile] = index
+}
+
+// pruneTableIndexes updates the in-memory indexes after the manifest's tables
+// change: it drops the cached file list, the indexes and layouts of SST
+// files that are no longer among the MaxIndexedTables newest, including
+// those removed by compaction, and the marks of corrupt files no longer in
+// the manifest. The caller must hold the write lock.
+func (kv *KeyValueStore) pruneTableIndexes() {
+	kv.indexMu.Lock()
+	kv.tableFiles = nil
+	kv.indexMu.Unlock()
+
+	files, err := kv.sstableFiles()
+	if err != nil {
+		return
+	}
+	committed := make(map[string]bool, len(files))
+	for _, sstFile := range files {
+		committed[sstFile] = true
+	}
+	if kv.options.MaxIndexedTables > 0 && len(files) > kv.options.MaxIndexedTables {
+		files = files[:kv.options.MaxIndexedTables]
+	}
+	indexed := make(map[string]bool, len(files))
+	for _, sstFile := range files {
+		indexed[sstFile] = true
+	}
+
+	kv.indexMu.Lock()
+	defer kv.indexMu.Unlock()
+
+	for sstFile := range kv.corruptFiles {
+		if !committed[sstFile] {
+			delete(kv.corruptFiles, sstFile)
+		}
+	}
+	for sstFile := range kv.tableIndexes {
+		if !indexed[sstFile] {
+			delete(kv.tableIndexes, sstFile)
+		}
+	}
+	for sstFile := range kv.tableLayouts {
+		if !indexed[sstFile] {
+			delete(kv.tableLayouts, sstFile)
+		}
+	}
+}
+
+// minSSTableEntrySize is the size of an SSTable entry with an empty key and
+// value: its operation marker and key and value lengths.
+const minSSTableEntrySize = 2 + 4 + 4
+
+// markCorrupt records that an SST file can't be read, and why, so lookups
+// skip it rather than failing on it again, and logs it the first time.
+func (kv *KeyValueStore) markCorrupt(sstFile string, err error) {
+	kv.indexMu.Lock()
+	defer kv.indexMu.Unlock()
+
+	if kv.corruptFiles[sstFile] != nil {
+		return
+	}
+	if kv.corruptFiles == nil {
+		kv.corruptFiles = make(map[string]error)
+	}
+	kv.corruptFiles[sstFile] = err
+	kv.logger.Error("skipping corrupt SST file in lookups", "file", sstFile, "err", err)
+}
+
+// corruptError returns the error markCorrupt recorded for the SST file, or
+// nil if it recorded none.
+func (kv *KeyValueStore) corruptError(sstFile string) error {
+	kv.indexMu.Lock()
+	defer kv.indexMu.Unlock()
+
+	return kv.corruptFiles[sstFile]
+}
+
+// tableLayout is the parsed header and footer of an SST file.
+type tableLayout struct {
+	header     sstableHeader
+	footer     sstableFooter // Unset for an empty file
+	dataOffset int64         // Offset of the first entry
+}
+
+// loadTableLayout returns the layout of an open SST file. The layouts of
+// indexed files are kept in memory, so lookups read the header and footer
+// once rather than on every call; other files are read each time.
+func (kv *KeyValueStore) loadTableLayout(sstFile string, file *os.File) (*tableLayout, error) {
+	kv.indexMu.Lock()
+	layout := kv.tableLayouts[sstFile]
+	kv.indexMu.Unlock()
+	if layout != nil {
+		return layout, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header, err := readSSTableHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	layout = &tableLayout{header: header}
+	if layout.dataOffset, err = file.Seek(0, io.SeekCurrent); err != nil {
+		return nil, err
+	}
+	if header.entryCount > 0 {
+		if layout.footer, err = readSSTableFooter(file, header); err != nil {
+			return nil, fmt.Errorf("error reading key range: %w", err)
+		}
+
+		// A wrong entry count would send lookups reading past the entries
+		if limit := (layout.footer.offset - layout.dataOffset) / minSSTableEntrySize; int64(header.entryCount) > limit {
+			return nil, fmt.Errorf("header claims %d entries, but the entries section holds at most %d", header.entryCount, limit)
+		}
+	}
+
+	kv.indexMu.Lock()
+	defer kv.indexMu.Unlock()
+	if kv.tableIndexes[sstFile] != nil {
+		if kv.tableLayouts == nil {
+			kv.tableLayouts = make(map[string]*tableLayout)
+		}
+		kv.tableLayouts[sstFile] = layout
+	}
+
+	return layout, nil
+}
+
+// inOlderTables reports whether the newest version of the key below the
+// active memtable, in the memtables being flushed or the SST files, is a
+// live value.
+func (kv *KeyValueStore) inOlderTables(key string) bool {
+	for _, frozen := range kv.flushing {
+		if frozen.deletedKeys[key] {
+			return false
+		}
+		if _, ok := frozen.data.get(key); ok {
+			return true
+		}
+	}
+
+	_, _, ok, _ := kv.searchSSTFiles(context.Background(), key)
+	return ok
+}
+
+// SearchSSTFile searches for the key in a specific SST file. A key whose
+// newest entry in the file is a tombstone is reported as not found.
+func (kv *KeyValueStore) SearchSSTFile(key string, sstFile string) ([]byte, bool) {
+	value, _, state, _ := kv.searchSSTFile(context.Background(), key, sstFile)
+	return value, state == entryLive
+}
+
+// searchSSTFile searches for the key in a specific SST file and reports
+// whether it holds a live value, a tombstone, or nothing for the key, with
+// the entry of a value found. Read errors are logged and returned wrapping
+// ErrUnreadableSSTable, with the key reported absent.
+func (kv *KeyValueStore) searchSSTFile(ctx context.Context, key string, sstFile string) ([]byte, sstableMatch, entryState, error) {
+	// Take the SST file from the pool
+	file, err := kv.files.acquire(sstFile)
+	if err != nil {
+		kv.logger.Error("error opening SST file", "file", sstFile, "err", err)
+		return nil, sstableMatch{}, entryAbsent, unreadable(sstFile, err)
+	}
+	defer kv.files.release(file)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		kv.logger.Error("error reading SST file", "file", sstFile, "err", err)
+		return nil, sstableMatch{}, entryAbsent, unreadable(sstFile, err)
+	}
+	kv.metrics.sstableReads.Add(1)
+
+	match, state, err := kv.locateInSSTFile(ctx, key, sstFile, file.File)
+	if err != nil || state != entryLive {
+		return nil, sstableMatch{}, state, err
+	}
+
+	value, err := kv.readMatch(match, file.File)
+	if err != nil {
+		kv.logger.Error("error decoding value from SST file", "file", sstFile, "err", err)
+		return nil, sstableMatch{}, entryAbsent, unreadable(sstFile, err)
+	}
+
+	return value, match, entryLive, nil // Key found
+}
+
+// locateInSSTFileByPath reports what an SST file holds for the key without
+// reading the value. Read errors are logged and returned wrapping
+// ErrUnreadableSSTable, with the key reported absent.
+func (kv *KeyValueStore) locateInSSTFileByPath(key string, sstFile string) (entryState, error) {
+	file, err := kv.files.acquire(sstFile)
+	if err != nil {
+		kv.logger.Error("error opening SST file", "file", sstFile, "err", err)
+		return entryAbsent, unreadable(sstFile, err)
+	}
+	defer kv.files.release(file)
+	kv.metrics.sstableReads.Add(1)
+
+	_, state, err := kv.locateInSSTFile(context.Background(), key, sstFile, file.File)
+	return state, err
+}
+
+// sstableMatch is the entry for a key found in an SST file by
+// locateInSSTFile.
+type sstableMatch struct {
+	header      sstableHeader
+	key         string
+	index       uint32 // The entry's position in the file
+	valueType   ValueType
+	valueLength uint32
+	inValueLog  bool   // The entry holds a valuePointer rather than the value
+	version     uint64 // Zero if the entry has none
+}
+
+// read reads the matched value from the SST file positioned at its start
+// and decodes it. For a value in the value log, that is its pointer.
+func (match sstableMatch) read(aead cipher.AEAD, file *os.File) ([]byte, error) {
+	value := make([]byte, match.valueLength)
+	if _, err := io.ReadFull(file, value); err != nil {
+		return nil, fmt.Errorf("error reading value: %w", err)
+	}
+	return match.header.decodeValue(aead, match.index, match.key, value)
+}
+
+// readMatch reads the matched value from the SST file positioned at its
+// start, following its pointer if it is in the value log.
+func (kv *KeyValueStore) readMatch(match sstableMatch, file *os.File) ([]byte, error) {
+	value, err := match.read(kv.aead, file)
+	if err != nil || !match.inValueLog {
+		return value, err
+	}
+	return kv.values.read(match.key, value)
+}
+
+// locateInSSTFile finds the newest entry for the key in an open SST file,
+// leaving the file positioned at the start of its value. The values of the
+// entries passed over are skipped rather than read. Read errors are logged
+// and returned wrapping ErrUnreadableSSTable, with the key reported absent.
+// A file whose header, footer, or entries turn out to be malformed or
+// truncated is marked corrupt and skipped from then on, still returning the
+// error that marked it.
+func (kv *KeyValueStore) locateInSSTFile(ctx context.Context, key string, sstFile string, file *os.File) (sstableMatch, entryState, error) {
+	var match sstableMatch
+
+	// A file already found corrupt holds nothing that can be read
+	if err := kv.corruptError(sstFile); err != nil {
+		return match, entryAbsent, unreadable(sstFile, err)
+	}
+
+	// Read the header and footer, or take them from memory
+	layout, err := kv.loadTableLayout(sstFile, file)
+	if err != nil {
+		kv.markCorrupt(sstFile, err)
+		return match, entryAbsent, unreadable(sstFile, err)
+	}
+	header, footer := layout.header, layout.footer
+	match.header = header
+
+	// Skip the file if it's empty or the key is outside its key range
+	if header.entryCount == 0 {
+		return match, entryAbsent, nil
+	}
+	// Tracing every entry is costly, so check once whether it is wanted
+	trace := kv.logger.Enabled(ctx, slog.LevelDebug)
+	if trace {
+		kv.logger.Debug("searching SST file", "file", sstFile, "key", key, "entries", header.entryCount, "seq", header.seq, "min_key", footer.minKey, "max_key", footer.maxKey)
+	}
+	if kv.compare(key, footer.minKey) < 0 || kv.compare(key, footer.maxKey) > 0 {
+		return match, entryAbsent, nil
+	}
+
+	// Jump to the sparse index point at or before the key, so only the
+	// entries up to the next point have to be read
+	offset, first := layout.dataOffset, uint32(0)
+	if pointOffset, ordinal, ok := footer.seek(kv.compare, key, header.entryCount); ok {
+		offset, first = pointOffset, ordinal
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		kv.logger.Error("error reading SST file", "file", sstFile, "err", err)
+		return match, entryAbsent, unreadable(sstFile, err)
+	}
+
+	// Iterate through entries in the SST file
+	for i := first; i < header.entryCount; i++ {
+		if err := ctx.Err(); err != nil {
+			return match, entryAbsent, err
+		}
+
+		entry, valueLength, err := readSSTableEntryKey(file)
+		if err != nil {
+			// Running out of entries means the file is truncated
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				kv.markCorrupt(sstFile, err)
+			} else {
+				kv.logger.Error("error reading SST file", "file", sstFile, "err", err)
+			}
+			return match, entryAbsent, unreadable(sstFile, err)
+		}
+		if trace {
+			kv.logger.Debug("read SSTable entry", "file", sstFile, "key", entry.key, "marker", entry.operationMarker, "value_type", entry.valueType, "value_length", valueLength)
+		}
+
+		if entry.key == key {
+			// Check if the key is marked as deleted
+			if entry.operationMarker == 1 {
+				return match, entryDeleted, nil // Key is marked as deleted
+			}
+
+			match.key = entry.key
+			match.index = i
+			match.valueType = entry.valueType &^ valueLogFlag
+			match.valueLength = valueLength
+			match.inValueLog = entry.valueType&valueLogFlag != 0
+			match.version = entry.version
+			return match, entryLive, nil
+		}
+
+		// Entries are sorted, so the key can't come after a larger one
+		if kv.compare(entry.key, key) > 0 {
+			break
+		}
+
+		if _, err := file.Seek(int64(valueLength), io.SeekCurrent); err != nil {
+			kv.logger.Error("error reading SST file", "file", sstFile, "err", err)
+			return match, entryAbsent, unreadable(sstFile, err)
+		}
+	}
+
+	return match, entryAbsent, nil // Key not found in this SST file
+}
+
+// sstableMagic starts every SSTable file, followed by a format version byte.
+// Files written before versioning start with legacySSTableMagic and no
+// version byte instead, and are read as version 0. The very first of those
+// have nothing but the entries after the key lengths, and are scanned
+// linearly; see readBaselineFooter.
+const (
+	sstableMagic       = "SSTV"
+	legacySSTableMagic = "SSTB"
+)
+
+// sstableFormatVersion is the version of the SSTable format written by this
+// build, and the newest it reads. Version 0 files may lack the footer's
+// sparse index; from version 1 on it is always present. Version 2 files may
+// hold pointers into the value log, and version 3 files versioned entries;
+// files without either are written as the version before them.
+const (
+	sstableFormatVersion = 3
+	valueLogVersion      = 2
+	valueLogFreeVersion  = 1
+)
+
+// versionedEntryFlag is set in the operation marker of an SSTable entry
+// whose value has a version, which follows the marker as 8 bytes.
+const versionedEntryFlag = 0x02
+
+// sstableHeader holds the fields at the start of an SSTable file.
+type sstableHeader struct {
+	version           byte
+	entryCount        uint32
+	smallestKeyLength uint32
+	largestKeyLength  uint32
+	compression       Compression
+	encrypted         bool
+	seq               uint64
+	noncePrefix       []byte // Shared prefix of the values' nonces, if encrypted
+	baseline          bool   // Written in the original format, with no compression byte, seq or footer
+}
+
+// encryptedFlag is set in the compression byte of an SSTable header when its
+// values are encrypted.
+const encryptedFlag = 0x80
+
+// noncePrefixSize is the length of the random per-file prefix of an
+// encrypted SSTable's nonces. The rest of each nonce is the entry's index.
+const noncePrefixSize = 8
+
+// entryNonce returns the AES-GCM nonce for the entry at index in an
+// encrypted SSTable.
+func entryNonce(noncePrefix []byte, index uint32) []byte {
+	nonce := make([]byte, noncePrefixSize+4)
+	copy(nonce, noncePrefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	return nonce
+}
+
+// sstableEntry is a key-value pair or tombstone read from an SSTable file.
+type sstableEntry struct {
+	operationMarker uint16 // 0 for a set, 1 for a delete
+	valueType       ValueType
+	version         uint64 // Zero if the entry has none
+	key             string
+	value           []byte
+}
+
+// size returns the number of bytes the entry takes up in its file.
+func (entry sstableEntry) size() int64 {
+	// The marker, the key and value lengths, the key, and the value
+	size := int64(2 + 4 + 4 + len(entry.key) + len(entry.value))
+	if entry.version != 0 {
+		size += 8
+	}
+	return size
+}
+
+// errInvalidSSTable is returned by readSSTableHeader for a file that doesn't
+// start with an SSTable magic number.
+var errInvalidSSTable = errors.New("invalid SST file format")
+
+// readSSTableHeader reads and validates the header at the start of an SSTable file.
+func readSSTableHeader(file *os.File) (sstableHeader, error) {
+	var header sstableHeader
+
+	// Read magic number
+	magicNumber := make([]byte, 4)
+	if _, err := io.ReadFull(file, magicNumber); err != nil {
+		return header, fmt.Errorf("error reading magic number: %w", err)
+	}
+
+	// Check if it's a valid SST file in a format version this build reads
+	switch string(magicNumber) {
+	case sstableMagic:
+		if err := binary.Read(file, binary.LittleEndian, &header.version); err != nil {
+			return header, fmt.Errorf("error reading format version: %w", err)
+		}
+		if header.version == 0 || header.version > sstableFormatVersion {
+			return header, fmt.Errorf("unsupported SSTable version %d: this build reads versions up to %d", header.version, sstableFormatVersion)
+		}
+	case legacySSTableMagic:
+		header.version = 0
+	default:
+		return header, errInvalidSSTable
+	}
+
+	// Read entry count
+	if err := binary.Read(file, binary.LittleEndian, &header.entryCount); err != nil {
+		return header, fmt.Errorf("error reading entry count: %w", err)
+	}
+
+	// Read smallest key length
+	if err := binary.Read(file, binary.LittleEndian, &header.smallestKeyLength); err != nil {
+		return header, fmt.Errorf("error reading smallest key length: %w", err)
+	}
+
+	// Read largest key length
+	if err := binary.Read(file, binary.LittleEndian, &header.largestKeyLength); err != nil {
+		return header, fmt.Errorf("error reading largest key length: %w", err)
+	}
+
+	// The entries of a file in the original format start right here
+	if header.version == 0 && isBaselineSSTable(file, header.entryCount) {
+		header.baseline = true
+		return header, nil
+	}
+
+	// Read compression type
+	if err := binary.Read(file, binary.LittleEndian, &header.compression); err != nil {
+		return header, fmt.Errorf("error reading compression type: %w", err)
+	}
+	header.encrypted = header.compression&encryptedFlag != 0
+	header.compression &^= encryptedFlag
+	if header.compression != NoCompression && header.compression != GzipCompression {
+		return header, fmt.Errorf("unknown compression type %d", header.compression)
+	}
+
+	// Read sequence number
+	if err := binary.Read(file, binary.LittleEndian, &header.seq); err != nil {
+		return header, fmt.Errorf("error reading sequence number: %w", err)
+	}
+
+	// Read the nonce prefix of an encrypted file
+	if header.encrypted {
+		header.noncePrefix = make([]byte, noncePrefixSize)
+		if _, err := io.ReadFull(file, header.noncePrefix); err != nil {
+			return header, fmt.Errorf("error reading nonce prefix: %w", err)
+		}
+	}
+
+	return header, nil
+}
+
+// baselineHeaderSize is the size of the header of an SSTable in the original
+// format: the magic number and the entry count and key lengths.
+const baselineHeaderSize = 4 + 4 + 4 + 4
+
+// isBaselineSSTable reports whether a legacySSTableMagic file is in the
+// original format rather than version 0. A version 0 file has a known
+// compression type after the key lengths and a footer its last 8 bytes
+// locate past the header; an original one has entryCount entries that end
+// exactly at the end of the file.
+func isBaselineSSTable(file *os.File, entryCount uint32) bool {
+	var compression [1]byte
+	if _, err := file.ReadAt(compression[:], baselineHeaderSize); err == nil {
+		switch Compression(compression[0]) &^ encryptedFlag {
+		case NoCompression, GzipCompression:
+			footer, err := readSSTableFooter(file, sstableHeader{})
+			if err == nil && footer.offset >= baselineHeaderSize+1+8 {
+				return false
+			}
+		}
+	}
+
+	_, err := readBaselineFooter(file, entryCount)
+	return err == nil
+}
+
+// readBaselineFooter scans the entries of an SSTable in the original
+// format, which has no footer, for the fields a footer would hold, without
+// moving the file's offset. The entries are sorted, so the first and last
+// keys are the smallest and largest, and there is no sparse index.
+func readBaselineFooter(file *os.File, entryCount uint32) (sstableFooter, error) {
+	var footer sstableFooter
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return footer, err
+	}
+	size := fileInfo.Size()
+	if size < baselineHeaderSize {
+		return footer, fmt.Errorf("file is too short for a header")
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(file, baselineHeaderSize, size-baselineHeaderSize))
+	offset := int64(baselineHeaderSize)
+	for i := uint32(0); i < entryCount; i++ {
+		entry, valueLength, err := readSSTableEntryKey(reader)
+		if err != nil {
+			return footer, fmt.Errorf("error reading entry %d: %w", i, err)
+		}
+		// The original format only has plain sets and deletes
+		if entry.operationMarker > 1 || entry.valueType != 0 || entry.version != 0 {
+			return footer, fmt.Errorf("entry %d has operation marker %d, which the original format doesn't use", i, entry.operationMarker)
+		}
+		if _, err := reader.Discard(int(valueLength)); err != nil {
+			return footer, fmt.Errorf("error reading value of entry %d: %w", i, err)
+		}
+		offset += entry.size() + int64(valueLength)
+
+		if i == 0 {
+			footer.minKey = entry.key
+		}
+		footer.maxKey = entry.key
+	}
+	if offset != size {
+		return footer, fmt.Errorf("entries end at offset %d, not at the end of the file at %d", offset, size)
+	}
+
+	footer.offset = size
+	return footer, nil
+}
+
+// readSSTableEntry reads the next entry from an SSTable file.
+func readSSTableEntry(file *os.File) (sstableEntry, error) {
+	entry, valueLength, err := readSSTableEntryKey(file)
+	if err != nil {
+		return entry, err
+	}
+
+	entry.value = make([]byte, valueLength)
+	if _, err := io.ReadFull(file, entry.value); err != nil {
+		return entry, fmt.Errorf("error reading value: %w", err)
+	}
+
+	return entry, nil
+}
+
+// readSSTableEntryKey reads the next entry from an SSTable file up to the
+// start of its value, and returns the value's length.
+func readSSTableEntryKey(file io.Reader) (sstableEntry, uint32, error) {
+	var entry sstableEntry
+
+	if err := binary.Read(file, binary.LittleEndian, &entry.operationMarker); err != nil {
+		return entry, 0, fmt.Errorf("error reading operation marker: %w", err)
+	}
+
+	// The high byte of the marker holds the value type, and a flag in the
+	// low byte a version after it
+	entry.valueType = ValueType(entry.operationMarker >> 8)
+	entry.operationMarker &= 0xff
+	if entry.operationMarker&versionedEntryFlag != 0 {
+		entry.operationMarker &^= versionedEntryFlag
+		if err := binary.Read(file, binary.LittleEndian, &entry.version); err != nil {
+			return entry, 0, fmt.Errorf("error reading version: %w", err)
+		}
+	}
+
+	var keyLength uint32
+	if err := binary.Read(file, binary.LittleEndian, &keyLength); err != nil {
+		return entry, 0, fmt.Errorf("error reading key length: %w", err)
+	}
+
+	var valueLength uint32
+	if err := binary.Read(file, binary.LittleEndian, &valueLength); err != nil {
+		return entry, 0, fmt.Errorf("error reading value length: %w", err)
+	}
+
+	keyBytes := make([]byte, keyLength)
+	if _, err := io.ReadFull(file, keyBytes); err != nil {
+		return entry, 0, fmt.Errorf("error reading key: %w", err)
+	}
+	entry.key = string(keyBytes)
+
+	return entry, valueLength, nil
+}
+
+// decodeValue returns the original bytes of the value of the entry at index
+// in the SSTable, decrypting it with aead if the file is encrypted.
+func (header sstableHeader) decodeValue(aead cipher.AEAD, index uint32, key string, value []byte) ([]byte, error) {
+	// Decrypt the value if the SSTable is encrypted
+	if header.encrypted {
+		if aead == nil {
+			return nil, fmt.Errorf("SSTable is encrypted but no encryption key is configured")
+		}
+		plaintext, err := aead.Open(nil, entryNonce(header.noncePrefix, index), value, []byte(key))
+		if err != nil {
+			return nil, ErrDecryption
+		}
+		value = plaintext
+	}
+
+	// Decompress the value if the SSTable uses compression
+	if header.compression == GzipCompression {
+		return gzipDecompress(value)
+	}
+	return value, nil
+}
+
+// valueLogFileBytes is the size at which the value log starts a new file.
+const valueLogFileBytes = 64 << 20
+
+// valueLog is the append-only log of the values that SSTables store out of
+// line, written as the SSTables are. Its files are named by valueLogFileName
+// in the data directory and are never rewritten, so a pointer stays valid
+// however often compaction moves it. The space of values that are
+// overwritten or deleted is not reclaimed.
+type valueLog struct {
+	dir  string
+	aead cipher.AEAD // Encrypts the values written; nil if unencrypted
+	mode os.FileMode // Options.FileMode, for the files it creates
+
+	mu         sync.Mutex
+	active     *os.File // The file being appended to; nil until the first append
+	activeID   uint32
+	activeSize int64
+	readers    map[uint32]*os.File // Files opened for reading, by ID
+}
+
+// valuePointer locates a value in the value log.
+type valuePointer struct {
+	file      uint32 // The ID of the value log file
+	offset    uint64
+	length    uint32 // The length of the stored record
+	encrypted bool   // The record is a nonce followed by the sealed value
+}
+
+// valuePointerSize is the length of an encoded valuePointer.
+const valuePointerSize = 4 + 8 + 4 + 1
+
+// encode returns the pointer's bytes as stored in an SSTable entry.
+func (pointer valuePointer) encode() []byte {
+	buf := make([]byte, valuePointerSize)
+	binary.LittleEndian.PutUint32(buf, pointer.file)
+	binary.LittleEndian.PutUint64(buf[4:], pointer.offset)
+	binary.LittleEndian.PutUint32(buf[12:], pointer.length)
+	if pointer.encrypted {
+		buf[16] = 1
+	}
+	return buf
+}
+
+// decodeValuePointer parses a pointer stored in an SSTable entry.
+func decodeValuePointer(buf []byte) (valuePointer, error) {
+	if len(buf) != valuePointerSize {
+		return valuePointer{}, fmt.Errorf("invalid value log pointer of %d bytes", len(buf))
+	}
+	return valuePointer{
+		file:      binary.LittleEndian.Uint32(buf),
+		offset:    binary.LittleEndian.Uint64(buf[4:]),
+		length:    binary.LittleEndian.Uint32(buf[12:]),
+		encrypted: buf[16] == 1,
+	}, nil
+}
+
+// valueLogFileName returns the name of the value log file with the given ID.
+func valueLogFileName(id uint32) string {
+	return fmt.Sprintf("vlog_%010d.vlog", id)
+}
+
+// newValueLog returns the value log of a data directory. No file is opened
+// or created until a value is read or appended.
+func newValueLog(dir string, aead cipher.AEAD, mode os.FileMode) *valueLog {
+	return &valueLog{dir: dir, aead: aead, mode: mode, readers: make(map[uint32]*os.File)}
+}
+
+// storesInValueLog reports whether a value is large enough to be stored in
+// the value log rather than inline.
+func (kv *KeyValueStore) storesInValueLog(value []byte) bool {
+	threshold := kv.options.ValueLogThreshold
+	return threshold > 0 && len(value) >= threshold
+}
+
+// append writes a value to the log and returns the encoded pointer to it.
+// The value is encrypted, bound to its key, if the store is. It isn't
+// durable until sync is called.
+func (vlog *valueLog) append(key string, value []byte) ([]byte, error) {
+	record := value
+	if vlog.aead != nil {
+		nonce := make([]byte, vlog.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		record = vlog.aead.Seal(nonce, nonce, value, []byte(key))
+	}
+
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+
+	if vlog.active == nil || vlog.activeSize >= valueLogFileBytes {
+		if err := vlog.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	pointer := valuePointer{file: vlog.activeID, offset: uint64(vlog.activeSize), length: uint32(len(record)), encrypted: vlog.aead != nil}
+	if _, err := vlog.active.Write(record); err != nil {
+		// Start the next value in a new file rather than after a partial
+		// record
+		vlog.active.Close()
+		vlog.active = nil
+		return nil, err
+	}
+	vlog.activeSize += int64(len(record))
+
+	return pointer.encode(), nil
+}
+
+// rotate finishes the active file, if any, and starts a new one numbered
+// after every existing file. The caller must hold mu.
+func (vlog *valueLog) rotate() error {
+	if vlog.active != nil {
+		if err := vlog.active.Sync(); err != nil {
+			return err
+		}
+		vlog.active.Close()
+		vlog.active = nil
+	}
+
+	// Never append to a file left by an earlier run, which may end in a
+	// partial record
+	matches, err := filepath.Glob(filepath.Join(vlog.dir, "vlog_*.vlog"))
+	if err != nil {
+		return err
+	}
+	id := vlog.activeID + 1
+	for _, match := range matches {
+		var existing uint32
+		if _, err := fmt.Sscanf(filepath.Base(match), "vlog_%d.vlog", &existing); err == nil && existing >= id {
+			id = existing + 1
+		}
+	}
+
+	file, err := openFile(filepath.Join(vlog.dir, valueLogFileName(id)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644, vlog.mode)
+	if err != nil {
+		return err
+	}
+	vlog.active, vlog.activeID, vlog.activeSize = file, id, 0
+	return nil
+}
+
+// sync fsyncs the values appended so far.
+func (vlog *valueLog) sync() error {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+
+	if vlog.active == nil {
+		return nil
+	}
+	return vlog.active.Sync()
+}
+
+// reader returns the value log file with the given ID, open for reading.
+func (vlog *valueLog) reader(id uint32) (*os.File, error) {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+
+	if file, ok := vlog.readers[id]; ok {
+		return file, nil
+	}
+	file, err := os.Open(filepath.Join(vlog.dir, valueLogFileName(id)))
+	if err != nil {
+		return nil, err
+	}
+	vlog.readers[id] = file
+	return file, nil
+}
+
+// read returns the value that an encoded pointer, stored for key, points to.
+func (vlog *valueLog) read(key string, encoded []byte) ([]byte, error) {
+	pointer, err := decodeValuePointer(encoded)
+	if err != nil {
+		return nil, err
+	}
+	file, err := vlog.reader(pointer.file)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, pointer.length)
+	if _, err := file.ReadAt(record, int64(pointer.offset)); err != nil {
+		return nil, fmt.Errorf("error reading value log %s: %w", valueLogFileName(pointer.file), err)
+	}
+	if !pointer.encrypted {
+		return record, nil
+	}
+
+	if vlog.aead == nil {
+		return nil, fmt.Errorf("value log is encrypted but no encryption key is configured")
+	}
+	nonceSize := vlog.aead.NonceSize()
+	if len(record) < nonceSize {
+		return nil, ErrDecryption
+	}
+	value, err := vlog.aead.Open(nil, record[:nonceSize], record[nonceSize:], []byte(key))
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return value, nil
+}
+
+// stream returns a reader over the value that an encoded pointer, stored for
+// key, points to, and the value's length. An unencrypted value is read from
+// the file as the stream is read; an encrypted one is decrypted in memory
+// first, since its authentication tag can only be checked once all of it is
+// read.
+func (vlog *valueLog) stream(key string, encoded []byte) (io.ReadCloser, int64, error) {
+	pointer, err := decodeValuePointer(encoded)
+	if err != nil {
+		return nil, 0, err
+	}
+	if pointer.encrypted {
+		value, err := vlog.read(key, encoded)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.NopCloser(bytes.NewReader(value)), int64(len(value)), nil
+	}
+
+	file, err := vlog.reader(pointer.file)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NopCloser(io.NewSectionReader(file, int64(pointer.offset), int64(pointer.length))), int64(pointer.length), nil
+}
+
+// close closes the log's files.
+func (vlog *valueLog) close() error {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+
+	var err error
+	if vlog.active != nil {
+		err = vlog.active.Sync()
+		vlog.active.Close()
+		vlog.active = nil
+	}
+	for id, file := range vlog.readers {
+		file.Close()
+		delete(vlog.readers, id)
+	}
+	return err
+}
+
+// KeyValue is a key and its value as returned by scans.
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// inRange reports whether key falls within [start, end) in the order of
+// compare. An empty end means the range is unbounded above.
+func inRange(compare Comparator, key, start, end string) bool {
+	return compare(key, start) >= 0 && (end == "" || compare(key, end) < 0)
+}
+
+// Scan returns the live key-value pairs with keys in [start, end), sorted by key.
+func (kv *KeyValueStore) Scan(start, end string) ([]KeyValue, error) {
+	return kv.ScanContext(context.Background(), start, end)
+}
+
+// Count returns the number of live keys in the store. A key present in
+// several layers is counted once, and deleted keys aren't counted. It reads
+// every SSTable, so its cost grows with the size of the store.
+func (kv *KeyValueStore) Count() (int, error) {
+	it := kv.NewIterator("", "")
+	defer it.Close()
+
+	count := 0
+	for it.Next() {
+		count++
+	}
+
+	return count, it.Err()
+}
+
+// Keys returns the live keys in [start, end), sorted by key; an empty end is
+// unbounded. Like Count, it resolves each key to its newest entry across the
+// memtables and SSTables, so a key deleted by a tombstone in a newer SSTable
+// than its value is left out.
+func (kv *KeyValueStore) Keys(start, end string) ([]string, error) {
+	return kv.KeysContext(context.Background(), start, end)
+}
+
+// KeysContext is Keys, aborting with the context's error if the context is
+// cancelled while iterating.
+func (kv *KeyValueStore) KeysContext(ctx context.Context, start, end string) ([]string, error) {
+	it := kv.NewIterator(start, end)
+	defer it.Close()
+
+	keys := []string{}
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// ScanPrefix returns the live key-value pairs whose keys start with prefix,
+// sorted by key. An empty prefix returns every pair.
+func (kv *KeyValueStore) ScanPrefix(prefix string) ([]KeyValue, error) {
+	return kv.ScanPrefixContext(context.Background(), prefix)
+}
+
+// ScanPrefixContext is ScanPrefix, aborting with the context's error if the
+// context is cancelled while iterating.
+func (kv *KeyValueStore) ScanPrefixContext(ctx context.Context, prefix string) ([]KeyValue, error) {
+	if kv.options.ComparatorName == bytewiseComparatorName {
+		return kv.ScanContext(ctx, prefix, prefixUpperBound(prefix))
+	}
+
+	// Keys sharing a prefix are only contiguous in bytewise order, so with
+	// another comparator every key is checked
+	it := kv.NewIterator("", "")
+	defer it.Close()
+
+	pairs := []KeyValue{}
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(it.Key(), prefix) {
+			pairs = append(pairs, KeyValue{Key: it.Key(), Value: it.Value()})
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return pairs, nil
+}
+
+// prefixUpperBound returns the smallest key greater than every key that
+// starts with prefix, or "" (unbounded) if there is none, as for an empty
+// prefix or one made only of 0xFF bytes.
+func prefixUpperBound(prefix string) string {
+	end := []byte(prefix)
+	for len(end) > 0 {
+		last := len(end) - 1
+		if end[last] != 0xff {
+			end[last]++
+			return string(end)
+		}
+		// 0xFF can't be incremented; carry into the previous byte
+		end = end[:last]
+	}
+	return ""
+}
+
+// ScanContext returns the live key-value pairs with keys in [start, end),
+// sorted by key. It aborts with the context's error if the context is
+// cancelled while iterating.
+func (kv *KeyValueStore) ScanContext(ctx context.Context, start, end string) ([]KeyValue, error) {
+	it := kv.NewIterator(start, end)
+	defer it.Close()
+
+	pairs := []KeyValue{}
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, KeyValue{Key: it.Key(), Value: it.Value()})
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return pairs, nil
+}
+
+// ScanPage returns up to limit live key-value pairs with keys in
+// [start, end), sorted by key, and the key the next page starts at, or "" if
+// there are no more. Passing that key back as start continues the scan
+// where the page ended, whatever was written in between: pages are cut at
+// keys rather than positions, so no key present throughout is skipped or
+// returned twice. A limit below 1 is an error.
+func (kv *KeyValueStore) ScanPage(ctx context.Context, start, end string, limit int) ([]KeyValue, string, error) {
+	if limit < 1 {
+		return nil, "", fmt.Errorf("page limit must be at least 1, got %d", limit)
+	}
+
+	it := kv.NewIterator(start, end)
+	defer it.Close()
+
+	pairs := []KeyValue{}
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		// One pair past the page is the next page's start
+		if len(pairs) == limit {
+			return pairs, it.Key(), nil
+		}
+		pairs = append(pairs, KeyValue{Key: it.Key(), Value: it.Value()})
+	}
+	if err := it.Err(); err != nil {
+		return nil, "", err
+	}
+
+	return pairs, "", nil
+}
+
+// Iterator walks the live key-value pairs in a key range in sorted order. It
+// merges the memtable and SST files lazily, reading one entry ahead from
+// each, so large ranges aren't buffered in memory. It must be closed.
+type Iterator struct {
+	sources []*iteratorSource // Newest first: the memtable, the one being flushed, then SST files
+	compare Comparator        // The order of the keys
+	values  *valueLog         // Reads values in the value log; nil leaves their pointers in place
+	key     string
+	value   []byte
+	err     error
+}
+
+// iteratorEntry is an entry from one layer of the store. Tombstones have
+// deleted set.
+type iteratorEntry struct {
+	key       string
+	value     []byte
+	valueType ValueType
+	version   uint64 // Zero if the value has none
+	deleted   bool
+	written   time.Time // When the entry's SSTable was written; zero for memtable entries
+}
+
+// iteratorSource is a sorted stream of entries from one layer of the store,
+// positioned at its current entry.
+type iteratorSource struct {
+	entry   iteratorEntry
+	valid   bool
+	advance func() (iteratorEntry, bool, error)
+	close   func() error
+}
+
+// next moves the source to its following entry.
+func (src *iteratorSource) next() error {
+	entry, ok, err := src.advance()
+	if err != nil {
+		src.valid = false
+		return err
+	}
+	src.entry, src.valid = entry, ok
+	return nil
+}
+
+// NewIterator returns an iterator over the live key-value pairs with keys in
+// [start, end); an empty end is unbounded. It reads a consistent view of the
+// store as of the call: the memtable is copied and the SST files are pinned
+// under the read lock, and later writes are not seen. The lock is held only
+// for that; the files are read after it is released, so a long scan doesn't
+// hold up writes.
+func (kv *KeyValueStore) NewIterator(start, end string) *Iterator {
+	kv.mu.RLock()
+	it := kv.newIterator(start, end)
+	kv.mu.RUnlock()
+
+	it.start()
+	return it
+}
+
+// newIterator creates an iterator without taking the lock. Its SST files
+// aren't read until it is started.
+func (kv *KeyValueStore) newIterator(start, end string) *Iterator {
+	it := &Iterator{compare: kv.compare, values: kv.values}
+
+	// Copy the entries in the range from the memtable, then from the ones
+	// being flushed
+	it.sources = append(it.sources, memtableSource(kv.data, kv.DeletedKeys, kv.valueTypes, kv.versions, start, end))
+	for _, frozen := range kv.flushing {
+		it.sources = append(it.sources, memtableSource(frozen.data, frozen.deletedKeys, frozen.valueTypes, frozen.versions, start, end))
+	}
+
+	files, err := kv.sstableFiles()
+	if err != nil {
+		it.err = err
+		return it
+	}
+	for _, sstFile := range files {
+		it.sources = append(it.sources, kv.deferSSTableSource(sstFile, start, end))
+	}
+
+	return it
+}
+
+// mergeSources returns an iterator merging the sources, which are ordered
+// newest first and whose keys are ordered by compare.
+func mergeSources(sources []*iteratorSource, compare Comparator) *Iterator {
+	it := &Iterator{sources: sources, compare: compare}
+	it.start()
+	return it
+}
+
+// start positions every source at its first entry.
+func (it *Iterator) start() {
+	for _, source := range it.sources {
+		if err := source.next(); err != nil {
+			it.err = err
+			return
+		}
+	}
+}
+
+// memtableEntries returns a memtable's entries with keys in [start, end) in
+// key order, merging in its tombstones. A tombstone takes precedence over a
+// value for the same key.
+func memtableEntries(data *skipList, deletedKeys map[string]bool, valueTypes map[string]ValueType, versions map[string]uint64, start, end string) []iteratorEntry {
+	// Tombstones are few, so sorting them is cheap
+	var tombstones []string
+	for key, deleted := range deletedKeys {
+		if deleted && inRange(data.compare, key, start, end) {
+			tombstones = append(tombstones, key)
+		}
+	}
+	sort.Slice(tombstones, func(i, j int) bool {
+		return data.compare(tombstones[i], tombstones[j]) < 0
+	})
+
+	var entries []iteratorEntry
+	for node := data.seek(start); node != nil && inRange(data.compare, node.key, start, end); node = node.next[0] {
+		// Emit the tombstones that sort before this key
+		for len(tombstones) > 0 && data.compare(tombstones[0], node.key) < 0 {
+			entries = append(entries, iteratorEntry{key: tombstones[0], deleted: true})
+			tombstones = tombstones[1:]
+		}
+		if len(tombstones) > 0 && tombstones[0] == node.key {
+			continue // The tombstone wins; it is emitted before the next key
+		}
+		entries = append(entries, iteratorEntry{key: node.key, value: node.value, valueType: valueTypes[node.key], version: versions[node.key]})
+	}
+	for _, key := range tombstones {
+		entries = append(entries, iteratorEntry{key: key, deleted: true})
+	}
+
+	return entries
+}
+
+// memtableSource returns an iterator source over a copy of a memtable's
+// entries with keys in [start, end), applying its tombstones.
+func memtableSource(data *skipList, deletedKeys map[string]bool, valueTypes map[string]ValueType, versions map[string]uint64, start, end string) *iteratorSource {
+	return entriesSource(memtableEntries(data, deletedKeys, valueTypes, versions, start, end))
+}
+
+// entriesSource returns an iterator source over entries in key order.
+func entriesSource(entries []iteratorEntry) *iteratorSource {
+	return &iteratorSource{
+		advance: func() (iteratorEntry, bool, error) {
+			if len(entries) == 0 {
+				return iteratorEntry{}, false, nil
+			}
+			entry := entries[0]
+			entries = entries[1:]
+			return entry, true, nil
+		},
+		close: func() error { return nil },
+	}
+}
+
+// filePool limits how many SST files readers hold open at once. A reader
+// takes a handle for each read and gives it back right after, and idle
+// handles stay open for reuse until the limit forces the least recently used
+// one closed. A reader waits while every handle is in use. Iterators pin the
+// files they read, so a file removed by compaction stays on disk, and can be
+// reopened, until the last iterator reading it is closed.
+type filePool struct {
+	mu      sync.Mutex
+	freed   *sync.Cond // Signalled when a handle is given back
+	limit   int
+	open    int             // Handles open, idle or in use
+	idle    *list.List      // Elements hold *pooledFile values, most recently used at the front
+	pins    map[string]int  // Number of iterators reading each file
+	removed map[string]bool // Pinned files to delete once unpinned
+
+	// openFile opens a file for reading; it is os.Open outside of tests
+	openFile func(name string) (*os.File, error)
+}
+
+// pooledFile is an open SST file handed out by a filePool.
+type pooledFile struct {
+	*os.File
+	path string
+}
+
+// newFilePool creates a pool holding at most limit files open.
+func newFilePool(limit int) *filePool {
+	if limit < 1 {
+		limit = 1
+	}
+	pool := &filePool{
+		limit:    limit,
+		idle:     list.New(),
+		pins:     make(map[string]int),
+		removed:  make(map[string]bool),
+		openFile: os.Open,
+	}
+	pool.freed = sync.NewCond(&pool.mu)
+	return pool
+}
+
+// acquire returns an open handle for the file, which the caller must give
+// back with release. The handle's offset is wherever its last reader left
+// it, so the caller must seek before reading.
+func (p *filePool) acquire(path string) (*pooledFile, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		// Reuse an idle handle for the file if there is one
+		for elem := p.idle.Front(); elem != nil; elem = elem.Next() {
+			if file := elem.Value.(*pooledFile); file.path == path {
+				p.idle.Remove(elem)
+				return file, nil
+			}
+		}
+		if p.open < p.limit {
+			break
+		}
+
+		// Make room by closing the least recently used idle handle, or
+		// wait for one to be given back
+		if elem := p.idle.Back(); elem != nil {
+			p.idle.Remove(elem)
+			elem.Value.(*pooledFile).Close()
+			p.open--
+			break
+		}
+		p.freed.Wait()
+	}
+
+	file, err := p.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p.open++
+
+	return &pooledFile{File: file, path: path}, nil
+}
+
+// release gives a handle back to the pool.
+func (p *filePool) release(file *pooledFile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.idle.PushFront(file)
+	p.freed.Signal()
+}
+
+// pin keeps the file on disk until unpin is called, even if it is removed.
+func (p *filePool) pin(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pins[path]++
+}
+
+// unpin undoes pin, deleting the file if it was removed while pinned.
+func (p *filePool) unpin(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pins[path]--
+	if p.pins[path] > 0 {
+		return nil
+	}
+	delete(p.pins, path)
+	if !p.removed[path] {
+		return nil
+	}
+	delete(p.removed, path)
+	return p.deleteFile(path)
+}
+
+// remove deletes the file, or defers deleting it until it is unpinned.
+func (p *filePool) remove(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pins[path] > 0 {
+		p.removed[path] = true
+		return nil
+	}
+	return p.deleteFile(path)
+}
+
+// deleteFile closes the idle handles for the file and deletes it. The caller
+// must hold the pool's lock.
+func (p *filePool) deleteFile(path string) error {
+	for elem := p.idle.Front(); elem != nil; {
+		next := elem.Next()
+		if file := elem.Value.(*pooledFile); file.path == path {
+			p.idle.Remove(elem)
+			file.Close()
+			p.open--
+		}
+		elem = next
+	}
+	return os.Remove(path)
+}
+
+// closeIdle closes every idle handle.
+func (p *filePool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for elem := p.idle.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(*pooledFile).Close()
+		p.open--
+	}
+	p.idle.Init()
+	p.freed.Broadcast()
+}
+
+// openSSTableSource opens an SST file as an iterator source over the entries
+// with keys in [start, end). It returns nil if the file can't hold any. The
+// source takes a handle from the file pool for each entry it reads, so an
+// iterator over many files keeps at most MaxOpenFiles of them open.
+func (kv *KeyValueStore) openSSTableSource(sstFile string, start, end string) (*iteratorSource, error) {
+	// Open the SST file
+	file, err := kv.files.acquire(sstFile)
+	if err != nil {
+		return nil, err
+	}
+	defer kv.files.release(file)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Read the header
+	header, err := readSSTableHeader(file.File)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SST file %s: %w", sstFile, err)
+	}
+
+	// Skip the file if it's empty or doesn't overlap the range
+	if header.entryCount == 0 {
+		return nil, nil
+	}
+	footer, err := readSSTableFooter(file.File, header)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key range from SST file %s: %w", sstFile, err)
+	}
+	if kv.compare(footer.maxKey, start) < 0 || (end != "" && kv.compare(footer.minKey, end) >= 0) {
+		return nil, nil
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	written := fileInfo.ModTime()
+
+	// Remember where the entries start, as the handle may be used by other
+	// readers between entries
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the entries before the sparse index point at or before the start
+	// of the range
+	remaining := header.entryCount
+	if pointOffset, ordinal, ok := footer.seek(kv.compare, start, header.entryCount); ok {
+		offset = pointOffset
+		remaining -= ordinal
+	}
+
+	advance := func() (iteratorEntry, bool, error) {
+		if remaining == 0 {
+			return iteratorEntry{}, false, nil
+		}
+		file, err := kv.files.acquire(sstFile)
+		if err != nil {
+			return iteratorEntry{}, false, err
+		}
+		defer kv.files.release(file)
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return iteratorEntry{}, false, err
+		}
+
+		for remaining > 0 {
+			index := header.entryCount - remaining
+			remaining--
+			entry, err := readSSTableEntry(file.File)
+			if err != nil {
+				return iteratorEntry{}, false, fmt.Errorf("error reading SST file %s: %w", sstFile, err)
+			}
+			offset += entry.size()
+
+			// Entries are sorted, so nothing after the end of the range matters
+			if end != "" && kv.compare(entry.key, end) >= 0 {
+				remaining = 0
+				break
+			}
+			if kv.compare(entry.key, start) < 0 {
+				continue
+			}
+
+			if entry.operationMarker == 1 {
+				return iteratorEntry{key: entry.key, deleted: true, written: written}, true, nil
+			}
+			value, err := header.decodeValue(kv.aead, index, entry.key, entry.value)
+			if err != nil {
+				return iteratorEntry{}, false, fmt.Errorf("error decoding value from SST file %s: %w", sstFile, err)
+			}
+			return iteratorEntry{key: entry.key, value: value, valueType: entry.valueType, version: entry.version, written: written}, true, nil
+		}
+		return iteratorEntry{}, false, nil
+	}
+
+	kv.files.pin(sstFile)
+	return &iteratorSource{advance: advance, close: func() error { return kv.files.unpin(sstFile) }}, nil
+}
+
+// deferSSTableSource returns an iterator source like openSSTableSource, but
+// only opens the file when the source is first advanced, so an iterator can
+// be set up under the store lock without any disk I/O. The file is pinned
+// meanwhile, so a compaction can't delete it first.
+func (kv *KeyValueStore) deferSSTableSource(sstFile string, start, end string) *iteratorSource {
+	kv.files.pin(sstFile)
+
+	var opened *iteratorSource
+	started := false
+	return &iteratorSource{
+		advance: func() (iteratorEntry, bool, error) {
+			if !started {
+				source, err := kv.openSSTableSource(sstFile, start, end)
+				if err != nil {
+					return iteratorEntry{}, false, err
+				}
+				opened, started = source, true
+			}
+			if opened == nil {
+				return iteratorEntry{}, false, nil // The file holds no keys in the range
+			}
+			return opened.advance()
+		},
+		close: func() error {
+			var err error
+			if opened != nil {
+				err = opened.close()
+			}
+			if unpinErr := kv.files.unpin(sstFile); err == nil {
+				err = unpinErr
+			}
+			return err
+		},
+	}
+}
+
+// Next advances the iterator to the next live pair and reports whether there
+// is one.
+func (it *Iterator) Next() bool {
+	for {
+		entry, ok := it.nextEntry()
+		if !ok {
+			break
+		}
+		if entry.deleted {
+			continue
+		}
+		if entry.valueType&valueLogFlag != 0 && it.values != nil {
+			value, err := it.values.read(entry.key, entry.value)
+			if err != nil {
+				it.err = err
+				break
+			}
+			entry.value = value
+		}
+		it.key, it.value = entry.key, entry.value
+		return true
+	}
+
+	it.key, it.value = "", nil
+	return false
+}
+
+// nextEntry advances the merge to the next key and returns its newest
+// version, which may be a tombstone.
+func (it *Iterator) nextEntry() (iteratorEntry, bool) {
+	if it.err != nil {
+		return iteratorEntry{}, false
+	}
+
+	// Find the smallest key; on a tie the newest source comes first
+	var newest *iteratorSource
+	for _, source := range it.sources {
+		if source.valid && (newest == nil || it.compare(source.entry.key, newest.entry.key) < 0) {
+			newest = source
+		}
+	}
+	if newest == nil {
+		return iteratorEntry{}, false
+	}
+	entry := newest.entry
+
+	// Move every source past this key, dropping older versions
+	for _, source := range it.sources {
+		if source.valid && source.entry.key == entry.key {
+			if err := source.next(); err != nil {
+				it.err = err
+				return iteratorEntry{}, false
+			}
+		}
+	}
+
+	return entry, true
+}
+
+// Key returns the key of the current pair.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value of the current pair.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the first error the iterator encountered, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the SST files held open by the iterator.
+func (it *Iterator) Close() error {
+	var firstErr error
+	for _, source := range it.sources {
+		if err := source.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	it.sources = nil
+	return firstErr
+}
+
+// ReadSnapshot is a consistent, read-only view of the store as of its
+// creation. Writes made afterwards, and flushes and compactions, are not
+// seen through it. It must be closed so the SST files it pins can be
+// deleted once compacted away.
+type ReadSnapshot struct {
+	kv      *KeyValueStore
+	entries []iteratorEntry // Copy of the memtable, tombstones included
+	frozen  []*frozenMemtable // The memtables being flushed, newest first; never modified
+	files   []string        // SST files, from most recent to oldest
+	closed  bool
+
+	// The indexes of the SST files looked up through the snapshot. They are
+	// kept here rather than with the store's, so the indexes of files
+	// compacted away while the snapshot is open go with it.
+	indexMu sync.Mutex
+	indexes map[string]*tableIndex
+}
+
+// NewReadSnapshot returns a snapshot of the store. It copies the memtable
+// and pins the SST files under the read lock.
+func (kv *KeyValueStore) NewReadSnapshot() *ReadSnapshot {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	snapshot := &ReadSnapshot{
+		kv:      kv,
+		entries: memtableEntries(kv.data, kv.DeletedKeys, kv.valueTypes, kv.versions, "", ""),
+		frozen:  kv.flushing,
+		indexes: make(map[string]*tableIndex),
+	}
+
+	// The cached list is replaced rather than modified, so it can be kept
+	files, err := kv.sstableFiles()
+	if err != nil {
+		kv.logger.Error("error listing SST files", "err", err)
+	}
+	snapshot.files = files
+	for _, sstFile := range files {
+		kv.files.pin(sstFile)
+	}
+
+	return snapshot
+}
+
+// Get retrieves the value the key had when the snapshot was taken.
+func (snapshot *ReadSnapshot) Get(key string) ([]byte, bool) {
+	kv := snapshot.kv
+
+	// Check the copy of the memtable, then the memtables being flushed
+	entries := snapshot.entries
+	i := sort.Search(len(entries), func(i int) bool { return kv.compare(entries[i].key, key) >= 0 })
+	if i < len(entries) && entries[i].key == key {
+		return entries[i].value, !entries[i].deleted
+	}
+	for _, frozen := range snapshot.frozen {
+		if frozen.deletedKeys[key] {
+			return nil, false
+		}
+		if value, ok := frozen.data.get(key); ok {
+			return value, true
+		}
+	}
+
+	// Then the pinned SST files, from most recent to oldest. The lookup
+	// cache holds the store's current values, so it is bypassed.
+	for i, sstFile := range snapshot.files {
+		if kv.corruptError(sstFile) != nil {
+			continue
+		}
+		if index := snapshot.index(i, sstFile); index != nil && !index.mayContain(key) {
+			continue
+		}
+		value, _, state, _ := kv.searchSSTFile(context.Background(), key, sstFile)
+		switch state {
+		case entryLive:
+			return value, true
+		case entryDeleted:
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
+
+// index returns the index of the snapshot's ith SST file, or nil if it isn't
+// indexed. An index the store already holds is shared; any other is built
+// and kept by the snapshot, never added to the store's, which only prunes
+// the indexes of files in its manifest.
+func (snapshot *ReadSnapshot) index(i int, sstFile string) *tableIndex {
+	kv := snapshot.kv
+	if kv.options.MaxIndexedTables > 0 && i >= kv.options.MaxIndexedTables {
+		return nil
+	}
+
+	snapshot.indexMu.Lock()
+	defer snapshot.indexMu.Unlock()
+	if index, ok := snapshot.indexes[sstFile]; ok {
+		return index
+	}
+
+	kv.indexMu.Lock()
+	index := kv.tableIndexes[sstFile]
+	kv.indexMu.Unlock()
+	if index == nil {
+		var err error
+		if index, err = buildTableIndex(sstFile, kv.compare); err != nil {
+			// The file is searched instead, which reports the error
+			kv.logger.Error("error indexing SST file", "file", sstFile, "err", err)
+			index = nil
+		}
+	}
+	snapshot.indexes[sstFile] = index
+
+	return index
+}
+
+// NewIterator returns an iterator over the snapshot's live key-value pairs
+// with keys in [start, end); an empty end is unbounded. The iterator must be
+// closed, and may be used after the snapshot is closed.
+func (snapshot *ReadSnapshot) NewIterator(start, end string) *Iterator {
+	kv := snapshot.kv
+	it := &Iterator{compare: kv.compare, values: kv.values}
+
+	// Take the copied entries in the range
+	entries := snapshot.entries
+	first := sort.Search(len(entries), func(i int) bool { return kv.compare(entries[i].key, start) >= 0 })
+	last := len(entries)
+	if end != "" {
+		last = sort.Search(len(entries), func(i int) bool { return kv.compare(entries[i].key, end) >= 0 })
+	}
+	if last < first {
+		last = first
+	}
+	it.sources = append(it.sources, entriesSource(entries[first:last]))
+
+	for _, frozen := range snapshot.frozen {
+		it.sources = append(it.sources, memtableSource(frozen.data, frozen.deletedKeys, frozen.valueTypes, frozen.versions, start, end))
+	}
+	for _, sstFile := range snapshot.files {
+		source, err := kv.openSSTableSource(sstFile, start, end)
+		if err != nil {
+			it.err = err
+			return it
+		}
+		if source != nil {
+			it.sources = append(it.sources, source)
+		}
+	}
+
+	it.start()
+	return it
+}
+
+// Close releases the snapshot's SST files. Closing it again does nothing.
+func (snapshot *ReadSnapshot) Close() error {
+	if snapshot.closed {
+		return nil
+	}
+	snapshot.closed = true
+
+	var firstErr error
+	for _, sstFile := range snapshot.files {
+		if err := snapshot.kv.files.unpin(sstFile); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// shardVirtualNodes is the number of points each shard of a ShardedStore
+// has on the hash ring. The more points, the closer each shard's share of
+// the keys is to even; with 1024, shares are within a few percent.
+const shardVirtualNodes = 1024
+
+// ShardedStore spreads keys across several KeyValueStores, each with its own
+// WAL, memtable, and SSTables in a data directory of its own, so writes to
+// different shards don't contend for one lock or WAL. Keys are assigned to
+// shards by consistent hashing. The shards are identified by their position
+// in the list of directories, which must stay the same whenever the store is
+// opened; keys are not moved between shards.
+type ShardedStore struct {
+	shards  []*KeyValueStore
+	ring    []ringPoint // Sorted by hash
+	compare Comparator
+}
+
+// ringPoint is one of a shard's points on the hash ring. A key belongs to
+// the shard of the first point at or after its hash.
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+// NewShardedStore opens a store sharded across dirs, opening a KeyValueStore
+// with the given options in each, with its WAL in wal.log there.
+func NewShardedStore(dirs []string, options Options) (*ShardedStore, error) {
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("a sharded store needs at least one directory")
+	}
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if seen[dir] {
+			return nil, fmt.Errorf("directory %s is given for more than one shard", dir)
+		}
+		seen[dir] = true
+	}
+
+	store := &ShardedStore{}
+	for i, dir := range dirs {
+		shard, err := NewKeyValueStore(filepath.Join(dir, "wal.log"), dir, options)
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("error opening shard %d: %w", i, err)
+		}
+		store.shards = append(store.shards, shard)
+
+		for v := 0; v < shardVirtualNodes; v++ {
+			store.ring = append(store.ring, ringPoint{hash: ringHash(fmt.Sprintf("shard-%d-%d", i, v)), shard: i})
+		}
+	}
+	sort.Slice(store.ring, func(i, j int) bool { return store.ring[i].hash < store.ring[j].hash })
+	store.compare = store.shards[0].compare
+
+	return store, nil
+}
+
+// ringHash returns the position of a key or shard point on the hash ring.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	// FNV barely changes the high bits for keys that differ only in their
+	// last bytes, such as numbered keys, so mix them in (MurmurHash3's
+	// finalizer) before the hash is placed on the ring
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// shardIndex returns the index of the shard that owns the key.
+func (store *ShardedStore) shardIndex(key string) int {
+	hash := ringHash(key)
+	i := sort.Search(len(store.ring), func(i int) bool { return store.ring[i].hash >= hash })
+	if i == len(store.ring) {
+		i = 0 // Past the last point, the ring wraps around to the first
+	}
+	return store.ring[i].shard
+}
+
+// shard returns the shard that owns the key.
+func (store *ShardedStore) shard(key string) *KeyValueStore {
+	return store.shards[store.shardIndex(key)]
+}
+
+// Recover recovers every shard from its SSTables and WAL, in parallel.
+func (store *ShardedStore) Recover() error {
+	errs := make([]error, len(store.shards))
+	var wg sync.WaitGroup
+	for i, shard := range store.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = shard.Recover()
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("error recovering shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Get retrieves the value associated with the given key from its shard.
+func (store *ShardedStore) Get(key string) ([]byte, bool) {
+	return store.shard(key).Get(key)
+}
+
+// Set sets a key-value pair in the key's shard.
+func (store *ShardedStore) Set(key string, value []byte) error {
+	return store.shard(key).Set(key, value)
+}
+
+// Delete deletes the key from its shard, returning the value it held.
+func (store *ShardedStore) Delete(key string) ([]byte, bool, error) {
+	return store.shard(key).Delete(key)
+}
+
+// Scan returns the live key-value pairs with keys in [start, end) across all
+// shards, sorted by key. Each shard is scanned in parallel, and their
+// results, each already sorted, are merged. A key lives in a single shard,
+// so no key is returned twice.
+func (store *ShardedStore) Scan(start, end string) ([]KeyValue, error) {
+	results := make([][]KeyValue, len(store.shards))
+	errs := make([]error, len(store.shards))
+	var wg sync.WaitGroup
+	for i, shard := range store.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = shard.Scan(start, end)
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("error scanning shard %d: %w", i, err)
+		}
+		total += len(results[i])
+	}
+
+	// Repeatedly take the smallest key at the head of a shard's results
+	pairs := make([]KeyValue, 0, total)
+	for len(pairs) < total {
+		smallest := -1
+		for i, result := range results {
+			if len(result) > 0 && (smallest < 0 || store.compare(result[0].Key, results[smallest][0].Key) < 0) {
+				smallest = i
+			}
+		}
+		pairs = append(pairs, results[smallest][0])
+		results[smallest] = results[smallest][1:]
+	}
+
+	return pairs, nil
+}
+
+// Close closes every shard, returning the first error.
+func (store *ShardedStore) Close() error {
+	var firstErr error
+	for _, shard := range store.shards {
+		if err := shard.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Compaction settings. L0 holds the possibly overlapping SSTables written by
+// flushes. Each deeper level holds non-overlapping SSTables and may grow to
+// levelSizeMultiplier times the size of the level above it.
+const (
+	l0CompactionTrigger = 4        // L0 tables that trigger an L0->L1 compaction
+	levelBaseBytes      = 10 << 20 // Size limit of L1
+	levelSizeMultiplier = 10
+	maxLevel            = 6
+	compactionFileBytes = 2 << 20 // Approximate size of SSTables written by compaction
+)
+
+// tableInfo describes a committed SSTable for picking compactions.
+type tableInfo struct {
+	ManifestEntry
+	path   string
+	size   int64
+	minKey string
+	maxKey string
+}
+
+// overlaps reports whether the table's key range intersects [minKey, maxKey]
+// in the order of compare.
+func (table tableInfo) overlaps(compare Comparator, minKey, maxKey string) bool {
+	return compare(table.minKey, maxKey) <= 0 && compare(table.maxKey, minKey) >= 0
+}
+
+// loadTableInfo reads the size and key range of a committed SSTable.
+func (kv *KeyValueStore) loadTableInfo(entry ManifestEntry) (tableInfo, error) {
+	table := tableInfo{ManifestEntry: entry, path: filepath.Join(kv.dataDir, entry.File)}
+
+	file, err := os.Open(table.path)
+	if err != nil {
+		return table, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return table, err
+	}
+	table.size = fileInfo.Size()
+
+	header, err := readSSTableHeader(file)
+	if err != nil {
+		return table, fmt.Errorf("error reading SST file %s: %w", table.path, err)
+	}
+	if header.entryCount > 0 {
+		table.minKey, table.maxKey, err = readKeyRange(file, header)
+		if err != nil {
+			return table, fmt.Errorf("error reading key range from SST file %s: %w", table.path, err)
+		}
+	}
+
+	return table, nil
+}
+
+// compact runs compactions in the background until no level needs one.
+func (kv *KeyValueStore) compact() {
+	defer func() {
+		kv.mu.Lock()
+		kv.compacting = false
+		kv.flushDone.Broadcast()
+		kv.mu.Unlock()
+	}()
+
+	for {
+		inputs, outputLevel, err := kv.pickCompaction()
+		if err != nil {
+			kv.logger.Error("error picking compaction", "err", err)
+			return
+		}
+		if inputs == nil {
+			if err := kv.enforceRetention(); err != nil {
+				kv.logger.Error("error enforcing SSTable retention", "err", err)
+			}
+			if err := kv.enforceTombstoneRatio(); err != nil {
+				kv.logger.Error("error compacting tombstones", "err", err)
+			}
+			return
+		}
+
+		if _, err := kv.compactTables(inputs, outputLevel); err != nil {
+			kv.logger.Error("error compacting SSTables", "err", err)
+			return
+		}
+	}
+}
+
+// pickCompaction chooses the next compaction and returns its input tables
+// and output level, or nil if no level needs one. L0 is compacted, together
+// with the L1 tables it overlaps, once it holds l0CompactionTrigger tables.
+// A deeper level is compacted once it outgrows its size limit, by merging
+// its oldest table into the tables it overlaps in the next level.
+func (kv *KeyValueStore) pickCompaction() ([]tableInfo, int, error) {
+	kv.mu.RLock()
+	entries := make([]ManifestEntry, len(kv.manifest.Tables))
+	copy(entries, kv.manifest.Tables)
+	kv.mu.RUnlock()
+
+	// Group the tables by level
+	levels := make(map[int][]tableInfo)
+	for _, entry := range entries {
+		table, err := kv.loadTableInfo(entry)
+		if err != nil {
+			return nil, 0, err
+		}
+		levels[entry.Level] = append(levels[entry.Level], table)
+	}
+
+	// overlapping returns the tables of a level that intersect the key range
+	overlapping := func(level int, minKey, maxKey string) []tableInfo {
+		var tables []tableInfo
+		for _, table := range levels[level] {
+			if table.overlaps(kv.compare, minKey, maxKey) {
+				tables = append(tables, table)
+			}
+		}
+		return tables
+	}
+
+	if len(levels[0]) >= l0CompactionTrigger {
+		inputs := levels[0]
+		minKey, maxKey := inputs[0].minKey, inputs[0].maxKey
+		for _, table := range inputs[1:] {
+			if kv.compare(table.minKey, minKey) < 0 {
+				minKey = table.minKey
+			}
+			if kv.compare(table.maxKey, maxKey) > 0 {
+				maxKey = table.maxKey
+			}
+		}
+		return append(inputs, overlapping(1, minKey, maxKey)...), 1, nil
+	}
+
+	limit := int64(levelBaseBytes)
+	for level := 1; level < maxLevel; level++ {
+		var size int64
+		var oldest *tableInfo
+		for i, table := range levels[level] {
+			size += table.size
+			if oldest == nil || table.Seq < oldest.Seq {
+				oldest = &levels[level][i]
+			}
+		}
+		if size > limit {
+			inputs := []tableInfo{*oldest}
+			return append(inputs, overlapping(level+1, oldest.minKey, oldest.maxKey)...), level + 1, nil
+		}
+		limit *= levelSizeMultiplier
+	}
+
+	return nil, 0, nil
+}
+
+// loadTables reads the size and key range of every committed SSTable and
+// returns them from most recent to oldest, the order of sstableFiles.
+func (kv *KeyValueStore) loadTables() ([]tableInfo, error) {
+	kv.mu.RLock()
+	entries := make([]ManifestEntry, len(kv.manifest.Tables))
+	copy(entries, kv.manifest.Tables)
+	kv.mu.RUnlock()
+	sortNewestFirst(entries)
+
+	tables := make([]tableInfo, 0, len(entries))
+	for _, entry := range entries {
+		table, err := kv.loadTableInfo(entry)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// overRetention reports whether the tables exceed MaxTables or
+// MaxTableBytes, and have outgrown what the last enforcement left.
+func (kv *KeyValueStore) overRetention(tables []tableInfo) bool {
+	var size int64
+	for _, table := range tables {
+		size += table.size
+	}
+
+	maxTables, maxBytes := kv.options.MaxTables, kv.options.MaxTableBytes
+	return (maxTables > 0 && len(tables) > maxTables && len(tables) > kv.retainedTables) ||
+		(maxBytes > 0 && size > maxBytes && size > kv.retainedBytes)
+}
+
+// enforceRetention brings the SSTables within MaxTables and MaxTableBytes:
+// it first removes the superseded tables, which costs only reads, and if
+// the rest still exceed a limit, merges them all into the deepest level in
+// use. The caller must have set compacting.
+func (kv *KeyValueStore) enforceRetention() error {
+	tables, err := kv.loadTables()
+	if err != nil {
+		return err
+	}
+	if !kv.overRetention(tables) {
+		return nil
+	}
+
+	if tables, err = kv.pruneSuperseded(tables); err != nil {
+		return err
+	}
+	if kv.overRetention(tables) {
+		outputLevel := 1
+		for _, table := range tables {
+			if table.Level > outputLevel {
+				outputLevel = table.Level
+			}
+		}
+		result, err := kv.compactTables(tables, outputLevel)
+		if err != nil {
+			return err
+		}
+		kv.logger.Info("compacted SSTables over the retention limits", "files_merged", result.FilesMerged, "files_written", result.FilesWritten)
+
+		if tables, err = kv.loadTables(); err != nil {
+			return err
+		}
+	}
+
+	// Wait for the tables to outgrow what is left before enforcing again
+	kv.retainedTables, kv.retainedBytes = len(tables), 0
+	for _, table := range tables {
+		kv.retainedBytes += table.size
+	}
+	return nil
+}
+
+// countTombstones returns the number of tombstones in the tables and the
+// fraction of their entries they make up, from the counts recorded in the
+// manifest.
+func countTombstones(tables []tableInfo) (int, float64) {
+	entries, tombstones := 0, 0
+	for _, table := range tables {
+		entries += table.Entries
+		tombstones += table.Tombstones
+	}
+	if entries == 0 {
+		return 0, 0
+	}
+	return tombstones, float64(tombstones) / float64(entries)
+}
+
+// enforceTombstoneRatio merges every SSTable into the deepest level in use,
+// dropping the tombstones that no longer hide anything, once tombstones make
+// up more than TombstoneRatio of the entries and outnumber what the last
+// such merge left. The caller must have set compacting.
+func (kv *KeyValueStore) enforceTombstoneRatio() error {
+	if kv.options.TombstoneRatio <= 0 {
+		return nil
+	}
+	tables, err := kv.loadTables()
+	if err != nil {
+		return err
+	}
+	tombstones, ratio := countTombstones(tables)
+	if ratio <= kv.options.TombstoneRatio || tombstones <= kv.retainedTombstones {
+		return nil
+	}
+
+	outputLevel := 1
+	for _, table := range tables {
+		if table.Level > outputLevel {
+			outputLevel = table.Level
+		}
+	}
+	result, err := kv.compactTables(tables, outputLevel)
+	if err != nil {
+		return err
+	}
+	kv.logger.Info("compacted SSTables over the tombstone ratio", "tombstones", tombstones, "ratio", ratio, "tombstones_dropped", result.TombstonesDropped)
+
+	// Wait for more tombstones than the merge kept before merging again
+	if tables, err = kv.loadTables(); err != nil {
+		return err
+	}
+	kv.retainedTombstones, _ = countTombstones(tables)
+	return nil
+}
+
+// pruneSuperseded removes the tables, given from most recent to oldest,
+// whose every entry is shadowed by an entry for the same key in a newer
+// table that is kept. Reads never reach such a table, so it holds no data
+// of its own. It returns the tables that are kept.
+func (kv *KeyValueStore) pruneSuperseded(tables []tableInfo) ([]tableInfo, error) {
+	var kept []tableInfo
+	var prunedFiles []string
+	var pruned []tableInfo
+	for _, table := range tables {
+		superseded, err := kv.superseded(table, kept)
+		if err != nil {
+			return nil, err
+		}
+		if superseded {
+			prunedFiles = append(prunedFiles, table.File)
+			pruned = append(pruned, table)
+		} else {
+			kept = append(kept, table)
+		}
+	}
+	if len(pruned) == 0 {
+		return kept, nil
+	}
+
+	kv.mu.Lock()
+	err := kv.manifest.replace(kv.dataDir, prunedFiles, nil)
+	kv.pruneTableIndexes()
+	kv.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	kv.logger.Info("pruned superseded SSTables", "files", len(pruned))
+
+	// The pruned tables are no longer read
+	for _, table := range pruned {
+		if err := kv.files.remove(table.path); err != nil {
+			kv.logger.Error("error removing superseded SST file", "file", table.path, "err", err)
+		}
+	}
+
+	return kept, nil
+}
+
+// superseded reports whether every entry of the table, value or tombstone,
+// has a newer entry for its key in one of the newer tables. A newer table
+// that can't be read is treated as not holding the key, so the table is
+// kept.
+func (kv *KeyValueStore) superseded(table tableInfo, newer []tableInfo) (bool, error) {
+	source, err := kv.openSSTableSource(table.path, "", "")
+	if err != nil {
+		return false, err
+	}
+	if source == nil {
+		return true, nil // An empty table holds nothing
+	}
+	it := mergeSources([]*iteratorSource{source}, kv.compare)
+	defer it.Close()
+
+	for {
+		entry, ok := it.nextEntry()
+		if !ok {
+			break
+		}
+
+		shadowed := false
+		for _, newerTable := range newer {
+			if !newerTable.overlaps(kv.compare, entry.key, entry.key) {
+				continue
+			}
+			_, _, state, err := kv.searchSSTFile(context.Background(), entry.key, newerTable.path)
+			if err != nil && !errors.Is(err, ErrUnreadableSSTable) {
+				return false, err
+			}
+			if state != entryAbsent {
+				shadowed = true
+				break
+			}
+		}
+		if !shadowed {
+			return false, nil
+		}
+	}
+
+	return true, it.Err()
+}
+
+// CompactionResult summarizes a compaction.
+type CompactionResult struct {
+	FilesMerged       int   `json:"files_merged"`
+	FilesWritten      int   `json:"files_written"`
+	BytesReclaimed    int64 `json:"bytes_reclaimed"`
+	TombstonesDropped int   `json:"tombstones_dropped"`
+}
+
+// Compact merges every SSTable into non-overlapping tables at the deepest
+// level in use, dropping overwritten values and, subject to
+// TombstoneGracePeriod, all tombstones, and returns a summary. It waits for
+// any background compaction to finish first. Reads and writes continue while
+// it runs; tables flushed meanwhile are left in L0.
+func (kv *KeyValueStore) Compact() (CompactionResult, error) {
+	if err := kv.checkWritable(); err != nil {
+		return CompactionResult{}, err
+	}
+
+	// Take over compaction from the background goroutine
+	kv.mu.Lock()
+	for kv.compacting {
+		kv.flushDone.Wait()
+	}
+	kv.compacting = true
+	entries := make([]ManifestEntry, len(kv.manifest.Tables))
+	copy(entries, kv.manifest.Tables)
+	kv.mu.Unlock()
+	defer func() {
+		kv.mu.Lock()
+		kv.compacting = false
+		kv.flushDone.Broadcast()
+		kv.mu.Unlock()
+	}()
+
+	if len(entries) == 0 {
+		return CompactionResult{}, nil
+	}
+	inputs := make([]tableInfo, 0, len(entries))
+	outputLevel := 1
+	for _, entry := range entries {
+		table, err := kv.loadTableInfo(entry)
+		if err != nil {
+			return CompactionResult{}, err
+		}
+		inputs = append(inputs, table)
+		if entry.Level > outputLevel {
+			outputLevel = entry.Level
+		}
+	}
+
+	return kv.compactTables(inputs, outputLevel)
+}
+
+// compactTables merges the input tables into new non-overlapping tables of
+// about compactionFileBytes each at the output level, keeping only the newest
+// version of each key and dropping tombstones that no longer hide anything,
+// and swaps them for the inputs in the manifest. The
+// merge runs without the store lock; the inputs are never modified, and
+// only the background compaction removes tables.
+func (kv *KeyValueStore) compactTables(inputs []tableInfo, outputLevel int) (CompactionResult, error) {
+	result := CompactionResult{FilesMerged: len(inputs)}
+	for _, input := range inputs {
+		result.BytesReclaimed += input.size
+	}
+
+	// Open the inputs newest first, so the merge keeps the newest versions
+	entries := make([]ManifestEntry, len(inputs))
+	for i, input := range inputs {
+		entries[i] = input.ManifestEntry
+	}
+	sortNewestFirst(entries)
+
+	var sources []*iteratorSource
+	for _, entry := range entries {
+		source, err := kv.openSSTableSource(filepath.Join(kv.dataDir, entry.File), "", "")
+		if err != nil {
+			for _, source := range sources {
+				source.close()
+			}
+			return CompactionResult{}, err
+		}
+		if source != nil {
+			sources = append(sources, source)
+		}
+	}
+	it := mergeSources(sources, kv.compare)
+	defer it.Close()
+
+	// Tables below the output level may hold older versions of the keys.
+	// Only compactions move tables down, so they don't change while this
+	// one runs.
+	kv.mu.RLock()
+	var deeperEntries []ManifestEntry
+	for _, entry := range kv.manifest.Tables {
+		if entry.Level > outputLevel {
+			deeperEntries = append(deeperEntries, entry)
+		}
+	}
+	kv.mu.RUnlock()
+	var deeper []tableInfo
+	for _, entry := range deeperEntries {
+		table, err := kv.loadTableInfo(entry)
+		if err != nil {
+			return CompactionResult{}, err
+		}
+		deeper = append(deeper, table)
+	}
+
+	// droppable reports whether a tombstone can be dropped: it must be
+	// older than the grace period, and no table below the output level may
+	// hold the key, or the older value would surface again
+	droppable := func(entry iteratorEntry) bool {
+		if time.Since(entry.written) < kv.options.TombstoneGracePeriod {
+			return false
+		}
+		for _, table := range deeper {
+			if table.overlaps(kv.compare, entry.key, entry.key) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var outputs []ManifestEntry
+	var outputFiles []string
+	removeOutputs := func() {
+		for _, outputFile := range outputFiles {
+			os.Remove(outputFile)
+		}
+	}
+
+	// Write the merged entries in key order, starting a new table whenever
+	// the current one is full, so the outputs don't overlap
+	newTable := func() *frozenMemtable {
+		return &frozenMemtable{
+			data:        newSkipList(kv.compare),
+			deletedKeys: make(map[string]bool),
+			valueTypes:  make(map[string]ValueType),
+			versions:    make(map[string]uint64),
+		}
+	}
+	table, tableBytes := newTable(), 0
+	writeTable := func() error {
+		kv.mu.Lock()
+		seq := kv.manifest.allocateSeq()
+		kv.mu.Unlock()
+
+		filename := filepath.Join(kv.dataDir, sstableFileName(seq))
+		outputFiles = append(outputFiles, filename)
+		if err := kv.writeSSTable(filename, seq, table); err != nil {
+			return err
+		}
+		if fileInfo, err := os.Stat(filename); err == nil {
+			result.BytesReclaimed -= fileInfo.Size()
+		}
+		outputs = append(outputs, ManifestEntry{
+			File:       filepath.Base(filename),
+			Seq:        seq,
+			Level:      outputLevel,
+			Entries:    table.data.len() + len(table.deletedKeys),
+			Tombstones: len(table.deletedKeys),
+		})
+
+		table, tableBytes = newTable(), 0
+		return nil
+	}
+
+	for {
+		entry, ok := it.nextEntry()
+		if !ok {
+			break
+		}
+
+		// Tombstones are kept while deeper levels may still hold the key
+		if entry.deleted {
+			if droppable(entry) {
+				result.TombstonesDropped++
+				continue
+			}
+			table.deletedKeys[entry.key] = true
+		} else {
+			table.data.put(entry.key, entry.value)
+			if entry.valueType != ValueBinary {
+				table.valueTypes[entry.key] = entry.valueType
+			}
+			if entry.version != 0 {
+				table.versions[entry.key] = entry.version
+			}
+		}
+		tableBytes += len(entry.key) + len(entry.value)
+
+		if tableBytes >= compactionFileBytes {
+			if err := writeTable(); err != nil {
+				removeOutputs()
+				return CompactionResult{}, err
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		removeOutputs()
+		return CompactionResult{}, err
+	}
+	if table.data.len() > 0 || len(table.deletedKeys) > 0 {
+		if err := writeTable(); err != nil {
+			removeOutputs()
+			return CompactionResult{}, err
+		}
+	}
+
+	// Swap the inputs for the outputs in the manifest
+	inputFiles := make([]string, len(inputs))
+	for i, input := range inputs {
+		inputFiles[i] = input.File
+	}
+	kv.mu.Lock()
+	err := kv.manifest.replace(kv.dataDir, inputFiles, outputs)
+	kv.pruneTableIndexes()
+	kv.mu.Unlock()
+	if err != nil {
+		removeOutputs()
+		return CompactionResult{}, err
+	}
+
+	result.FilesWritten = len(outputs)
+
+	// The inputs are no longer read
+	for _, input := range inputs {
+		if err := kv.files.remove(input.path); err != nil {
+			kv.logger.Error("error removing compacted SST file", "file", input.path, "err", err)
+		}
+	}
+
+	return result, nil
+}
+
+// snapshotMagic identifies a snapshot file written by Snapshot.
+const snapshotMagic = "SNAP"
+
+// Snapshot writes a consistent point-in-time dump of all live key-value
+// pairs to w. The dump holds the magic number, the pair count, and then each
+// key and value prefixed with its length.
+func (kv *KeyValueStore) Snapshot(w io.Writer) error {
+	// Scan reads a consistent view of the memtable and SSTables
+	pairs, err := kv.Scan("", "")
+	if err != nil {
+		return err
+	}
+
+	// Write magic number and pair count
+	if _, err := w.Write([]byte(snapshotMagic)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(pairs))); err != nil {
+		return err
+	}
+
+	// Write key-value pairs
+	for _, pair := range pairs {
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(pair.Key))); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(pair.Value))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, pair.Key); err != nil {
+			return err
+		}
+		if _, err := w.Write(pair.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Restore loads the key-value pairs from a dump written by Snapshot into the
+// store, through the WAL so they are durable. It is meant for a fresh store;
+// keys already in the store are overwritten by the dump's values.
+func (kv *KeyValueStore) Restore(r io.Reader) error {
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
+
+	// Read magic number
+	magicNumber := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magicNumber); err != nil {
+		return fmt.Errorf("error reading snapshot magic number: %w", err)
+	}
+	if string(magicNumber) != snapshotMagic {
+		return fmt.Errorf("invalid snapshot format")
+	}
+
+	// Read pair count
+	var pairCount uint64
+	if err := binary.Read(r, binary.LittleEndian, &pairCount); err != nil {
+		return fmt.Errorf("error reading snapshot pair count: %w", err)
+	}
+
+	if err := kv.lockWrite(); err != nil {
+		return err
+	}
+	defer kv.commitWAL()
+	defer kv.mu.Unlock()
+
+	// Read and store key-value pairs
+	for i := uint64(0); i < pairCount; i++ {
+		var keyLength, valueLength uint32
+		if err := binary.Read(r, binary.LittleEndian, &keyLength); err != nil {
+			return fmt.Errorf("error reading snapshot key length: %w", err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &valueLength); err != nil {
+			return fmt.Errorf("error reading snapshot value length: %w", err)
+		}
+
+		keyBytes := make([]byte, keyLength)
+		if _, err := io.ReadFull(r, keyBytes); err != nil {
+			return fmt.Errorf("error reading snapshot key: %w", err)
+		}
+		value := make([]byte, valueLength)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return fmt.Errorf("error reading snapshot value: %w", err)
+		}
+
+		if err := kv.set(string(keyBytes), value, ValueBinary); err != nil {
+			return err
+		}
+		if err := kv.flushIfFull(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histogram
+// buckets exposed on /metrics.
+var latencyBuckets = [...]float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// histogram counts operation latencies in latencyBuckets. The zero value is
+// ready to use.
+type histogram struct {
+	buckets  [len(latencyBuckets) + 1]atomic.Uint64 // Per-bucket counts; the last is +Inf
+	count    atomic.Uint64
+	sumNanos atomic.Uint64
+}
+
+// observe records the time elapsed since start.
+func (h *histogram) observe(start time.Time) {
+	elapsed := time.Since(start)
+	h.buckets[sort.SearchFloat64s(latencyBuckets[:], elapsed.Seconds())].Add(1)
+	h.count.Add(1)
+	h.sumNanos.Add(uint64(elapsed))
+}
+
+// storeMetrics counts store operations for the /metrics endpoint. The number
+// of each operation is the count of its latency histogram.
+type storeMetrics struct {
+	set          histogram
+	get          histogram
+	delete       histogram
+	flush        histogram
+	cacheHits    atomic.Uint64
+	cacheMisses  atomic.Uint64
+	sstableReads atomic.Uint64 // SST files opened by point lookups
+}
 
-        // Write key
-        if _, err := sstableFile.Write([]byte(key)); err != nil {
-            return err
-        }
+// WriteMetrics writes the store's metrics to w in the Prometheus text
+// exposition format.
+func (kv *KeyValueStore) WriteMetrics(w io.Writer) error {
+	m := &kv.metrics
+	operations := []struct {
+		name      string
+		histogram *histogram
+	}{
+		{"set", &m.set},
+		{"get", &m.get},
+		{"delete", &m.delete},
+		{"flush", &m.flush},
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "# HELP kv_operations_total Number of store operations by type.\n")
+	fmt.Fprintf(&buf, "# TYPE kv_operations_total counter\n")
+	for _, op := range operations {
+		fmt.Fprintf(&buf, "kv_operations_total{op=%q} %d\n", op.name, op.histogram.count.Load())
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"kv_cache_hits_total", "Number of SSTable lookups served by the cache.", m.cacheHits.Load()},
+		{"kv_cache_misses_total", "Number of SSTable lookups not found in the cache.", m.cacheMisses.Load()},
+		{"kv_sstable_reads_total", "Number of SST files read by point lookups.", m.sstableReads.Load()},
+		{"kv_flushes_total", "Number of memtable flushes to SSTables.", m.flush.count.Load()},
+	}
+	for _, counter := range counters {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", counter.name, counter.help)
+		fmt.Fprintf(&buf, "# TYPE %s counter\n", counter.name)
+		fmt.Fprintf(&buf, "%s %d\n", counter.name, counter.value)
+	}
+
+	fmt.Fprintf(&buf, "# HELP kv_operation_duration_seconds Latency of store operations by type.\n")
+	fmt.Fprintf(&buf, "# TYPE kv_operation_duration_seconds histogram\n")
+	for _, op := range operations {
+		// Prometheus buckets are cumulative
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += op.histogram.buckets[i].Load()
+			fmt.Fprintf(&buf, "kv_operation_duration_seconds_bucket{op=%q,le=%q} %d\n", op.name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		cumulative += op.histogram.buckets[len(latencyBuckets)].Load()
+		fmt.Fprintf(&buf, "kv_operation_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op.name, cumulative)
+		fmt.Fprintf(&buf, "kv_operation_duration_seconds_sum{op=%q} %g\n", op.name, time.Duration(op.histogram.sumNanos.Load()).Seconds())
+		fmt.Fprintf(&buf, "kv_operation_duration_seconds_count{op=%q} %d\n", op.name, op.histogram.count.Load())
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// exportRecord is one line of an export. Values are base64-encoded by
+// encoding/json, so binary values survive.
+type exportRecord struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// importBatchSize is the number of records Import commits at a time.
+const importBatchSize = 1000
+
+// Export streams all live key-value pairs to w as newline-delimited JSON in
+// key order, reading a consistent view of the store through an iterator, and
+// returns the number of pairs written.
+func (kv *KeyValueStore) Export(w io.Writer) (int, error) {
+	it := kv.NewIterator("", "")
+	defer it.Close()
+
+	encoder := json.NewEncoder(w)
+	exported := 0
+	for it.Next() {
+		if err := encoder.Encode(exportRecord{Key: it.Key(), Value: it.Value()}); err != nil {
+			return exported, err
+		}
+		exported++
+	}
+
+	return exported, it.Err()
+}
+
+// Import reads newline-delimited JSON in the format written by Export and
+// stores every pair, committing them in batches of importBatchSize. It
+// returns the number of pairs imported.
+func (kv *KeyValueStore) Import(r io.Reader) (int, error) {
+	decoder := json.NewDecoder(r)
+	return kv.importRecords(func() (exportRecord, error) {
+		var record exportRecord
+		err := decoder.Decode(&record)
+		return record, err
+	})
+}
+
+// binaryExportMagic identifies an export written by ExportBinary.
+const binaryExportMagic = "KVBX"
+
+// ExportBinary streams all live key-value pairs to w in key order like
+// Export, but in a length-prefixed binary format that keeps any bytes in
+// keys and values, including newlines, nulls, and invalid UTF-8, which
+// JSON strings can't hold. The export holds the magic number and then each
+// key and value prefixed with its length, up to the end of the stream. It
+// returns the number of pairs written.
+func (kv *KeyValueStore) ExportBinary(w io.Writer) (int, error) {
+	it := kv.NewIterator("", "")
+	defer it.Close()
+
+	if _, err := io.WriteString(w, binaryExportMagic); err != nil {
+		return 0, err
+	}
+
+	exported := 0
+	for it.Next() {
+		key, value := it.Key(), it.Value()
+		if err := binary.Write(w, binary.LittleEndian, [2]uint32{uint32(len(key)), uint32(len(value))}); err != nil {
+			return exported, err
+		}
+		if _, err := io.WriteString(w, key); err != nil {
+			return exported, err
+		}
+		if _, err := w.Write(value); err != nil {
+			return exported, err
+		}
+		exported++
+	}
+
+	return exported, it.Err()
+}
+
+// ImportBinary reads an export written by ExportBinary and stores every
+// pair, committing them in batches of importBatchSize like Import. It
+// returns the number of pairs imported.
+func (kv *KeyValueStore) ImportBinary(r io.Reader) (int, error) {
+	magic := make([]byte, len(binaryExportMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return 0, fmt.Errorf("error reading binary export magic number: %w", err)
+	}
+	if string(magic) != binaryExportMagic {
+		return 0, fmt.Errorf("invalid binary export format")
+	}
+
+	return kv.importRecords(func() (exportRecord, error) {
+		var record exportRecord
+		var lengths [2]uint32
+		if err := binary.Read(r, binary.LittleEndian, &lengths); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return record, fmt.Errorf("truncated record header: %w", err)
+			}
+			return record, err // io.EOF ends the export
+		}
+
+		// Check the lengths before allocating, so a corrupt export can't
+		// ask for gigabytes
+		if int64(lengths[0]) > int64(kv.options.MaxKeySize) {
+			return record, fmt.Errorf("%w: %d > %d bytes", ErrKeyTooLarge, lengths[0], kv.options.MaxKeySize)
+		}
+		if int64(lengths[1]) > int64(kv.options.MaxValueSize) {
+			return record, fmt.Errorf("%w: %d > %d bytes", ErrValueTooLarge, lengths[1], kv.options.MaxValueSize)
+		}
+
+		key := make([]byte, lengths[0])
+		record.Value = make([]byte, lengths[1])
+		if _, err := io.ReadFull(r, key); err != nil {
+			return record, fmt.Errorf("error reading key: %w", noEOF(err))
+		}
+		if _, err := io.ReadFull(r, record.Value); err != nil {
+			return record, fmt.Errorf("error reading value: %w", noEOF(err))
+		}
+		record.Key = string(key)
+		return record, nil
+	})
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for reads in the middle of a
+// record.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// importRecords stores the records returned by next until it returns
+// io.EOF, committing them in batches of importBatchSize, and returns the
+// number of pairs imported.
+func (kv *KeyValueStore) importRecords(next func() (exportRecord, error)) (int, error) {
+	imported := 0
+
+	batch := kv.NewWriteBatch()
+	staged := 0
+	for {
+		record, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			batch.Close()
+			return imported, fmt.Errorf("error decoding record %d: %w", imported+staged+1, err)
+		}
+
+		if err := batch.Set(record.Key, record.Value); err != nil {
+			batch.Close()
+			return imported, fmt.Errorf("error importing key %q: %w", record.Key, err)
+		}
+		staged++
+
+		if staged == importBatchSize {
+			if err := batch.Commit(); err != nil {
+				return imported, err
+			}
+			imported += staged
+			batch, staged = kv.NewWriteBatch(), 0
+		}
+	}
+
+	if err := batch.Commit(); err != nil {
+		return imported, err
+	}
+	imported += staged
+
+	return imported, nil
+}
+
+// IngestSorted bulk-loads key-value pairs in the newline-delimited JSON
+// format written by Export straight into new L0 SSTables, bypassing the WAL
+// and the memtable, and returns the number of pairs ingested. The keys must
+// be in strictly ascending order. The memtable is flushed first, so the
+// ingested pairs replace any earlier values of their keys; writes made while
+// the ingestion runs may or may not be overwritten by it. The tables are
+// registered in the manifest only once all of them are written, so a failed
+// ingestion leaves the store unchanged. An in-memory store returns
+// ErrInMemoryOnly.
+func (kv *KeyValueStore) IngestSorted(r io.Reader) (int, error) {
+	if err := kv.checkWritable(); err != nil {
+		return 0, err
+	}
+	if kv.options.InMemoryOnly {
+		return 0, ErrInMemoryOnly
+	}
+
+	// Flush the memtable, so the ingested tables are newer than every
+	// earlier write
+	kv.mu.Lock()
+	err := kv.flush()
+	kv.waitForFlush()
+	kv.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	var outputs []ManifestEntry
+	var outputFiles []string
+	removeOutputs := func() {
+		for _, outputFile := range outputFiles {
+			os.Remove(outputFile)
+		}
+	}
+
+	newTable := func() *frozenMemtable {
+		return &frozenMemtable{
+			data:        newSkipList(kv.compare),
+			deletedKeys: make(map[string]bool),
+			valueTypes:  make(map[string]ValueType),
+		}
+	}
+	table, tableBytes := newTable(), 0
+	writeTable := func() error {
+		kv.mu.Lock()
+		seq := kv.manifest.allocateSeq()
+		kv.mu.Unlock()
+
+		filename := filepath.Join(kv.dataDir, sstableFileName(seq))
+		outputFiles = append(outputFiles, filename)
+		if err := kv.writeSSTable(filename, seq, table); err != nil {
+			return err
+		}
+		outputs = append(outputs, ManifestEntry{
+			File:       filepath.Base(filename),
+			Seq:        seq,
+			Entries:    table.data.len() + len(table.deletedKeys),
+			Tombstones: len(table.deletedKeys),
+		})
+
+		table, tableBytes = newTable(), 0
+		return nil
+	}
+
+	decoder := json.NewDecoder(r)
+	ingested := 0
+	previousKey := ""
+	for {
+		var record exportRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			removeOutputs()
+			return 0, fmt.Errorf("error decoding record %d: %w", ingested+1, err)
+		}
+
+		if err := kv.validate(record.Key, record.Value); err != nil {
+			removeOutputs()
+			return 0, fmt.Errorf("error ingesting key %q: %w", record.Key, err)
+		}
+		if ingested > 0 && kv.compare(record.Key, previousKey) <= 0 {
+			removeOutputs()
+			return 0, fmt.Errorf("key %q is not after %q: input must be sorted", record.Key, previousKey)
+		}
+		previousKey = record.Key
+
+		table.data.put(record.Key, record.Value)
+		tableBytes += len(record.Key) + len(record.Value)
+		ingested++
+
+		// Split the input into tables of about compactionFileBytes each;
+		// since it is sorted, they don't overlap
+		if tableBytes >= compactionFileBytes {
+			if err := writeTable(); err != nil {
+				removeOutputs()
+				return 0, err
+			}
+		}
+	}
+	if table.data.len() > 0 {
+		if err := writeTable(); err != nil {
+			removeOutputs()
+			return 0, err
+		}
+	}
+	if len(outputs) == 0 {
+		return 0, nil
+	}
+
+	// Register all the tables at once
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if err := kv.manifest.replace(kv.dataDir, nil, outputs); err != nil {
+		removeOutputs()
+		return 0, err
+	}
+	kv.pruneTableIndexes()
+
+	// Cached lookups, including misses, may be stale now
+	kv.cache.clear()
+
+	// The new L0 tables may trigger a compaction
+	if !kv.compacting {
+		kv.compacting = true
+		go kv.compact()
+	}
+
+	return ingested, nil
+}
+
+// StoreStats holds a point-in-time view of the store's metrics.
+type StoreStats struct {
+	MemtableKeys      int    `json:"memtable_keys"`
+	MemtableBytes     int64  `json:"memtable_bytes"`
+	PendingFlushes    int    `json:"pending_flushes"`
+	Tombstones        int    `json:"tombstones"`
+	SSTableFiles      int    `json:"sstable_files"`
+	SSTableTombstones int    `json:"sstable_tombstones"` // As recorded in the manifest
+	SSTableBytes      int64  `json:"sstable_bytes"`
+	WALBytes          int64  `json:"wal_bytes"`
+	WALSequence       uint64 `json:"wal_sequence"`
+}
+
+// Stats collects metrics about the memtable, SSTables, and WAL.
+func (kv *KeyValueStore) Stats() (StoreStats, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	stats := StoreStats{
+		MemtableKeys:   kv.data.len(),
+		MemtableBytes:  kv.memtableBytes,
+		PendingFlushes: len(kv.flushing),
+	}
+
+	// Count only tombstones that are still active
+	for _, deleted := range kv.DeletedKeys {
+		if deleted {
+			stats.Tombstones++
+		}
+	}
+
+	// Get the list of committed SST files
+	files, err := kv.sstableFiles()
+	if err != nil {
+		return stats, err
+	}
+	stats.SSTableFiles = len(files)
+	for _, table := range kv.manifest.Tables {
+		stats.SSTableTombstones += table.Tombstones
+	}
+	for _, sstFile := range files {
+		fileInfo, err := os.Stat(sstFile)
+		if err != nil {
+			return stats, err
+		}
+		stats.SSTableBytes += fileInfo.Size()
+	}
+
+	// Get the current WAL size across all segments
+	if stats.WALBytes, err = kv.walBytes(); err != nil {
+		return stats, err
+	}
+	stats.WALSequence = kv.LastSequence()
+
+	return stats, nil
+}
+
+// fileInfoModTime returns the modification time of a file.
+func fileInfoModTime(filename string) time.Time {
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		log.Printf("Error getting file info for %s: %v\n", filename, err)
+		return time.Time{}
+	}
+	return fileInfo.ModTime()
+}
+
+// handleGet handles the GET request for retrieving a key's value.
+func handleGet(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		encoding := r.URL.Query().Get("encoding")
+		if encoding != "" && encoding != "base64" {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Unsupported encoding: %s", encoding))
+			return
+		}
+
+		// Serve the value itself, with its content type, if asked to
+		if r.URL.Query().Get("raw") != "" {
+			serveValueStream(kv, w, r, key)
+			return
+		}
+
+		versioned, err := kv.GetVersionContext(r.Context(), key)
+		if err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, fmt.Sprintf("Error getting key: %v", err))
+			return
+		}
+
+		// Report which layer served the read
+		if versioned == nil {
+			w.Header().Set("X-Source", SourceNotFound.String())
+			writeError(w, r, http.StatusNotFound, "Key not found")
+			return
+		}
+		w.Header().Set("X-Source", versioned.Source.String())
+
+		// Tag the value with its version, so a caching client can send it
+		// back in If-None-Match and be told its copy is still current
+		if versioned.Version != 0 {
+			w.Header().Set("ETag", versionETag(versioned.Version))
+			if etagMatches(r.Header.Get("If-None-Match"), versioned.Version) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		// Base64-encode the value if asked to, so binary values survive
+		// being embedded in text
+		value := versioned.Value
+		noteAccess(r, key, int64(len(value)))
+		response := map[string]string{"key": key, "value": string(value), "content_type": versioned.ContentType}
+		if encoding == "base64" {
+			response["value"] = base64.StdEncoding.EncodeToString(value)
+			response["encoding"] = encoding
+		}
+
+		writeResponse(w, r, http.StatusOK, fmt.Sprintf("Value: %s\n", response["value"]), response)
+	}
+}
+
+// versionETag returns the ETag of a value with the given version.
+func versionETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header names the version,
+// as its ETag, weak or strong, or as the bare number, or is "*".
+func etagMatches(header string, version uint64) bool {
+	if header == "" {
+		return false
+	}
+	want := strconv.FormatUint(version, 10)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || strings.Trim(tag, `"`) == want {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMultiGet handles the POST request for the values of many keys, given
+// as a JSON array. It responds with an object mapping the keys that exist to
+// their values.
+func handleMultiGet(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		if !decodeJSONBody(w, r, &keys) {
+			return
+		}
+
+		values, err := kv.MultiGetContext(r.Context(), keys)
+		if err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, fmt.Sprintf("Error getting keys: %v", err))
+			return
+		}
+
+		response := make(map[string]string, len(values))
+		for key, value := range values {
+			response[key] = string(value)
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// handleGetMany handles the POST request for the values of many keys, given
+// as a JSON array, like handleMultiGet, but also lists the keys that don't
+// exist, in the order they were asked for.
+func handleGetMany(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		if !decodeJSONBody(w, r, &keys) {
+			return
+		}
+
+		values, err := kv.MultiGetContext(r.Context(), keys)
+		if err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, fmt.Sprintf("Error getting keys: %v", err))
+			return
+		}
+
+		found := make(map[string]string, len(values))
+		for key, value := range values {
+			found[key] = string(value)
+		}
+		missing := []string{}
+		listed := make(map[string]bool)
+		for _, key := range keys {
+			if _, ok := values[key]; !ok && !listed[key] {
+				missing = append(missing, key)
+				listed[key] = true
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"found": found, "missing": missing})
+	}
+}
+
+// handleScan handles the GET request for listing the pairs in a key range.
+// With a limit, it returns one page of pairs and the start of the next.
+func handleScan(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := r.URL.Query().Get("start")
+		end := r.URL.Query().Get("end")
+
+		if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+			limit, err := strconv.Atoi(limitParam)
+			if err != nil || limit <= 0 {
+				writeError(w, r, http.StatusBadRequest, "Limit must be a positive integer")
+				return
+			}
+
+			pairs, next, err := kv.ScanPage(r.Context(), start, end, limit)
+			if err != nil {
+				writeError(w, r, http.StatusServiceUnavailable, fmt.Sprintf("Error scanning keys: %v", err))
+				return
+			}
+
+			response := map[string]interface{}{"pairs": pairsJSON(pairs)}
+			if next != "" {
+				response["next"] = next
+			}
+			writeJSON(w, http.StatusOK, response)
+			return
+		}
+
+		pairs, err := kv.ScanContext(r.Context(), start, end)
+		if err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, fmt.Sprintf("Error scanning keys: %v", err))
+			return
+		}
+
+		writePairs(w, pairs)
+	}
+}
+
+// handleKeys handles the GET request for listing the live keys in a key
+// range, without their values.
+func handleKeys(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := kv.KeysContext(r.Context(), r.URL.Query().Get("start"), r.URL.Query().Get("end"))
+		if err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, fmt.Sprintf("Error listing keys: %v", err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, keys)
+	}
+}
+
+// handleScanPrefix handles the request for listing the pairs whose keys
+// start with a prefix.
+func handleScanPrefix(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+
+		pairs, err := kv.ScanPrefixContext(r.Context(), prefix)
+		if err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, fmt.Sprintf("Error scanning keys: %v", err))
+			return
+		}
+
+		writePairs(w, pairs)
+	}
+}
+
+// writePairs writes scanned pairs as a JSON array of string keys and values.
+func writePairs(w http.ResponseWriter, pairs []KeyValue) {
+	writeJSON(w, http.StatusOK, pairsJSON(pairs))
+}
+
+// pairsJSON converts scanned pairs to the string keys and values written by
+// writePairs.
+func pairsJSON(pairs []KeyValue) []map[string]string {
+	response := make([]map[string]string, 0, len(pairs))
+	for _, pair := range pairs {
+		response = append(response, map[string]string{"key": pair.Key, "value": string(pair.Value)})
+	}
+	return response
+}
+
+// handleDelete handles the DELETE request for deleting a key.
+func handleDelete(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+
+		// Tell a failed delete apart from a key that didn't exist
+		value, ok, err := kv.Delete(key)
+		if err != nil {
+			writeError(w, r, validationStatus(err), fmt.Sprintf("Error deleting key: %v", err))
+			return
+		}
+		if !ok {
+			writeError(w, r, http.StatusNotFound, "Key not found")
+			return
+		}
+
+		writeResponse(w, r, http.StatusOK, fmt.Sprintf("Deleted key: %s, Value: %s\n", key, value), map[string]string{"key": key, "value": string(value)})
+	}
+}
+
+// handleDeleteRange handles the request for deleting all keys in a range.
+func handleDeleteRange(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := r.URL.Query().Get("start")
+		end := r.URL.Query().Get("end")
+
+		deleted, err := kv.DeleteRange(start, end)
+		if err != nil {
+			writeError(w, r, validationStatus(err), fmt.Sprintf("Error deleting range: %v", err))
+			return
+		}
+
+		writeResponse(w, r, http.StatusOK, fmt.Sprintf("Deleted %d keys\n", deleted), map[string]int{"deleted": deleted})
+	}
+}
 
-        // Write value
-        if _, err := sstableFile.Write(value); err != nil {
-            return err
-        }
-    }
+// handleKVGet handles GET /kv/{key}, serving the value's exact bytes with
+// its content type.
+func handleKVGet(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := requestKey(r)
+		if err != nil {
+			writeError(w, r, validationStatus(err), err.Error())
+			return
+		}
+		serveValueStream(kv, w, r, key)
+	}
+}
 
-    return nil
+// requestKey returns the key named by a /kv/{key} request, in the bucket
+// named by a /b/{bucket}/kv/{key} request.
+func requestKey(r *http.Request) (string, error) {
+	key := r.PathValue("key")
+	if bucket := r.PathValue("bucket"); bucket != "" {
+		return bucketKey(bucket, key)
+	}
+	return key, nil
 }
 
-// writeToWAL writes a log entry to the Write-Ahead Log file.
-func (kv *KeyValueStore) writeToWAL(entry map[string]interface{}) {
-	// Convert the entry to JSON
-	entryJSON, err := json.Marshal(entry)
+// serveValueStream writes a value's exact bytes as the response body with
+// its content type, copying it from the store as it is read so large values
+// aren't held in memory.
+func serveValueStream(kv *KeyValueStore, w http.ResponseWriter, r *http.Request, key string) {
+	stream, err := kv.GetStreamContext(r.Context(), key)
 	if err != nil {
-		log.Printf("Error marshaling WAL entry: %v\n", err)
+		writeError(w, r, http.StatusServiceUnavailable, fmt.Sprintf("Error getting key: %v", err))
 		return
 	}
-
-	// Write the JSON entry followed by a newline to the WAL
-	if _, err := kv.wal.WriteString(string(entryJSON) + "\n"); err != nil {
-		log.Printf("Error writing to WAL: %v\n", err)
+	if stream == nil {
+		w.Header().Set("X-Source", SourceNotFound.String())
+		writeError(w, r, http.StatusNotFound, "Key not found")
+		return
 	}
+	defer stream.Close()
+	liftDeadlines(w)
+	noteAccess(r, key, stream.Size)
 
-	// Flush to ensure the entry is written to disk
-	if err := kv.wal.Sync(); err != nil {
-		log.Printf("Error syncing WAL: %v\n", err)
+	// Report which layer served the read
+	w.Header().Set("X-Source", stream.Source.String())
+	w.Header().Set("Content-Type", stream.ContentType)
+	if stream.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(stream.Size, 10))
+	}
+	if _, err := io.Copy(w, stream); err != nil {
+		// The status line has been sent, so all that can be done is to
+		// cut the response short
+		kv.logger.Error("error streaming value", "key", key, "err", err)
 	}
 }
 
-// RecoverFromWAL replays operations from the Write-Ahead Log during system startup.
-func (kv *KeyValueStore) RecoverFromWAL() error {
-    // Open the WAL file
-    walFile, err := os.Open(kv.wal.Name())
-    if err != nil {
-        return err
-    }
-    defer walFile.Close()
-
-    // Create a JSON decoder for the WAL file
-    decoder := json.NewDecoder(walFile)
-
-    // Replay operations from the Write-Ahead Log
-    for {
-        var logEntry map[string]interface{}
+// handleKVHead handles HEAD /kv/{key}, answering whether the key exists
+// without reading its value, or 503 if an SST file that may hold it can't
+// be read, as GET does.
+func handleKVHead(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := requestKey(r)
+		if err != nil {
+			w.WriteHeader(validationStatus(err))
+			return
+		}
+		exists, err := kv.Exists(key)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
 
-        // Decode the next log entry
-        if err := decoder.Decode(&logEntry); err == io.EOF {
-            // End of file reached
-            break
-        } else if err != nil {
-            return err
-        }
+// handleKVPut handles PUT and POST /kv/{key}, storing the request body as
+// the value byte for byte. The Content-Type header, if any, sets the value's
+// type.
+func handleKVPut(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		liftDeadlines(w)
 
-        // Perform the operation based on the log entry
-        switch operation := logEntry["operation"].(string); operation {
-        case "set":
-            key := logEntry["key"].(string)
-            value := logEntry["value"].(string)
-			fmt.Printf("Set operation recovered from WAL - Key: %s, Value: %s\n", key, string(value))
-            // Set the key-value pair in memory
-            kv.data[key] = []byte(value)
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(kv.options.MaxValueSize)))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("%v: more than %d bytes", ErrValueTooLarge, tooLarge.Limit))
+				return
+			}
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Error reading body: %v", err))
+			return
+		}
 
-        case "delete":
-            key := logEntry["key"].(string)
-			value := logEntry["value"].(string)
-            // Delete the key from memory
-			fmt.Printf("Delete operation recovered from WAL - Key: %s, Value: %s\n", key, string(value))
-			delete(kv.data, key)
-        }
-    }
+		storeKey, err := requestKey(r)
+		noteAccess(r, key, int64(len(value)))
+		if err == nil {
+			err = kv.SetTyped(storeKey, value, r.Header.Get("Content-Type"))
+		}
+		if err != nil {
+			writeError(w, r, validationStatus(err), err.Error())
+			return
+		}
 
-    return nil
+		writeResponse(w, r, http.StatusCreated, "OK\n", map[string]string{"key": key})
+	}
 }
 
-// handleSet handles the POST request for setting a key-value pair.
-func handleSet(kv *KeyValueStore) http.HandlerFunc {
+// handleKVDelete handles DELETE /kv/{key}.
+func handleKVDelete(kv *KeyValueStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Parse the JSON body
-		var requestBody map[string]string
-		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		key, err := requestKey(r)
 		if err != nil {
-			http.Error(w, "Error decoding JSON body", http.StatusBadRequest)
+			writeError(w, r, validationStatus(err), fmt.Sprintf("Error deleting key: %v", err))
 			return
 		}
 
-		// Extract key and value from the JSON body
-		key, ok := requestBody["key"]
-		if !ok {
-			http.Error(w, "Key not found in JSON body", http.StatusBadRequest)
+		_, ok, err := kv.Delete(key)
+		if err != nil {
+			writeError(w, r, validationStatus(err), fmt.Sprintf("Error deleting key: %v", err))
 			return
 		}
-
-		value, ok := requestBody["value"]
 		if !ok {
-			http.Error(w, "Value not found in JSON body", http.StatusBadRequest)
+			writeError(w, r, http.StatusNotFound, "Key not found")
 			return
 		}
 
-		// Update the in-memory store
-		kv.Set(key, []byte(value))
-
-		fmt.Fprintf(w, "OK\n")
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-// SearchSSTFiles searches for the key in SST files from most recent to oldest.
-func (kv *KeyValueStore) SearchSSTFiles(key string) ([]byte, bool) {
-	// Get a list of SST files in the directory
-	files, err := filepath.Glob("sstable_*.sst")
-	if err != nil {
-		log.Printf("Error listing SST files: %v\n", err)
-		return nil, false
-	}
+// handleBucketScan handles GET /b/{bucket}/scan, listing the pairs in a
+// bucket.
+func handleBucketScan(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pairs, err := kv.ScanBucketContext(r.Context(), r.PathValue("bucket"))
+		if err != nil {
+			status := validationStatus(err)
+			if status == http.StatusInternalServerError {
+				status = http.StatusServiceUnavailable
+			}
+			writeError(w, r, status, fmt.Sprintf("Error scanning keys: %v", err))
+			return
+		}
 
-	// Sort files based on modification time (most recent to oldest)
-	sort.Slice(files, func(i, j int) bool {
-		return fileInfoModTime(files[i]).After(fileInfoModTime(files[j]))
-	})
+		writePairs(w, pairs)
+	}
+}
 
-	// Iterate through SST files from most recent to oldest
-	for _, sstFile := range files {
-		// Search for the key in the SST file
-		value, ok := kv.SearchSSTFile(key, sstFile)
-		if ok {
-			return value, true
+// handleBucketDelete handles DELETE /b/{bucket}, deleting every key in a
+// bucket.
+func handleBucketDelete(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deleted, err := kv.DeleteBucket(r.PathValue("bucket"))
+		if err != nil {
+			writeError(w, r, validationStatus(err), fmt.Sprintf("Error deleting bucket: %v", err))
+			return
 		}
-	}
 
-	return nil, false
+		writeResponse(w, r, http.StatusOK, fmt.Sprintf("Deleted %d keys\n", deleted), map[string]int{"deleted": deleted})
+	}
 }
 
-// SearchSSTFile searches for the key in a specific SST file.
-func (kv *KeyValueStore) SearchSSTFile(key string, sstFile string) ([]byte, bool) {
-	// Open the SST file
-	file, err := os.Open(sstFile)
-	if err != nil {
-		log.Printf("Error opening SST file %s: %v\n", sstFile, err)
-		return nil, false
-	}
-	defer file.Close()
+// handleCompact handles the POST request for compacting all SSTables.
+func handleCompact(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := kv.Compact()
+		if err != nil {
+			writeError(w, r, validationStatus(err), fmt.Sprintf("Error compacting: %v", err))
+			return
+		}
 
-	// Read magic number
-	magicNumber := make([]byte, 4)
-	if _, err := file.Read(magicNumber); err != nil {
-		log.Printf("Error reading magic number from SST file %s: %v\n", sstFile, err)
-		return nil, false
+		writeJSON(w, http.StatusOK, result)
 	}
-	log.Printf("Magic Number: %s\n", magicNumber)
+}
 
-	// Check if it's a valid SST file
-	if string(magicNumber) != "SSTB" {
-		log.Printf("Invalid SST file format for file %s\n", sstFile)
-		return nil, false
-	}
+// handleSSTable handles the GET request for dumping one SST file's header
+// and key range, and its entries with entries=true, for debugging.
+func handleSSTable(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		withEntries, _ := strconv.ParseBool(r.URL.Query().Get("entries"))
+		dump, err := kv.DumpSSTable(r.URL.Query().Get("file"), withEntries)
+		switch {
+		case errors.Is(err, ErrInvalidTableName):
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		case errors.Is(err, os.ErrNotExist):
+			writeError(w, r, http.StatusNotFound, "SST file not found")
+			return
+		case err != nil:
+			writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Error reading SST file: %v", err))
+			return
+		}
 
-	// Read entry count
-	var entryCount uint32
-	if err := binary.Read(file, binary.LittleEndian, &entryCount); err != nil {
-		log.Printf("Error reading entry count from SST file %s: %v\n", sstFile, err)
-		return nil, false
+		writeJSON(w, http.StatusOK, dump)
 	}
-	log.Printf("Entry Count: %d\n", entryCount)
+}
 
-	// Read smallest key length
-	var smallestKeyLength uint32
-	if err := binary.Read(file, binary.LittleEndian, &smallestKeyLength); err != nil {
-		log.Printf("Error reading smallest key length from SST file %s: %v\n", sstFile, err)
-		return nil, false
-	}
-	log.Printf("Smallest Key Length: %d\n", smallestKeyLength)
+// handleSSTables handles the GET request for the list of committed SSTables.
+func handleSSTables(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tables, err := kv.SSTables()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Error listing SSTables: %v", err))
+			return
+		}
 
-	// Read largest key length
-	var largestKeyLength uint32
-	if err := binary.Read(file, binary.LittleEndian, &largestKeyLength); err != nil {
-		log.Printf("Error reading largest key length from SST file %s: %v\n", sstFile, err)
-		return nil, false
+		writeJSON(w, http.StatusOK, tables)
 	}
-	log.Printf("Largest Key Length: %d\n", largestKeyLength)
+}
 
-	// Iterate through entries in the SST file
-	for i := uint32(0); i < entryCount; i++ {
-		var operationMarker uint16
-		if err := binary.Read(file, binary.LittleEndian, &operationMarker); err != nil {
-			log.Printf("Error reading operation marker from SST file %s: %v\n", sstFile, err)
-			return nil, false
+// handleStats handles the GET request for store metrics.
+func handleStats(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := kv.Stats()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Error collecting stats: %v", err))
+			return
 		}
-		log.Printf("Operation Marker: %d\n", operationMarker)
 
-		var keyLength uint32
-		if err := binary.Read(file, binary.LittleEndian, &keyLength); err != nil {
-			log.Printf("Error reading key length from SST file %s: %v\n", sstFile, err)
-			return nil, false
-		}
-		log.Printf("Key Length: %d\n", keyLength)
+		writeJSON(w, http.StatusOK, stats)
+	}
+}
 
-		var valueLength uint32
-		if err := binary.Read(file, binary.LittleEndian, &valueLength); err != nil {
-			log.Printf("Error reading value length from SST file %s: %v\n", sstFile, err)
-			return nil, false
+// handleMetrics handles the GET request for metrics in Prometheus format.
+func handleMetrics(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := kv.WriteMetrics(w); err != nil {
+			kv.logger.Error("error writing metrics", "err", err)
 		}
-		log.Printf("Value Length: %d\n", valueLength)
+	}
+}
 
-		keyBytes := make([]byte, keyLength)
-		if _, err := file.Read(keyBytes); err != nil {
-			log.Printf("Error reading key from SST file %s: %v\n", sstFile, err)
-			return nil, false
+// handleHealth handles the liveness check, failing if the WAL can't be written.
+func handleHealth(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := kv.Healthy(); err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, err.Error())
+			return
 		}
-		log.Printf("Key: %s\n", keyBytes)
 
-		valueBytes := make([]byte, valueLength)
-		if _, err := file.Read(valueBytes); err != nil {
-			log.Printf("Error reading value from SST file %s: %v\n", sstFile, err)
-			return nil, false
+		writeResponse(w, r, http.StatusOK, "OK\n", map[string]string{"status": "ok"})
+	}
+}
+
+// handleReady handles the readiness check, failing until recovery has
+// completed and while the store is degraded because memtable flushes fail.
+func handleReady(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !kv.Ready() {
+			writeError(w, r, http.StatusServiceUnavailable, "Recovery in progress")
+			return
+		}
+		if err := kv.FlushError(); err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, fmt.Sprintf("Degraded: flushing to SSTable failed: %v", err))
+			return
 		}
-		log.Printf("Value: %s\n", valueBytes)
 
-		if string(keyBytes) == key {
-			// Check if the key is marked as deleted
-			if operationMarker == 1 {
-				log.Printf("Key marked as deleted: %s\n", key)
-				return []byte("DELETED"), true // Key is marked as deleted
-			}
+		writeResponse(w, r, http.StatusOK, "OK\n", map[string]string{"status": "ok"})
+	}
+}
 
-			return valueBytes, true // Key found
+// handleSnapshot handles the GET request for streaming a snapshot of the store.
+func handleSnapshot(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		liftDeadlines(w)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="snapshot.snap"`)
+
+		// Headers are already sent once the dump starts, so errors can only be logged
+		if err := kv.Snapshot(w); err != nil {
+			kv.logger.Error("error writing snapshot", "err", err)
 		}
 	}
-
-	return nil, false // Key not found in this SST file
 }
 
-// fileInfoModTime returns the modification time of a file.
-func fileInfoModTime(filename string) time.Time {
-	fileInfo, err := os.Stat(filename)
-	if err != nil {
-		log.Printf("Error getting file info for %s: %v\n", filename, err)
-		return time.Time{}
+// handleReplicate handles the GET request for streaming WAL records to a
+// follower as newline-delimited JSON, from the record numbered "from" on.
+// The stream stays open and sends new records as they are written.
+func handleReplicate(kv *KeyValueStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "From must be a sequence number")
+			return
+		}
+
+		tailer, err := kv.tailWAL(from)
+		if errors.Is(err, ErrReplicationGap) {
+			writeError(w, r, http.StatusGone, err.Error())
+			return
+		} else if errors.Is(err, ErrFollowerAhead) {
+			writeError(w, r, http.StatusConflict, err.Error())
+			return
+		}
+
+		liftDeadlines(w)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		controller := http.NewResponseController(w)
+		controller.Flush()
+
+		// Headers are already sent once the stream starts, so errors can only be logged
+		for {
+			records, err := tailer.wait(r.Context())
+			if err != nil {
+				if r.Context().Err() == nil {
+					kv.logger.Error("error streaming WAL to follower", "err", err)
+				}
+				return
+			}
+			for _, record := range records {
+				if _, err := w.Write(record); err != nil {
+					return
+				}
+				if _, err := w.Write([]byte("\n")); err != nil {
+					return
+				}
+			}
+			if err := controller.Flush(); err != nil {
+				return
+			}
+		}
 	}
-	return fileInfo.ModTime()
 }
 
-// handleGet handles the GET request for retrieving a key's value.
-func handleGet(kv *KeyValueStore) http.HandlerFunc {
+// handleExport handles the GET request for streaming all pairs as
+// newline-delimited JSON, or in the binary export format with
+// format=binary.
+func handleExport(kv *KeyValueStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
+		liftDeadlines(w)
 
-		value, ok := kv.Get(key)
+		// Without a Content-Length, the server sends the export with chunked
+		// transfer encoding as its buffer fills, so it is never held in memory
+		export := kv.Export
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if r.URL.Query().Get("format") == "binary" {
+			export = kv.ExportBinary
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
 
-		if ok {
-			fmt.Fprintf(w, "Value: %s\n", string(value))
-		} else {
-			fmt.Fprintf(w, "Key not found\n")
+		// Headers are already sent once the export starts, so errors can only be logged
+		if _, err := export(w); err != nil {
+			kv.logger.Error("error writing export", "err", err)
 		}
 	}
-}	
+}
 
-// handleDelete handles the DELETE request for deleting a key.
-func handleDelete(kv *KeyValueStore) http.HandlerFunc {
+// handleImport handles the POST request for ingesting newline-delimited JSON
+// in the export format, or the binary export format with format=binary.
+func handleImport(kv *KeyValueStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-
-		value, ok := kv.Delete(key)
-		if ok {
-			fmt.Fprintf(w, "Deleted key: %s, Value: %s\n", key, value)
-		} else {
-			fmt.Fprintf(w, "Key not found\n")
+		liftDeadlines(w)
+		importFunc := kv.Import
+		if r.URL.Query().Get("format") == "binary" {
+			importFunc = kv.ImportBinary
+		}
+		imported, err := importFunc(r.Body)
+		if err != nil {
+			status := validationStatus(err)
+			if status == http.StatusInternalServerError {
+				status = http.StatusBadRequest
+			}
+			writeError(w, r, status, fmt.Sprintf("Error importing after %d pairs: %v", imported, err))
+			return
 		}
+
+		writeResponse(w, r, http.StatusOK, fmt.Sprintf("Imported %d pairs\n", imported), map[string]int{"imported": imported})
+	}
+}
+
+// restoreSnapshot restores the store from a snapshot file.
+func restoreSnapshot(kv *KeyValueStore, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
+
+	return kv.Restore(file)
 }
 
+// defaultListenAddr returns the server's listen address when -addr isn't
+// given: $KV_ADDR if set, or :8080.
+func defaultListenAddr() string {
+	if addr := os.Getenv("KV_ADDR"); addr != "" {
+		return addr
+	}
+	return ":8080"
+}
 
 func main() {
-	walFilePath := "wal.log" 
+    restorePath := flag.String("restore", "", "restore the store from a snapshot file and exit")
+    readOnly := flag.Bool("readonly", false, "serve reads only, without modifying the data directory")
+    keyFile := flag.String("encryption-key-file", "", "encrypt data at rest with the raw 16, 24, or 32 byte AES key in this file")
+    tokenFile := flag.String("auth-token-file", "", "require the bearer token in this file for writes and admin endpoints")
+    authReads := flag.Bool("auth-reads", false, "also require the bearer token for reads")
+    accessLogs := flag.Bool("access-log", false, "log each HTTP request's method, path, key, status, value size, and latency, but never values")
+    logLevel := flag.String("log-level", "info", "minimum level of the store's logs: debug, info, warn, or error")
+    addr := flag.String("addr", defaultListenAddr(), "address to listen on, such as :8080 or 127.0.0.1:8080; defaults to $KV_ADDR or :8080")
+    maxBodyBytes := flag.Int64("max-body-bytes", defaultMaxBodyBytes, "largest accepted JSON request body in bytes")
+    readTimeout := flag.Duration("read-timeout", 30*time.Second, "time allowed to read a request; streaming uploads are exempt")
+    writeTimeout := flag.Duration("write-timeout", time.Minute, "time allowed to write a response; streaming downloads are exempt")
+    inMemory := flag.Bool("in-memory", false, "keep all data in memory, made durable by the WAL alone, and never write SSTables")
+    maxTables := flag.Int("max-tables", 0, "prune superseded SSTables, then compact, once there are more than this many; 0 disables")
+    maxTableBytes := flag.Int64("max-table-bytes", 0, "prune superseded SSTables, then compact, once they total more than this many bytes; 0 disables")
+    tombstoneRatio := flag.Float64("tombstone-ratio", 0, "compact all SSTables once tombstones make up more than this fraction of their entries; 0 disables")
+    maxWALBytes := flag.Int64("max-wal-bytes", 0, "flush, or with -in-memory rewrite the WAL, once this many WAL bytes are written, dropping overwritten values; 0 disables")
+    maxPendingFlushes := flag.Int("max-pending-flushes", 1, "full memtables that may wait to be flushed before writes block")
+    valueLogThreshold := flag.Int("value-log-threshold", 0, "store values of at least this many bytes in the value log instead of inline in SSTables; 0 disables")
+    follow := flag.String("follow", "", "run as a read replica of the leader at this URL, such as http://leader:8080")
+    followTokenFile := flag.String("follow-token-file", "", "send the bearer token in this file to the leader")
+    verify := flag.Bool("verify", false, "read every SSTable in full at startup and refuse to start if any is corrupt")
+    fileMode := flag.String("file-mode", "", "octal permission of the files the store creates, such as 0600; empty uses the defaults less the umask")
+    flag.Parse()
+
+	walFilePath := "wal.log"
+    dataDir := "."
+
+    var level slog.Level
+    if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+        log.Fatal("Invalid log level:", err)
+    }
+    var mode uint64
+    if *fileMode != "" {
+        parsed, err := strconv.ParseUint(*fileMode, 8, 32)
+        if err != nil {
+            log.Fatal("Invalid file mode:", err)
+        }
+        mode = parsed
+    }
+    options := Options{
+        FileMode:          os.FileMode(mode),
+        ReadOnly:          *readOnly,
+        InMemoryOnly:      *inMemory,
+        MaxWALBytes:       *maxWALBytes,
+        MaxTables:         *maxTables,
+        MaxTableBytes:     *maxTableBytes,
+        TombstoneRatio:    *tombstoneRatio,
+        MaxPendingFlushes: *maxPendingFlushes,
+        ValueLogThreshold: *valueLogThreshold,
+        Follower:          *follow != "",
+        Logger:            slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})),
+    }
+    if *keyFile != "" {
+        key, err := os.ReadFile(*keyFile)
+        if err != nil {
+            log.Fatal("Error reading encryption key:", err)
+        }
+        options.EncryptionKey = key
+    }
 
-    kv, err := NewKeyValueStore(walFilePath)
+    kv, err := NewKeyValueStore(walFilePath, dataDir, options)
     if err != nil {
         log.Fatal("Error creating KeyValueStore:", err)
     }
-    defer kv.CloseWAL()
 
-    // Recover from WAL on system restart
-    if err := kv.RecoverFromWAL(); err != nil {
-        log.Printf("Error recovering from WAL: %v\n", err)
+    // Restore from a snapshot instead of serving requests if asked to
+    if *restorePath != "" {
+        if err := kv.Recover(); err != nil {
+            log.Fatal("Error recovering store:", err)
+        }
+        if err := restoreSnapshot(kv, *restorePath); err != nil {
+            log.Fatal("Error restoring snapshot:", err)
+        }
+        if err := kv.Close(); err != nil {
+            log.Fatal("Error closing KeyValueStore:", err)
+        }
+        log.Printf("Restored snapshot %s\n", *restorePath)
+        return
+    }
+
+    // Check every SSTable before serving anything from them if asked to
+    if *verify {
+        corrupt, err := kv.Verify()
+        if err != nil {
+            log.Fatal("Error verifying SSTables:", err)
+        }
+        for _, table := range corrupt {
+            log.Printf("Corrupt SST file %s: %v\n", table.File, table.Err)
+        }
+        if len(corrupt) > 0 {
+            log.Fatalf("Found %d corrupt SST files\n", len(corrupt))
+        }
+        log.Printf("Verified SST files\n")
+    }
+
+    // Protect writes and admin endpoints, and reads if asked to, with a
+    // bearer token
+    var authToken string
+    if *tokenFile != "" {
+        token, err := os.ReadFile(*tokenFile)
+        if err != nil {
+            log.Fatal("Error reading auth token:", err)
+        }
+        authToken = strings.TrimSpace(string(token))
+        if authToken == "" {
+            log.Fatal("Auth token file is empty")
+        }
+    }
+    protected := func(handler http.HandlerFunc) http.HandlerFunc {
+        return requireToken(authToken, handler)
+    }
+    limited := func(handler http.HandlerFunc) http.HandlerFunc {
+        return limitBody(*maxBodyBytes, handler)
+    }
+    read := func(handler http.HandlerFunc) http.HandlerFunc {
+        if *authReads {
+            return protected(handler)
+        }
+        return handler
     }
 
     // Start the HTTP server
     router := http.NewServeMux()
-    router.HandleFunc("/get", handleGet(kv))
-    router.HandleFunc("/set", handleSet(kv))
-    router.HandleFunc("/del", handleDelete(kv))
+    router.HandleFunc("/get", read(handleGet(kv)))
+    router.HandleFunc("/set", protected(limited(handleSet(kv))))
+    router.HandleFunc("/del", protected(handleDelete(kv)))
+    router.HandleFunc("/delrange", protected(handleDeleteRange(kv)))
+    router.HandleFunc("/stats", read(handleStats(kv)))
+    router.HandleFunc("/metrics", handleMetrics(kv))
+    router.HandleFunc("/cas", protected(limited(handleCompareAndSwap(kv))))
+    router.HandleFunc("/incr", protected(handleIncrement(kv)))
+    router.HandleFunc("POST /append", protected(handleAppend(kv)))
+    router.HandleFunc("POST /mget", read(limited(handleMultiGet(kv))))
+    router.HandleFunc("POST /getmany", read(limited(handleGetMany(kv))))
+    router.HandleFunc("/scan", read(handleScan(kv)))
+    router.HandleFunc("/scanprefix", read(handleScanPrefix(kv)))
+    router.HandleFunc("GET /keys", read(handleKeys(kv)))
+    router.HandleFunc("/health", handleHealth(kv))
+    router.HandleFunc("/ready", handleReady(kv))
+    router.HandleFunc("/snapshot", protected(handleSnapshot(kv)))
+    router.HandleFunc("/export", protected(handleExport(kv)))
+    router.HandleFunc("GET /replicate", protected(handleReplicate(kv)))
+    router.HandleFunc("/import", protected(handleImport(kv)))
+    router.HandleFunc("POST /compact", protected(handleCompact(kv)))
+    router.HandleFunc("GET /sstable", protected(handleSSTable(kv)))
+    router.HandleFunc("GET /sstables", protected(handleSSTables(kv)))
+    router.HandleFunc("GET /kv/{key...}", read(handleKVGet(kv)))
+    router.HandleFunc("HEAD /kv/{key...}", read(handleKVHead(kv)))
+    router.HandleFunc("PUT /kv/{key...}", protected(handleKVPut(kv)))
+    router.HandleFunc("POST /kv/{key...}", protected(handleKVPut(kv)))
+    router.HandleFunc("DELETE /kv/{key...}", protected(handleKVDelete(kv)))
+    router.HandleFunc("GET /b/{bucket}/kv/{key...}", read(handleKVGet(kv)))
+    router.HandleFunc("HEAD /b/{bucket}/kv/{key...}", read(handleKVHead(kv)))
+    router.HandleFunc("PUT /b/{bucket}/kv/{key...}", protected(handleKVPut(kv)))
+    router.HandleFunc("POST /b/{bucket}/kv/{key...}", protected(handleKVPut(kv)))
+    router.HandleFunc("DELETE /b/{bucket}/kv/{key...}", protected(handleKVDelete(kv)))
+    router.HandleFunc("GET /b/{bucket}/scan", read(handleBucketScan(kv)))
+    router.HandleFunc("DELETE /b/{bucket}", protected(handleBucketDelete(kv)))
+
+    // Log each request for auditing, if asked to
+    var handler http.Handler = router
+    if *accessLogs {
+        handler = accessLog(options.Logger, router)
+    }
+
+    // Bound how long slow clients can hold a connection
+    server := &http.Server{
+        Handler:           handler,
+        ReadHeaderTimeout: 10 * time.Second,
+        ReadTimeout:       *readTimeout,
+        WriteTimeout:      *writeTimeout,
+        IdleTimeout:       2 * time.Minute,
+    }
+
+    // Stop the server on SIGINT/SIGTERM so the memtable can be flushed
+    stop := make(chan os.Signal, 1)
+    signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+    go func() {
+        sig := <-stop
+        log.Printf("Received %v, shutting down...\n", sig)
+
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        if err := server.Shutdown(ctx); err != nil {
+            log.Printf("Error shutting down server: %v\n", err)
+        }
+    }()
+
+    // Read the leader's token before starting, so a bad file fails fast
+    var followToken string
+    if *followTokenFile != "" {
+        token, err := os.ReadFile(*followTokenFile)
+        if err != nil {
+            log.Fatal("Error reading leader token:", err)
+        }
+        followToken = strings.TrimSpace(string(token))
+    }
+
+    // Recover from the SSTables and WAL on system restart while the server
+    // starts; /ready reports 503 until this completes. A follower then
+    // starts following its leader until the server stops.
+    followCtx, stopFollowing := context.WithCancel(context.Background())
+    var following sync.WaitGroup
+    following.Add(1)
+    go func() {
+        defer following.Done()
+        if err := kv.Recover(); err != nil {
+            log.Printf("Error recovering store: %v\n", err)
+            return
+        }
+        if *follow != "" {
+            kv.Follow(followCtx, *follow, followToken)
+        }
+    }()
+
+    // Listen before serving, so the actual address is known even for port 0
+    listener, err := net.Listen("tcp", *addr)
+    if err != nil {
+        log.Fatal("Error listening:", err)
+    }
+    log.Printf("Server listening on %s...\n", listener.Addr())
+    if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+        log.Fatal(err)
+    }
 
-    port := 8080
-    log.Printf("Server listening on :%d...\n", port)
-    log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), router))
+    // Stop following before the store is closed
+    stopFollowing()
+    following.Wait()
+
+    // Flush pending data and close the WAL once in-flight requests are done
+    if err := kv.Close(); err != nil {
+        log.Printf("Error closing KeyValueStore: %v\n", err)
+    }
 }
\ No newline at end of file
@@ -0,0 +1,4647 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// openStore opens the store whose WAL and SSTables are in dir and recovers
+// it. The store is closed when the test ends, if the test hasn't closed it.
+func openStore(t testing.TB, dir string, options Options) *KeyValueStore {
+	t.Helper()
+	kv, err := NewKeyValueStore(filepath.Join(dir, "wal.log"), dir, options)
+	if err != nil {
+		t.Fatalf("NewKeyValueStore: %v", err)
+	}
+	t.Cleanup(func() { kv.Close() })
+	if err := kv.Recover(); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	return kv
+}
+
+// waitForBackground waits for the memtables being flushed and any
+// compaction in progress to finish.
+func waitForBackground(kv *KeyValueStore) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.waitForFlush()
+	for kv.compacting {
+		kv.flushDone.Wait()
+	}
+}
+
+// lastWALSegment returns the path of the newest WAL segment in dir.
+func lastWALSegment(t *testing.T, dir string) string {
+	t.Helper()
+	segments, err := listWALSegments(filepath.Join(dir, "wal.log"))
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("listing WAL segments: %v, %v", segments, err)
+	}
+	return walSegmentPath(filepath.Join(dir, "wal.log"), segments[len(segments)-1])
+}
+
+// serve sends a request with the body, if not empty, to the handler and
+// returns the response.
+func serve(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, target, reader))
+	return w
+}
+
+// mustSet sets the key or fails the test.
+func mustSet(t testing.TB, kv *KeyValueStore, key, value string) {
+	t.Helper()
+	if err := kv.Set(key, []byte(value)); err != nil {
+		t.Fatalf("Set(%q): %v", key, err)
+	}
+}
+
+// mustGet fails the test unless the key holds the value.
+func mustGet(t testing.TB, kv *KeyValueStore, key, want string) {
+	t.Helper()
+	value, ok := kv.Get(key)
+	if !ok {
+		t.Fatalf("Get(%q): not found, want %q", key, want)
+	}
+	if string(value) != want {
+		t.Fatalf("Get(%q) = %q, want %q", key, value, want)
+	}
+}
+
+// mustMiss fails the test if the key is found.
+func mustMiss(t testing.TB, kv *KeyValueStore, key string) {
+	t.Helper()
+	if value, ok := kv.Get(key); ok {
+		t.Fatalf("Get(%q) = %q, want not found", key, value)
+	}
+}
+
+func TestCloseFlushesPendingKeys(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	keys := []string{"a", "b", "c"}
+	for _, key := range keys {
+		mustSet(t, kv, key, "value-"+key)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Look in the SSTables alone, without replaying the WAL
+	reader, err := NewKeyValueStore(filepath.Join(dir, "wal.log"), dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	tables, err := reader.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("got %d SSTables after Close, want 1", len(tables))
+	}
+	sstFile := filepath.Join(dir, tables[0].File)
+	for _, key := range keys {
+		value, ok := reader.SearchSSTFile(key, sstFile)
+		if !ok || string(value) != "value-"+key {
+			t.Errorf("SearchSSTFile(%q) = %q, %v; want %q", key, value, ok, "value-"+key)
+		}
+	}
+}
+
+func TestStatsMatchStore(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	for i := 0; i < memtableFlushKeys+2; i++ {
+		mustSet(t, kv, fmt.Sprintf("key%02d", i), "value")
+	}
+	waitForBackground(kv)
+
+	w := serve(handleStats(kv), "GET", "/stats", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /stats returned %d: %s", w.Code, w.Body)
+	}
+	var stats StoreStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "sstable_*.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SSTableFiles != len(files) || len(files) != 1 {
+		t.Errorf("sstable_files = %d, want the %d files on disk", stats.SSTableFiles, len(files))
+	}
+	if stats.MemtableKeys != 2 {
+		t.Errorf("memtable_keys = %d, want 2", stats.MemtableKeys)
+	}
+	if stats.SSTableBytes == 0 || stats.WALBytes == 0 {
+		t.Errorf("sstable_bytes = %d, wal_bytes = %d; want both nonzero", stats.SSTableBytes, stats.WALBytes)
+	}
+}
+
+func TestStoresInSeparateDirectories(t *testing.T) {
+	first := openStore(t, t.TempDir(), Options{})
+	second := openStore(t, t.TempDir(), Options{})
+	mustSet(t, first, "first", "1")
+	mustSet(t, second, "second", "2")
+	for _, kv := range []*KeyValueStore{first, second} {
+		if err := kv.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustGet(t, first, "first", "1")
+	mustMiss(t, first, "second")
+	mustGet(t, second, "second", "2")
+	mustMiss(t, second, "first")
+}
+
+func TestCompareAndSwapRace(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "k", "old")
+
+	var wg sync.WaitGroup
+	swapped := make([]bool, 2)
+	for i := range swapped {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := kv.CompareAndSwap("k", []byte("old"), []byte(fmt.Sprint("new", i)))
+			if err != nil {
+				t.Error(err)
+			}
+			swapped[i] = ok
+		}(i)
+	}
+	wg.Wait()
+
+	if swapped[0] == swapped[1] {
+		t.Fatalf("swaps = %v, want exactly one to succeed", swapped)
+	}
+	winner := 0
+	if swapped[1] {
+		winner = 1
+	}
+	mustGet(t, kv, "k", fmt.Sprint("new", winner))
+}
+
+func TestIncrementConcurrently(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(delta int64) {
+			defer wg.Done()
+			if _, err := kv.Increment("counter", delta); err != nil {
+				t.Error(err)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	mustGet(t, kv, "counter", "1275")
+}
+
+func TestIncrementNonNumeric(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "name", "alice")
+
+	if _, err := kv.Increment("name", 1); err == nil {
+		t.Fatal("Increment of a non-numeric value succeeded")
+	}
+	mustGet(t, kv, "name", "alice")
+}
+
+// mustFlush flushes the memtable or fails the test.
+func mustFlush(t testing.TB, kv *KeyValueStore) {
+	t.Helper()
+	if err := kv.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+}
+
+// newestTable returns the name of the most recent SSTable.
+func newestTable(t testing.TB, kv *KeyValueStore) string {
+	t.Helper()
+	tables, err := kv.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) == 0 {
+		t.Fatal("no SSTables")
+	}
+	return tables[0].File
+}
+
+func TestFlushTombstoneEntries(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "a", "1")
+	mustSet(t, kv, "b", "2")
+	mustFlush(t, kv)
+
+	// a is only deleted, b is set again and then deleted, and c is live
+	if _, ok, err := kv.Delete("a"); !ok || err != nil {
+		t.Fatalf("Delete(a) = %v, %v", ok, err)
+	}
+	mustSet(t, kv, "b", "22")
+	if _, ok, err := kv.Delete("b"); !ok || err != nil {
+		t.Fatalf("Delete(b) = %v, %v", ok, err)
+	}
+	mustSet(t, kv, "c", "333")
+	mustFlush(t, kv)
+
+	dump, err := kv.DumpSSTable(newestTable(t, kv), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SSTableDumpEntry{
+		{Key: "a", Marker: 1, ValueLength: 0},
+		{Key: "b", Marker: 1, ValueLength: 0},
+		{Key: "c", Marker: 0, ValueLength: 3},
+	}
+	if len(dump.Entries) != len(want) {
+		t.Fatalf("got entries %+v, want %+v", dump.Entries, want)
+	}
+	for i, entry := range dump.Entries {
+		entry.Version = 0
+		if entry != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entry, want[i])
+		}
+	}
+	mustMiss(t, kv, "a")
+	mustMiss(t, kv, "b")
+	mustGet(t, kv, "c", "333")
+}
+
+// countOpens closes the store's idle SST file handles, so the next read of
+// each file opens it, and returns a function listing the names of the files
+// the file pool has opened since.
+func countOpens(kv *KeyValueStore) func() []string {
+	var mu sync.Mutex
+	var opened []string
+	kv.files.closeIdle()
+	kv.files.mu.Lock()
+	defer kv.files.mu.Unlock()
+	kv.files.openFile = func(name string) (*os.File, error) {
+		mu.Lock()
+		opened = append(opened, filepath.Base(name))
+		mu.Unlock()
+		return os.Open(name)
+	}
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), opened...)
+	}
+}
+
+func TestLookupOpensOnlyCoveringTable(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{CacheSize: -1})
+	var covering string
+	for _, prefix := range []string{"a", "m", "x"} {
+		for i := 0; i < 3; i++ {
+			mustSet(t, kv, fmt.Sprint(prefix, i), "value")
+		}
+		mustFlush(t, kv)
+		if prefix == "m" {
+			covering = newestTable(t, kv)
+		}
+	}
+
+	opened := countOpens(kv)
+	mustGet(t, kv, "m1", "value")
+	if got := opened(); len(got) != 1 || got[0] != covering {
+		t.Fatalf("looking up m1 opened %v, want only %s", got, covering)
+	}
+}
+
+func TestValueDELETEDIsNotATombstone(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "k", "DELETED")
+	mustFlush(t, kv)
+
+	mustGet(t, kv, "k", "DELETED")
+}
+
+func TestFlushedTombstoneIsNotFound(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "k", "value")
+	mustFlush(t, kv)
+	if _, ok, err := kv.Delete("k"); !ok || err != nil {
+		t.Fatalf("Delete = %v, %v", ok, err)
+	}
+	mustFlush(t, kv)
+
+	mustMiss(t, kv, "k")
+	if value, ok := kv.SearchSSTFile("k", filepath.Join(kv.dataDir, newestTable(t, kv))); ok {
+		t.Fatalf("SearchSSTFile found %q in the tombstone's table", value)
+	}
+}
+
+func TestGzipCompressedSSTable(t *testing.T) {
+	value := strings.Repeat("compressible text ", 500)
+	sizes := make(map[Compression]int64)
+	for _, compression := range []Compression{NoCompression, GzipCompression} {
+		kv := openStore(t, t.TempDir(), Options{Compression: compression})
+		for i := 0; i < 5; i++ {
+			mustSet(t, kv, fmt.Sprint("key", i), value)
+		}
+		mustFlush(t, kv)
+		tables, err := kv.SSTables()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[compression] = tables[0].Size
+
+		for i := 0; i < 5; i++ {
+			mustGet(t, kv, fmt.Sprint("key", i), value)
+		}
+	}
+
+	if sizes[GzipCompression] >= sizes[NoCompression]/4 {
+		t.Fatalf("compressed SSTable is %d bytes, uncompressed %d", sizes[GzipCompression], sizes[NoCompression])
+	}
+}
+
+func TestScanContextCancelled(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	for table := 0; table < 3; table++ {
+		for i := 0; i < 5; i++ {
+			mustSet(t, kv, fmt.Sprintf("key%d-%d", i, table), "value")
+		}
+		mustFlush(t, kv)
+	}
+	waitForBackground(kv)
+
+	// Cancel the scan once it has started reading the SST files
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	countOpens(kv)
+	kv.files.mu.Lock()
+	open := kv.files.openFile
+	kv.files.openFile = func(name string) (*os.File, error) {
+		cancel()
+		return open(name)
+	}
+	kv.files.mu.Unlock()
+
+	begin := time.Now()
+	pairs, err := kv.ScanContext(ctx, "", "")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ScanContext = %d pairs, %v; want context.Canceled", len(pairs), err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("ScanContext took %v to return after cancellation", elapsed)
+	}
+}
+
+func TestGetContextCancelled(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "k", "value")
+	mustFlush(t, kv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := kv.GetContext(ctx, "k"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetContext = %v, want context.Canceled", err)
+	}
+}
+
+func TestUncommittedSSTableIgnored(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	mustSet(t, kv, "k", "committed")
+	mustFlush(t, kv)
+
+	// Leave a newer table the manifest doesn't list, and a half-written copy
+	// of it, as a crash during a flush would
+	newer := filepath.Join(dir, sstableFileName(999))
+	entries := []iteratorEntry{{key: "k", value: []byte("uncommitted")}, {key: "other", value: []byte("uncommitted")}}
+	if err := kv.writeSSTableEntries(newer, 999, entries); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, sstableFileName(1000)), data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	kv = openStore(t, dir, Options{})
+	mustGet(t, kv, "k", "committed")
+	mustMiss(t, kv, "other")
+	pairs, err := kv.Scan("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 1 || pairs[0].Key != "k" {
+		t.Fatalf("Scan = %v, want only k", pairs)
+	}
+}
+
+func TestNewerSequenceWins(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	mustSet(t, kv, "k", "old")
+	mustFlush(t, kv)
+	mustSet(t, kv, "k", "new")
+	mustFlush(t, kv)
+	tables, err := kv.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the tables look written at once, the newer one even earlier
+	stamp := time.Now()
+	for i, table := range tables {
+		modTime := stamp.Add(time.Duration(len(tables)-i) * time.Second)
+		if err := os.Chtimes(filepath.Join(dir, table.File), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kv = openStore(t, dir, Options{})
+	mustGet(t, kv, "k", "new")
+
+	// Sequence numbers carry on after the restart
+	mustSet(t, kv, "k", "newest")
+	mustFlush(t, kv)
+	reopened, err := kv.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened[0].Seq <= tables[0].Seq {
+		t.Fatalf("table flushed after restart has seq %d, not above %d", reopened[0].Seq, tables[0].Seq)
+	}
+	mustGet(t, kv, "k", "newest")
+}
+
+func TestGetWithSource(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "flushed", "1")
+	mustFlush(t, kv)
+	mustSet(t, kv, "memory", "2")
+
+	tests := []struct {
+		key    string
+		value  string
+		source Source
+	}{
+		{"memory", "2", SourceMemtable},
+		{"flushed", "1", SourceSSTable},
+		{"missing", "", SourceNotFound},
+	}
+	for _, test := range tests {
+		value, source, ok := kv.GetWithSource(test.key)
+		if string(value) != test.value || source != test.source || ok != (test.source != SourceNotFound) {
+			t.Errorf("GetWithSource(%q) = %q, %v, %v; want %q, %v", test.key, value, source, ok, test.value, test.source)
+		}
+		w := serve(handleGet(kv), "GET", "/get?key="+test.key, "")
+		if got := w.Header().Get("X-Source"); got != test.source.String() {
+			t.Errorf("GET /get?key=%s has X-Source %q, want %q", test.key, got, test.source)
+		}
+	}
+}
+
+func TestCacheServesRepeatedReads(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{CacheSize: 16})
+	mustSet(t, kv, "k", "flushed")
+	mustFlush(t, kv)
+
+	opened := countOpens(kv)
+	mustGet(t, kv, "k", "flushed")
+	first := len(opened())
+	mustGet(t, kv, "k", "flushed")
+	if first != 1 || len(opened()) != first {
+		t.Fatalf("reads opened %v; want one file for the first read and none for the second", opened())
+	}
+
+	// Writes to the key invalidate the cached value
+	mustSet(t, kv, "k", "updated")
+	mustFlush(t, kv)
+	mustGet(t, kv, "k", "updated")
+	if _, ok, err := kv.Delete("k"); !ok || err != nil {
+		t.Fatalf("Delete = %v, %v", ok, err)
+	}
+	mustFlush(t, kv)
+	mustMiss(t, kv, "k")
+}
+
+// crashCopy copies the files in dir, as they are on disk, to a new
+// directory, as if the process had crashed, and returns its path.
+func crashCopy(t testing.TB, dir string) string {
+	t.Helper()
+	copied := t.TempDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(copied, entry.Name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return copied
+}
+
+func TestWALSegmentsRecovered(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{WALSegmentBytes: 300})
+	value := strings.Repeat("v", 100)
+	for i := 0; i < memtableFlushKeys-1; i++ {
+		mustSet(t, kv, fmt.Sprint("key", i), value)
+	}
+	if _, ok, err := kv.Delete("key0"); !ok || err != nil {
+		t.Fatalf("Delete = %v, %v", ok, err)
+	}
+	segments, err := listWALSegments(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 3 {
+		t.Fatalf("WAL has %d segments, want at least 3", len(segments))
+	}
+
+	recovered := openStore(t, crashCopy(t, dir), Options{WALSegmentBytes: 300})
+	mustMiss(t, recovered, "key0")
+	for i := 1; i < memtableFlushKeys-1; i++ {
+		mustGet(t, recovered, fmt.Sprint("key", i), value)
+	}
+}
+
+func TestAcknowledgedWritesSurviveCrash(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{SyncMode: SyncAlways})
+
+	var wg sync.WaitGroup
+	for writer := 0; writer < 8; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := kv.Set(fmt.Sprintf("w%d-%d", writer, i), []byte("value")); err != nil {
+					t.Error(err)
+				}
+			}
+		}(writer)
+	}
+	wg.Wait()
+	waitForBackground(kv)
+
+	recovered := openStore(t, crashCopy(t, dir), Options{})
+	for writer := 0; writer < 8; writer++ {
+		for i := 0; i < 20; i++ {
+			mustGet(t, recovered, fmt.Sprintf("w%d-%d", writer, i), "value")
+		}
+	}
+}
+
+// benchmarkSet measures concurrent Sets with the sync mode.
+func benchmarkSet(b *testing.B, mode SyncMode) {
+	kv := openStore(b, b.TempDir(), Options{SyncMode: mode})
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := kv.Set(fmt.Sprint("key", next.Add(1)), []byte("value")); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSetSyncAlways(b *testing.B) {
+	benchmarkSet(b, SyncAlways)
+}
+
+func BenchmarkSetSyncInterval(b *testing.B) {
+	benchmarkSet(b, SyncInterval(10*time.Millisecond))
+}
+
+func BenchmarkSetSyncNever(b *testing.B) {
+	benchmarkSet(b, SyncNever)
+}
+
+func TestSyncModeDurability(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		mode    SyncMode
+		durable bool
+	}{
+		{"SyncAlways", SyncAlways, true},
+		// Records wait in the WAL buffer for an explicit Sync
+		{"SyncNever", SyncNever, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			kv := openStore(t, dir, Options{SyncMode: test.mode, WALBufferSize: 1 << 20})
+			mustSet(t, kv, "k", "first")
+			if err := kv.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			mustSet(t, kv, "k", "latest")
+
+			recovered := openStore(t, crashCopy(t, dir), Options{})
+			if test.durable {
+				mustGet(t, recovered, "k", "latest")
+			} else {
+				mustGet(t, recovered, "k", "first")
+			}
+		})
+	}
+}
+
+func TestRecoverKeysOnlyInSSTables(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	mustSet(t, kv, "flushed", "durable")
+	mustFlush(t, kv)
+	mustSet(t, kv, "logged", "in the WAL")
+
+	// The flushed key is no longer in any WAL segment
+	walFiles, err := kv.walFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, walFile := range walFiles {
+		data, err := os.ReadFile(walFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "flushed") {
+			t.Fatalf("WAL segment %s still holds the flushed key", walFile)
+		}
+	}
+
+	copied := crashCopy(t, dir)
+	recovered := openStore(t, copied, Options{})
+	mustGet(t, recovered, "flushed", "durable")
+	mustGet(t, recovered, "logged", "in the WAL")
+	recovered.Close()
+
+	// Recovery refuses to serve a view missing a committed SSTable
+	tables, err := filepath.Glob(filepath.Join(copied, "sstable_*.sst"))
+	if err != nil || len(tables) == 0 {
+		t.Fatalf("found SSTables %v, %v", tables, err)
+	}
+	if err := os.Remove(tables[0]); err != nil {
+		t.Fatal(err)
+	}
+	broken, err := NewKeyValueStore(filepath.Join(copied, "wal.log"), copied, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broken.Close()
+	if err := broken.Recover(); err == nil {
+		t.Fatal("Recover succeeded without a committed SSTable")
+	}
+}
+
+func TestReadyAfterRecovery(t *testing.T) {
+	dir := t.TempDir()
+	kv, err := NewKeyValueStore(filepath.Join(dir, "wal.log"), dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	if w := serve(handleReady(kv), "GET", "/ready", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/ready before recovery returned %d, want 503", w.Code)
+	}
+	if w := serve(handleHealth(kv), "GET", "/health", ""); w.Code != http.StatusOK {
+		t.Fatalf("/health returned %d, want 200", w.Code)
+	}
+	if err := kv.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(handleReady(kv), "GET", "/ready", ""); w.Code != http.StatusOK {
+		t.Fatalf("/ready after recovery returned %d, want 200", w.Code)
+	}
+
+	// A closed WAL is no longer live
+	kv.CloseWAL()
+	if w := serve(handleHealth(kv), "GET", "/health", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/health with the WAL closed returned %d, want 503", w.Code)
+	}
+}
+
+// decodeJSON decodes the response body into a map, failing the test if it
+// isn't a JSON object.
+func decodeJSON(t testing.TB, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", contentType)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+	return body
+}
+
+func TestHandlerStatusCodes(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+
+	w := serve(handleSet(kv), "POST", "/set", `{"key": "k", "value": "v"}`)
+	if w.Code != http.StatusCreated || decodeJSON(t, w)["key"] != "k" {
+		t.Fatalf("set returned %d %s, want 201 with the key", w.Code, w.Body)
+	}
+	w = serve(handleSet(kv), "POST", "/set", `{"key": `)
+	if w.Code != http.StatusBadRequest || decodeJSON(t, w)["error"] == nil {
+		t.Fatalf("set with bad JSON returned %d %s, want 400 with an error", w.Code, w.Body)
+	}
+
+	w = serve(handleGet(kv), "GET", "/get?key=k", "")
+	if body := decodeJSON(t, w); w.Code != http.StatusOK || body["key"] != "k" || body["value"] != "v" {
+		t.Fatalf("get of a hit returned %d %s, want 200 with the value", w.Code, w.Body)
+	}
+	w = serve(handleGet(kv), "GET", "/get?key=missing", "")
+	if w.Code != http.StatusNotFound || decodeJSON(t, w)["error"] == nil {
+		t.Fatalf("get of a miss returned %d %s, want 404 with an error", w.Code, w.Body)
+	}
+
+	w = serve(handleDelete(kv), "DELETE", "/del?key=k", "")
+	if body := decodeJSON(t, w); w.Code != http.StatusOK || body["value"] != "v" {
+		t.Fatalf("delete of an existing key returned %d %s, want 200 with the value", w.Code, w.Body)
+	}
+	w = serve(handleDelete(kv), "DELETE", "/del?key=k", "")
+	if w.Code != http.StatusNotFound || decodeJSON(t, w)["error"] == nil {
+		t.Fatalf("delete of a missing key returned %d %s, want 404 with an error", w.Code, w.Body)
+	}
+}
+
+func TestHandlerPlainText(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "k", "v")
+
+	r := httptest.NewRequest("GET", "/get?key=k", nil)
+	r.Header.Set("Accept", "text/plain")
+	w := httptest.NewRecorder()
+	handleGet(kv)(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "Value: v\n" {
+		t.Fatalf("plain-text get returned %d %q", w.Code, w.Body)
+	}
+}
+
+func TestKeyAndValueSizeLimits(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{MaxKeySize: 8, MaxValueSize: 16})
+
+	if err := kv.Set(strings.Repeat("k", 8), []byte("v")); err != nil {
+		t.Fatalf("Set of a key at the limit: %v", err)
+	}
+	if err := kv.Set(strings.Repeat("k", 9), []byte("v")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("Set of a key one byte over the limit = %v, want ErrKeyTooLarge", err)
+	}
+	if err := kv.Set("", []byte("v")); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("Set of an empty key = %v, want ErrEmptyKey", err)
+	}
+	if err := kv.Set("k", make([]byte, 16)); err != nil {
+		t.Fatalf("Set of a value at the limit: %v", err)
+	}
+	if err := kv.Set("k", make([]byte, 17)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Set of a value one byte over the limit = %v, want ErrValueTooLarge", err)
+	}
+
+	body := fmt.Sprintf(`{"key": %q, "value": "v"}`, strings.Repeat("k", 9))
+	if w := serve(handleSet(kv), "POST", "/set", body); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("/set with an oversized key returned %d, want 413", w.Code)
+	}
+	if w := serve(handleSet(kv), "POST", "/set", `{"key": "", "value": "v"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("/set with an empty key returned %d, want 400", w.Code)
+	}
+}
+
+// mustScan scans the whole store or fails the test.
+func mustScan(t testing.TB, kv *KeyValueStore) []KeyValue {
+	t.Helper()
+	pairs, err := kv.Scan("", "")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	return pairs
+}
+
+// populate sets n keys named key000 and up, flushing the first half, and
+// deletes every third one.
+func populate(t testing.TB, kv *KeyValueStore, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		mustSet(t, kv, fmt.Sprintf("key%03d", i), fmt.Sprint("value", i))
+		if i == n/2 {
+			mustFlush(t, kv)
+		}
+	}
+	for i := 0; i < n; i += 3 {
+		if _, _, err := kv.Delete(fmt.Sprintf("key%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSnapshotRestoreRoundTrip(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	populate(t, kv, 30)
+	want := mustScan(t, kv)
+
+	var buf bytes.Buffer
+	if err := kv.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := openStore(t, t.TempDir(), Options{})
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := mustScan(t, restored); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored store holds %v, want %v", got, want)
+	}
+}
+
+func TestMetricsCountOperations(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "a", "1")
+	mustSet(t, kv, "b", "2")
+	mustFlush(t, kv)
+	mustGet(t, kv, "a", "1") // Reads the SSTable and caches the result
+	mustGet(t, kv, "a", "1")
+	mustMiss(t, kv, "missing")
+	if _, _, err := kv.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(handleMetrics(kv), "GET", "/metrics", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics returned %d", w.Code)
+	}
+	for _, line := range []string{
+		`kv_operations_total{op="set"} 2`,
+		`kv_operations_total{op="get"} 3`,
+		`kv_operations_total{op="delete"} 1`,
+		`kv_flushes_total 1`,
+		`kv_cache_hits_total 1`,
+		`kv_operation_duration_seconds_count{op="set"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("/metrics lacks %q", line)
+		}
+	}
+	if strings.Contains(w.Body.String(), "kv_sstable_reads_total 0\n") {
+		t.Error("/metrics counted no SSTable reads")
+	}
+}
+
+func TestWriteBatchCommit(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "old", "value")
+
+	batch := kv.NewWriteBatch()
+	batch.Set("a", []byte("1"))
+	batch.Set("b", []byte("2"))
+	batch.Delete("old")
+	mustGet(t, kv, "old", "value")
+	mustMiss(t, kv, "a")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	mustGet(t, kv, "a", "1")
+	mustGet(t, kv, "b", "2")
+	mustMiss(t, kv, "old")
+	if err := batch.Commit(); !errors.Is(err, ErrBatchClosed) {
+		t.Fatalf("second Commit = %v, want ErrBatchClosed", err)
+	}
+}
+
+func TestWriteBatchDiscard(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "old", "value")
+
+	batch := kv.NewWriteBatch()
+	batch.Set("a", []byte("1"))
+	batch.Delete("old")
+	batch.Close()
+	if err := batch.Commit(); !errors.Is(err, ErrBatchClosed) {
+		t.Fatalf("Commit after Close = %v, want ErrBatchClosed", err)
+	}
+
+	mustMiss(t, kv, "a")
+	mustGet(t, kv, "old", "value")
+}
+
+func TestWriteBatchValidatesKeys(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{MaxKeySize: 4})
+	batch := kv.NewWriteBatch()
+	if err := batch.Set("", []byte("v")); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Set of an empty key = %v, want ErrEmptyKey", err)
+	}
+	if err := batch.Delete(""); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Delete of an empty key = %v, want ErrEmptyKey", err)
+	}
+	if err := batch.Delete("toolong"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Delete of an oversized key = %v, want ErrKeyTooLarge", err)
+	}
+	if len(batch.ops) != 0 {
+		t.Errorf("batch staged %d rejected operations", len(batch.ops))
+	}
+}
+
+func TestWriteBatchRecoveredAtomically(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	mustSet(t, kv, "old", "value")
+	batch := kv.NewWriteBatch()
+	batch.Set("a", []byte("1"))
+	batch.Set("b", []byte("2"))
+	batch.Delete("old")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The whole batch is recovered
+	recovered := openStore(t, crashCopy(t, dir), Options{})
+	mustGet(t, recovered, "a", "1")
+	mustGet(t, recovered, "b", "2")
+	mustMiss(t, recovered, "old")
+
+	// None of a batch whose record was torn by a crash is
+	torn := crashCopy(t, dir)
+	walFile := lastWALSegment(t, torn)
+	info, err := os.Stat(walFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(walFile, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+	recovered = openStore(t, torn, Options{})
+	mustMiss(t, recovered, "a")
+	mustMiss(t, recovered, "b")
+	mustGet(t, recovered, "old", "value")
+}
+
+func TestNewerTombstoneHidesOlderValue(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{CacheSize: -1})
+	mustSet(t, kv, "k", "stale")
+	mustSet(t, kv, "other", "live")
+	mustFlush(t, kv)
+	if _, ok, err := kv.Delete("k"); !ok || err != nil {
+		t.Fatalf("Delete = %v, %v", ok, err)
+	}
+	mustFlush(t, kv)
+
+	if value, ok := kv.SearchSSTFiles("k"); ok {
+		t.Fatalf("SearchSSTFiles = %q, want the tombstone to hide it", value)
+	}
+	mustMiss(t, kv, "k")
+	if pairs := mustScan(t, kv); len(pairs) != 1 || pairs[0].Key != "other" {
+		t.Fatalf("Scan = %v, want only other", pairs)
+	}
+}
+
+// iterate collects the pairs an iterator returns and closes it.
+func iterate(t testing.TB, it *Iterator) []string {
+	t.Helper()
+	defer it.Close()
+	var pairs []string
+	for it.Next() {
+		pairs = append(pairs, it.Key()+"="+string(it.Value()))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iterating: %v", err)
+	}
+	return pairs
+}
+
+func TestIteratorMergesLayers(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	for _, key := range []string{"a", "c", "e"} {
+		mustSet(t, kv, key, "old")
+	}
+	mustFlush(t, kv)
+	for _, key := range []string{"b", "c", "d"} {
+		mustSet(t, kv, key, "mid")
+	}
+	mustFlush(t, kv)
+	mustSet(t, kv, "e", "new")
+	mustSet(t, kv, "f", "new")
+	if _, _, err := kv.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"b=mid", "c=mid", "d=mid", "e=new", "f=new"}
+	if got := iterate(t, kv.NewIterator("", "")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("iterator returned %v, want %v", got, want)
+	}
+	want = []string{"c=mid", "d=mid"}
+	if got := iterate(t, kv.NewIterator("c", "e")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("iterator over [c, e) returned %v, want %v", got, want)
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	for i := 0; i < 10; i++ {
+		mustSet(t, kv, fmt.Sprint("key", i), "value")
+		if i == 4 {
+			mustFlush(t, kv)
+		}
+	}
+
+	deleted, err := kv.DeleteRange("key3", "key7")
+	if err != nil || deleted != 4 {
+		t.Fatalf("DeleteRange = %d, %v; want 4 keys", deleted, err)
+	}
+	for i := 0; i < 10; i++ {
+		if i >= 3 && i < 7 {
+			mustMiss(t, kv, fmt.Sprint("key", i))
+		} else {
+			mustGet(t, kv, fmt.Sprint("key", i), "value")
+		}
+	}
+
+	w := serve(handleDeleteRange(kv), "POST", "/delrange?start=key0&end=key2", "")
+	if body := decodeJSON(t, w); w.Code != http.StatusOK || body["deleted"] != 2.0 {
+		t.Fatalf("/delrange returned %d %s, want 2 deleted", w.Code, w.Body)
+	}
+	if pairs := mustScan(t, kv); len(pairs) != 4 {
+		t.Fatalf("%d keys remain, want 4", len(pairs))
+	}
+}
+
+func TestReadOnlyStore(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	mustSet(t, kv, "flushed", "1")
+	mustFlush(t, kv)
+	mustSet(t, kv, "logged", "2")
+	kv.Close()
+	before, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := openStore(t, dir, Options{ReadOnly: true})
+	mustGet(t, reader, "flushed", "1")
+	mustGet(t, reader, "logged", "2")
+	if pairs := mustScan(t, reader); len(pairs) != 2 {
+		t.Fatalf("Scan = %v, want 2 pairs", pairs)
+	}
+	if err := reader.Set("k", []byte("v")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Set = %v, want ErrReadOnly", err)
+	}
+	if _, _, err := reader.Delete("flushed"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete = %v, want ErrReadOnly", err)
+	}
+	if err := reader.Flush(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Flush = %v, want ErrReadOnly", err)
+	}
+	if w := serve(handleSet(reader), "POST", "/set", `{"key": "k", "value": "v"}`); w.Code != http.StatusForbidden {
+		t.Errorf("/set returned %d, want 403", w.Code)
+	}
+	reader.Close()
+
+	after, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("the read-only store changed the directory from %v to %v", before, after)
+	}
+}
+
+func TestContentTypeSurvivesFlush(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	if err := kv.SetTyped("doc", []byte(`{"a": 1}`), "application/json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.SetTyped("note", []byte("hi"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, kv, "blob", "\x00\x01")
+	if err := kv.SetTyped("bad", []byte("x"), "image/png"); !errors.Is(err, ErrUnsupportedContentType) {
+		t.Fatalf("SetTyped with an unknown type = %v, want ErrUnsupportedContentType", err)
+	}
+	mustFlush(t, kv)
+	kv.Close()
+
+	kv = openStore(t, dir, Options{})
+	for key, want := range map[string]string{
+		"doc":  "application/json",
+		"note": "text/plain; charset=utf-8",
+		"blob": "application/octet-stream",
+	} {
+		if _, contentType, ok := kv.GetTyped(key); !ok || contentType != want {
+			t.Errorf("GetTyped(%q) has type %q, %v; want %q", key, contentType, ok, want)
+		}
+	}
+	w := serve(handleGet(kv), "GET", "/get?key=doc&raw=1", "")
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("/get?raw=1 has Content-Type %q, want application/json", contentType)
+	}
+}
+
+func TestKeyLengthBoundsPerSSTable(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, strings.Repeat("l", 20), "v")
+	mustSet(t, kv, strings.Repeat("m", 30), "v")
+	mustFlush(t, kv)
+	long := newestTable(t, kv)
+	mustSet(t, kv, "s", "v")
+	mustSet(t, kv, "ss", "v")
+	mustFlush(t, kv)
+	short := newestTable(t, kv)
+
+	for _, test := range []struct {
+		table             string
+		smallest, largest uint32
+	}{
+		{long, 20, 30},
+		{short, 1, 2},
+	} {
+		dump, err := kv.DumpSSTable(test.table, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dump.SmallestKeyLength != test.smallest || dump.LargestKeyLength != test.largest {
+			t.Errorf("%s has key lengths %d to %d, want %d to %d", test.table, dump.SmallestKeyLength, dump.LargestKeyLength, test.smallest, test.largest)
+		}
+	}
+}
+
+func TestFlushAtMemtableBytes(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{MaxMemtableBytes: 1000})
+	value := strings.Repeat("v", 400)
+	mustSet(t, kv, "a", value)
+	mustSet(t, kv, "b", value)
+	waitForBackground(kv)
+	if files, _ := filepath.Glob(filepath.Join(dir, "sstable_*.sst")); len(files) != 0 {
+		t.Fatal("flushed below the byte limit")
+	}
+
+	mustSet(t, kv, "c", value)
+	waitForBackground(kv)
+	files, err := filepath.Glob(filepath.Join(dir, "sstable_*.sst"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got SSTables %v after crossing the byte limit, want 1", files)
+	}
+	stats, err := kv.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MemtableKeys != 0 || stats.MemtableBytes != 0 {
+		t.Fatalf("memtable holds %d keys, %d bytes after the flush", stats.MemtableKeys, stats.MemtableBytes)
+	}
+}
+
+// holdFlushes makes the store's flushes wait, before writing each SSTable,
+// until the returned function is called. Each flush's SSTable write is
+// reported on started.
+func holdFlushes(kv *KeyValueStore) (started <-chan string, release func()) {
+	starts := make(chan string, 100)
+	held := make(chan struct{})
+	kv.mu.Lock()
+	write := kv.writeTable
+	kv.writeTable = func(filename string, seq uint64, entries []iteratorEntry) error {
+		starts <- filename
+		<-held
+		return write(filename, seq, entries)
+	}
+	kv.mu.Unlock()
+	return starts, sync.OnceFunc(func() { close(held) })
+}
+
+func TestReadsDuringFlush(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	started, release := holdFlushes(kv)
+	defer release()
+	for i := 0; i < memtableFlushKeys; i++ {
+		mustSet(t, kv, fmt.Sprint("key", i), "value")
+	}
+	<-started
+
+	// The full memtable is being flushed while it is read and written
+	stats, err := kv.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.PendingFlushes != 1 || stats.MemtableKeys != 0 {
+		t.Fatalf("stats = %+v, want the memtable waiting to be flushed", stats)
+	}
+	for i := 0; i < memtableFlushKeys; i++ {
+		value, source, ok := kv.GetWithSource(fmt.Sprint("key", i))
+		if !ok || string(value) != "value" || source != SourceMemtable {
+			t.Fatalf("GetWithSource(key%d) = %q, %v, %v during the flush", i, value, source, ok)
+		}
+	}
+	mustSet(t, kv, "during", "flush")
+
+	release()
+	waitForBackground(kv)
+	for i := 0; i < memtableFlushKeys; i++ {
+		if _, source, _ := kv.GetWithSource(fmt.Sprint("key", i)); source != SourceSSTable {
+			t.Fatalf("key%d is served from %v after the flush", i, source)
+		}
+	}
+	mustGet(t, kv, "during", "flush")
+}
+
+func TestCompactionIntoL1(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	value := strings.Repeat("v", 80<<10)
+	// Each flush covers the whole key range, so every L0 table overlaps
+	// the others; together they hold more than one compaction output file.
+	for round := 0; round < l0CompactionTrigger; round++ {
+		for i := 0; i < memtableFlushKeys; i++ {
+			mustSet(t, kv, fmt.Sprintf("key%03d", i*l0CompactionTrigger+round), value)
+		}
+		waitForBackground(kv)
+	}
+	waitForBackground(kv)
+
+	tables, err := kv.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l1 []SSTableInfo
+	for _, table := range tables {
+		if table.Level != 1 {
+			t.Fatalf("%s is in L%d after compaction", table.File, table.Level)
+		}
+		l1 = append(l1, table)
+	}
+	if len(l1) < 2 {
+		t.Fatalf("compaction wrote %d L1 tables, want several", len(l1))
+	}
+	sort.Slice(l1, func(i, j int) bool { return l1[i].MinKey < l1[j].MinKey })
+	for i := 1; i < len(l1); i++ {
+		if l1[i].MinKey <= l1[i-1].MaxKey {
+			t.Fatalf("L1 tables overlap: %s [%s, %s] and %s [%s, %s]", l1[i-1].File, l1[i-1].MinKey, l1[i-1].MaxKey, l1[i].File, l1[i].MinKey, l1[i].MaxKey)
+		}
+	}
+	for i := 0; i < memtableFlushKeys*l0CompactionTrigger; i++ {
+		mustGet(t, kv, fmt.Sprintf("key%03d", i), value)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := openStore(t, t.TempDir(), Options{})
+	populate(t, src, 30)
+	mustSet(t, src, "binary", "\x00\xff\n")
+	want := mustScan(t, src)
+
+	w := serve(handleExport(src), http.MethodGet, "/export", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("export returned %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if lines := strings.Count(w.Body.String(), "\n"); lines != len(want) {
+		t.Fatalf("export has %d lines, want %d", lines, len(want))
+	}
+
+	dst := openStore(t, t.TempDir(), Options{})
+	w = serve(handleImport(dst), http.MethodPost, "/import", w.Body.String())
+	if w.Code != http.StatusOK {
+		t.Fatalf("import returned %d: %s", w.Code, w.Body)
+	}
+	if got := mustScan(t, dst); !reflect.DeepEqual(got, want) {
+		t.Fatalf("imported %v, want %v", got, want)
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, 32)
+	kv := openStore(t, dir, Options{EncryptionKey: key})
+	mustSet(t, kv, "flushed", "secret value")
+	mustFlush(t, kv)
+	mustSet(t, kv, "logged", "secret value")
+	waitForBackground(kv)
+
+	// Nothing on disk holds the plaintext
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("secret value")) {
+			t.Fatalf("%s holds a value in plaintext", file)
+		}
+	}
+
+	reopened := openStore(t, crashCopy(t, dir), Options{EncryptionKey: key})
+	mustGet(t, reopened, "flushed", "secret value")
+	mustGet(t, reopened, "logged", "secret value")
+
+	wrongKey := bytes.Repeat([]byte{2}, 32)
+	wrongDir := crashCopy(t, dir)
+	wrong, err := NewKeyValueStore(filepath.Join(wrongDir, "wal.log"), wrongDir, Options{EncryptionKey: wrongKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrong.Close()
+	if err := wrong.Recover(); !errors.Is(err, ErrDecryption) {
+		t.Fatalf("recovering the WAL with the wrong key returned %v, want ErrDecryption", err)
+	}
+	if _, err := wrong.GetE("flushed"); !errors.Is(err, ErrDecryption) {
+		t.Fatalf("reading an SSTable with the wrong key returned %v, want ErrDecryption", err)
+	}
+}
+
+func TestTruncatedWALTail(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	mustSet(t, kv, "complete", "value")
+	crashed := crashCopy(t, dir)
+
+	// A crash in the middle of a write leaves half a record at the end
+	walPath := lastWALSegment(t, crashed)
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := bytes.TrimSuffix(data, []byte("\n"))
+	if err := os.WriteFile(walPath, append(data, record[:len(record)/2]...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openStore(t, crashed, Options{})
+	mustGet(t, reopened, "complete", "value")
+
+	// New records follow the last complete one, so they survive another restart
+	mustSet(t, reopened, "after", "recovery")
+	reopened = openStore(t, crashCopy(t, crashed), Options{})
+	mustGet(t, reopened, "complete", "value")
+	mustGet(t, reopened, "after", "recovery")
+}
+
+// walBytes returns the total size of the store's WAL segments.
+func walBytes(t *testing.T, kv *KeyValueStore) int64 {
+	t.Helper()
+	walFiles, err := kv.walFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, walFile := range walFiles {
+		info, err := os.Stat(walFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+	}
+	return total
+}
+
+func TestIngestSorted(t *testing.T) {
+	const pairs = 100000
+	kv := openStore(t, t.TempDir(), Options{})
+	var input bytes.Buffer
+	encoder := json.NewEncoder(&input)
+	for i := 0; i < pairs; i++ {
+		if err := encoder.Encode(exportRecord{Key: fmt.Sprintf("key%06d", i), Value: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := walBytes(t, kv)
+
+	ingested, err := kv.IngestSorted(&input)
+	if err != nil || ingested != pairs {
+		t.Fatalf("IngestSorted = %d, %v, want %d", ingested, err, pairs)
+	}
+
+	// The pairs went straight to a few synced SSTables, not through the
+	// WAL, which is synced for every write
+	if after := walBytes(t, kv); after != before {
+		t.Fatalf("the WAL grew from %d to %d bytes", before, after)
+	}
+	tables, err := kv.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) == 0 || len(tables) > 4 {
+		t.Fatalf("ingestion wrote %d SSTables", len(tables))
+	}
+	scanned := mustScan(t, kv)
+	if len(scanned) != pairs {
+		t.Fatalf("scanned %d pairs, want %d", len(scanned), pairs)
+	}
+	for i, pair := range scanned {
+		if pair.Key != fmt.Sprintf("key%06d", i) || string(pair.Value) != fmt.Sprint(i) {
+			t.Fatalf("pair %d is %s=%s", i, pair.Key, pair.Value)
+		}
+	}
+	mustGet(t, kv, "key000000", "0")
+	mustGet(t, kv, "key099999", "99999")
+}
+
+// keysOf returns the keys of the pairs.
+func keysOf(pairs []KeyValue) []string {
+	keys := []string{}
+	for _, pair := range pairs {
+		keys = append(keys, pair.Key)
+	}
+	return keys
+}
+
+func TestScanPrefix(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	for _, key := range []string{"app", "apple", "apply", "apr", "b", "\xff\xffx"} {
+		mustSet(t, kv, key, "v")
+	}
+	mustFlush(t, kv)
+	mustSet(t, kv, "appz", "v")
+	if _, _, err := kv.Delete("apply"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"app", []string{"app", "apple", "appz"}},
+		{"", []string{"app", "apple", "appz", "apr", "b", "\xff\xffx"}},
+		{"c", []string{}},
+		{"\xff\xff", []string{"\xff\xffx"}}, // The upper bound wraps to unbounded
+	} {
+		pairs, err := kv.ScanPrefix(test.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keysOf(pairs); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ScanPrefix(%q) = %q, want %q", test.prefix, got, test.want)
+		}
+	}
+
+	w := serve(handleScanPrefix(kv), http.MethodGet, "/scanprefix?prefix=ap", "")
+	var pairs []map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&pairs); err != nil || len(pairs) != 4 || pairs[3]["key"] != "apr" {
+		t.Fatalf("/scanprefix returned %d %v, %v", w.Code, pairs, err)
+	}
+}
+
+func TestCount(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	for i := 0; i < 5; i++ {
+		mustSet(t, kv, fmt.Sprint("flushed", i), "v")
+	}
+	mustFlush(t, kv)
+	mustSet(t, kv, "flushed0", "overwritten")
+	mustSet(t, kv, "new0", "v")
+	mustSet(t, kv, "new1", "v")
+	if count, err := kv.Count(); err != nil || count != 7 {
+		t.Fatalf("Count = %d, %v, want 7", count, err)
+	}
+
+	if _, _, err := kv.Delete("flushed1"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := kv.Count(); err != nil || count != 6 {
+		t.Fatalf("Count after a delete = %d, %v, want 6", count, err)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	handler := requireToken("secret", handleSet(kv))
+	for _, test := range []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"authorized", "Bearer secret", http.StatusCreated},
+		{"missing token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+		{"wrong scheme", "Basic secret", http.StatusUnauthorized},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/set", strings.NewReader(`{"key": "k", "value": "v"}`))
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != test.want {
+				t.Fatalf("status %d, want %d", w.Code, test.want)
+			}
+			if test.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("401 without a WWW-Authenticate header")
+			}
+		})
+	}
+
+	// Without a token, the handler is left open
+	if w := serve(requireToken("", handleSet(kv)), http.MethodPost, "/set", `{"key": "k", "value": "v"}`); w.Code != http.StatusCreated {
+		t.Fatalf("unprotected handler returned %d", w.Code)
+	}
+}
+
+func TestKVRawBody(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	router := http.NewServeMux()
+	router.HandleFunc("GET /kv/{key...}", handleKVGet(kv))
+	router.HandleFunc("POST /kv/{key...}", handleKVPut(kv))
+	router.HandleFunc("DELETE /kv/{key...}", handleKVDelete(kv))
+
+	// Null bytes and invalid UTF-8 can't be carried by a JSON string
+	value := "\x00binary\xff\xfe\x00\n"
+	if w := serve(router.ServeHTTP, http.MethodPost, "/kv/dir/file", value); w.Code != http.StatusCreated {
+		t.Fatalf("POST returned %d: %s", w.Code, w.Body)
+	}
+	mustGet(t, kv, "dir/file", value)
+
+	for _, flushed := range []bool{false, true} {
+		if flushed {
+			mustFlush(t, kv)
+		}
+		w := serve(router.ServeHTTP, http.MethodGet, "/kv/dir/file", "")
+		if w.Code != http.StatusOK || w.Body.String() != value || w.Header().Get("Content-Length") != fmt.Sprint(len(value)) {
+			t.Fatalf("GET returned %d %q (Content-Length %s), want %q", w.Code, w.Body, w.Header().Get("Content-Length"), value)
+		}
+	}
+
+	if w := serve(router.ServeHTTP, http.MethodDelete, "/kv/dir/file", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE returned %d", w.Code)
+	}
+	if w := serve(router.ServeHTTP, http.MethodGet, "/kv/dir/file", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("GET of a deleted key returned %d", w.Code)
+	}
+}
+
+// tableEntries returns the entries of every committed SSTable for key.
+func tableEntries(t *testing.T, kv *KeyValueStore, key string) []SSTableDumpEntry {
+	t.Helper()
+	tables, err := kv.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []SSTableDumpEntry
+	for _, table := range tables {
+		dump, err := kv.DumpSSTable(table.File, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range dump.Entries {
+			if entry.Key == key {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+func TestTombstoneGC(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		gracePeriod time.Duration
+		dropped     bool
+	}{
+		{"past grace period", 0, true},
+		{"within grace period", time.Hour, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			kv := openStore(t, t.TempDir(), Options{TombstoneGracePeriod: test.gracePeriod})
+			mustSet(t, kv, "k", "old")
+			mustSet(t, kv, "other", "v")
+			mustFlush(t, kv)
+
+			// Move the value down to L2, as deeper compactions would
+			kv.mu.Lock()
+			kv.manifest.Tables[0].Level = 2
+			kv.mu.Unlock()
+
+			if _, _, err := kv.Delete("k"); err != nil {
+				t.Fatal(err)
+			}
+			mustFlush(t, kv)
+			waitForBackground(kv)
+
+			// A compaction of L0 into L1 leaves the value in L2, so the
+			// tombstone must stay to hide it
+			tombstoneTable := kv.manifest.Tables[1]
+			if tombstoneTable.Level != 0 {
+				t.Fatalf("the tombstone was flushed to L%d", tombstoneTable.Level)
+			}
+			table, err := kv.loadTableInfo(tombstoneTable)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := kv.compactTables([]tableInfo{table}, 1)
+			if err != nil || result.TombstonesDropped != 0 {
+				t.Fatalf("partial compaction = %+v, %v, want the tombstone kept", result, err)
+			}
+			mustMiss(t, kv, "k")
+
+			// A compaction of every table leaves nothing for it to hide
+			result, err = kv.Compact()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries := tableEntries(t, kv, "k")
+			if test.dropped && (result.TombstonesDropped != 1 || len(entries) != 0) {
+				t.Fatalf("full compaction = %+v with %v left for k, want the tombstone dropped", result, entries)
+			}
+			if !test.dropped && (result.TombstonesDropped != 0 || len(entries) != 1 || entries[0].Marker != 1) {
+				t.Fatalf("full compaction = %+v with %v left for k, want the tombstone kept", result, entries)
+			}
+			mustMiss(t, kv, "k")
+			mustGet(t, kv, "other", "v")
+
+			// Nor does the value return after a restart
+			kv.Close()
+			mustMiss(t, openStore(t, kv.dataDir, Options{}), "k")
+		})
+	}
+}
+
+func TestSkipListSorted(t *testing.T) {
+	list := newSkipList(strings.Compare)
+	want := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint((i * 7919) % 1009) // Not in order, with repeats
+		list.put(key, []byte(fmt.Sprint(i)))
+		want[key] = fmt.Sprint(i)
+		if i%5 == 0 {
+			list.remove(key)
+			delete(want, key)
+		}
+	}
+
+	var keys []string
+	for node := list.head.next[0]; node != nil; node = node.next[0] {
+		if string(node.value) != want[node.key] {
+			t.Fatalf("%s = %s, want %s", node.key, node.value, want[node.key])
+		}
+		keys = append(keys, node.key)
+	}
+	if !sort.StringsAreSorted(keys) || len(keys) != len(want) || list.len() != len(want) {
+		t.Fatalf("skip list holds %d keys (len %d) in order %v, want %d sorted keys", len(keys), list.len(), keys, len(want))
+	}
+
+	// A memtable scan walks the list in order
+	kv := openStore(t, t.TempDir(), Options{})
+	for _, key := range []string{"c", "a", "b"} {
+		mustSet(t, kv, key, key)
+	}
+	if got := keysOf(mustScan(t, kv)); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("memtable scan = %q", got)
+	}
+}
+
+// BenchmarkFlush compares writing an SSTable from the sorted memtable with
+// sorting the keys of a map first, as the memtable used to be.
+func BenchmarkFlush(b *testing.B) {
+	kv := openStore(b, b.TempDir(), Options{})
+	data := map[string][]byte{}
+	table := &frozenMemtable{data: newSkipList(kv.compare), deletedKeys: map[string]bool{}}
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprint("key", (i*7919)%10007)
+		data[key] = []byte("value")
+		table.data.put(key, []byte("value"))
+	}
+	filename := filepath.Join(b.TempDir(), "flush.sst")
+
+	b.Run("skiplist", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := kv.writeSSTable(filename, 1, table); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("sorted map", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			keys := make([]string, 0, len(data))
+			for key := range data {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			sorted := &frozenMemtable{data: newSkipList(kv.compare), deletedKeys: map[string]bool{}}
+			for _, key := range keys {
+				sorted.data.put(key, data[key])
+			}
+			if err := kv.writeSSTable(filename, 1, sorted); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestGetEncodings(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "text", "hello")
+	binaryValue := "\x00\xff\xfe\n"
+	mustSet(t, kv, "binary", binaryValue)
+
+	// A text value, as JSON and as the raw bytes
+	w := serve(handleGet(kv), http.MethodGet, "/get?key=text", "")
+	if body := decodeJSON(t, w); w.Code != http.StatusOK || body["value"] != "hello" {
+		t.Fatalf("/get returned %d %v", w.Code, body)
+	}
+	w = serve(handleGet(kv), http.MethodGet, "/get?key=text&raw=1", "")
+	if w.Code != http.StatusOK || w.Body.String() != "hello" || w.Header().Get("Content-Length") != "5" {
+		t.Fatalf("/get raw returned %d %q (Content-Length %s)", w.Code, w.Body, w.Header().Get("Content-Length"))
+	}
+
+	// A binary value round-trips through base64
+	w = serve(handleGet(kv), http.MethodGet, "/get?key=binary&encoding=base64", "")
+	body := decodeJSON(t, w)
+	value, err := base64.StdEncoding.DecodeString(fmt.Sprint(body["value"]))
+	if w.Code != http.StatusOK || body["encoding"] != "base64" || err != nil || string(value) != binaryValue {
+		t.Fatalf("/get with base64 returned %d %v, decoded to %q, %v", w.Code, body, value, err)
+	}
+
+	w = serve(handleGet(kv), http.MethodGet, "/get?key=missing&encoding=base64", "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("/get of a missing key returned %d", w.Code)
+	}
+	w = serve(handleGet(kv), http.MethodGet, "/get?key=text&encoding=hex", "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("/get with an unknown encoding returned %d", w.Code)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{FlushInterval: 20 * time.Millisecond})
+	mustSet(t, kv, "a", "1")
+	mustSet(t, kv, "b", "2")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tables, err := kv.SSTables()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tables) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no SSTable was flushed after the interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForBackground(kv)
+	for _, key := range []string{"a", "b"} {
+		if _, source, _ := kv.GetWithSource(key); source != SourceSSTable {
+			t.Fatalf("%s is served from %v after the timed flush", key, source)
+		}
+	}
+
+	// Close stops the timer
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNegativeLookupOpensNoFiles(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	for table := 0; table < 3; table++ {
+		for i := 0; i < 5; i++ {
+			mustSet(t, kv, fmt.Sprintf("key%02d", i*3+table), "value")
+		}
+		mustFlush(t, kv)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tables are indexed at startup; every key range covers the
+	// missing keys, so only the bloom filters rule them out
+	reopened := openStore(t, dir, Options{CacheSize: -1})
+	opened := countOpens(reopened)
+	for i := 0; i < 20; i++ {
+		mustMiss(t, reopened, fmt.Sprintf("key%02d.5", i))
+	}
+	if got := opened(); len(got) != 0 {
+		t.Fatalf("negative lookups opened %v", got)
+	}
+	mustGet(t, reopened, "key07", "value")
+}
+
+func TestDeleteReturnsPriorValue(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "flushed", "on disk")
+	mustFlush(t, kv)
+	mustSet(t, kv, "memory", "in memory")
+
+	for _, test := range []struct {
+		key   string
+		value string
+		ok    bool
+	}{
+		{"memory", "in memory", true},
+		{"flushed", "on disk", true},
+		{"flushed", "", false}, // Already deleted
+		{"missing", "", false},
+	} {
+		value, ok, err := kv.Delete(test.key)
+		if err != nil || ok != test.ok || string(value) != test.value {
+			t.Fatalf("Delete(%s) = %q, %v, %v, want %q, %v", test.key, value, ok, err, test.value, test.ok)
+		}
+		mustMiss(t, kv, test.key)
+	}
+
+	// Deleting the flushed key wrote a tombstone that hides it on disk too
+	mustFlush(t, kv)
+	if entries := tableEntries(t, kv, "flushed"); len(entries) != 2 || entries[0].Marker != 1 {
+		t.Fatalf("SSTable entries for the deleted key: %+v, want a tombstone over the value", entries)
+	}
+	mustMiss(t, kv, "flushed")
+}
+
+func TestLookupLogsNothingByDefault(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil)) // Info, as slog.Default
+	kv := openStore(t, t.TempDir(), Options{Logger: logger, CacheSize: -1})
+	populate(t, kv, 20)
+	mustFlush(t, kv)
+	waitForBackground(kv)
+
+	logs.Reset()
+	mustGet(t, kv, "key001", "value1")
+	mustMiss(t, kv, "key003")
+	mustMiss(t, kv, "missing")
+	if logs.Len() != 0 {
+		t.Fatalf("lookups logged:\n%s", logs.String())
+	}
+
+	// The per-entry tracing is there at Debug level
+	debug := openStore(t, t.TempDir(), Options{Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})), CacheSize: -1})
+	mustSet(t, debug, "k", "v")
+	mustFlush(t, debug)
+	logs.Reset()
+	mustGet(t, debug, "k", "v")
+	if logs.Len() == 0 {
+		t.Fatal("a lookup at Debug level logged nothing")
+	}
+}
+
+func TestFailedWALWriteLeavesStoreUnchanged(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "k", "before")
+	lastSeq := kv.LastSequence()
+
+	// Make every WAL write fail
+	kv.walMu.Lock()
+	kv.wal.Close()
+	kv.walMu.Unlock()
+
+	if err := kv.Set("k", []byte("after")); err == nil {
+		t.Fatal("Set succeeded without a WAL")
+	}
+	if err := kv.Set("new", []byte("value")); err == nil {
+		t.Fatal("Set succeeded without a WAL")
+	}
+	if _, _, err := kv.Delete("k"); err == nil {
+		t.Fatal("Delete succeeded without a WAL")
+	}
+	if swapped, err := kv.CompareAndSwap("k", []byte("before"), []byte("swapped")); swapped || err == nil {
+		t.Fatalf("CompareAndSwap = %v, %v without a WAL", swapped, err)
+	}
+	batch := kv.NewWriteBatch()
+	batch.Set("batched", []byte("value"))
+	if err := batch.Commit(); err == nil {
+		t.Fatal("Commit succeeded without a WAL")
+	}
+
+	if seq := kv.LastSequence(); seq != lastSeq {
+		t.Fatalf("LastSequence moved from %d to %d", lastSeq, seq)
+	}
+	mustGet(t, kv, "k", "before")
+	mustMiss(t, kv, "new")
+	mustMiss(t, kv, "batched")
+}
+
+func TestCompactEndpoint(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 5; i++ {
+			mustSet(t, kv, fmt.Sprint("key", i), fmt.Sprint("value", round))
+		}
+		if round == 2 {
+			if _, _, err := kv.Delete("key0"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mustFlush(t, kv)
+	}
+	waitForBackground(kv)
+
+	// Reads and writes carry on while the compaction runs
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := kv.Set(fmt.Sprint("concurrent", i%5), []byte("v")); err != nil {
+				t.Error(err)
+			}
+			if value, ok := kv.Get("key1"); !ok || string(value) != "value2" {
+				t.Errorf("Get(key1) = %q, %v during the compaction", value, ok)
+			}
+		}
+	}()
+	w := serve(handleCompact(kv), http.MethodPost, "/compact", "")
+	close(stop)
+	wg.Wait()
+
+	body := decodeJSON(t, w)
+	if w.Code != http.StatusOK || body["files_merged"] != 3.0 || body["files_written"] != 1.0 || body["tombstones_dropped"] != 1.0 || body["bytes_reclaimed"].(float64) <= 0 {
+		t.Fatalf("/compact returned %d %v", w.Code, body)
+	}
+	tables, err := kv.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("%d SSTables after compaction, want 1", len(tables))
+	}
+	mustMiss(t, kv, "key0")
+	for i := 1; i < 5; i++ {
+		mustGet(t, kv, fmt.Sprint("key", i), "value2")
+	}
+}
+
+func TestGetStreamLargeValue(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	value := bytes.Repeat([]byte("0123456789abcdef"), 50<<20/16)
+	want := sha256.Sum256(value)
+	if err := kv.Set("large", value); err != nil {
+		t.Fatal(err)
+	}
+	value = nil
+	mustFlush(t, kv)
+	waitForBackground(kv)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	stream, ok := kv.GetStream("large")
+	if !ok {
+		t.Fatal("GetStream found no value")
+	}
+	hash := sha256.New()
+	n, err := io.Copy(hash, stream)
+	stream.Close()
+	runtime.ReadMemStats(&after)
+
+	if err != nil || n != 50<<20 || !bytes.Equal(hash.Sum(nil), want[:]) {
+		t.Fatalf("streamed %d bytes, %v, with a different hash", n, err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 10<<20 {
+		t.Fatalf("streaming a 50MB value allocated %d bytes", allocated)
+	}
+}
+
+func TestFlushSplitsAtTargetFileSize(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{TargetFileSize: 300})
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 9; i++ {
+		mustSet(t, kv, fmt.Sprint("key", i), value)
+	}
+	mustFlush(t, kv)
+	waitForBackground(kv)
+
+	tables, err := kv.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 3 {
+		t.Fatalf("the flush wrote %d SSTables, want 3", len(tables))
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].MinKey < tables[j].MinKey })
+	var keys []string
+	for i, table := range tables {
+		if err := verifySSTable(filepath.Join(kv.dataDir, table.File), nil, kv.compare); err != nil {
+			t.Fatalf("%s: %v", table.File, err)
+		}
+		if i > 0 && table.MinKey <= tables[i-1].MaxKey {
+			t.Fatalf("%s starts at %s, within %s", table.File, table.MinKey, tables[i-1].File)
+		}
+		dump, err := kv.DumpSSTable(table.File, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range dump.Entries {
+			keys = append(keys, entry.Key)
+		}
+	}
+	if want := []string{"key0", "key1", "key2", "key3", "key4", "key5", "key6", "key7", "key8"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("the tables hold %v, want %v", keys, want)
+	}
+	for i := 0; i < 9; i++ {
+		mustGet(t, kv, fmt.Sprint("key", i), value)
+	}
+}
+
+func TestScanWithBoundedFilePool(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{MaxOpenFiles: 8, CacheSize: -1})
+
+	// Hold off compaction, so the tables stay separate
+	kv.mu.Lock()
+	kv.compacting = true
+	kv.mu.Unlock()
+	defer func() {
+		kv.mu.Lock()
+		kv.compacting = false
+		kv.flushDone.Broadcast()
+		kv.mu.Unlock()
+	}()
+	for i := 0; i < 100; i++ {
+		mustSet(t, kv, fmt.Sprintf("key%03d", i), "value")
+		mustSet(t, kv, "shared", fmt.Sprint(i))
+		mustFlush(t, kv)
+	}
+
+	// Count the handles open at once; the pool's lock is held while it
+	// opens a file
+	peak := 0
+	opened := 0
+	kv.files.closeIdle()
+	kv.files.mu.Lock()
+	kv.files.openFile = func(name string) (*os.File, error) {
+		opened++
+		if kv.files.open+1 > peak {
+			peak = kv.files.open + 1
+		}
+		return os.Open(name)
+	}
+	kv.files.mu.Unlock()
+
+	pairs := mustScan(t, kv)
+	if len(pairs) != 101 || pairs[100].Key != "shared" || string(pairs[100].Value) != "99" {
+		t.Fatalf("scanned %d pairs, ending with %+v", len(pairs), pairs[len(pairs)-1])
+	}
+	for i, pair := range pairs[:100] {
+		if pair.Key != fmt.Sprintf("key%03d", i) || string(pair.Value) != "value" {
+			t.Fatalf("pair %d is %s=%s", i, pair.Key, pair.Value)
+		}
+	}
+
+	// A streamed value takes its handle from the same pool
+	kv.files.closeIdle()
+	kv.files.mu.Lock()
+	openedBefore := opened
+	kv.files.mu.Unlock()
+	stream, ok := kv.GetStream("key000")
+	if !ok {
+		t.Fatal("GetStream found no value")
+	}
+	kv.files.mu.Lock()
+	if opened != openedBefore+1 {
+		t.Errorf("GetStream opened %d files through the pool, want 1", opened-openedBefore)
+	}
+	kv.files.mu.Unlock()
+	if value, err := io.ReadAll(stream); err != nil || string(value) != "value" {
+		t.Fatalf("streamed %q, %v", value, err)
+	}
+	stream.Close()
+
+	kv.files.mu.Lock()
+	defer kv.files.mu.Unlock()
+	if opened < 100 || peak > 8 || kv.files.open > 8 {
+		t.Fatalf("opened %d files with at most %d open at once, and %d open now; the limit is 8", opened, peak, kv.files.open)
+	}
+}
+
+func TestSetIfAbsent(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	if stored, err := kv.SetIfAbsent("new", []byte("first")); !stored || err != nil {
+		t.Fatalf("SetIfAbsent of a new key = %v, %v", stored, err)
+	}
+	mustSet(t, kv, "flushed", "value")
+	mustFlush(t, kv)
+	for _, key := range []string{"new", "flushed"} {
+		if stored, err := kv.SetIfAbsent(key, []byte("second")); stored || err != nil {
+			t.Fatalf("SetIfAbsent of existing %s = %v, %v", key, stored, err)
+		}
+	}
+	mustGet(t, kv, "new", "first")
+	mustGet(t, kv, "flushed", "value")
+
+	// Of two racing callers, exactly one stores its value
+	for round := 0; round < 20; round++ {
+		key := fmt.Sprint("race", round)
+		var wins atomic.Int32
+		var wg sync.WaitGroup
+		for caller := 0; caller < 2; caller++ {
+			wg.Add(1)
+			go func(caller int) {
+				defer wg.Done()
+				stored, err := kv.SetIfAbsent(key, []byte(fmt.Sprint(caller)))
+				if err != nil {
+					t.Error(err)
+				}
+				if stored {
+					wins.Add(1)
+				}
+			}(caller)
+		}
+		wg.Wait()
+		if wins.Load() != 1 {
+			t.Fatalf("%d callers stored %s", wins.Load(), key)
+		}
+	}
+
+	// On /set, If-None-Match: * asks for the same
+	for _, want := range []int{http.StatusCreated, http.StatusPreconditionFailed} {
+		r := httptest.NewRequest(http.MethodPost, "/set", strings.NewReader(`{"key": "header", "value": "v"}`))
+		r.Header.Set("If-None-Match", "*")
+		w := httptest.NewRecorder()
+		handleSet(kv)(w, r)
+		if w.Code != want {
+			t.Fatalf("/set with If-None-Match: * returned %d, want %d", w.Code, want)
+		}
+	}
+}
+
+func TestVerifyFindsCorruptTable(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	var corrupted string
+	for table := 0; table < 3; table++ {
+		for i := 0; i < 5; i++ {
+			mustSet(t, kv, fmt.Sprintf("t%d-key%d", table, i), strings.Repeat("v", 50))
+		}
+		mustFlush(t, kv)
+		if table == 1 {
+			corrupted = newestTable(t, kv)
+		}
+	}
+	waitForBackground(kv)
+	if corrupt, err := kv.Verify(); err != nil || len(corrupt) != 0 {
+		t.Fatalf("Verify of intact tables = %v, %v", corrupt, err)
+	}
+
+	// Cut the middle table short
+	path := filepath.Join(kv.dataDir, corrupted)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+	kv.files.closeIdle()
+
+	corrupt, err := kv.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) != 1 || corrupt[0].File != path || corrupt[0].Err == nil {
+		t.Fatalf("Verify = %+v, want only %s", corrupt, corrupted)
+	}
+}
+
+func TestSetAfterDelete(t *testing.T) {
+	for _, flushed := range []bool{false, true} {
+		t.Run(fmt.Sprint("flushed=", flushed), func(t *testing.T) {
+			dir := t.TempDir()
+			kv := openStore(t, dir, Options{})
+			mustSet(t, kv, "k", "old")
+			if flushed {
+				mustFlush(t, kv)
+			}
+			if _, ok, err := kv.Delete("k"); !ok || err != nil {
+				t.Fatalf("Delete = %v, %v", ok, err)
+			}
+			mustSet(t, kv, "k", "new")
+			mustGet(t, kv, "k", "new")
+
+			// The new value was written to the WAL, and outlives a flush
+			waitForBackground(kv)
+			mustGet(t, openStore(t, crashCopy(t, dir), Options{}), "k", "new")
+			mustFlush(t, kv)
+			mustGet(t, kv, "k", "new")
+		})
+	}
+}
+
+func TestServerOnEphemeralPort(t *testing.T) {
+	// Run as the server when started by the test below
+	if os.Getenv("KV_TEST_SERVER") == "1" {
+		flag.CommandLine = flag.NewFlagSet("kvstore", flag.ExitOnError)
+		os.Args = []string{"kvstore", "-addr", "127.0.0.1:0"}
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestServerOnEphemeralPort$")
+	cmd.Dir = t.TempDir()
+	cmd.Env = append(os.Environ(), "KV_TEST_SERVER=1")
+	logs, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Signal(os.Interrupt)
+		cmd.Wait()
+	}()
+
+	// The server logs the address it actually listens on
+	var addr string
+	scanner := bufio.NewScanner(logs)
+	for addr == "" && scanner.Scan() {
+		if _, after, ok := strings.Cut(scanner.Text(), "Server listening on "); ok {
+			addr = strings.TrimSuffix(after, "...")
+		}
+	}
+	if addr == "" {
+		t.Fatalf("the server didn't report its address: %v", scanner.Err())
+	}
+	go io.Copy(io.Discard, logs)
+
+	response, err := http.Post("http://"+addr+"/set", "application/json", strings.NewReader(`{"key": "k", "value": "v"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("/set returned %d", response.StatusCode)
+	}
+	response, err = http.Get("http://" + addr + "/get?key=k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]string
+	err = json.NewDecoder(response.Body).Decode(&body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || err != nil || body["value"] != "v" {
+		t.Fatalf("/get returned %d %v, %v", response.StatusCode, body, err)
+	}
+}
+
+func TestOversizedBody(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	handler := limitBody(1024, handleSet(kv))
+
+	body := fmt.Sprintf(`{"key": "k", "value": %q}`, strings.Repeat("v", 2048))
+	if w := serve(handler, http.MethodPost, "/set", body); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("/set with a %d byte body returned %d, want 413", len(body), w.Code)
+	}
+	mustMiss(t, kv, "k")
+
+	if w := serve(handler, http.MethodPost, "/set", `{"key": "k", "value": "v"}`); w.Code != http.StatusCreated {
+		t.Fatalf("/set with a small body returned %d", w.Code)
+	}
+	mustGet(t, kv, "k", "v")
+}
+
+func TestDeleteStatus(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{CacheSize: -1})
+	mustSet(t, kv, "flushed", "old value")
+	mustFlush(t, kv)
+
+	w := serve(handleDelete(kv), http.MethodDelete, "/del?key=flushed", "")
+	if body := decodeJSON(t, w); w.Code != http.StatusOK || body["value"] != "old value" {
+		t.Fatalf("deleting an existing key returned %d %v, want 200 with its value", w.Code, body)
+	}
+	for _, key := range []string{"flushed", "never"} {
+		w = serve(handleDelete(kv), http.MethodDelete, "/del?key="+key, "")
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("deleting missing key %s returned %d, want 404", key, w.Code)
+		}
+	}
+
+	// An invalid key is neither
+	if w = serve(handleDelete(kv), http.MethodDelete, "/del?key=", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("deleting an empty key returned %d, want 400", w.Code)
+	}
+}
+
+// flushedStore returns a store whose only SSTable holds n keys, key0000,
+// key0002, and so on, written with the sparse index interval.
+func flushedStore(t testing.TB, n, interval int) *KeyValueStore {
+	kv := openStore(t, t.TempDir(), Options{SparseIndexInterval: interval, CacheSize: -1})
+	batch := kv.NewWriteBatch()
+	for i := 0; i < n; i++ {
+		batch.Set(fmt.Sprintf("key%04d", 2*i), []byte(fmt.Sprint(2*i)))
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForBackground(kv)
+	return kv
+}
+
+func TestSparseIndexLookups(t *testing.T) {
+	for _, interval := range []int{1, 4, 16} {
+		t.Run(fmt.Sprint("interval=", interval), func(t *testing.T) {
+			kv := flushedStore(t, 100, interval)
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key%04d", i)
+				if i%2 == 0 {
+					mustGet(t, kv, key, fmt.Sprint(i))
+				} else {
+					mustMiss(t, kv, key) // Between two entries
+				}
+			}
+			mustMiss(t, kv, "a") // Before the first point
+			mustMiss(t, kv, "z") // After the last entry
+		})
+	}
+}
+
+// BenchmarkSparseIndex compares lookups through a dense index, with a point
+// for every entry, with the default sparse one.
+func BenchmarkSparseIndex(b *testing.B) {
+	for _, interval := range []int{1, defaultSparseIndexInterval} {
+		b.Run(fmt.Sprint("interval=", interval), func(b *testing.B) {
+			kv := flushedStore(b, 10000, interval)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				kv.Get(fmt.Sprintf("key%04d", 2*(i%10000)))
+			}
+		})
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{CacheSize: -1})
+	want := map[string][]byte{}
+	for table := 0; table < 3; table++ {
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprintf("t%d-%d", table, i)
+			mustSet(t, kv, key, key)
+			want[key] = []byte(key)
+		}
+		// Newer tables overwrite and delete keys of older ones
+		if table > 0 {
+			mustSet(t, kv, fmt.Sprintf("t%d-0", table-1), "overwritten")
+			want[fmt.Sprintf("t%d-0", table-1)] = []byte("overwritten")
+			if _, _, err := kv.Delete(fmt.Sprintf("t%d-1", table-1)); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, fmt.Sprintf("t%d-1", table-1))
+		}
+		mustFlush(t, kv)
+	}
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprint("memory", i)
+		mustSet(t, kv, key, key)
+		want[key] = []byte(key)
+	}
+	waitForBackground(kv)
+
+	keys := []string{"missing", "absent"}
+	for key := range want {
+		keys = append(keys, key)
+	}
+	for table := 0; table < 2; table++ {
+		keys = append(keys, fmt.Sprintf("t%d-1", table))
+	}
+	if len(keys) != 20 {
+		t.Fatalf("asking for %d keys, want 20", len(keys))
+	}
+
+	opened := countOpens(kv)
+	values, err := kv.MultiGet(keys)
+	if err != nil || !reflect.DeepEqual(values, want) {
+		t.Fatalf("MultiGet = %q, %v, want %q", values, err, want)
+	}
+	seen := map[string]bool{}
+	for _, file := range opened() {
+		if seen[file] {
+			t.Fatalf("MultiGet opened %s more than once: %v", file, opened())
+		}
+		seen[file] = true
+	}
+}
+
+func TestMultiGetUnreadableTable(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "k", "old")
+	mustFlush(t, kv)
+	mustSet(t, kv, "k", "new")
+	mustFlush(t, kv)
+	waitForBackground(kv)
+
+	// Move the newer table away, so it can't be opened
+	newer := filepath.Join(kv.dataDir, newestTable(t, kv))
+	kv.files.closeIdle()
+	if err := os.Rename(newer, newer+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	values, err := kv.MultiGet([]string{"k"})
+	if !errors.Is(err, ErrUnreadableSSTable) {
+		t.Fatalf("MultiGet with an unreadable table = %q, %v, want ErrUnreadableSSTable", values, err)
+	}
+
+	// The older table's answer wasn't cached, so the newer value is read
+	// once its table is back
+	if err := os.Rename(newer+".moved", newer); err != nil {
+		t.Fatal(err)
+	}
+	values, err = kv.MultiGet([]string{"k"})
+	if err != nil || string(values["k"]) != "new" {
+		t.Fatalf("MultiGet = %q, %v, want the newer value", values, err)
+	}
+}
+
+func TestInMemoryOnly(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{InMemoryOnly: true})
+	for i := 0; i < 1000; i++ {
+		mustSet(t, kv, fmt.Sprint("key", i), fmt.Sprint("value", i))
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	tables, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 0 {
+		t.Fatalf("in-memory store wrote SSTables %v", tables)
+	}
+
+	recovered := openStore(t, dir, Options{InMemoryOnly: true})
+	for i := 0; i < 1000; i++ {
+		mustGet(t, recovered, fmt.Sprint("key", i), fmt.Sprint("value", i))
+	}
+}
+
+// walSequences returns the sequence numbers of the records in the WAL
+// segments of kv, in the order they were written.
+func walSequences(t *testing.T, kv *KeyValueStore) []uint64 {
+	t.Helper()
+	walFiles, err := kv.walFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint64
+	for _, walFile := range walFiles {
+		data, err := os.ReadFile(walFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each segment starts with a header, which isn't a record
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		for _, line := range lines[1:] {
+			var record struct {
+				Seq uint64 `json:"seq"`
+			}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("WAL record %q: %v", line, err)
+			}
+			seqs = append(seqs, record.Seq)
+		}
+	}
+	return seqs
+}
+
+func TestWALSequenceNumbers(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{WALSegmentBytes: 200})
+	for i := 0; i < memtableFlushKeys/2; i++ {
+		mustSet(t, kv, fmt.Sprint("key", i), "value")
+		if _, _, err := kv.Delete(fmt.Sprint("key", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForBackground(kv)
+	segments, err := listWALSegments(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 3 {
+		t.Fatalf("WAL has %d segments, want at least 3", len(segments))
+	}
+
+	seqs := walSequences(t, kv)
+	if len(seqs) != memtableFlushKeys {
+		t.Fatalf("WAL has %d records, want %d", len(seqs), memtableFlushKeys)
+	}
+	for i, seq := range seqs {
+		if seq != uint64(i+1) {
+			t.Fatalf("WAL sequence numbers %v aren't 1, 2, 3, ...", seqs)
+		}
+	}
+	if last := kv.LastSequence(); last != uint64(len(seqs)) {
+		t.Fatalf("LastSequence = %d, want %d", last, len(seqs))
+	}
+
+	// Recovery continues the numbering after the last record
+	recovered := openStore(t, crashCopy(t, dir), Options{WALSegmentBytes: 200})
+	if last := recovered.LastSequence(); last != uint64(len(seqs)) {
+		t.Fatalf("LastSequence after recovery = %d, want %d", last, len(seqs))
+	}
+	mustSet(t, recovered, "after", "value")
+	if seqs := walSequences(t, recovered); seqs[len(seqs)-1] != uint64(memtableFlushKeys+1) {
+		t.Fatalf("record written after recovery is numbered %d, want %d", seqs[len(seqs)-1], memtableFlushKeys+1)
+	}
+}
+
+func TestFollowerReplicatesLeader(t *testing.T) {
+	leader := openStore(t, t.TempDir(), Options{})
+	mustSet(t, leader, "before", "value")
+	server := httptest.NewServer(handleReplicate(leader))
+	defer server.Close()
+
+	follower := openStore(t, t.TempDir(), Options{Follower: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	following := make(chan error, 1)
+	go func() { following <- follower.Follow(ctx, server.URL, "") }()
+	defer func() {
+		cancel()
+		<-following
+	}()
+
+	// Stay below a flush, which would delete records before they are streamed
+	for i := 0; i < memtableFlushKeys-3; i++ {
+		mustSet(t, leader, fmt.Sprint("key", i), fmt.Sprint("value", i))
+	}
+	if _, _, err := leader.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for follower.LastSequence() < leader.LastSequence() {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower applied %d records, want %d", follower.LastSequence(), leader.LastSequence())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mustGet(t, follower, "before", "value")
+	mustMiss(t, follower, "key0")
+	for i := 1; i < memtableFlushKeys-3; i++ {
+		mustGet(t, follower, fmt.Sprint("key", i), fmt.Sprint("value", i))
+	}
+	if err := follower.Set("local", []byte("value")); err == nil {
+		t.Fatal("Set on a follower succeeded")
+	}
+}
+
+func TestUnsupportedSSTableVersion(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "key", "value")
+	mustFlush(t, kv)
+	waitForBackground(kv)
+
+	// Bump the version byte after the magic number past the newest known
+	path := filepath.Join(kv.dataDir, newestTable(t, kv))
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{sstableFormatVersion + 1}, int64(len(sstableMagic))); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	kv.files.closeIdle()
+
+	corrupt, err := kv.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("unsupported SSTable version %d", sstableFormatVersion+1)
+	if len(corrupt) != 1 || !strings.Contains(fmt.Sprint(corrupt[0].Err), want) {
+		t.Fatalf("Verify = %+v, want an error containing %q", corrupt, want)
+	}
+	if _, err := kv.GetE("key"); !errors.Is(err, ErrUnreadableSSTable) || !strings.Contains(err.Error(), want) {
+		t.Fatalf("GetE = %v, want ErrUnreadableSSTable containing %q", err, want)
+	}
+}
+
+func TestSSTableEndpoint(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	// The tombstone is kept only over an older table holding the key
+	mustSet(t, kv, "b", "22")
+	mustFlush(t, kv)
+	mustSet(t, kv, "a", "1")
+	mustSet(t, kv, "c", "333")
+	if _, _, err := kv.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	mustFlush(t, kv)
+	waitForBackground(kv)
+	file := newestTable(t, kv)
+
+	w := serve(handleSSTable(kv), http.MethodGet, "/sstable?file="+file+"&entries=true", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /sstable = %d: %s", w.Code, w.Body)
+	}
+	var dump SSTableDump
+	if err := json.Unmarshal(w.Body.Bytes(), &dump); err != nil {
+		t.Fatal(err)
+	}
+	want := []SSTableDumpEntry{
+		{Key: "a", ValueLength: 1},
+		{Key: "b", Marker: 1},
+		{Key: "c", ValueLength: 3},
+	}
+	if dump.File != file || dump.EntryCount != 3 || dump.MinKey != "a" || dump.MaxKey != "c" {
+		t.Fatalf("dump = %+v, want 3 entries from a to c", dump)
+	}
+	for i := range dump.Entries {
+		dump.Entries[i].Version = 0
+	}
+	if !reflect.DeepEqual(dump.Entries, want) {
+		t.Fatalf("entries = %+v, want %+v", dump.Entries, want)
+	}
+
+	// Without entries=true only the header is returned
+	w = serve(handleSSTable(kv), http.MethodGet, "/sstable?file="+file, "")
+	if body := decodeJSON(t, w); body["entries"] != nil || body["entry_count"] != 3.0 {
+		t.Fatalf("GET /sstable without entries = %v", body)
+	}
+
+	for target, code := range map[string]int{
+		"/sstable?file=../" + file:                              http.StatusBadRequest,
+		"/sstable?file=" + url.QueryEscape(kv.dataDir+"/"+file): http.StatusBadRequest,
+		"/sstable?file=sstable_9999999999.sst":                  http.StatusNotFound,
+	} {
+		if w := serve(handleSSTable(kv), http.MethodGet, target, ""); w.Code != code {
+			t.Errorf("GET %s = %d, want %d", target, w.Code, code)
+		}
+	}
+}
+
+// numericOrder orders keys holding decimal numbers by their value.
+func numericOrder(a, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+func TestNumericComparator(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{Comparator: numericOrder, ComparatorName: "numeric"}
+	kv := openStore(t, dir, options)
+	for _, key := range []string{"10", "9", "100", "2", "25"} {
+		mustSet(t, kv, key, "in-table")
+	}
+	mustFlush(t, kv)
+	for _, key := range []string{"1", "30", "11"} {
+		mustSet(t, kv, key, "in-memory")
+	}
+
+	want := []string{"1", "2", "9", "10", "11", "25", "30", "100"}
+	if keys := keysOf(mustScan(t, kv)); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("scan = %v, want %v", keys, want)
+	}
+	pairs, err := kv.Scan("9", "30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := keysOf(pairs); !reflect.DeepEqual(keys, []string{"9", "10", "11", "25"}) {
+		t.Fatalf("Scan(9, 30) = %v, want [9 10 11 25]", keys)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tables were written in numeric order, so another order is refused
+	if _, err := NewKeyValueStore(filepath.Join(dir, "wal.log"), dir, Options{}); err == nil {
+		t.Fatal("opened numerically ordered tables with the bytewise comparator")
+	}
+}
+
+func TestMaxWALBytesCoalescesOverwrites(t *testing.T) {
+	for _, inMemory := range []bool{false, true} {
+		t.Run(fmt.Sprint("inMemory=", inMemory), func(t *testing.T) {
+			dir := t.TempDir()
+			options := Options{MaxWALBytes: 1000, InMemoryOnly: inMemory}
+			kv := openStore(t, dir, options)
+			for i := 0; i < 50; i++ {
+				mustSet(t, kv, "key", fmt.Sprint("value", i))
+			}
+			if !inMemory {
+				mustFlush(t, kv)
+			}
+			waitForBackground(kv)
+
+			if records := len(walSequences(t, kv)); records >= 50 {
+				t.Fatalf("WAL has %d records after 50 overwrites", records)
+			}
+			recovered := openStore(t, crashCopy(t, dir), options)
+			mustGet(t, recovered, "key", "value49")
+		})
+	}
+}
+
+func TestMaxTablesRetention(t *testing.T) {
+	for _, superseded := range []bool{true, false} {
+		t.Run(fmt.Sprint("superseded=", superseded), func(t *testing.T) {
+			// Three tables stay below the L0 compaction trigger, so only
+			// retention can reduce them
+			kv := openStore(t, t.TempDir(), Options{MaxTables: 2})
+			want := map[string]string{}
+			for table := 0; table < l0CompactionTrigger-1; table++ {
+				for i := 0; i < 3; i++ {
+					key := fmt.Sprint("shared", i)
+					mustSet(t, kv, key, fmt.Sprint("value", table))
+					want[key] = fmt.Sprint("value", table)
+				}
+				// Unless the oldest table is to be superseded, each table
+				// holds the only copy of a key
+				if table > 0 || !superseded {
+					key := fmt.Sprint("own", table)
+					mustSet(t, kv, key, "value")
+					want[key] = "value"
+				}
+				mustFlush(t, kv)
+				waitForBackground(kv)
+			}
+
+			tables, err := kv.SSTables()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantTables := 1
+			if superseded {
+				// Removing the superseded table is enough, without a merge
+				wantTables = 2
+			}
+			if len(tables) != wantTables {
+				t.Fatalf("%d SSTables left with MaxTables = 2, want %d", len(tables), wantTables)
+			}
+			for key, value := range want {
+				mustGet(t, kv, key, value)
+			}
+			if pairs := mustScan(t, kv); len(pairs) != len(want) {
+				t.Fatalf("scan returned %d pairs, want %d", len(pairs), len(want))
+			}
+		})
+	}
+}
+
+func TestScanPages(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	for i := 0; i < 1000; i++ {
+		mustSet(t, kv, fmt.Sprintf("key%04d", i), "value")
+	}
+
+	var keys []string
+	start := ""
+	for pages := 0; ; pages++ {
+		if pages == 10 {
+			t.Fatalf("more than 10 pages of 100 for 1000 keys")
+		}
+		pairs, next, err := kv.ScanPage(context.Background(), start, "", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pairs) != 100 {
+			t.Fatalf("page %d has %d pairs, want 100", pages, len(pairs))
+		}
+		keys = append(keys, keysOf(pairs)...)
+		// A key written behind the pages isn't returned, and doesn't shift them
+		mustSet(t, kv, fmt.Sprintf("key%04d-", pages*100), "value")
+		if next == "" {
+			break
+		}
+		start = next
+	}
+	for i, key := range keys {
+		if want := fmt.Sprintf("key%04d", i); key != want {
+			t.Fatalf("key %d of the pages is %q, want %q", i, key, want)
+		}
+	}
+
+	if _, _, err := kv.ScanPage(context.Background(), "", "", 0); err == nil {
+		t.Fatal("ScanPage with limit 0 succeeded")
+	}
+	if w := serve(handleScan(kv), http.MethodGet, "/scan?limit=0", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("GET /scan?limit=0 = %d, want 400", w.Code)
+	}
+}
+
+func TestWALHeaderValidated(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	mustSet(t, kv, "key", "value")
+
+	for name, tc := range map[string]struct {
+		header walHeader
+		crc    bool // Whether to give the header its correct checksum
+		want   string
+	}{
+		"corrupt":     {walHeader{Magic: walMagic, Version: walFormatVersion, Created: "then"}, false, "corrupt WAL header"},
+		"foreign":     {walHeader{Magic: "OTHER", Version: walFormatVersion}, true, "not a WAL file"},
+		"unsupported": {walHeader{Magic: walMagic, Version: walFormatVersion + 1}, true, "unsupported WAL version"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			copied := crashCopy(t, dir)
+			segment := lastWALSegment(t, copied)
+			data, err := os.ReadFile(segment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.crc {
+				tc.header.CRC = tc.header.checksum()
+			}
+			header, err := json.Marshal(tc.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, records, _ := bytes.Cut(data, []byte("\n"))
+			if err := os.WriteFile(segment, append(append(header, '\n'), records...), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			recovered, err := NewKeyValueStore(filepath.Join(copied, "wal.log"), copied, Options{})
+			if err == nil {
+				defer recovered.Close()
+				err = recovered.Recover()
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("recovering a WAL with a %s header = %v, want an error containing %q", name, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestTableListInvalidatedByFlush(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{CacheSize: -1})
+	mustSet(t, kv, "b", "old")
+	mustFlush(t, kv)
+	mustMiss(t, kv, "a")
+	mustGet(t, kv, "b", "old")
+	kv.indexMu.Lock()
+	cached := len(kv.tableFiles)
+	kv.indexMu.Unlock()
+	if cached != 1 {
+		t.Fatalf("%d SST files cached after lookups, want 1", cached)
+	}
+
+	// Reads see the tables of a later flush and compaction
+	mustSet(t, kv, "a", "new")
+	mustSet(t, kv, "b", "new")
+	mustFlush(t, kv)
+	mustGet(t, kv, "a", "new")
+	mustGet(t, kv, "b", "new")
+	if _, err := kv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, kv, "a", "new")
+	mustGet(t, kv, "b", "new")
+
+	files, err := kv.sstableFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, err := kv.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(tables) || filepath.Base(files[0]) != tables[0].File {
+		t.Fatalf("cached SST files %v, but the manifest lists %+v", files, tables)
+	}
+}
+
+// BenchmarkGetMiss measures lookups of keys between those of an SSTable,
+// with the table list and layouts cached, and with them dropped before
+// every lookup as if they were read each time.
+func BenchmarkGetMiss(b *testing.B) {
+	for _, cached := range []bool{true, false} {
+		b.Run(fmt.Sprint("cached=", cached), func(b *testing.B) {
+			kv := flushedStore(b, 10000, defaultSparseIndexInterval)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !cached {
+					kv.indexMu.Lock()
+					kv.tableFiles, kv.tableLayouts = nil, nil
+					kv.indexMu.Unlock()
+				}
+				kv.Get(fmt.Sprintf("key%04d", 2*(i%10000)+1))
+			}
+		})
+	}
+}
+
+func TestAppend(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	for i, suffix := range []string{"one", "-two", "-three"} {
+		value, err := kv.Append("key", []byte(suffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := strings.Join([]string{"one", "-two", "-three"}[:i+1], "")
+		if string(value) != want {
+			t.Fatalf("Append %d = %q, want %q", i, value, want)
+		}
+		// Append to a value in an SSTable too
+		if i == 0 {
+			mustFlush(t, kv)
+		}
+	}
+	mustGet(t, kv, "key", "one-two-three")
+
+	// The response carries the new length, and the value only if asked for
+	w := serve(handleAppend(kv), http.MethodPost, "/append?key=key", "-four")
+	if body := decodeJSON(t, w); w.Code != http.StatusOK || body["length"] != float64(len("one-two-three-four")) || body["value"] != nil {
+		t.Fatalf("POST /append = %d %v", w.Code, body)
+	}
+	w = serve(handleAppend(kv), http.MethodPost, "/append?key=key&encoding=base64", "\xff")
+	want := base64.StdEncoding.EncodeToString([]byte("one-two-three-four\xff"))
+	if body := decodeJSON(t, w); w.Code != http.StatusOK || body["value"] != want || body["length"] != float64(19) {
+		t.Fatalf("POST /append?encoding=base64 = %d %v, want value %s", w.Code, body, want)
+	}
+	if w := serve(handleAppend(kv), http.MethodPost, "/append?key=key&encoding=hex", "x"); w.Code != http.StatusBadRequest {
+		t.Fatalf("POST /append with an unsupported encoding = %d, want 400", w.Code)
+	}
+	if w := serve(handleAppend(kv), http.MethodPost, "/append?key=", "x"); w.Code != http.StatusBadRequest {
+		t.Fatalf("POST /append with no key = %d, want 400", w.Code)
+	}
+
+	recovered := openStore(t, crashCopy(t, dir), Options{})
+	mustGet(t, recovered, "key", "one-two-three-four\xff")
+}
+
+func TestReadSnapshot(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	for table := 0; table < 3; table++ {
+		mustSet(t, kv, fmt.Sprint("key", table), "old")
+		mustFlush(t, kv)
+	}
+	mustSet(t, kv, "memory", "old")
+	snapshot := kv.NewReadSnapshot()
+	defer snapshot.Close()
+
+	// Change every key, and compact away the tables the snapshot reads
+	for table := 0; table < 3; table++ {
+		mustSet(t, kv, fmt.Sprint("key", table), "new")
+	}
+	if _, _, err := kv.Delete("memory"); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, kv, "added", "new")
+	mustFlush(t, kv)
+	if _, err := kv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"key0", "key1", "key2", "memory"} {
+		if value, ok := snapshot.Get(key); !ok || string(value) != "old" {
+			t.Errorf("snapshot.Get(%q) = %q, %v, want the old value", key, value, ok)
+		}
+	}
+	mustGet(t, kv, "key0", "new")
+	mustMiss(t, kv, "memory")
+	if value, ok := snapshot.Get("added"); ok {
+		t.Errorf("snapshot.Get of a key added later = %q", value)
+	}
+
+	// The store holds no index of the compacted tables the snapshot read
+	files, err := kv.sstableFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.indexMu.Lock()
+	defer kv.indexMu.Unlock()
+	for sstFile := range kv.tableIndexes {
+		if !slices.Contains(files, sstFile) {
+			t.Errorf("the store holds the index of %s, which was compacted away", sstFile)
+		}
+	}
+}
+
+func TestOnFlush(t *testing.T) {
+	type flushed struct {
+		path       string
+		entryCount int
+		value      []byte
+	}
+	calls := make(chan flushed, 1)
+	var kv *KeyValueStore
+	kv = openStore(t, t.TempDir(), Options{OnFlush: func(path string, entryCount int) {
+		// The lock is released, so the store can be used from the callback
+		value, _ := kv.Get("a")
+		calls <- flushed{path, entryCount, value}
+	}})
+	for _, key := range []string{"a", "b", "c"} {
+		mustSet(t, kv, key, "value")
+	}
+	mustFlush(t, kv)
+
+	select {
+	case call := <-calls:
+		want := filepath.Join(kv.dataDir, newestTable(t, kv))
+		if call.path != want || call.entryCount != 3 || string(call.value) != "value" {
+			t.Fatalf("OnFlush(%q, %d) read %q, want OnFlush(%q, 3) reading %q", call.path, call.entryCount, call.value, want, "value")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnFlush wasn't called")
+	}
+}
+
+func TestExistsDoesNotReadValue(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{EncryptionKey: bytes.Repeat([]byte{1}, 32), CacheSize: -1})
+	mustSet(t, kv, "large", strings.Repeat("v", 1<<20))
+	mustSet(t, kv, "deleted", "value")
+	mustFlush(t, kv)
+	if _, _, err := kv.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	mustFlush(t, kv)
+	waitForBackground(kv)
+
+	// Corrupt the middle of the large value, so reading it fails to decrypt
+	var path string
+	tables, err := kv.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if table.Size > 1<<20 {
+			path = filepath.Join(kv.dataDir, table.File)
+		}
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	middle := make([]byte, 1)
+	if _, err := file.ReadAt(middle, info.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{^middle[0]}, info.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	kv.files.closeIdle()
+	if _, err := kv.GetE("large"); err == nil {
+		t.Fatal("GetE of the corrupted value succeeded")
+	}
+
+	if exists, err := kv.Exists("large"); !exists || err != nil {
+		t.Errorf("Exists(large) = %v, %v, but it has a value whose bytes needn't be read", exists, err)
+	}
+	for _, key := range []string{"deleted", "missing"} {
+		if exists, err := kv.Exists(key); exists || err != nil {
+			t.Errorf("Exists(%s) = %v, %v, want false", key, exists, err)
+		}
+	}
+	for key, code := range map[string]int{"large": http.StatusOK, "deleted": http.StatusNotFound} {
+		r := httptest.NewRequest(http.MethodHead, "/kv/"+key, nil)
+		r.SetPathValue("key", key)
+		w := httptest.NewRecorder()
+		handleKVHead(kv)(w, r)
+		if w.Code != code || w.Body.Len() != 0 {
+			t.Errorf("HEAD /kv/%s = %d with %d bytes, want %d and no body", key, w.Code, w.Body.Len(), code)
+		}
+	}
+}
+
+func TestLookupSkipsTruncatedTable(t *testing.T) {
+	for name, corrupt := range map[string]func(path string) error{
+		"truncated": func(path string) error {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			return os.Truncate(path, info.Size()/2)
+		},
+		"entry count": func(path string) error {
+			file, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			// The entry count follows the magic number and version
+			_, err = file.WriteAt([]byte{0xff, 0xff, 0, 0}, int64(len(sstableMagic)+1))
+			return err
+		},
+		"magic number": func(path string) error {
+			file, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = file.WriteAt(bytes.Repeat([]byte{'X'}, len(sstableMagic)), 0)
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var logs bytes.Buffer
+			kv := openStore(t, t.TempDir(), Options{Logger: slog.New(slog.NewTextHandler(&logs, nil)), CacheSize: -1})
+			mustSet(t, kv, "a", "valid")
+			mustFlush(t, kv)
+			// The newer table's key range covers the older one's key
+			for _, key := range []string{"0", "b", "z"} {
+				mustSet(t, kv, key, strings.Repeat("v", 100))
+			}
+			mustFlush(t, kv)
+			waitForBackground(kv)
+			if err := corrupt(filepath.Join(kv.dataDir, newestTable(t, kv))); err != nil {
+				t.Fatal(err)
+			}
+
+			// Drop what the store knows of the table, as after a restart
+			kv.mu.Lock()
+			kv.indexMu.Lock()
+			kv.tableIndexes, kv.tableLayouts = nil, nil
+			kv.indexMu.Unlock()
+			kv.mu.Unlock()
+			kv.files.closeIdle()
+			logs.Reset()
+
+			for i := 0; i < 3; i++ {
+				mustGet(t, kv, "a", "valid")
+				mustMiss(t, kv, "b")
+			}
+			if n := strings.Count(logs.String(), "skipping corrupt SST file"); n != 1 {
+				t.Fatalf("the corrupt table was logged %d times, want once:\n%s", n, logs.String())
+			}
+		})
+	}
+}
+
+func TestBinaryExportRoundTrip(t *testing.T) {
+	src := openStore(t, t.TempDir(), Options{})
+	pairs := map[string]string{
+		"line\nbreak":  "first\nsecond\n",
+		"nul\x00key":   "\x00\x00",
+		"\xff\xfehigh": "\x80\xff\xc3",
+		"empty":        "",
+	}
+	for key, value := range pairs {
+		mustSet(t, src, key, value)
+	}
+	mustFlush(t, src)
+	mustSet(t, src, "memory", "\r\n\x00")
+	want := mustScan(t, src)
+
+	var export bytes.Buffer
+	if n, err := src.ExportBinary(&export); err != nil || n != len(want) {
+		t.Fatalf("ExportBinary = %d, %v, want %d pairs", n, err, len(want))
+	}
+	dst := openStore(t, t.TempDir(), Options{})
+	if n, err := dst.ImportBinary(bytes.NewReader(export.Bytes())); err != nil || n != len(want) {
+		t.Fatalf("ImportBinary = %d, %v, want %d pairs", n, err, len(want))
+	}
+	if got := mustScan(t, dst); !reflect.DeepEqual(got, want) {
+		t.Fatalf("imported %q, want %q", got, want)
+	}
+
+	// A truncated export is an error rather than a shorter import
+	truncated := export.Bytes()[:export.Len()-1]
+	if _, err := openStore(t, t.TempDir(), Options{}).ImportBinary(bytes.NewReader(truncated)); err == nil {
+		t.Fatal("ImportBinary of a truncated export succeeded")
+	}
+}
+
+// failFlushes makes the next n SSTable writes of kv's flushes fail, and
+// returns the number of writes attempted so far.
+func failFlushes(kv *KeyValueStore, n int) func() int {
+	var attempts, failures atomic.Int32
+	kv.mu.Lock()
+	write := kv.writeTable
+	kv.writeTable = func(filename string, seq uint64, entries []iteratorEntry) error {
+		attempts.Add(1)
+		if failures.Add(1) <= int32(n) {
+			return errors.New("disk full")
+		}
+		return write(filename, seq, entries)
+	}
+	kv.mu.Unlock()
+	return func() int { return int(attempts.Load()) }
+}
+
+func TestFlushRetried(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	attempts := failFlushes(kv, 1)
+	mustSet(t, kv, "key", "value")
+	mustFlush(t, kv)
+
+	if attempts() != 2 {
+		t.Fatalf("flush made %d attempts, want a failure and a retry", attempts())
+	}
+	if err := kv.FlushError(); err != nil {
+		t.Fatalf("FlushError after a successful retry = %v", err)
+	}
+	stats, err := kv.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MemtableKeys != 0 || stats.SSTableFiles != 1 {
+		t.Fatalf("stats after the retried flush = %+v, want an empty memtable and one SSTable", stats)
+	}
+	mustGet(t, kv, "key", "value")
+	if w := serve(handleReady(kv), http.MethodGet, "/ready", ""); w.Code != http.StatusOK {
+		t.Fatalf("GET /ready = %d, want 200", w.Code)
+	}
+}
+
+func TestFlushFailureDegradesStore(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	attempts := failFlushes(kv, flushRetries+1)
+	mustSet(t, kv, "key", "value")
+	if err := kv.Flush(); err == nil {
+		t.Fatal("Flush succeeded though every attempt failed")
+	}
+
+	if attempts() != flushRetries+1 {
+		t.Fatalf("flush made %d attempts, want %d", attempts(), flushRetries+1)
+	}
+	if kv.FlushError() == nil {
+		t.Fatal("FlushError is nil after every attempt failed")
+	}
+	if w := serve(handleReady(kv), http.MethodGet, "/ready", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("GET /ready of a degraded store = %d, want 503", w.Code)
+	}
+	// The entries are back in the memtable, and no table was left behind
+	mustGet(t, kv, "key", "value")
+	if tables, _ := filepath.Glob(filepath.Join(kv.dataDir, "*.sst")); len(tables) != 0 {
+		t.Fatalf("failed flush left %v", tables)
+	}
+
+	// The next flush succeeds and clears the error
+	mustFlush(t, kv)
+	if err := kv.FlushError(); err != nil {
+		t.Fatalf("FlushError after a successful flush = %v", err)
+	}
+	if w := serve(handleReady(kv), http.MethodGet, "/ready", ""); w.Code != http.StatusOK {
+		t.Fatalf("GET /ready after recovering = %d, want 200", w.Code)
+	}
+	mustGet(t, kv, "key", "value")
+}
+
+func TestBuckets(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	for _, bucket := range []string{"tenant", "tenant2"} {
+		for _, key := range []string{"a", "b"} {
+			if err := kv.SetInBucket(bucket, key, []byte(bucket+"-"+key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	mustSet(t, kv, "a", "unbucketed")
+	mustFlush(t, kv)
+	if err := kv.SetInBucket("tenant", "c", []byte("tenant-c")); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, ok := kv.GetFromBucket("tenant2", "a"); !ok || string(value) != "tenant2-a" {
+		t.Fatalf("GetFromBucket(tenant2, a) = %q, %v", value, ok)
+	}
+	mustGet(t, kv, "a", "unbucketed")
+	want := map[string][]KeyValue{
+		"tenant":  {{Key: "a", Value: []byte("tenant-a")}, {Key: "b", Value: []byte("tenant-b")}, {Key: "c", Value: []byte("tenant-c")}},
+		"tenant2": {{Key: "a", Value: []byte("tenant2-a")}, {Key: "b", Value: []byte("tenant2-b")}},
+	}
+	for bucket, pairs := range want {
+		if got, err := kv.ScanBucket(bucket); err != nil || !reflect.DeepEqual(got, pairs) {
+			t.Fatalf("ScanBucket(%s) = %q, %v, want %q", bucket, got, err, pairs)
+		}
+	}
+	if _, err := kv.ScanBucket(""); !errors.Is(err, ErrInvalidBucket) {
+		t.Fatalf("ScanBucket with no name = %v, want ErrInvalidBucket", err)
+	}
+
+	// Deleting a bucket leaves the other bucket and unbucketed keys alone
+	if deleted, err := kv.DeleteBucket("tenant"); err != nil || deleted != 3 {
+		t.Fatalf("DeleteBucket = %d, %v, want 3", deleted, err)
+	}
+	if pairs, err := kv.ScanBucket("tenant"); err != nil || len(pairs) != 0 {
+		t.Fatalf("ScanBucket of a deleted bucket = %q, %v", pairs, err)
+	}
+	if pairs, err := kv.ScanBucket("tenant2"); err != nil || len(pairs) != 2 {
+		t.Fatalf("ScanBucket(tenant2) after deleting tenant = %q, %v", pairs, err)
+	}
+	mustGet(t, kv, "a", "unbucketed")
+
+	// The routes take the bucket from the path
+	r := httptest.NewRequest(http.MethodGet, "/b/tenant2/scan", nil)
+	r.SetPathValue("bucket", "tenant2")
+	w := httptest.NewRecorder()
+	handleBucketScan(kv)(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "tenant2-b") || strings.Contains(w.Body.String(), "unbucketed") {
+		t.Fatalf("GET /b/tenant2/scan = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	for _, key := range []string{"a", "b", "c"} {
+		mustSet(t, kv, key, "value-"+key)
+	}
+	if err := kv.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	tables, err := kv.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 || tables[0].EntryCount != 3 || tables[0].MinKey != "a" || tables[0].MaxKey != "c" {
+		t.Fatalf("SSTables after Flush = %+v, want one holding a, b, and c", tables)
+	}
+	stats, err := kv.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MemtableKeys != 0 || stats.Tombstones != 0 {
+		t.Fatalf("stats after Flush = %+v, want an empty memtable", stats)
+	}
+	if records := len(walSequences(t, kv)); records != 0 {
+		t.Fatalf("WAL holds %d records after Flush, want none", records)
+	}
+
+	// Flushing an empty memtable writes nothing
+	if err := kv.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if tables, _ := kv.SSTables(); len(tables) != 1 {
+		t.Fatalf("flushing an empty memtable left %d SSTables", len(tables))
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		mustGet(t, kv, key, "value-"+key)
+	}
+}
+
+func TestValueLog(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{ValueLogThreshold: 1024}
+	kv := openStore(t, dir, options)
+	large := strings.Repeat("large value ", 1000)
+	mustSet(t, kv, "large", large)
+	mustSet(t, kv, "small", "small value")
+	mustFlush(t, kv)
+
+	// The large value is in the value log, and the table holds a pointer
+	logs, err := filepath.Glob(filepath.Join(dir, "*.vlog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged []byte
+	for _, log := range logs {
+		data, err := os.ReadFile(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logged = append(logged, data...)
+	}
+	if !bytes.Contains(logged, []byte(large)) || bytes.Contains(logged, []byte("small value")) {
+		t.Fatalf("value log of %d bytes doesn't hold just the large value", len(logged))
+	}
+	lengths := map[string]uint32{}
+	for _, key := range []string{"large", "small"} {
+		entries := tableEntries(t, kv, key)
+		if len(entries) != 1 {
+			t.Fatalf("%d table entries for %s, want 1", len(entries), key)
+		}
+		lengths[key] = entries[0].ValueLength
+	}
+	if lengths["large"] >= 1024 || lengths["small"] != uint32(len("small value")) {
+		t.Fatalf("table value lengths = %v, want a pointer for large and small inline", lengths)
+	}
+
+	// Every read follows the pointer, also after a compaction and a restart
+	check := func(kv *KeyValueStore) {
+		t.Helper()
+		mustGet(t, kv, "large", large)
+		mustGet(t, kv, "small", "small value")
+		pairs := mustScan(t, kv)
+		if len(pairs) != 2 || string(pairs[0].Value) != large {
+			t.Fatalf("scan = %d pairs, want the large value first", len(pairs))
+		}
+		stream, ok := kv.GetStream("large")
+		if !ok {
+			t.Fatal("GetStream(large) found nothing")
+		}
+		defer stream.Close()
+		if streamed, err := io.ReadAll(stream); err != nil || string(streamed) != large {
+			t.Fatalf("GetStream(large) read %d bytes, %v", len(streamed), err)
+		}
+	}
+	check(kv)
+	if _, err := kv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(kv)
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(openStore(t, dir, options))
+}
+
+func TestShardedStore(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()}
+	store, err := NewShardedStore(dirs, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("key", i)
+		keys = append(keys, key)
+		if err := store.Set(key, []byte(fmt.Sprint("value", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(keys)
+
+	// Each shard holds roughly a quarter of the keys
+	for i, shard := range store.shards {
+		pairs, err := shard.Scan("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pairs) < 150 || len(pairs) > 350 {
+			t.Errorf("shard %d holds %d of 1000 keys", i, len(pairs))
+		}
+		for _, pair := range pairs {
+			if owner := store.shardIndex(pair.Key); owner != i {
+				t.Fatalf("key %s is in shard %d, but shard %d owns it", pair.Key, i, owner)
+			}
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		if value, ok := store.Get(fmt.Sprint("key", i)); !ok || string(value) != fmt.Sprint("value", i) {
+			t.Fatalf("Get(key%d) = %q, %v", i, value, ok)
+		}
+	}
+	pairs, err := store.Scan("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keysOf(pairs); !reflect.DeepEqual(got, keys) {
+		t.Fatalf("Scan returned %d keys, not the 1000 keys in order", len(got))
+	}
+	if _, ok, err := store.Delete("key0"); !ok || err != nil {
+		t.Fatalf("Delete(key0) = %v, %v", ok, err)
+	}
+	if _, ok := store.Get("key0"); ok {
+		t.Fatal("key0 is found after Delete")
+	}
+}
+
+func TestRecoverySkipsFlushedRecords(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	mustSet(t, kv, "key", "old")
+	beforeFlush := crashCopy(t, dir)
+	mustFlush(t, kv)
+	mustSet(t, kv, "key", "new")
+	mustFlush(t, kv)
+	mustSet(t, kv, "post", "value")
+	kv.mu.RLock()
+	checkpoint := kv.manifest.LastWALSeq
+	kv.mu.RUnlock()
+	if checkpoint != 2 {
+		t.Fatalf("manifest's LastWALSeq = %d, want 2", checkpoint)
+	}
+
+	// Crash leaving the segment of the first flush behind, as if it failed
+	// to be deleted; replaying it would hide the newer flushed value
+	crashed := crashCopy(t, dir)
+	segments, err := filepath.Glob(filepath.Join(beforeFlush, "wal.log.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, segment := range segments {
+		if _, err := os.Stat(filepath.Join(crashed, filepath.Base(segment))); err == nil {
+			continue
+		}
+		data, err := os.ReadFile(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(crashed, filepath.Base(segment)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var logs bytes.Buffer
+	recovered := openStore(t, crashed, Options{Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))})
+	mustGet(t, recovered, "key", "new")
+	mustGet(t, recovered, "post", "value")
+	if n := strings.Count(logs.String(), "skipping applied WAL record"); n != 1 {
+		t.Fatalf("recovery skipped %d records, want the flushed one:\n%s", n, logs.String())
+	}
+	if stats, err := recovered.Stats(); err != nil || stats.MemtableKeys != 1 {
+		t.Fatalf("recovered memtable holds %d keys, %v, want only the unflushed one", stats.MemtableKeys, err)
+	}
+}
+
+func TestMaxPendingFlushesBlocksWriters(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{MaxPendingFlushes: 2})
+	_, release := holdFlushes(kv)
+	defer release()
+
+	// The third full memtable has to wait for the first to be written
+	var written atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 4*memtableFlushKeys; i++ {
+			if err := kv.Set(fmt.Sprint("key", i), []byte("value")); err != nil {
+				t.Error(err)
+				return
+			}
+			written.Add(1)
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for written.Load() < 3*memtableFlushKeys-1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("writer stopped after %d writes", written.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := written.Load(); n != 3*memtableFlushKeys-1 {
+		t.Fatalf("writer made %d writes with the flushes held, want %d", n, 3*memtableFlushKeys-1)
+	}
+	kv.mu.RLock()
+	pending := len(kv.flushing)
+	kv.mu.RUnlock()
+	if pending != 2 {
+		t.Fatalf("%d memtables wait to be flushed, want MaxPendingFlushes = 2", pending)
+	}
+
+	release()
+	<-done
+	waitForBackground(kv)
+	for i := 0; i < 4*memtableFlushKeys; i++ {
+		mustGet(t, kv, fmt.Sprint("key", i), "value")
+	}
+}
+
+func TestGetETag(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{})
+	mustSet(t, kv, "key", "first")
+	get := func(kv *KeyValueStore, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/get?key=key", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		handleGet(kv)(w, r)
+		return w
+	}
+
+	w := get(kv, "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET /get = %d with ETag %q", w.Code, etag)
+	}
+	if _, version, ok := kv.GetVersion("key"); !ok || etag != versionETag(version) {
+		t.Fatalf("ETag %q, but GetVersion = %d, %v", etag, version, ok)
+	}
+	if w := get(kv, etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("GET /get with the current ETag = %d: %s, want 304 and no body", w.Code, w.Body)
+	}
+
+	// The version survives a flush and a restart
+	mustFlush(t, kv)
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	kv = openStore(t, dir, Options{})
+	if w := get(kv, etag); w.Code != http.StatusNotModified {
+		t.Fatalf("GET /get with the ETag after a restart = %d, want 304", w.Code)
+	}
+
+	// An update changes the ETag
+	mustSet(t, kv, "key", "second")
+	w = get(kv, etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag || !strings.Contains(w.Body.String(), "second") {
+		t.Fatalf("GET /get after an update = %d with ETag %q: %s", w.Code, w.Header().Get("ETag"), w.Body)
+	}
+	if w := get(kv, w.Header().Get("ETag")); w.Code != http.StatusNotModified {
+		t.Fatalf("GET /get with the new ETag = %d, want 304", w.Code)
+	}
+}
+
+func TestIteratorDoesNotBlockWrites(t *testing.T) {
+	kv := flushedStore(t, 5000, defaultSparseIndexInterval)
+	it := kv.NewIterator("", "")
+	defer it.Close()
+	for i := 0; i < 10; i++ {
+		if !it.Next() {
+			t.Fatal(it.Err())
+		}
+	}
+
+	// Writes, flushes included, go ahead while the scan is half done
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3*memtableFlushKeys; i++ {
+			if err := kv.Set(fmt.Sprintf("key%04d", 2*i+1), []byte("new")); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes were blocked by an open iterator")
+	}
+
+	// The scan sees the store as it was when it started
+	scanned := 10
+	for it.Next() {
+		if it.Key() != fmt.Sprintf("key%04d", 2*scanned) {
+			t.Fatalf("scan key %d is %s, want key%04d", scanned, it.Key(), 2*scanned)
+		}
+		scanned++
+	}
+	if err := it.Err(); err != nil || scanned != 5000 {
+		t.Fatalf("scan returned %d keys, %v, want 5000", scanned, err)
+	}
+}
+
+// writeLegacySSTable writes the pairs, sorted by key, to an SSTable in the
+// format before versioning: the legacy magic number, no format version, and
+// a footer holding only the key range, with no sparse index. An empty value
+// is written as a tombstone.
+func writeLegacySSTable(t *testing.T, path string, seq uint64, pairs []KeyValue) {
+	t.Helper()
+	var buf bytes.Buffer
+	write := func(data interface{}) {
+		if err := binary.Write(&buf, binary.LittleEndian, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.WriteString(legacySSTableMagic)
+	write(uint32(len(pairs)))
+	write(uint32(len(pairs[0].Key)))
+	write(uint32(len(pairs[len(pairs)-1].Key)))
+	write(NoCompression)
+	write(seq)
+	for _, pair := range pairs {
+		marker := uint16(0)
+		if len(pair.Value) == 0 {
+			marker = 1
+		}
+		write(marker)
+		write(uint32(len(pair.Key)))
+		write(uint32(len(pair.Value)))
+		buf.WriteString(pair.Key)
+		buf.Write(pair.Value)
+	}
+	footerOffset := buf.Len()
+	for _, key := range []string{pairs[0].Key, pairs[len(pairs)-1].Key} {
+		write(uint32(len(key)))
+		buf.WriteString(key)
+	}
+	write(uint64(footerOffset))
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacySSTableWithoutIndex(t *testing.T) {
+	// A data directory from before the manifest holds one legacy table
+	dir := t.TempDir()
+	var pairs []KeyValue
+	for i := 0; i < 200; i++ {
+		pairs = append(pairs, KeyValue{Key: fmt.Sprintf("key%04d", 2*i), Value: []byte(fmt.Sprint("legacy", i))})
+	}
+	pairs[1].Value = nil // A tombstone
+	writeLegacySSTable(t, filepath.Join(dir, "sstable_0000000001.sst"), 1, pairs)
+
+	kv := openStore(t, dir, Options{CacheSize: -1})
+	dump, err := kv.DumpSSTable("sstable_0000000001.sst", false)
+	if err != nil || dump.Version != 0 || dump.EntryCount != 200 {
+		t.Fatalf("DumpSSTable = %+v, %v, want a version 0 table of 200 entries", dump, err)
+	}
+	check := func() {
+		t.Helper()
+		mustGet(t, kv, "key0000", "legacy0")
+		mustMiss(t, kv, "key0002")
+		mustGet(t, kv, "key0398", "legacy199")
+		mustMiss(t, kv, "key0399")
+		if value, err := kv.GetE("key0200"); err != nil || string(value) != "legacy100" {
+			t.Fatalf("GetE(key0200) = %q, %v", value, err)
+		}
+	}
+	check()
+
+	// Newer tables are written in the current format over the legacy one
+	mustSet(t, kv, "key0000", "new")
+	mustFlush(t, kv)
+	mustGet(t, kv, "key0000", "new")
+	if _, err := kv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, kv, "key0000", "legacy0")
+	check()
+}
+
+// writeBaselineSSTable writes pairs, sorted by key, to an SSTable at path
+// byte for byte as the original WriteSSTable did: the magic number, the
+// entry count and smallest and largest key lengths, and the entries, with
+// no compression byte, seq or footer. Keys in deleted are written with
+// operation marker 1.
+func writeBaselineSSTable(t *testing.T, path string, pairs []KeyValue, deleted map[string]bool) {
+	t.Helper()
+	var buf bytes.Buffer
+	write := func(data interface{}) {
+		if err := binary.Write(&buf, binary.LittleEndian, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	smallest, largest := 0, 0
+	for _, pair := range pairs {
+		if smallest == 0 || len(pair.Key) < smallest {
+			smallest = len(pair.Key)
+		}
+		if len(pair.Key) > largest {
+			largest = len(pair.Key)
+		}
+	}
+	buf.WriteString("SSTB")
+	write(uint32(len(pairs)))
+	write(uint32(smallest))
+	write(uint32(largest))
+	for _, pair := range pairs {
+		marker := uint16(0)
+		if deleted[pair.Key] {
+			marker = 1
+		}
+		write(marker)
+		write(uint32(len(pair.Key)))
+		write(uint32(len(pair.Value)))
+		buf.WriteString(pair.Key)
+		buf.Write(pair.Value)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBaselineSSTablesUpgrade(t *testing.T) {
+	// A data directory written by the original code: two tables named by
+	// their creation time, the newer deleting and overwriting keys of the
+	// older one
+	dir := t.TempDir()
+	var older []KeyValue
+	for i := 0; i < 20; i++ {
+		older = append(older, KeyValue{Key: fmt.Sprintf("key%02d", i), Value: []byte(fmt.Sprint("old", i))})
+	}
+	newer := []KeyValue{
+		{Key: "key03"},                           // A tombstone, written with no value
+		{Key: "key05", Value: []byte("DELETED")}, // A tombstone with a value
+		{Key: "key07", Value: []byte("new7")},
+		{Key: "key20", Value: []byte("new20")},
+	}
+	tables := []string{"sstable_1700000000000000000.sst", "sstable_1700000001000000000.sst"}
+	writeBaselineSSTable(t, filepath.Join(dir, tables[0]), older, nil)
+	writeBaselineSSTable(t, filepath.Join(dir, tables[1]), newer, map[string]bool{"key03": true, "key05": true})
+	for i, table := range tables {
+		modTime := time.Unix(1700000000+int64(i), 0)
+		if err := os.Chtimes(filepath.Join(dir, table), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(kv *KeyValueStore) {
+		t.Helper()
+		mustGet(t, kv, "key00", "old0")
+		mustMiss(t, kv, "key03")
+		mustMiss(t, kv, "key05")
+		mustGet(t, kv, "key07", "new7")
+		mustGet(t, kv, "key19", "old19")
+		mustGet(t, kv, "key20", "new20")
+		mustMiss(t, kv, "key21")
+		if pairs := mustScan(t, kv); len(pairs) != 19 {
+			t.Fatalf("Scan returned %d pairs, want 19: %+v", len(pairs), pairs)
+		}
+	}
+
+	kv := openStore(t, dir, Options{CacheSize: -1})
+	dump, err := kv.DumpSSTable(tables[1], false)
+	if err != nil || dump.Version != 0 || dump.EntryCount != 4 {
+		t.Fatalf("DumpSSTable = %+v, %v, want a version 0 table of 4 entries", dump, err)
+	}
+	check(kv)
+	if corrupt, err := kv.Verify(); err != nil || len(corrupt) != 0 {
+		t.Fatalf("Verify = %+v, %v, want no corrupt tables", corrupt, err)
+	}
+
+	// Compacting rewrites the tables in the current format
+	if _, err := kv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(kv)
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(openStore(t, dir, Options{CacheSize: -1}))
+}
+
+func TestSSTablesEndpoint(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	for _, key := range []string{"a", "b", "c"} {
+		mustSet(t, kv, key, "value")
+	}
+	mustFlush(t, kv)
+	for _, key := range []string{"d", "e"} {
+		mustSet(t, kv, key, "value")
+	}
+	mustFlush(t, kv)
+	waitForBackground(kv)
+
+	w := serve(handleSSTables(kv), http.MethodGet, "/sstables", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /sstables = %d: %s", w.Code, w.Body)
+	}
+	var tables []SSTableInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &tables); err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 2 {
+		t.Fatalf("GET /sstables listed %+v, want 2 tables", tables)
+	}
+	// Most recent first
+	for i, want := range []SSTableInfo{{EntryCount: 2, MinKey: "d", MaxKey: "e", Seq: 2}, {EntryCount: 3, MinKey: "a", MaxKey: "c", Seq: 1}} {
+		table := tables[i]
+		info, err := os.Stat(filepath.Join(kv.dataDir, table.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table.EntryCount != want.EntryCount || table.MinKey != want.MinKey || table.MaxKey != want.MaxKey || table.Seq != want.Seq || table.Size != info.Size() {
+			t.Errorf("table %d = %+v, want %d entries from %s to %s with seq %d and size %d", i, table, want.EntryCount, want.MinKey, want.MaxKey, want.Seq, info.Size())
+		}
+	}
+}
+
+func TestGetEErrors(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{CacheSize: -1})
+	mustSet(t, kv, "older", "value")
+	mustSet(t, kv, "key", "old")
+	mustFlush(t, kv)
+	mustSet(t, kv, "key", "new")
+	mustSet(t, kv, "deleted", "value")
+	mustFlush(t, kv)
+	if _, _, err := kv.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	waitForBackground(kv)
+
+	for _, key := range []string{"missing", "deleted"} {
+		if value, err := kv.GetE(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetE(%s) = %q, %v, want ErrNotFound", key, value, err)
+		}
+	}
+	if value, err := kv.GetE("key"); err != nil || string(value) != "new" {
+		t.Fatalf("GetE(key) = %q, %v", value, err)
+	}
+
+	// Remove the newer table, so reading it fails
+	newer := filepath.Join(kv.dataDir, newestTable(t, kv))
+	kv.files.closeIdle()
+	if err := os.Remove(newer); err != nil {
+		t.Fatal(err)
+	}
+	_, err := kv.GetE("key")
+	if !errors.Is(err, ErrUnreadableSSTable) || !errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetE with an unreadable table = %v, want ErrUnreadableSSTable wrapping the I/O error", err)
+	}
+	// Get skips the table and answers from the older one, and the other
+	// keys of the older table are read as before
+	if value, ok := kv.Get("key"); !ok || string(value) != "old" {
+		t.Fatalf("Get(key) = %q, %v, want the older table's value", value, ok)
+	}
+	mustGet(t, kv, "older", "value")
+}
+
+// memorySink is a ChangeSink that records the changes it is sent, failing
+// the first failures attempts.
+type memorySink struct {
+	mu       sync.Mutex
+	failures int
+	changes  []string
+}
+
+func (sink *memorySink) Publish(op string, key string, value []byte, seq uint64) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.failures > 0 {
+		sink.failures--
+		return errors.New("sink unavailable")
+	}
+	sink.changes = append(sink.changes, fmt.Sprintf("%d %s %s=%s", seq, op, key, value))
+	return nil
+}
+
+func TestChangeSink(t *testing.T) {
+	sink := &memorySink{failures: 1}
+	kv := openStore(t, t.TempDir(), Options{ChangeSink: sink})
+	mustSet(t, kv, "a", "1")
+	mustSet(t, kv, "b", "2")
+	if _, _, err := kv.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	batch := kv.NewWriteBatch()
+	batch.Set("c", []byte("3"))
+	batch.Delete("b")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// A delete of a missing key changes nothing
+	if _, _, err := kv.Delete("missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed first attempt was retried, and nothing was sent twice
+	want := []string{"1 set a=1", "2 set b=2", "3 delete a=", "4 set c=3", "4 delete b="}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if !reflect.DeepEqual(sink.changes, want) {
+		t.Fatalf("published %q, want %q", sink.changes, want)
+	}
+}
+
+// addMerge is a MergeFunc that adds integer operands to an integer value.
+func addMerge(existing []byte, operands [][]byte) []byte {
+	sum, _ := strconv.ParseInt(string(existing), 10, 64)
+	for _, operand := range operands {
+		n, _ := strconv.ParseInt(string(operand), 10, 64)
+		sum += n
+	}
+	return []byte(strconv.FormatInt(sum, 10))
+}
+
+func TestMergeConcurrently(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{MergeFunc: addMerge})
+	var wg sync.WaitGroup
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := kv.Merge("counter", []byte(strconv.Itoa(i))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	mustGet(t, kv, "counter", "5050")
+
+	// Merging into a flushed value reads it from its SSTable
+	mustFlush(t, kv)
+	if err := kv.Merge("counter", []byte("-50")); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, kv, "counter", "5000")
+	if err := openStore(t, t.TempDir(), Options{}).Merge("counter", []byte("1")); !errors.Is(err, ErrNoMergeFunc) {
+		t.Fatalf("Merge without a MergeFunc = %v, want ErrNoMergeFunc", err)
+	}
+}
+
+// TestWriteSucceedsWhenFlushFails checks that the read-modify-write
+// operations, like Set, report a write that reached the WAL and memtable as
+// done even if the flush it triggers fails.
+func TestWriteSucceedsWhenFlushFails(t *testing.T) {
+	for name, write := range map[string]func(kv *KeyValueStore) error{
+		"CompareAndSwap": func(kv *KeyValueStore) error {
+			if swapped, err := kv.CompareAndSwap("key0", []byte("value"), []byte("written")); !swapped || err != nil {
+				return fmt.Errorf("CompareAndSwap = %v, %v", swapped, err)
+			}
+			return nil
+		},
+		"SetIfAbsent": func(kv *KeyValueStore) error {
+			if stored, err := kv.SetIfAbsent("new", []byte("written")); !stored || err != nil {
+				return fmt.Errorf("SetIfAbsent = %v, %v", stored, err)
+			}
+			return nil
+		},
+		"Increment": func(kv *KeyValueStore) error {
+			if value, err := kv.Increment("new", 7); value != 7 || err != nil {
+				return fmt.Errorf("Increment = %d, %v", value, err)
+			}
+			return nil
+		},
+		"Append": func(kv *KeyValueStore) error {
+			if value, err := kv.Append("new", []byte("written")); string(value) != "written" || err != nil {
+				return fmt.Errorf("Append = %q, %v", value, err)
+			}
+			return nil
+		},
+		"Merge": func(kv *KeyValueStore) error {
+			return kv.Merge("new", []byte("7"))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var logs bytes.Buffer
+			kv := openStore(t, t.TempDir(), Options{MergeFunc: addMerge, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+			mustSet(t, kv, "key0", "value")
+			mustFlush(t, kv)
+			for i := 1; i < memtableFlushKeys; i++ {
+				mustSet(t, kv, fmt.Sprint("key", i), "value")
+			}
+
+			// A directory in the way of the next WAL segment fails the flush
+			kv.walMu.Lock()
+			next := walSegmentPath(kv.walPath, kv.walSegment+1)
+			kv.walMu.Unlock()
+			if err := os.Mkdir(next, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := write(kv); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(logs.String(), "error flushing to SSTable") {
+				t.Fatalf("the failed flush wasn't logged:\n%s", logs.String())
+			}
+			if stats, err := kv.Stats(); err != nil || stats.MemtableKeys != memtableFlushKeys {
+				t.Fatalf("memtable holds %d keys, %v, want the write kept in it", stats.MemtableKeys, err)
+			}
+		})
+	}
+}
+
+func TestCloseDuringFlush(t *testing.T) {
+	dir := t.TempDir()
+	kv, err := NewKeyValueStore(filepath.Join(dir, "wal.log"), dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	started, release := holdFlushes(kv)
+	defer release()
+	for i := 0; i < memtableFlushKeys+3; i++ {
+		mustSet(t, kv, fmt.Sprint("key", i), "value")
+	}
+	<-started
+
+	// Close waits for the flush in progress, then flushes the rest
+	closed := make(chan error, 1)
+	go func() { closed <- kv.Close() }()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned %v during a flush", err)
+	default:
+	}
+	if err := kv.Set("late", []byte("value")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Set during Close = %v, want ErrClosed", err)
+	}
+	release()
+	if err := <-closed; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := kv.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("second Close = %v, want ErrClosed", err)
+	}
+
+	// Every file in the directory is a committed table, the manifest, or
+	// the WAL
+	reopened := openStore(t, dir, Options{})
+	tables, err := reopened.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed := map[string]bool{manifestFileName: true}
+	for _, table := range tables {
+		committed[table.File] = true
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !committed[entry.Name()] && !strings.HasPrefix(entry.Name(), "wal.log") {
+			t.Errorf("Close left %s behind", entry.Name())
+		}
+	}
+	for i := 0; i < memtableFlushKeys+3; i++ {
+		mustGet(t, reopened, fmt.Sprint("key", i), "value")
+	}
+	mustMiss(t, reopened, "late")
+}
+
+func TestFileMode(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	kv := openStore(t, dir, Options{FileMode: 0600, ValueLogThreshold: 1024})
+	mustSet(t, kv, "large", strings.Repeat("x", 2048))
+	populate(t, kv, 30)
+	if _, err := kv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	waitForBackground(kv)
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0700 {
+		t.Errorf("data directory has mode %v, want 0700", mode)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]bool{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("%s has mode %v, want 0600", entry.Name(), mode)
+		}
+		kinds[strings.TrimRight(filepath.Ext(entry.Name()), "0123456789")] = true
+	}
+	for _, ext := range []string{".sst", ".vlog", "."} {
+		if !kinds[ext] {
+			t.Errorf("no %q file was checked among %v", ext, kinds)
+		}
+	}
+
+	for _, mode := range []os.FileMode{0400, 0200, os.ModeDir | 0600} {
+		_, err := NewKeyValueStore(filepath.Join(dir, "wal.log"), dir, Options{FileMode: mode})
+		if err == nil {
+			t.Errorf("FileMode %v was accepted", mode)
+		}
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	populate(t, kv, 20)
+
+	// Seven keys from the table and the memtable, a deleted one, and two
+	// that never existed
+	keys := []string{"key001", "key004", "key006", "key008", "absent", "key011", "key016", "key019", "none", "key010"}
+	w := serve(handleGetMany(kv), http.MethodPost, "/getmany", `["`+strings.Join(keys, `","`)+`"]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Found   map[string]string `json:"found"`
+		Missing []string          `json:"missing"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{}
+	for _, i := range []int{1, 4, 8, 11, 16, 19, 10} {
+		want[fmt.Sprintf("key%03d", i)] = fmt.Sprintf("value%d", i)
+	}
+	if !reflect.DeepEqual(body.Found, want) {
+		t.Errorf("found = %v, want %v", body.Found, want)
+	}
+	if missing := []string{"key006", "absent", "none"}; !reflect.DeepEqual(body.Missing, missing) {
+		t.Errorf("missing = %v, want %v", body.Missing, missing)
+	}
+
+	if got := kv.GetOrDefault("key004", []byte("default")); string(got) != "value4" {
+		t.Errorf("GetOrDefault(key004) = %q, want value4", got)
+	}
+	if got := kv.GetOrDefault("key006", []byte("default")); string(got) != "default" {
+		t.Errorf("GetOrDefault(key006) = %q, want default", got)
+	}
+}
+
+// BenchmarkGetFromSSTables reads keys from flushed tables, every read
+// checking a table's magic number, and fails if anything is logged.
+func BenchmarkGetFromSSTables(b *testing.B) {
+	var logs bytes.Buffer
+	kv, err := NewKeyValueStore(filepath.Join(b.TempDir(), "wal.log"), b.TempDir(), Options{
+		Logger:    slog.New(slog.NewTextHandler(&logs, nil)),
+		CacheSize: -1,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer kv.Close()
+	if err := kv.Recover(); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		mustSet(b, kv, fmt.Sprintf("key%04d", i), fmt.Sprint("value", i))
+	}
+	mustFlush(b, kv)
+	waitForBackground(kv)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := kv.Get(fmt.Sprintf("key%04d", i%1000)); !ok {
+			b.Fatalf("key%04d not found", i%1000)
+		}
+	}
+	b.StopTimer()
+	if logs.Len() != 0 {
+		b.Fatalf("lookups logged:\n%s", logs.String())
+	}
+}
+
+func TestKeysSkipTombstonesInNewerTables(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	for _, key := range []string{"a", "b", "c"} {
+		mustSet(t, kv, key, "value")
+	}
+	mustFlush(t, kv)
+	if _, ok, err := kv.Delete("b"); !ok || err != nil {
+		t.Fatalf("Delete = %v, %v", ok, err)
+	}
+	mustFlush(t, kv)
+	if entries := tableEntries(t, kv, "b"); len(entries) != 2 || entries[0].Marker != 1 {
+		t.Fatalf("SSTable entries for b: %+v, want a tombstone in the newer table", entries)
+	}
+
+	if count, err := kv.Count(); count != 2 || err != nil {
+		t.Errorf("Count = %d, %v, want 2", count, err)
+	}
+	keys, err := kv.Keys("", "")
+	if want := []string{"a", "c"}; !reflect.DeepEqual(keys, want) || err != nil {
+		t.Errorf("Keys = %q, %v, want %q", keys, err, want)
+	}
+	w := serve(handleKeys(kv), http.MethodGet, "/keys", "")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `["a","c"]` {
+		t.Errorf("GET /keys = %d %s, want [\"a\",\"c\"]", w.Code, w.Body)
+	}
+	w = serve(handleKeys(kv), http.MethodGet, "/keys?start=b", "")
+	if strings.TrimSpace(w.Body.String()) != `["c"]` {
+		t.Errorf("GET /keys?start=b = %s, want [\"c\"]", w.Body)
+	}
+}
+
+func TestSyncWritesWALBuffer(t *testing.T) {
+	dir := t.TempDir()
+	kv := openStore(t, dir, Options{SyncMode: SyncNever, WALBufferSize: 1 << 16})
+	for i := 0; i < 5; i++ {
+		mustSet(t, kv, fmt.Sprint("synced", i), "value")
+	}
+	if err := kv.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	// These stay in the WAL buffer
+	for i := 0; i < 3; i++ {
+		mustSet(t, kv, fmt.Sprint("unsynced", i), "value")
+	}
+
+	crashed := openStore(t, crashCopy(t, dir), Options{})
+	for i := 0; i < 5; i++ {
+		mustGet(t, crashed, fmt.Sprint("synced", i), "value")
+	}
+	for i := 0; i < 3; i++ {
+		mustMiss(t, crashed, fmt.Sprint("unsynced", i))
+	}
+
+	// Close writes out the buffer
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Sync(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Sync after Close = %v, want ErrClosed", err)
+	}
+	reopened := openStore(t, dir, Options{})
+	for i := 0; i < 3; i++ {
+		mustGet(t, reopened, fmt.Sprint("unsynced", i), "value")
+	}
+}
+
+func TestTombstoneRatioCompacts(t *testing.T) {
+	churn := func(t *testing.T, ratio float64) (*KeyValueStore, *bytes.Buffer) {
+		var logs bytes.Buffer
+		kv := openStore(t, t.TempDir(), Options{TombstoneRatio: ratio, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+		for i := 0; i < 1000; i++ {
+			mustSet(t, kv, fmt.Sprintf("key%04d", i), "value")
+		}
+		waitForBackground(kv)
+		if _, err := kv.Compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		// One table of tombstones over the compacted values, too few tables
+		// for the L0 trigger
+		batch := kv.NewWriteBatch()
+		for i := 0; i < 1000; i++ {
+			if err := batch.Delete(fmt.Sprintf("key%04d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		mustFlush(t, kv)
+		waitForBackground(kv)
+		return kv, &logs
+	}
+	stats := func(t *testing.T, kv *KeyValueStore) StoreStats {
+		stats, err := kv.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+	// The fastest of a few full scans, which skip every tombstone
+	scanTime := func(t *testing.T, kv *KeyValueStore) time.Duration {
+		fastest := time.Duration(math.MaxInt64)
+		for i := 0; i < 5; i++ {
+			start := time.Now()
+			if pairs := mustScan(t, kv); len(pairs) != 0 {
+				t.Fatalf("scan found %d deleted pairs", len(pairs))
+			}
+			fastest = min(fastest, time.Since(start))
+		}
+		return fastest
+	}
+
+	churned, logs := churn(t, 0)
+	if stats := stats(t, churned); stats.SSTableTombstones != 1000 || strings.Contains(logs.String(), "tombstone ratio") {
+		t.Fatalf("without TombstoneRatio, %d tombstones are left in %d tables, want 1000:\n%s", stats.SSTableTombstones, stats.SSTableFiles, logs)
+	}
+	compacted, logs := churn(t, 0.3)
+	if n := strings.Count(logs.String(), "compacted SSTables over the tombstone ratio"); n != 1 {
+		t.Fatalf("the tombstone ratio compaction ran %d times, want once:\n%s", n, logs)
+	}
+	if stats := stats(t, compacted); stats.SSTableTombstones != 0 || stats.SSTableFiles != 0 {
+		t.Fatalf("%d tombstones are left in %d tables, want none", stats.SSTableTombstones, stats.SSTableFiles)
+	}
+	if before, after := scanTime(t, churned), scanTime(t, compacted); after >= before {
+		t.Errorf("scans take %v after the compaction, no faster than %v before it", after, before)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	var logs bytes.Buffer
+	router := http.NewServeMux()
+	router.HandleFunc("/get", handleGet(kv))
+	router.HandleFunc("/set", handleSet(kv))
+	router.HandleFunc("GET /kv/{key...}", handleKVGet(kv))
+	handler := accessLog(slog.New(slog.NewJSONHandler(&logs, nil)), router)
+
+	const secret = "hunter2-secret-value"
+	for _, request := range []struct {
+		method, target, body string
+	}{
+		{"POST", "/set", `{"key": "password", "value": "` + secret + `"}`},
+		{"GET", "/get?key=password", ""},
+		{"GET", "/get?key=missing", ""},
+		{"GET", "/kv/password", ""},
+	} {
+		var body io.Reader
+		if request.body != "" {
+			body = strings.NewReader(request.body)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(request.method, request.target, body))
+	}
+
+	if strings.Contains(logs.String(), secret) {
+		t.Fatalf("the access log holds the value:\n%s", logs.String())
+	}
+	type record struct {
+		Method     string `json:"method"`
+		Path       string `json:"path"`
+		Key        string `json:"key"`
+		Status     int    `json:"status"`
+		ValueBytes *int64 `json:"value_bytes"`
+	}
+	var records []record
+	decoder := json.NewDecoder(&logs)
+	for decoder.More() {
+		var r record
+		if err := decoder.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	size := int64(len(secret))
+	want := []record{
+		{"POST", "/set", "password", http.StatusCreated, &size},
+		{"GET", "/get", "password", http.StatusOK, &size},
+		{"GET", "/get", "missing", http.StatusNotFound, nil},
+		{"GET", "/kv/password", "password", http.StatusOK, &size},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("access log records:\n%+v\nwant\n%+v", records, want)
+	}
+}
+
+func TestIncrementHandlerStatus(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{})
+	mustSet(t, kv, "name", "alice")
+	if w := serve(handleIncrement(kv), "POST", "/incr?key=counter&delta=5", ""); w.Code != http.StatusOK {
+		t.Fatalf("/incr = %d: %s", w.Code, w.Body)
+	}
+	if w := serve(handleIncrement(kv), "POST", "/incr?key=name", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("/incr of a non-numeric value = %d, want 400", w.Code)
+	}
+	if _, err := kv.Increment("name", 1); !errors.Is(err, ErrNotInteger) {
+		t.Errorf("Increment of a non-numeric value = %v, want ErrNotInteger", err)
+	}
+
+	// Errors that aren't the client's fault aren't reported as 400
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(handleIncrement(kv), "POST", "/incr?key=counter", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/incr on a closed store = %d, want 503", w.Code)
+	}
+}
+
+func TestBatchCommitSucceedsWhenFlushFails(t *testing.T) {
+	var logs bytes.Buffer
+	kv := openStore(t, t.TempDir(), Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	// The batch below fills the memtable
+	for i := 0; i < memtableFlushKeys-2; i++ {
+		mustSet(t, kv, fmt.Sprint("key", i), "value")
+	}
+
+	// A directory in the way of the next WAL segment fails the flush
+	kv.walMu.Lock()
+	next := walSegmentPath(kv.walPath, kv.walSegment+1)
+	kv.walMu.Unlock()
+	if err := os.Mkdir(next, 0755); err != nil {
+		t.Fatal(err)
+	}
+	batch := kv.NewWriteBatch()
+	for i := 0; i < 3; i++ {
+		if err := batch.Set(fmt.Sprint("batch", i), []byte("written")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("Commit = %v, want the batch stored despite the failed flush", err)
+	}
+	if !strings.Contains(logs.String(), "error flushing to SSTable") {
+		t.Fatalf("the failed flush wasn't logged:\n%s", logs.String())
+	}
+	for i := 0; i < 3; i++ {
+		mustGet(t, kv, fmt.Sprint("batch", i), "written")
+	}
+	mustMiss(t, kv, "key0")
+
+	// The batch is in the WAL, so it survives a crash too
+	if err := os.Remove(next); err != nil {
+		t.Fatal(err)
+	}
+	crashed := openStore(t, crashCopy(t, kv.dataDir), Options{})
+	for i := 0; i < 3; i++ {
+		mustGet(t, crashed, fmt.Sprint("batch", i), "written")
+	}
+	mustMiss(t, crashed, "key0")
+}
+
+func TestGetStreamUnreadableTable(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{CacheSize: -1})
+	mustSet(t, kv, "key", "old")
+	mustFlush(t, kv)
+	mustSet(t, kv, "key", "new")
+	mustFlush(t, kv)
+	waitForBackground(kv)
+
+	// Remove the newer table, so reading it fails
+	newer := filepath.Join(kv.dataDir, newestTable(t, kv))
+	kv.files.closeIdle()
+	if err := os.Remove(newer); err != nil {
+		t.Fatal(err)
+	}
+
+	// The older table's value is stale, so it isn't served
+	stream, err := kv.GetStreamContext(context.Background(), "key")
+	if !errors.Is(err, ErrUnreadableSSTable) || !errors.Is(err, os.ErrNotExist) || stream != nil {
+		t.Fatalf("GetStreamContext with an unreadable table = %v, %v, want ErrUnreadableSSTable wrapping the I/O error", stream, err)
+	}
+	if w := serve(handleGet(kv), "GET", "/get?key=key&raw=1", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/get?raw=1 with an unreadable table = %d %s, want 503", w.Code, w.Body)
+	}
+}
+
+func TestApplyReplicatedSucceedsWhenFlushFails(t *testing.T) {
+	var logs bytes.Buffer
+	follower := openStore(t, t.TempDir(), Options{Follower: true, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	record := func(seq int, key string) []byte {
+		entry := map[string]interface{}{"operation": "set", "key": key, "seq": seq}
+		setWALValue(entry, []byte("value"))
+		data, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	for i := 1; i < memtableFlushKeys; i++ {
+		if err := follower.ApplyReplicated(record(i, fmt.Sprint("key", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A directory in the way of the next WAL segment fails the flush the
+	// next record fills the memtable for
+	follower.walMu.Lock()
+	next := walSegmentPath(follower.walPath, follower.walSegment+1)
+	follower.walMu.Unlock()
+	if err := os.Mkdir(next, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.ApplyReplicated(record(memtableFlushKeys, "last")); err != nil {
+		t.Fatalf("ApplyReplicated = %v, want the applied record reported applied", err)
+	}
+	if !strings.Contains(logs.String(), "error flushing to SSTable") {
+		t.Fatalf("the failed flush wasn't logged:\n%s", logs.String())
+	}
+	if seq := follower.LastSequence(); seq != memtableFlushKeys {
+		t.Fatalf("LastSequence = %d, want %d", seq, memtableFlushKeys)
+	}
+	mustGet(t, follower, "last", "value")
+}
+
+func TestExistsUnreadableTable(t *testing.T) {
+	kv := openStore(t, t.TempDir(), Options{CacheSize: -1})
+	mustSet(t, kv, "key", "value")
+	mustFlush(t, kv)
+	if _, _, err := kv.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	mustFlush(t, kv)
+	waitForBackground(kv)
+
+	// Remove the newer table, whose tombstone hides the older value
+	newer := filepath.Join(kv.dataDir, newestTable(t, kv))
+	kv.files.closeIdle()
+	if err := os.Remove(newer); err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := kv.Exists("key")
+	if !errors.Is(err, ErrUnreadableSSTable) || !errors.Is(err, os.ErrNotExist) || exists {
+		t.Fatalf("Exists with an unreadable table = %v, %v, want ErrUnreadableSSTable wrapping the I/O error", exists, err)
+	}
+	r := httptest.NewRequest(http.MethodHead, "/kv/key", nil)
+	r.SetPathValue("key", "key")
+	w := httptest.NewRecorder()
+	handleKVHead(kv)(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("HEAD /kv/key with an unreadable table = %d, want 503 as GET gets", w.Code)
+	}
+}